@@ -1,6 +1,7 @@
 package muduo
 
 import (
+	"golang.org/x/sys/unix"
 	"muduo/pkg/logging"
 	"net"
 	"strings"
@@ -28,10 +29,13 @@ func newAcceptor(el *Eventloop, addr string, cb func(int, net.Addr)) *acceptor {
 	_ = so.setReuseAddr(true)
 	network, addr := parseProtoAddr(addr)
 	localAddr, err := so.bind(network, addr)
-	a.localAddr = SockaddrToTCPAddr(localAddr)
 	if err != nil {
 		logging.Errorf("bind() failed due to error: %v", err)
+	} else if bound, err := unix.Getsockname(so.fd); err == nil {
+		// the kernel picks the port when binding to port 0
+		localAddr = bound
 	}
+	a.localAddr = SockaddrToTCPAddr(localAddr)
 	a.ch.setReadCallback(a.handleRead)
 	return a
 }
@@ -50,7 +54,30 @@ func parseProtoAddr(addr string) (network, address string) {
 func (a *acceptor) listen() {
 	a.listening = true
 	a.so.listen()
-	a.ch.enableReading()
+	if iop, ok := a.el.poller.(ioPoller); ok {
+		iop.accept(a.ch, a.handleAccept)
+	} else {
+		a.ch.enableReading()
+	}
+}
+
+// handleAccept is the completion counterpart of handleRead.
+func (a *acceptor) handleAccept(fd int, err error) {
+	if err != nil {
+		logging.Errorf("accept() failed due to error: %v", err)
+		return
+	}
+	sa, err := unix.Getpeername(fd)
+	if err != nil {
+		logging.Errorf("getpeername() failed due to error: %v", err)
+		_ = unix.Close(fd)
+		return
+	}
+	if a.cb != nil {
+		a.cb(fd, SockaddrToTCPOrUnixAddr(sa))
+	} else {
+		_ = unix.Close(fd)
+	}
 }
 
 func (a *acceptor) handleRead(ts time.Time) {
@@ -66,3 +93,15 @@ func (a *acceptor) handleRead(ts time.Time) {
 		a.cb(fd, addr)
 	}
 }
+
+// close stops listening and releases the listening socket.
+func (a *acceptor) close() {
+	if a.listening {
+		a.listening = false
+		a.ch.disableAll()
+		a.el.removeChannel(a.ch)
+	}
+	if err := a.so.close(); err != nil {
+		logging.Errorf("close() failed due to error: %v", err)
+	}
+}
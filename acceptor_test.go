@@ -1,19 +1,37 @@
 package muduo
 
 import (
+	"bufio"
 	"golang.org/x/sys/unix"
 	"muduo/pkg/logging"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestAcceptor(t *testing.T) {
 	el := NewEventloop("")
-	ac := newAcceptor(el, "tcp4://:9981", nil)
+	ac := newAcceptor(el, "tcp4://127.0.0.1:0", nil)
 	ac.cb = func(fd int, addr net.Addr) {
 		logging.Debugf("new connection: fd=%d, addr=%s", fd, addr.String())
 		_, _ = unix.Write(fd, []byte("how are you?\n"))
+		_ = unix.Close(fd)
 	}
 	ac.listen()
-	el.Loop()
+	stop := startLoop(el)
+	defer stop()
+
+	c, err := net.DialTimeout("tcp", ac.localAddr.String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "how are you?\n" {
+		t.Fatalf("got %q", line)
+	}
 }
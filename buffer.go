@@ -111,8 +111,11 @@ func (b *Buffer) ensureWritableBytes(n int) {
 	}
 }
 
+// makeSpace grows the buffer, unless moving the readable bytes to the front
+// frees the readIndex bytes already read, which together with the writable
+// ones are enough for n.
 func (b *Buffer) makeSpace(n int) {
-	if b.WritableBytes()+b.ReadableBytes() < n {
+	if b.WritableBytes()+b.readIndex < n {
 		b.buf = append(b.buf, make([]byte, n)...)
 	} else {
 		copy(b.buf, b.buf[b.readIndex:b.writeIndex])
@@ -0,0 +1,33 @@
+package muduo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuffer_MakeSpace(t *testing.T) {
+	// the bytes already read make room once the readable ones move to the front
+	b := NewBuffer()
+	_, _ = b.Write(bytes.Repeat([]byte{'a'}, 1000))
+	b.Next(900)
+	_, _ = b.Write(bytes.Repeat([]byte{'b'}, 500))
+	if b.Capacity() != 1024 {
+		t.Fatalf("capacity %d, the buffer grew instead of compacting", b.Capacity())
+	}
+	want := append(bytes.Repeat([]byte{'a'}, 100), bytes.Repeat([]byte{'b'}, 500)...)
+	if !bytes.Equal(b.Peek(), want) {
+		t.Fatalf("compacted to %q", b.Peek())
+	}
+
+	// too little was read to make room, the buffer grows and nothing is cut
+	b = NewBuffer()
+	_, _ = b.Write(bytes.Repeat([]byte{'a'}, 1000))
+	b.Next(100)
+	if n, _ := b.Write(bytes.Repeat([]byte{'b'}, 200)); n != 200 {
+		t.Fatalf("wrote %d of 200 bytes", n)
+	}
+	want = append(bytes.Repeat([]byte{'a'}, 900), bytes.Repeat([]byte{'b'}, 200)...)
+	if !bytes.Equal(b.Peek(), want) {
+		t.Fatalf("grew to %d readable bytes", b.ReadableBytes())
+	}
+}
@@ -10,6 +10,9 @@ import (
 type EventCallback func()
 type ReadCallback func(ts time.Time)
 
+// EventsCallback receives all returned events of one poll at once.
+type EventsCallback func(revents uint32, ts time.Time)
+
 const (
 	eventRead  = unix.POLLIN | unix.POLLPRI
 	eventWrite = unix.POLLOUT
@@ -17,17 +20,18 @@ const (
 )
 
 type Channel struct {
-	ele           *list.Element
-	el            *Eventloop
-	fd            int
-	events        uint32
-	revents       uint32
-	index         int
-	readCallback  ReadCallback
-	writeCallback EventCallback
-	errorCallback EventCallback
-	closeCallback EventCallback
-	evtHandling   bool
+	ele            *list.Element
+	el             *Eventloop
+	fd             int
+	events         uint32
+	revents        uint32
+	index          int
+	readCallback   ReadCallback
+	writeCallback  EventCallback
+	errorCallback  EventCallback
+	closeCallback  EventCallback
+	eventsCallback EventsCallback
+	evtHandling    bool
 }
 
 func NewChannel(el *Eventloop, fd int) *Channel {
@@ -58,11 +62,20 @@ func (c *Channel) setCloseCallback(cb EventCallback) {
 	c.closeCallback = cb
 }
 
+func (c *Channel) setEventsCallback(cb EventsCallback) {
+	c.eventsCallback = cb
+}
+
 func (c *Channel) enableReading() {
 	c.events |= eventRead
 	c.update()
 }
 
+func (c *Channel) disableReading() {
+	c.events &= ^uint32(eventRead)
+	c.update()
+}
+
 func (c *Channel) disableAll() {
 	c.events = eventNone
 	c.update()
@@ -93,6 +106,11 @@ func (c *Channel) update() {
 func (c *Channel) handleEvent(ts time.Time) {
 	c.evtHandling = true
 	logging.Debugf("Channel::handleEvent() %s", events2String(c.fd, c.revents))
+	if c.eventsCallback != nil {
+		c.eventsCallback(c.revents, ts)
+		c.evtHandling = false
+		return
+	}
 	if c.revents&unix.POLLNVAL != 0 {
 		logging.Warnf("Channel::handleEvent() POLLNVAL")
 	}
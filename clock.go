@@ -0,0 +1,80 @@
+package muduo
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of an Eventloop: the timestamps passed to callbacks
+// and the deadlines of its timers come from it.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// WithClock makes the Eventloop read the time from c. With a FakeClock the loop
+// creates no timerfd and its timers only fire when the clock is advanced.
+func WithClock(c Clock) EventloopOption {
+	return func(el *Eventloop) {
+		el.clock = c
+	}
+}
+
+// FakeClock is a Clock that only moves when told to, for deterministic tests.
+// Timers of the Eventloops using it fire synchronously in Advance.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	queues map[*timerQueue]struct{}
+}
+
+// NewFakeClock returns a FakeClock reading start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{
+		now:    start,
+		queues: make(map[*timerQueue]struct{}),
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and runs every timer that became due. Like
+// a loop that was stalled, a repeating timer runs once however many periods d
+// spans; advance in steps to observe each period.
+//
+// Timers of an Eventloop that is not looping run on the calling goroutine. For a
+// looping Eventloop they run on the loop goroutine and Advance waits for them, so
+// it must not be called from that goroutine.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	queues := make([]*timerQueue, 0, len(c.queues))
+	for tq := range c.queues {
+		queues = append(queues, tq)
+	}
+	c.mu.Unlock()
+	for _, tq := range queues {
+		tq.el.runSync(tq.runExpired)
+	}
+}
+
+func (c *FakeClock) attach(tq *timerQueue) {
+	c.mu.Lock()
+	c.queues[tq] = struct{}{}
+	c.mu.Unlock()
+}
+
+func (c *FakeClock) detach(tq *timerQueue) {
+	c.mu.Lock()
+	delete(c.queues, tq)
+	c.mu.Unlock()
+}
@@ -0,0 +1,51 @@
+package muduo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock_Advance(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	if !clock.Now().Equal(start) {
+		t.Fatalf("now = %v, want %v", clock.Now(), start)
+	}
+	// one clock drives the timers of every loop using it
+	el1 := NewEventloop("1", WithClock(clock))
+	el2 := NewEventloop("2", WithClock(clock))
+	if el1.tq.timerFd >= 0 {
+		t.Fatal("a loop with a fake clock should not create a timerfd")
+	}
+	var fired []string
+	el1.ScheduleDelay(func() { fired = append(fired, "1") }, time.Minute)
+	el2.ScheduleDelay(func() { fired = append(fired, "2") }, time.Hour)
+	clock.Advance(time.Minute)
+	if len(fired) != 1 || fired[0] != "1" {
+		t.Fatalf("fired %v after a minute", fired)
+	}
+	if el2.Now().Sub(start) != time.Minute {
+		t.Fatalf("loop time %v, want a minute after start", el2.Now())
+	}
+	clock.Advance(time.Hour)
+	if len(fired) != 2 {
+		t.Fatalf("fired %v after an hour", fired)
+	}
+}
+
+func TestFakeClock_DueTimerInRunningLoop(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("", WithClock(clock))
+	stop := startLoop(el)
+	defer stop()
+	// a timer that is already due runs without advancing the clock
+	tt := el.AsyncScheduleDelay(func() {}, 0)
+	waitDone(t, tt, time.Second)
+	later := el.AsyncScheduleDelay(func() {}, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if later.State() != TimerPending {
+		t.Fatalf("state = %v, fake time did not move", later.State())
+	}
+	clock.Advance(time.Millisecond)
+	waitDone(t, later, time.Second)
+}
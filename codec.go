@@ -0,0 +1,82 @@
+package muduo
+
+import (
+	"encoding/binary"
+	"muduo/pkg/errors"
+)
+
+// Codec splits the byte stream of a connection into frames.
+type Codec interface {
+	// Decode removes the next complete frame from buf and returns its payload,
+	// or returns nil and leaves buf untouched when the frame is incomplete.
+	// The payload may alias buf, copy it to keep it past the next read.
+	Decode(buf *Buffer) ([]byte, error)
+	// Encode returns payload with its framing.
+	Encode(payload []byte) []byte
+}
+
+// LengthFieldCodec frames payloads with a 4 byte big endian length prefix.
+type LengthFieldCodec struct {
+	// MaxFrame rejects longer frames, 0 means no limit.
+	MaxFrame int
+}
+
+const lengthFieldSize = 4
+
+func (c LengthFieldCodec) Decode(buf *Buffer) ([]byte, error) {
+	if buf.ReadableBytes() < lengthFieldSize {
+		return nil, nil
+	}
+	n := int(binary.BigEndian.Uint32(buf.Peek()))
+	if c.MaxFrame > 0 && n > c.MaxFrame {
+		return nil, errors.ErrFrameTooLarge
+	}
+	if buf.ReadableBytes() < lengthFieldSize+n {
+		return nil, nil
+	}
+	buf.Advance(lengthFieldSize)
+	return buf.Next(n), nil
+}
+
+func (c LengthFieldCodec) Encode(payload []byte) []byte {
+	frame := make([]byte, lengthFieldSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[lengthFieldSize:], payload)
+	return frame
+}
+
+// LineCodec frames payloads with a delimiter, "\r\n" when Delim is empty. The
+// delimiter is not part of the decoded payload.
+type LineCodec struct {
+	Delim []byte
+	// MaxLine rejects longer lines, 0 means no limit.
+	MaxLine int
+}
+
+func (c LineCodec) delim() []byte {
+	if len(c.Delim) == 0 {
+		return []byte("\r\n")
+	}
+	return c.Delim
+}
+
+func (c LineCodec) Decode(buf *Buffer) ([]byte, error) {
+	delim := c.delim()
+	i := buf.Search(delim)
+	if i < 0 {
+		if c.MaxLine > 0 && buf.ReadableBytes() > c.MaxLine {
+			return nil, errors.ErrFrameTooLarge
+		}
+		return nil, nil
+	}
+	if c.MaxLine > 0 && i > c.MaxLine {
+		return nil, errors.ErrFrameTooLarge
+	}
+	line := buf.Next(i)
+	buf.Advance(len(delim))
+	return line, nil
+}
+
+func (c LineCodec) Encode(payload []byte) []byte {
+	return append(append(make([]byte, 0, len(payload)+len(c.delim())), payload...), c.delim()...)
+}
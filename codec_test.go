@@ -0,0 +1,57 @@
+package muduo
+
+import (
+	"muduo/pkg/errors"
+	"testing"
+)
+
+func TestLengthFieldCodec(t *testing.T) {
+	codec := LengthFieldCodec{MaxFrame: 16}
+	buf := NewBuffer()
+	stream := append(codec.Encode([]byte("hello")), codec.Encode(nil)...)
+	stream = append(stream, codec.Encode([]byte("world"))...)
+	// feed the stream a byte at a time
+	var frames []string
+	for _, b := range stream {
+		_, _ = buf.Write([]byte{b})
+		for {
+			frame, err := codec.Decode(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame == nil {
+				break
+			}
+			frames = append(frames, string(frame))
+		}
+	}
+	if len(frames) != 3 || frames[0] != "hello" || frames[1] != "" || frames[2] != "world" {
+		t.Fatalf("frames = %q", frames)
+	}
+	_, _ = buf.Write(codec.Encode(make([]byte, 17)))
+	if _, err := codec.Decode(buf); err != errors.ErrFrameTooLarge {
+		t.Fatalf("err = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestLineCodec(t *testing.T) {
+	codec := LineCodec{MaxLine: 8}
+	buf := NewBuffer()
+	_, _ = buf.Write([]byte("get k\r\n\r\nparti"))
+	for _, want := range []string{"get k", ""} {
+		line, err := codec.Decode(buf)
+		if err != nil || line == nil || string(line) != want {
+			t.Fatalf("line %q, %v, want %q", line, err, want)
+		}
+	}
+	if line, err := codec.Decode(buf); line != nil || err != nil {
+		t.Fatalf("partial line decoded as %q, %v", line, err)
+	}
+	_, _ = buf.Write([]byte("al line"))
+	if _, err := codec.Decode(buf); err != errors.ErrFrameTooLarge {
+		t.Fatalf("err = %v, want ErrFrameTooLarge", err)
+	}
+	if got := string(LineCodec{Delim: []byte("\n")}.Encode([]byte("x"))); got != "x\n" {
+		t.Fatalf("encoded %q", got)
+	}
+}
@@ -0,0 +1,469 @@
+package muduo
+
+import (
+	"context"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"sync"
+	"time"
+)
+
+const (
+	poolMaintainInterval = time.Second
+	defaultPoolMax       = 8
+)
+
+// HealthCheck probes an idle pooled connection, e.g. with an application level
+// ping. It runs on its own goroutine and owns conn until it returns; a non nil
+// error evicts the connection.
+type HealthCheck func(ctx context.Context, conn *TcpConn) error
+
+// PoolStats is a snapshot of the connections to one address.
+type PoolStats struct {
+	Open     int // established connections, idle or in use
+	Idle     int
+	InUse    int
+	Dialing  int
+	Waiters  int // Acquire calls waiting for a connection
+	Dials    uint64
+	Failures uint64 // failed dials
+	Evicted  uint64 // connections closed by the pool: idle, broken or unhealthy
+}
+
+// PoolOption configures a ConnPool.
+type PoolOption func(p *ConnPool)
+
+// WithPoolSize keeps at least min connections open to every address and opens at
+// most max. The defaults are 0 and 8.
+func WithPoolSize(min, max int) PoolOption {
+	return func(p *ConnPool) {
+		p.min, p.max = min, max
+	}
+}
+
+// WithIdleTimeout closes connections, above the minimum, that stayed idle for d.
+func WithIdleTimeout(d time.Duration) PoolOption {
+	return func(p *ConnPool) {
+		p.idleTimeout = d
+	}
+}
+
+// WithHealthCheck runs check on every idle connection once per interval, bounded
+// by a timeout of one interval.
+func WithHealthCheck(interval time.Duration, check HealthCheck) PoolOption {
+	return func(p *ConnPool) {
+		p.healthInterval = interval
+		p.healthCheck = check
+	}
+}
+
+// WithPoolOnMsg sets the message callback of every pooled connection.
+func WithPoolOnMsg(cb func(*TcpConn, *Buffer, time.Time)) PoolOption {
+	return func(p *ConnPool) {
+		p.onMsg = cb
+	}
+}
+
+// WithPoolConnectTimeout bounds every dial, see Connector.SetConnectTimeout.
+func WithPoolConnectTimeout(d time.Duration) PoolOption {
+	return func(p *ConnPool) {
+		p.connectTimeout = d
+	}
+}
+
+// ConnPool keeps client connections to a set of addresses, spread over the loops
+// of an EventloopEngineGroup. Acquire hands out a connection for exclusive use
+// until Release; the connection's I/O still happens on its own loop, so use
+// AsyncWrite or the loop's AsyncExecute from other goroutines.
+type ConnPool struct {
+	group          *EventloopEngineGroup
+	el             *Eventloop // runs the maintenance timer
+	min, max       int
+	idleTimeout    time.Duration
+	healthInterval time.Duration
+	healthCheck    HealthCheck
+	connectTimeout time.Duration
+	onMsg          func(*TcpConn, *Buffer, time.Time)
+
+	mu     sync.Mutex
+	hosts  map[string]*hostPool
+	conns  map[*TcpConn]*pooledConn
+	timer  *TimerTask
+	closed bool
+}
+
+type pooledState int
+
+const (
+	pooledDialing pooledState = iota
+	pooledIdle
+	pooledInUse
+	pooledChecking
+	pooledClosed
+)
+
+type pooledConn struct {
+	host        *hostPool
+	client      *TcpClient
+	conn        *TcpConn
+	state       pooledState
+	broken      bool
+	lastUsed    time.Time
+	lastChecked time.Time
+}
+
+type acquireResult struct {
+	conn *TcpConn
+	err  error
+}
+
+type hostPool struct {
+	addr    string
+	idle    []*pooledConn // most recently used last
+	open    int
+	dialing int
+	waiters []chan acquireResult
+	stats   PoolStats
+}
+
+// NewConnPool creates a pool over the loops of group, which must be started.
+func NewConnPool(group *EventloopEngineGroup, opts ...PoolOption) *ConnPool {
+	p := &ConnPool{
+		group: group,
+		el:    group.GetNextLoop(),
+		max:   defaultPoolMax,
+		hosts: make(map[string]*hostPool),
+		conns: make(map[*TcpConn]*pooledConn),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.max < 1 {
+		p.max = 1
+	}
+	if p.min > p.max {
+		p.min = p.max
+	}
+	p.timer = p.el.AsyncScheduleAtFixRate(p.maintain, poolMaintainInterval)
+	return p
+}
+
+// Add registers addr and opens its minimum number of connections in the
+// background. Acquire registers unknown addresses by itself.
+func (p *ConnPool) Add(addr string) error {
+	if _, err := parseEndpoint(addr); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.ErrPoolClosed
+	}
+	p.fill(p.host(addr))
+	return nil
+}
+
+// Acquire returns an idle connection to addr, dials a new one while there are
+// fewer than max, or waits for a Release until ctx is done.
+func (p *ConnPool) Acquire(ctx context.Context, addr string) (*TcpConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.ErrPoolClosed
+	}
+	h := p.host(addr)
+	for len(h.idle) > 0 {
+		pc := h.idle[len(h.idle)-1]
+		h.idle = h.idle[:len(h.idle)-1]
+		if pc.broken || !pc.conn.IsConnected() {
+			p.evict(pc)
+			continue
+		}
+		pc.state = pooledInUse
+		p.mu.Unlock()
+		return pc.conn, nil
+	}
+	wait := make(chan acquireResult, 1)
+	h.waiters = append(h.waiters, wait)
+	if h.open+h.dialing < p.max && h.dialing < len(h.waiters) {
+		p.dial(h)
+	}
+	p.mu.Unlock()
+
+	select {
+	case r := <-wait:
+		return r.conn, r.err
+	case <-ctx.Done():
+		p.mu.Lock()
+		for i, w := range h.waiters {
+			if w == wait {
+				h.waiters = append(h.waiters[:i], h.waiters[i+1:]...)
+				p.mu.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+		p.mu.Unlock()
+		// handed a connection at the same time, give it back
+		if r := <-wait; r.conn != nil {
+			p.Release(r.conn)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Release returns a connection obtained from Acquire to the pool.
+func (p *ConnPool) Release(conn *TcpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc := p.conns[conn]
+	if pc == nil || pc.state != pooledInUse {
+		return
+	}
+	p.put(pc)
+}
+
+// Discard closes a connection obtained from Acquire instead of returning it, e.g.
+// after a protocol error.
+func (p *ConnPool) Discard(conn *TcpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc := p.conns[conn]; pc != nil && pc.state == pooledInUse {
+		p.evict(pc)
+		p.fill(pc.host)
+	}
+}
+
+// Stats returns the statistics of addr.
+func (p *ConnPool) Stats(addr string) PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.hosts[addr]
+	if h == nil {
+		return PoolStats{}
+	}
+	s := h.stats
+	s.Open = h.open
+	s.Idle = len(h.idle)
+	s.Dialing = h.dialing
+	s.Waiters = len(h.waiters)
+	for _, pc := range p.conns {
+		if pc.host == h && pc.state == pooledInUse {
+			s.InUse++
+		}
+	}
+	return s
+}
+
+// Close closes every connection and fails the waiting Acquire calls.
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.timer.Cancel()
+	for _, h := range p.hosts {
+		for _, w := range h.waiters {
+			w <- acquireResult{err: errors.ErrPoolClosed}
+		}
+		h.waiters = nil
+		h.idle = nil
+	}
+	for _, pc := range p.conns {
+		p.evict(pc)
+	}
+}
+
+func (p *ConnPool) host(addr string) *hostPool {
+	h := p.hosts[addr]
+	if h == nil {
+		h = &hostPool{addr: addr}
+		p.hosts[addr] = h
+	}
+	return h
+}
+
+// put hands pc to the first waiter, or makes it idle.
+func (p *ConnPool) put(pc *pooledConn) {
+	h := pc.host
+	if pc.broken || !pc.conn.IsConnected() {
+		p.evict(pc)
+		p.fill(h)
+		return
+	}
+	pc.lastUsed = p.el.Now()
+	if len(h.waiters) > 0 {
+		w := h.waiters[0]
+		h.waiters = h.waiters[1:]
+		pc.state = pooledInUse
+		w <- acquireResult{conn: pc.conn}
+		return
+	}
+	pc.state = pooledIdle
+	h.idle = append(h.idle, pc)
+}
+
+// fill dials until the host has its minimum, or enough dials for its waiters.
+func (p *ConnPool) fill(h *hostPool) {
+	for !p.closed && h.open+h.dialing < p.max && (h.open+h.dialing < p.min || h.dialing < len(h.waiters)) {
+		p.dial(h)
+	}
+}
+
+func (p *ConnPool) dial(h *hostPool) {
+	el := p.group.GetNextLoop()
+	client, err := NewTcpClient(el, h.addr)
+	if err != nil {
+		h.stats.Failures++
+		p.failWaiter(h, err)
+		return
+	}
+	pc := &pooledConn{host: h, client: client, state: pooledDialing}
+	h.dialing++
+	h.stats.Dials++
+	var lastErr error
+	client.connector.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	client.SetConnectTimeout(p.connectTimeout)
+	client.SetOnMsg(p.onMsg)
+	client.SetOnConnectFailed(func(err error, attempt int) {
+		lastErr = err
+	})
+	client.SetOnGiveUp(func() {
+		p.dialFailed(pc, lastErr)
+	})
+	client.SetOnConn(func(conn *TcpConn) {
+		if conn.IsConnected() {
+			p.connected(pc, conn)
+		} else {
+			p.disconnected(pc)
+		}
+	})
+	client.Connect()
+}
+
+func (p *ConnPool) connected(pc *pooledConn, conn *TcpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := pc.host
+	h.dialing--
+	if p.closed || pc.state == pooledClosed {
+		pc.client.Stop()
+		conn.ForceClose()
+		return
+	}
+	h.open++
+	pc.conn = conn
+	pc.lastChecked = p.el.Now()
+	p.conns[conn] = pc
+	p.put(pc)
+}
+
+func (p *ConnPool) dialFailed(pc *pooledConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := pc.host
+	h.dialing--
+	h.stats.Failures++
+	pc.state = pooledClosed
+	logging.Warnf("ConnPool[%s] dial failed: %v", h.addr, err)
+	if err == nil {
+		err = errors.ErrConnNotOpened
+	}
+	p.failWaiter(h, err)
+}
+
+// failWaiter reports a failed dial to the waiter it was started for.
+func (p *ConnPool) failWaiter(h *hostPool, err error) {
+	if len(h.waiters) > h.dialing {
+		w := h.waiters[0]
+		h.waiters = h.waiters[1:]
+		w <- acquireResult{err: err}
+	}
+}
+
+func (p *ConnPool) disconnected(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch pc.state {
+	case pooledIdle:
+		p.evict(pc)
+		p.fill(pc.host)
+	case pooledInUse, pooledChecking:
+		// the holder finds out on Release
+		pc.broken = true
+	}
+}
+
+// evict closes pc and forgets it.
+func (p *ConnPool) evict(pc *pooledConn) {
+	if pc.state == pooledClosed {
+		return
+	}
+	h := pc.host
+	if pc.state == pooledIdle {
+		for i, v := range h.idle {
+			if v == pc {
+				h.idle = append(h.idle[:i], h.idle[i+1:]...)
+				break
+			}
+		}
+	}
+	pc.state = pooledClosed
+	h.open--
+	h.stats.Evicted++
+	delete(p.conns, pc.conn)
+	pc.client.Stop()
+	pc.conn.ForceClose()
+}
+
+// maintain runs on the pool's loop: it closes idle connections, starts health
+// checks and refills every host to its minimum.
+func (p *ConnPool) maintain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	now := p.el.Now()
+	for _, h := range p.hosts {
+		for _, pc := range append([]*pooledConn(nil), h.idle...) {
+			if !pc.conn.IsConnected() {
+				p.evict(pc)
+			} else if p.idleTimeout > 0 && h.open > p.min && now.Sub(pc.lastUsed) >= p.idleTimeout {
+				logging.Debugf("ConnPool[%s] close idle connection %s", h.addr, pc.conn.Name())
+				p.evict(pc)
+			} else if p.healthCheck != nil && now.Sub(pc.lastChecked) >= p.healthInterval {
+				p.check(pc, now)
+			}
+		}
+		p.fill(h)
+	}
+}
+
+func (p *ConnPool) check(pc *pooledConn, now time.Time) {
+	h := pc.host
+	for i, v := range h.idle {
+		if v == pc {
+			h.idle = append(h.idle[:i], h.idle[i+1:]...)
+			break
+		}
+	}
+	pc.state = pooledChecking
+	pc.lastChecked = now
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.healthInterval)
+		err := p.healthCheck(ctx, pc.conn)
+		cancel()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if pc.state != pooledChecking {
+			return
+		}
+		if err != nil {
+			logging.Warnf("ConnPool[%s] health check of %s failed: %v", h.addr, pc.conn.Name(), err)
+			pc.broken = true
+		}
+		p.put(pc)
+	}()
+}
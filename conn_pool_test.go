@@ -0,0 +1,195 @@
+package muduo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func startPoolServer(t *testing.T) (string, *TcpServer, func()) {
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "echo", "tcp4://127.0.0.1:0", 1)
+	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, t time.Time) {
+		_, _ = conn.Write(buffer.Next(-1))
+	})
+	stop := startTestServer(t, el, svr)
+	return "tcp4://" + svr.addr, svr, stop
+}
+
+func newTestPool(clock Clock, opts ...PoolOption) (*ConnPool, func()) {
+	var elOpts []EventloopOption
+	if clock != nil {
+		elOpts = append(elOpts, WithClock(clock))
+	}
+	group := NewEventloopEngineGroup(2, NewEventloop("pool", elOpts...))
+	group.Start()
+	p := NewConnPool(group, opts...)
+	return p, func() {
+		p.Close()
+		group.Stop()
+	}
+}
+
+func TestConnPool_AcquireRelease(t *testing.T) {
+	addr, _, stop := startPoolServer(t)
+	defer stop()
+	p, closePool := newTestPool(nil, WithPoolSize(1, 2))
+	defer closePool()
+	if err := p.Add(addr); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the minimum connection", func() bool { return p.Stats(addr).Idle == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	a, err := p.Acquire(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Acquire(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("the same connection was handed out twice")
+	}
+	if s := p.Stats(addr); s.Open != 2 || s.InUse != 2 || s.Dials != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+
+	// the pool is exhausted
+	short, cancelShort := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelShort()
+	if _, err := p.Acquire(short, addr); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+	if s := p.Stats(addr); s.Waiters != 0 {
+		t.Fatalf("%d waiters left", s.Waiters)
+	}
+
+	// a waiter gets the released connection
+	got := make(chan *TcpConn)
+	go func() {
+		c, _ := p.Acquire(ctx, addr)
+		got <- c
+	}()
+	waitFor(t, "the waiter", func() bool { return p.Stats(addr).Waiters == 1 })
+	p.Release(a)
+	if c := <-got; c != a {
+		t.Fatal("the waiter did not get the released connection")
+	}
+	p.Release(a)
+	p.Release(b)
+	if s := p.Stats(addr); s.Idle != 2 || s.InUse != 0 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestConnPool_IdleAndBroken(t *testing.T) {
+	addr, svr, stop := startPoolServer(t)
+	defer stop()
+	clock := NewFakeClock(time.Unix(1000, 0))
+	p, closePool := newTestPool(clock, WithPoolSize(1, 4), WithIdleTimeout(10*time.Second))
+	defer closePool()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var conns []*TcpConn
+	for i := 0; i < 3; i++ {
+		c, err := p.Acquire(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		p.Release(c)
+	}
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Second)
+	}
+	// idle connections above the minimum are closed
+	if s := p.Stats(addr); s.Open != 1 || s.Evicted != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+
+	// the server drops the last one, the pool replaces it
+	svr.el.AsyncExecute(func() {
+		for _, c := range svr.connMap {
+			c.ForceClose()
+		}
+	})
+	waitFor(t, "the replacement", func() bool {
+		s := p.Stats(addr)
+		return s.Evicted == 3 && s.Idle == 1
+	})
+}
+
+func TestConnPool_HealthCheck(t *testing.T) {
+	addr, _, stop := startPoolServer(t)
+	defer stop()
+	clock := NewFakeClock(time.Unix(1000, 0))
+	unhealthy := make(chan *TcpConn, 1)
+	check := func(ctx context.Context, conn *TcpConn) error {
+		select {
+		case bad := <-unhealthy:
+			if bad == conn {
+				return errors.New("no pong")
+			}
+			unhealthy <- bad
+		default:
+		}
+		return nil
+	}
+	p, closePool := newTestPool(clock, WithPoolSize(1, 1), WithHealthCheck(5*time.Second, check))
+	defer closePool()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	c, err := p.Acquire(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release(c)
+
+	unhealthy <- c
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Second)
+	}
+	waitFor(t, "the eviction", func() bool { return p.Stats(addr).Evicted == 1 })
+	// the next round of maintenance refills the minimum
+	clock.Advance(time.Second)
+	waitFor(t, "the replacement", func() bool { return p.Stats(addr).Idle == 1 })
+	if c2, err := p.Acquire(ctx, addr); err != nil || c2 == c {
+		t.Fatalf("acquired %v, %v", c2, err)
+	}
+}
+
+func TestConnPool_DialFailure(t *testing.T) {
+	p, closePool := newTestPool(nil)
+	defer closePool()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addr := "tcp4://" + closedPort(t)
+	if _, err := p.Acquire(ctx, addr); err == nil || err == context.DeadlineExceeded {
+		t.Fatalf("err = %v, want the dial error", err)
+	}
+	if s := p.Stats(addr); s.Failures != 1 || s.Open != 0 || s.Dialing != 0 {
+		t.Fatalf("stats %+v", s)
+	}
+	p.Close()
+	if _, err := p.Acquire(ctx, addr); err == nil {
+		t.Fatal("Acquire after Close should fail")
+	}
+}
@@ -1,12 +1,20 @@
 package muduo
 
 import (
+	"context"
 	"golang.org/x/sys/unix"
 	"math"
+	"math/rand"
+	"muduo/pkg/errors"
 	"muduo/pkg/logging"
+	"muduo/socks5"
+	"net"
 	"time"
 )
 
+// resolveTimeout bounds a lookup when no connect timeout is set.
+const resolveTimeout = 10 * time.Second
+
 type ConnectState int
 
 const (
@@ -15,37 +23,187 @@ const (
 	connectorConnected
 )
 
+// RetryPolicy tells a Connector how long to wait before each new attempt.
+type RetryPolicy struct {
+	// Initial is the delay after the first failed attempt.
+	Initial time.Duration
+	// Max caps the delay.
+	Max time.Duration
+	// Multiplier grows the delay after every failed attempt, values below 1 keep it constant.
+	Multiplier float64
+	// Jitter adds a random fraction of up to Jitter of the delay, e.g. 0.2 for up to 20% more.
+	Jitter float64
+	// MaxAttempts is the number of attempts before giving up, 0 means no limit.
+	MaxAttempts int
+}
+
+// DefaultRetryPolicy starts at 500ms and doubles up to 30s, forever.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Initial:    500 * time.Millisecond,
+		Max:        30 * time.Second,
+		Multiplier: 2,
+	}
+}
+
+// delay returns how long to wait after the attempt-th consecutive failure.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.Initial)
+	if p.Multiplier > 1 {
+		d *= math.Pow(p.Multiplier, float64(attempt-1))
+	}
+	if p.Max > 0 && d > float64(p.Max) {
+		d = float64(p.Max)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// endpoint is one server address of a Connector, its host is resolved on every round.
+type endpoint struct {
+	addr    string // as given, e.g. tcp4://example.com:80
+	network string
+	host    string
+	port    int
+}
+
+// dialTarget is one resolved address of an endpoint, or of the SOCKS5 proxy
+// to reach it through.
+type dialTarget struct {
+	endpoint string
+	family   int
+	sa       unix.Sockaddr
+	dest     *endpoint // asked of the proxy at sa, nil without a proxy
+}
+
 type Connector struct {
-	el          *Eventloop
-	svrAddr     string
-	unixSvrAddr unix.Sockaddr
-	connect     bool
-	state       ConnectState
-	ch          *Channel
-	cb          func(int)
-	retryDelay  time.Duration
-	tt          *TimerTask
+	el              *Eventloop
+	svrAddr         string
+	endpoints       []endpoint
+	resolver        Resolver
+	targets         []dialTarget // addresses of the current round, in dial order
+	next            int
+	target          dialTarget // the address being dialed or connected to
+	lastErr         error
+	gen             uint64 // bumped by Stop, drops lookups of an older round
+	connect         bool
+	state           ConnectState
+	ch              *Channel
+	cb              func(int)
+	policy          RetryPolicy
+	attempt         int
+	connectTimeout  time.Duration
+	onConnectFailed func(err error, attempt int)
+	onGiveUp        func()
+	tt              *TimerTask
+	timeoutTt       *TimerTask
+	proxy           *endpoint
+	proxyAuth       *socks5.UserPass
+	hs              *socksHandshake
 }
 
+// NewConnector creates a connector to svrAddr, e.g. tcp://example.com:80. Host
+// names are resolved on every connect, see SetResolver and SetEndpoints.
 func NewConnector(el *Eventloop, svrAddr string, cb func(int)) (*Connector, error) {
-	network, addr := parseProtoAddr(svrAddr)
-	sa, _, _, _, err := GetTCPSockAddr(network, addr)
+	ep, err := parseEndpoint(svrAddr)
 	if err != nil {
 		return nil, err
 	}
 	return &Connector{
-		el:          el,
-		svrAddr:     svrAddr,
-		unixSvrAddr: sa,
-		connect:     false,
-		state:       connectorDisconnected,
-		ch:          nil,
-		cb:          cb,
-		retryDelay:  500 * time.Millisecond,
-		tt:          nil,
+		el:        el,
+		svrAddr:   svrAddr,
+		endpoints: []endpoint{ep},
+		resolver:  net.DefaultResolver,
+		connect:   false,
+		state:     connectorDisconnected,
+		ch:        nil,
+		cb:        cb,
+		policy:    DefaultRetryPolicy(),
+		tt:        nil,
 	}, nil
 }
 
+func parseEndpoint(addr string) (endpoint, error) {
+	network, hostPort := parseProtoAddr(addr)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return endpoint{}, errors.ErrUnsupportedTCPProtocol
+	}
+	host, service, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return endpoint{}, err
+	}
+	port, err := net.LookupPort(network, service)
+	if err != nil {
+		return endpoint{}, err
+	}
+	return endpoint{addr: addr, network: network, host: host, port: port}, nil
+}
+
+// SetEndpoints replaces the server addresses. Each round tries the endpoints in
+// order, and the addresses of every endpoint in Happy Eyeballs order, before
+// backing off according to the retry policy. It must be called before Start.
+func (c *Connector) SetEndpoints(svrAddrs ...string) error {
+	if len(svrAddrs) == 0 {
+		return errors.ErrNoEndpoints
+	}
+	endpoints := make([]endpoint, 0, len(svrAddrs))
+	for _, addr := range svrAddrs {
+		ep, err := parseEndpoint(addr)
+		if err != nil {
+			return err
+		}
+		endpoints = append(endpoints, ep)
+	}
+	c.svrAddr = svrAddrs[0]
+	c.endpoints = endpoints
+	return nil
+}
+
+// SetResolver replaces net.DefaultResolver, it must be called before Start.
+func (c *Connector) SetResolver(r Resolver) {
+	c.resolver = r
+}
+
+// Endpoint returns the endpoint, as passed in, of the last established connection.
+func (c *Connector) Endpoint() string {
+	return c.target.endpoint
+}
+
+// RemoteAddr returns the address of the last established connection, that of
+// the proxy when connecting through one.
+func (c *Connector) RemoteAddr() net.Addr {
+	if c.target.sa == nil {
+		return nil
+	}
+	return SockaddrToTCPOrUnixAddr(c.target.sa)
+}
+
+// SetRetryPolicy replaces DefaultRetryPolicy, it must be called before Start.
+func (c *Connector) SetRetryPolicy(policy RetryPolicy) {
+	c.policy = policy
+}
+
+// SetConnectTimeout fails an attempt still in progress after d, 0 (the default)
+// leaves it to the kernel.
+func (c *Connector) SetConnectTimeout(d time.Duration) {
+	c.connectTimeout = d
+}
+
+// SetOnConnectFailed is called on the loop goroutine after every failed attempt,
+// attempt counts the consecutive failures.
+func (c *Connector) SetOnConnectFailed(cb func(err error, attempt int)) {
+	c.onConnectFailed = cb
+}
+
+// SetOnGiveUp is called on the loop goroutine once MaxAttempts attempts have failed.
+func (c *Connector) SetOnGiveUp(cb func()) {
+	c.onGiveUp = cb
+}
+
 func (c *Connector) Start() {
 	c.connect = true
 	c.el.AsyncExecute(c.start)
@@ -56,72 +214,222 @@ func (c *Connector) Stop() {
 	if c.tt != nil {
 		c.tt.Cancel()
 	}
+	c.el.AsyncExecute(c.stopInLoop)
 }
 
 func (c *Connector) Restart() {
 	c.connect = true
 	c.state = connectorDisconnected
-	c.retryDelay = 500 * time.Millisecond
+	c.attempt = 0
 	c.start()
 }
 
 func (c *Connector) start() {
 	if c.connect {
-		c.connect0()
+		c.resolve()
 	} else {
 		logging.Debugf("do not connect")
 	}
 }
 
-func (c *Connector) connect0() {
-	fd, err := sysSocket(unix.AF_INET, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+func (c *Connector) stopInLoop() {
+	c.gen++
+	if c.state == connectorConnecting {
+		c.cancelTimeout()
+		fd := c.removeAndResetChannel()
+		c.state = connectorDisconnected
+		c.hs = nil
+		_ = unix.Close(fd)
+	}
+}
+
+// resolve starts a round. Addresses given as IP literals are used right away,
+// host names are looked up off the loop goroutine.
+func (c *Connector) resolve() {
+	literal := true
+	endpoints := c.endpoints
+	if c.proxy != nil {
+		// the proxy resolves the endpoints
+		endpoints = []endpoint{*c.proxy}
+	}
+	for _, ep := range endpoints {
+		if ep.host != "" && net.ParseIP(ep.host) == nil {
+			literal = false
+			break
+		}
+	}
+	if literal {
+		c.startRound(c.lookup(context.Background()))
+		return
+	}
+	gen := c.gen
+	timeout := c.connectTimeout
+	if timeout <= 0 {
+		timeout = resolveTimeout
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		targets, err := c.lookup(ctx)
+		c.el.AsyncExecute(func() {
+			if gen == c.gen && c.connect {
+				c.startRound(targets, err)
+			}
+		})
+	}()
+}
+
+// lookup resolves every endpoint, it returns the last error when none resolves.
+// Through a proxy, the targets are the addresses of the proxy for every endpoint.
+func (c *Connector) lookup(ctx context.Context) ([]dialTarget, error) {
+	var targets []dialTarget
+	var lastErr error
+	if c.proxy != nil {
+		proxies, err := c.lookupEndpoint(ctx, *c.proxy)
+		for i := range c.endpoints {
+			for _, t := range proxies {
+				t.endpoint, t.dest = c.endpoints[i].addr, &c.endpoints[i]
+				targets = append(targets, t)
+			}
+		}
+		lastErr = err
+	} else {
+		for _, ep := range c.endpoints {
+			t, err := c.lookupEndpoint(ctx, ep)
+			if err != nil {
+				lastErr = err
+			}
+			targets = append(targets, t...)
+		}
+	}
+	if len(targets) == 0 {
+		if lastErr == nil {
+			lastErr = &net.AddrError{Err: "no suitable address", Addr: c.svrAddr}
+		}
+		return nil, lastErr
+	}
+	return targets, nil
+}
+
+// lookupEndpoint resolves the addresses of one endpoint, in dial order.
+func (c *Connector) lookupEndpoint(ctx context.Context, ep endpoint) ([]dialTarget, error) {
+	var addrs []net.IPAddr
+	if ep.host == "" {
+		addrs = []net.IPAddr{{IP: net.IPv4zero}}
+	} else if ip := net.ParseIP(ep.host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		var err error
+		if addrs, err = c.resolver.LookupIPAddr(ctx, ep.host); err != nil {
+			logging.Warnf("Connector::lookup - resolve %s failed: %v", ep.addr, err)
+			return nil, err
+		}
+	}
+	var targets []dialTarget
+	var lastErr error
+	for _, a := range happyEyeballsOrder(addrs) {
+		family := unix.AF_INET6
+		if a.IP.To4() != nil {
+			family = unix.AF_INET
+		}
+		if (ep.network == "tcp4" && family != unix.AF_INET) || (ep.network == "tcp6" && family != unix.AF_INET6) {
+			continue
+		}
+		sa, err := ipToSockaddr(family, a.IP, ep.port, a.Zone)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		targets = append(targets, dialTarget{endpoint: ep.addr, family: family, sa: sa})
+	}
+	return targets, lastErr
+}
+
+func (c *Connector) startRound(targets []dialTarget, err error) {
+	c.targets = targets
+	c.next = 0
+	c.lastErr = err
+	c.dialNext()
+}
+
+// dialNext dials the next address of the round, or fails the round when there is none left.
+func (c *Connector) dialNext() {
+	if c.next >= len(c.targets) {
+		c.retry(c.lastErr)
+		return
+	}
+	c.target = c.targets[c.next]
+	c.next++
+	fd, err := sysSocket(c.target.family, unix.SOCK_STREAM, unix.IPPROTO_TCP)
 	if err != nil {
 		panic(err)
 	}
 
-	err = unix.Connect(fd, c.unixSvrAddr)
-	logging.Errorf("connect to %s failed due to error: %v", c.svrAddr, err)
+	err = unix.Connect(fd, c.target.sa)
 	if err != nil {
 		switch err {
 		case unix.EINPROGRESS, unix.EINTR, unix.EISCONN:
 			c.connecting(fd)
-		case unix.EAGAIN, unix.EADDRINUSE, unix.EADDRNOTAVAIL, unix.ECONNREFUSED, unix.ENETUNREACH:
-			c.retry(fd)
+		case unix.EAGAIN, unix.EADDRINUSE, unix.EADDRNOTAVAIL, unix.ECONNREFUSED, unix.ENETUNREACH, unix.EHOSTUNREACH:
+			c.failover(fd, err)
 		case unix.EACCES, unix.EPERM, unix.EAFNOSUPPORT, unix.EALREADY, unix.EBADF, unix.EFAULT, unix.ENOTSOCK:
-			logging.Errorf("connect to %s failed due to unrecoverable error: %v", c.svrAddr, err)
-			_ = unix.Close(fd)
+			logging.Errorf("connect to %s failed due to unrecoverable error: %v", c.targetString(), err)
+			c.giveUp(fd, err)
 		default:
-			logging.Errorf("connect to %s failed due to unrecoverable error: %v", c.svrAddr, err)
-			_ = unix.Close(fd)
+			logging.Errorf("connect to %s failed due to unrecoverable error: %v", c.targetString(), err)
+			c.giveUp(fd, err)
 		}
 	} else {
 		c.connecting(fd)
 	}
 }
 
+// failover closes a failed socket and moves on to the next address of the round.
+func (c *Connector) failover(fd int, err error) {
+	_ = unix.Close(fd)
+	c.state = connectorDisconnected
+	c.lastErr = err
+	logging.Warnf("Connector::failover - connect to %s failed: %v", c.targetString(), err)
+	if !c.connect {
+		logging.Infof("do not connect")
+		return
+	}
+	c.dialNext()
+}
+
+func (c *Connector) targetString() string {
+	if c.target.dest != nil {
+		return c.target.endpoint + " (via " + SockaddrToTCPOrUnixAddr(c.target.sa).String() + ")"
+	}
+	return c.target.endpoint + " (" + SockaddrToTCPOrUnixAddr(c.target.sa).String() + ")"
+}
+
 func (c *Connector) connecting(fd int) {
 	c.state = connectorConnecting
 	c.ch = NewChannel(c.el, fd)
 	c.ch.setWriteCallback(c.handleWrite)
 	c.ch.setErrorCallback(c.handleError)
 	c.ch.enableWriting()
+	if c.connectTimeout > 0 {
+		c.timeoutTt = c.el.ScheduleDelay(c.handleTimeout, c.connectTimeout)
+	}
 }
 
 func (c *Connector) handleWrite() {
 	logging.Debugf("Connector::handleWrite")
 	if c.state == connectorConnecting {
+		c.cancelTimeout()
 		fd := c.removeAndResetChannel()
-		_, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
-		if err != nil {
+		if err := socketError(fd); err != nil {
 			logging.Warnf("Connector::handleWrite - SO_ERROR : %v", err)
-			c.retry(fd)
+			c.failover(fd, err)
+		} else if isSelfConnect(fd) {
+			logging.Warnf("Connector::handleWrite - self connect to %s", c.targetString())
+			c.failover(fd, errors.ErrSelfConnect)
+		} else if c.target.dest != nil {
+			c.startHandshake(fd)
 		} else {
-			c.state = connectorConnected
-			if c.connect {
-				c.cb(fd)
-			} else {
-				_ = unix.Close(fd)
-			}
+			c.established(fd)
 		}
 	} else {
 		logging.Errorf("Connector::handleWrite - unexpected state %v", c.state)
@@ -129,32 +437,130 @@ func (c *Connector) handleWrite() {
 	}
 }
 
+// established hands a connected socket over.
+func (c *Connector) established(fd int) {
+	c.state = connectorConnected
+	c.attempt = 0
+	if c.connect {
+		c.cb(fd)
+	} else {
+		_ = unix.Close(fd)
+	}
+}
+
 func (c *Connector) handleError() {
 	logging.Errorf("Connector::handleError")
 	if c.state == connectorConnecting {
+		c.cancelTimeout()
 		fd := c.removeAndResetChannel()
-		c.retry(fd)
+		err := socketError(fd)
+		if err == nil {
+			err = unix.ECONNREFUSED
+		}
+		c.failover(fd, err)
 	} else {
 		logging.Errorf("Connector::handleError - unexpected state %v", c.state)
 	}
 }
 
+func (c *Connector) handleTimeout() {
+	c.timeoutTt = nil
+	if c.state == connectorConnecting {
+		logging.Warnf("Connector::handleTimeout - connect to %s timed out after %v", c.targetString(), c.connectTimeout)
+		fd := c.removeAndResetChannel()
+		c.failover(fd, errors.ErrConnectTimeout)
+	}
+}
+
+func (c *Connector) cancelTimeout() {
+	if c.timeoutTt != nil {
+		c.timeoutTt.Cancel()
+		c.timeoutTt = nil
+	}
+}
+
 func (c *Connector) removeAndResetChannel() int {
-	c.ch.disableAll()
-	c.el.removeChannel(c.ch)
-	fd := c.ch.fd
-	c.el.AsyncExecute(func() { c.ch = nil })
-	return fd
+	ch := c.ch
+	ch.disableAll()
+	c.el.removeChannel(ch)
+	// we may be in ch's handleEvent, and a failover may have replaced it by then
+	c.el.AsyncExecute(func() {
+		if c.ch == ch {
+			c.ch = nil
+		}
+	})
+	return ch.fd
 }
 
-func (c *Connector) retry(fd int) {
-	_ = unix.Close(fd)
+// retry fails the round, every address has been tried.
+func (c *Connector) retry(err error) {
 	c.state = connectorDisconnected
-	if c.connect {
-		logging.Infof("Connector::retry - Retry connecting to %s in %v seconds.", c.svrAddr, c.retryDelay.Seconds())
-		c.tt = c.el.AsyncScheduleDelay(c.start, c.retryDelay)
-		c.retryDelay = time.Duration(math.Min(float64(c.retryDelay*2), float64(30*time.Second)))
-	} else {
+	if !c.connect {
+		// stopped during the round, its failure is no longer reported
 		logging.Infof("do not connect")
+		return
+	}
+	c.attempt++
+	if c.onConnectFailed != nil {
+		c.onConnectFailed(err, c.attempt)
+	}
+	if c.policy.MaxAttempts > 0 && c.attempt >= c.policy.MaxAttempts {
+		logging.Errorf("Connector::retry - give up connecting to %s after %d attempts, %v", c.svrAddr, c.attempt, err)
+		c.connect = false
+		if c.onGiveUp != nil {
+			c.onGiveUp()
+		}
+		return
+	}
+	delay := c.policy.delay(c.attempt)
+	logging.Infof("Connector::retry - Retry connecting to %s in %v seconds.", c.svrAddr, delay.Seconds())
+	c.tt = c.el.ScheduleDelay(c.start, delay)
+}
+
+// giveUp handles errors that retrying cannot fix.
+func (c *Connector) giveUp(fd int, err error) {
+	_ = unix.Close(fd)
+	c.state = connectorDisconnected
+	c.attempt++
+	c.connect = false
+	if c.onConnectFailed != nil {
+		c.onConnectFailed(err, c.attempt)
+	}
+	if c.onGiveUp != nil {
+		c.onGiveUp()
+	}
+}
+
+// socketError returns the pending error of a socket whose connect has completed.
+func socketError(fd int) error {
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if soErr != 0 {
+		return unix.Errno(soErr)
+	}
+	return nil
+}
+
+// isSelfConnect detects the TCP simultaneous open of a socket whose ephemeral port
+// is the port it connects to, which happens when the server is down.
+func isSelfConnect(fd int) bool {
+	local, err := unix.Getsockname(fd)
+	if err != nil {
+		return false
+	}
+	peer, err := unix.Getpeername(fd)
+	if err != nil {
+		return false
+	}
+	switch l := local.(type) {
+	case *unix.SockaddrInet4:
+		p, ok := peer.(*unix.SockaddrInet4)
+		return ok && l.Port == p.Port && l.Addr == p.Addr
+	case *unix.SockaddrInet6:
+		p, ok := peer.(*unix.SockaddrInet6)
+		return ok && l.Port == p.Port && l.Addr == p.Addr
 	}
+	return false
 }
@@ -0,0 +1,191 @@
+package muduo
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"muduo/socks5"
+	"net"
+	"time"
+)
+
+// socksMaxReply is the longest reply, with a host name of 255 bytes.
+const socksMaxReply = 4 + 1 + 255 + 2
+
+const (
+	socksMethod = iota
+	socksAuth
+	socksReply
+)
+
+// socksHandshake is the state of the SOCKS5 handshake on a socket connected to
+// the proxy. Only the bytes of each answer are read, whatever the endpoint
+// sends right after the reply is left to the connection.
+type socksHandshake struct {
+	fd   int
+	step int
+	buf  []byte
+	want int
+}
+
+// SetSocks5 makes the connector reach its endpoints through the SOCKS5 proxy at
+// proxyAddr, e.g. tcp://127.0.0.1:1080. The connection is handed over once the
+// proxy has connected to an endpoint, host names of the endpoints are resolved
+// by the proxy. username and password are sent if the proxy asks for them,
+// leave username empty for no authentication. The connect timeout bounds the
+// handshake too. It must be called before Start.
+func (c *Connector) SetSocks5(proxyAddr, username, password string) error {
+	ep, err := parseEndpoint(proxyAddr)
+	if err != nil {
+		return err
+	}
+	c.proxy = &ep
+	c.proxyAuth = nil
+	if username != "" {
+		c.proxyAuth = &socks5.UserPass{Username: username, Password: password}
+		if _, err := c.proxyAuth.Append(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startHandshake greets the proxy on a connected socket.
+func (c *Connector) startHandshake(fd int) {
+	c.hs = &socksHandshake{fd: fd, step: socksMethod, buf: make([]byte, 0, socksMaxReply), want: 2}
+	c.ch = NewChannel(c.el, fd)
+	c.ch.setReadCallback(c.handleSocksRead)
+	c.ch.setErrorCallback(c.handleError)
+	c.ch.setCloseCallback(c.handleError)
+	c.ch.enableReading()
+	if c.connectTimeout > 0 {
+		c.timeoutTt = c.el.ScheduleDelay(c.handleTimeout, c.connectTimeout)
+	}
+	g := &socks5.Greeting{Methods: []byte{socks5.MethodNoAuth}}
+	if c.proxyAuth != nil {
+		g.Methods = append(g.Methods, socks5.MethodUserPass)
+	}
+	b, _ := g.Append(nil)
+	c.socksWrite(b)
+}
+
+// socksWrite sends a message of the handshake. They are short and sent one at
+// a time, the socket buffer always has room for them.
+func (c *Connector) socksWrite(b []byte) {
+	n, err := unix.Write(c.hs.fd, b)
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		c.socksFail(err, false)
+	}
+}
+
+func (c *Connector) handleSocksRead(ts time.Time) {
+	hs := c.hs
+	if c.state != connectorConnecting || hs == nil {
+		return
+	}
+	for len(hs.buf) < hs.want {
+		n, err := unix.Read(hs.fd, hs.buf[len(hs.buf):hs.want])
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return
+		}
+		if err == nil && n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			c.socksFail(err, false)
+			return
+		}
+		hs.buf = hs.buf[:len(hs.buf)+n]
+		if hs.step == socksReply && hs.want == 5 && len(hs.buf) == 5 {
+			// the address type tells the length of the rest
+			if hs.want, err = socks5.MessageLen(hs.buf); err != nil {
+				c.socksFail(err, false)
+				return
+			}
+		}
+	}
+	c.socksNext()
+}
+
+// socksNext handles a complete answer of the proxy.
+func (c *Connector) socksNext() {
+	hs := c.hs
+	data := hs.buf
+	hs.buf = hs.buf[:0]
+	switch hs.step {
+	case socksMethod:
+		method, _, err := socks5.ParseMethod(data)
+		switch {
+		case err != nil:
+			c.socksFail(err, false)
+		case method == socks5.MethodNoAuth:
+			c.socksRequest()
+		case method == socks5.MethodUserPass && c.proxyAuth != nil:
+			hs.step, hs.want = socksAuth, 2
+			b, _ := c.proxyAuth.Append(nil)
+			c.socksWrite(b)
+		default:
+			c.socksFail(errors.ErrSocksNoMethod, true)
+		}
+	case socksAuth:
+		ok, _, err := socks5.ParseAuthStatus(data)
+		switch {
+		case err != nil:
+			c.socksFail(err, false)
+		case !ok:
+			c.socksFail(errors.ErrSocksAuthFailed, true)
+		default:
+			c.socksRequest()
+		}
+	case socksReply:
+		reply, _, err := socks5.ParseReply(data)
+		switch {
+		case err != nil:
+			c.socksFail(err, false)
+		case reply.Code != socks5.ReplySucceeded:
+			c.socksFail(socks5.ReplyError(reply.Code), false)
+		default:
+			c.cancelTimeout()
+			fd := c.removeAndResetChannel()
+			c.hs = nil
+			c.established(fd)
+		}
+	}
+}
+
+// socksRequest asks the proxy to connect to the endpoint.
+func (c *Connector) socksRequest() {
+	c.hs.step, c.hs.want = socksReply, 5
+	dest := c.target.dest
+	host := dest.host
+	if host == "" {
+		host = net.IPv4zero.String()
+	}
+	b, err := (&socks5.Request{Command: socks5.CmdConnect, Addr: socks5.NewAddr(host, dest.port)}).Append(nil)
+	if err != nil {
+		c.socksFail(err, true)
+		return
+	}
+	c.socksWrite(b)
+}
+
+// socksFail closes the socket and moves on to the next address, or gives up
+// when the proxy refuses the credentials, which no other address would take.
+func (c *Connector) socksFail(err error, fatal bool) {
+	logging.Warnf("Connector::socksFail - SOCKS5 handshake with %s failed: %v", c.targetString(), err)
+	c.cancelTimeout()
+	fd := c.removeAndResetChannel()
+	c.hs = nil
+	if fatal {
+		c.giveUp(fd, err)
+		return
+	}
+	c.failover(fd, err)
+}
@@ -0,0 +1,202 @@
+package muduo
+
+import (
+	"io"
+	"muduo/pkg/errors"
+	"muduo/socks5"
+	"net"
+	"testing"
+	"time"
+)
+
+// readSocks reads one message off c with parse, which returns its length once
+// complete.
+func readSocks(c net.Conn, parse func([]byte) (int, error)) ([]byte, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := c.Read(b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+		n, err := parse(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return buf, nil
+		}
+	}
+}
+
+// socksProxy is a SOCKS5 proxy asking for username and password when password
+// is not empty, it answers every request with code and hands the connection
+// to serve on success.
+func socksProxy(t *testing.T, password string, code byte, serve func(req *socks5.Request, c net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+				data, err := readSocks(c, func(b []byte) (int, error) { _, n, err := socks5.ParseGreeting(b); return n, err })
+				if err != nil {
+					return
+				}
+				g, _, _ := socks5.ParseGreeting(data)
+				if password == "" {
+					_, _ = c.Write(socks5.AppendMethod(nil, socks5.MethodNoAuth))
+				} else {
+					if !g.Has(socks5.MethodUserPass) {
+						_, _ = c.Write(socks5.AppendMethod(nil, socks5.MethodNoAcceptable))
+						return
+					}
+					_, _ = c.Write(socks5.AppendMethod(nil, socks5.MethodUserPass))
+					data, err := readSocks(c, func(b []byte) (int, error) { _, n, err := socks5.ParseUserPass(b); return n, err })
+					if err != nil {
+						return
+					}
+					u, _, _ := socks5.ParseUserPass(data)
+					ok := u.Password == password
+					_, _ = c.Write(socks5.AppendAuthStatus(nil, ok))
+					if !ok {
+						return
+					}
+				}
+				data, err = readSocks(c, func(b []byte) (int, error) { _, n, err := socks5.ParseRequest(b); return n, err })
+				if err != nil {
+					return
+				}
+				req, _, _ := socks5.ParseRequest(data)
+				reply, _ := (&socks5.Reply{Code: code, Addr: socks5.AddrOf(c.LocalAddr())}).Append(nil)
+				if code != socks5.ReplySucceeded {
+					_, _ = c.Write(reply)
+					return
+				}
+				// what the endpoint sends first comes with the reply
+				_, _ = c.Write(append(reply, "banner "+req.Addr.String()+"\n"...))
+				serve(req, c)
+			}()
+		}
+	}()
+	return "tcp4://" + ln.Addr().String()
+}
+
+func testTcpClientSocks5(t *testing.T, opts ...EventloopOption) {
+	proxy := socksProxy(t, "s3cret", socks5.ReplySucceeded, func(req *socks5.Request, c net.Conn) {
+		_, _ = io.Copy(c, c)
+	})
+	el := NewEventloop("test", opts...)
+	// the proxy resolves the name
+	client, err := NewTcpClient(el, "tcp://backend.invalid:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetSocks5(proxy, "alice", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan *TcpConn, 1)
+	client.SetOnConn(func(conn *TcpConn) {
+		if conn.IsConnected() {
+			conns <- conn
+		}
+	})
+	received := make(chan string, 8)
+	client.SetOnMsg(func(conn *TcpConn, buf *Buffer, _ time.Time) {
+		received <- string(buf.Next(-1))
+	})
+	client.Connect()
+	stop := startLoop(el)
+	defer stop()
+	defer el.AsyncExecute(client.Stop)
+
+	var conn *TcpConn
+	select {
+	case conn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection")
+	}
+	if conn.GetPeerAddr().String() != proxy[len("tcp4://"):] {
+		t.Fatalf("peer %v, proxy %s", conn.GetPeerAddr(), proxy)
+	}
+	read := func(want string) {
+		t.Helper()
+		got := ""
+		for len(got) < len(want) {
+			select {
+			case s := <-received:
+				got += s
+			case <-time.After(5 * time.Second):
+				t.Fatalf("read %q, want %q", got, want)
+			}
+		}
+		if got != want {
+			t.Fatalf("read %q, want %q", got, want)
+		}
+	}
+	read("banner backend.invalid:7\n")
+	el.AsyncExecute(func() { _, _ = conn.Write([]byte("ping")) })
+	read("ping")
+}
+
+func TestTcpClient_Socks5(t *testing.T) {
+	testTcpClientSocks5(t)
+}
+
+func TestTcpClient_Socks5IoUring(t *testing.T) {
+	skipWithoutIoUring(t)
+	testTcpClientSocks5(t, WithIoUring())
+}
+
+func TestConnector_Socks5Failed(t *testing.T) {
+	cases := []struct {
+		name     string
+		code     byte
+		password string
+		want     error
+	}{
+		{"bad password", socks5.ReplySucceeded, "other", errors.ErrSocksAuthFailed},
+		{"refused", socks5.ReplyConnectionRefused, "", socks5.ReplyError(socks5.ReplyConnectionRefused)},
+	}
+	for _, c := range cases {
+		proxy := socksProxy(t, c.password, c.code, nil)
+		el := NewEventloop("test")
+		connector, err := NewConnector(el, "tcp4://127.0.0.1:7", func(fd int) {
+			t.Errorf("%s: connected", c.name)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = connector.SetSocks5(proxy, "alice", "s3cret")
+		connector.SetRetryPolicy(RetryPolicy{Initial: time.Millisecond, MaxAttempts: 1})
+		failed := make(chan error, 2)
+		connector.SetOnConnectFailed(func(err error, attempt int) { failed <- err })
+		gaveUp := make(chan struct{})
+		connector.SetOnGiveUp(func() { close(gaveUp) })
+		stop := startLoop(el)
+		connector.Start()
+		select {
+		case err := <-failed:
+			if err != c.want {
+				t.Fatalf("%s: failed with %v", c.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: did not fail", c.name)
+		}
+		select {
+		case <-gaveUp:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: did not give up", c.name)
+		}
+		stop()
+	}
+}
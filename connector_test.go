@@ -1,19 +1,326 @@
 package muduo
 
 import (
+	"context"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"muduo/pkg/errors"
 	"muduo/pkg/logging"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestNewConnector(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
 	el := NewEventloop("test")
-	connector, err := NewConnector(el, "tcp4://192.168.1.57:9681", nil)
+	connector, err := NewConnector(el, "tcp4://"+ln.Addr().String(), nil)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	connected := make(chan int, 1)
 	connector.cb = func(fd int) {
 		logging.Infof(">>>>>>>>>>>>>>>>>>>>fd: %d", fd)
+		connected <- fd
 	}
 	connector.Start()
-	el.Loop()
+	stop := startLoop(el)
+	defer stop()
+
+	select {
+	case fd := <-connected:
+		_ = unix.Close(fd)
+	case <-time.After(time.Second):
+		t.Fatal("connector did not connect")
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 3}
+	for i, want := range []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if d := p.delay(i + 1); d != want {
+			t.Errorf("delay(%d) = %v, want %v", i+1, d, want)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.delay(1); d < time.Second || d > 1500*time.Millisecond {
+			t.Fatalf("jittered delay %v is out of [1s, 1.5s]", d)
+		}
+	}
+}
+
+// closedPort returns an address nobody listens on.
+func closedPort(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+func TestConnector_GiveUp(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("test", WithClock(clock))
+	connector, err := NewConnector(el, "tcp4://"+closedPort(t), func(fd int) {
+		t.Error("connected to a closed port")
+		_ = unix.Close(fd)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := RetryPolicy{Initial: time.Second, Max: 2 * time.Second, Multiplier: 2, MaxAttempts: 3}
+	connector.SetRetryPolicy(policy)
+	failed := make(chan int, 4)
+	connector.SetOnConnectFailed(func(err error, attempt int) {
+		if err != unix.ECONNREFUSED {
+			t.Errorf("attempt %d failed with %v", attempt, err)
+		}
+		failed <- attempt
+	})
+	gaveUp := make(chan struct{})
+	connector.SetOnGiveUp(func() { close(gaveUp) })
+	stop := startLoop(el)
+	defer stop()
+	connector.Start()
+
+	for want := 1; want <= 3; want++ {
+		select {
+		case attempt := <-failed:
+			if attempt != want {
+				t.Fatalf("attempt %d reported, want %d", attempt, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d did not fail", want)
+		}
+		if want < 3 {
+			// nothing happens until the backoff has elapsed
+			clock.Advance(policy.delay(want) - time.Millisecond)
+			select {
+			case attempt := <-failed:
+				t.Fatalf("attempt %d started before the backoff elapsed", attempt)
+			case <-time.After(20 * time.Millisecond):
+			}
+			clock.Advance(time.Millisecond)
+		}
+	}
+	select {
+	case <-gaveUp:
+	case <-time.After(time.Second):
+		t.Fatal("connector did not give up")
+	}
+}
+
+func TestConnector_ConnectTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("test", WithClock(clock))
+	connector, err := NewConnector(el, "tcp4://"+ln.Addr().String(), func(fd int) {
+		t.Error("connected after the timeout")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector.SetConnectTimeout(3 * time.Second)
+	connector.SetRetryPolicy(RetryPolicy{Initial: time.Second, MaxAttempts: 1})
+	var failure error
+	connector.SetOnConnectFailed(func(err error, attempt int) { failure = err })
+	gaveUp := false
+	connector.SetOnGiveUp(func() { gaveUp = true })
+
+	// the loop is not polling, so the attempt stays in progress until it times out
+	connector.connect = true
+	connector.start()
+	if connector.state != connectorConnecting {
+		t.Fatalf("state = %v, want connecting", connector.state)
+	}
+	clock.Advance(2 * time.Second)
+	if failure != nil {
+		t.Fatalf("failed early with %v", failure)
+	}
+	clock.Advance(time.Second)
+	if failure != errors.ErrConnectTimeout || !gaveUp {
+		t.Fatalf("failure %v, gave up %v", failure, gaveUp)
+	}
+	if connector.state != connectorDisconnected {
+		t.Fatalf("state = %v, want disconnected", connector.state)
+	}
+}
+
+func TestConnector_StopDuringRound(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("test", WithClock(clock))
+	connector, err := NewConnector(el, "tcp4://"+closedPort(t), func(fd int) {
+		t.Error("connected after Stop")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector.SetOnConnectFailed(func(err error, attempt int) {
+		t.Errorf("attempt %d failed with %v after Stop", attempt, err)
+	})
+	connector.SetOnGiveUp(func() { t.Error("gave up after Stop") })
+
+	// the round in flight when Stop is called fails on the loop afterwards
+	connector.connect = true
+	connector.Stop()
+	connector.startRound(nil, unix.ECONNREFUSED)
+	if connector.tt != nil {
+		t.Fatal("next attempt scheduled after Stop")
+	}
+	clock.Advance(time.Hour)
+}
+
+func TestIsSelfConnect(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	local, err := unix.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a simultaneous open with itself
+	if err := unix.Connect(fd, local); err != nil {
+		t.Fatal(err)
+	}
+	if !isSelfConnect(fd) {
+		t.Fatal("self connect is not detected")
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	raw, _ := c.(*net.TCPConn).SyscallConn()
+	_ = raw.Control(func(fd uintptr) {
+		if isSelfConnect(int(fd)) {
+			t.Error("a regular connection is reported as self connect")
+		}
+	})
+}
+
+func TestConnector_Failover(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	el := NewEventloop("test")
+	connected := make(chan int, 1)
+	connector, err := NewConnector(el, "tcp://"+closedPort(t), func(fd int) { connected <- fd })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first endpoint is down, so is the first address of the second one
+	svc := fmt.Sprintf("tcp://svc.test:%d", port)
+	if err := connector.SetEndpoints("tcp://"+closedPort(t), svc); err != nil {
+		t.Fatal(err)
+	}
+	connector.SetResolver(StaticResolver{"svc.test": {"127.0.0.2", "127.0.0.1"}})
+	connector.SetOnConnectFailed(func(err error, attempt int) {
+		t.Errorf("round %d failed: %v", attempt, err)
+	})
+	stop := startLoop(el)
+	defer stop()
+	connector.Start()
+
+	select {
+	case fd := <-connected:
+		_ = unix.Close(fd)
+	case <-time.After(time.Second):
+		t.Fatal("connector did not fail over")
+	}
+	done := make(chan struct{})
+	el.AsyncExecute(func() {
+		defer close(done)
+		if connector.Endpoint() != svc {
+			t.Errorf("endpoint = %s, want %s", connector.Endpoint(), svc)
+		}
+		if addr := connector.RemoteAddr().String(); addr != ln.Addr().String() {
+			t.Errorf("remote addr = %s, want %s", addr, ln.Addr())
+		}
+	})
+	<-done
+}
+
+type switchingResolver struct {
+	lookups chan string
+	addrs   [][]string
+}
+
+func (r *switchingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	n := len(r.lookups)
+	r.lookups <- host
+	if n >= len(r.addrs) {
+		n = len(r.addrs) - 1
+	}
+	return StaticResolver{host: r.addrs[n]}.LookupIPAddr(ctx, host)
+}
+
+func TestConnector_ResolveOnRetry(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("test", WithClock(clock))
+	connected := make(chan int, 1)
+	connector, err := NewConnector(el, fmt.Sprintf("tcp4://moving.test:%d", port), func(fd int) { connected <- fd })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the service moves from a dead address to the listener
+	resolver := &switchingResolver{lookups: make(chan string, 4), addrs: [][]string{{"127.0.0.2"}, {"127.0.0.1"}}}
+	connector.SetResolver(resolver)
+	failed := make(chan error, 4)
+	connector.SetOnConnectFailed(func(err error, attempt int) { failed <- err })
+	stop := startLoop(el)
+	defer stop()
+	connector.Start()
+
+	select {
+	case err := <-failed:
+		if err != unix.ECONNREFUSED {
+			t.Fatalf("first round failed with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("first round did not fail")
+	}
+	clock.Advance(DefaultRetryPolicy().Initial)
+	select {
+	case fd := <-connected:
+		_ = unix.Close(fd)
+	case <-time.After(time.Second):
+		t.Fatal("connector did not follow the new address")
+	}
+	if n := len(resolver.lookups); n != 2 {
+		t.Fatalf("resolved %d times, want once per round", n)
+	}
 }
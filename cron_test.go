@@ -0,0 +1,58 @@
+package muduo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron_Next(t *testing.T) {
+	utc := time.UTC
+	from := time.Date(2024, 1, 31, 10, 15, 30, 0, utc) // a Wednesday
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 16, 0, 0, utc)},
+		{"* * * * * *", time.Date(2024, 1, 31, 10, 15, 31, 0, utc)},
+		{"*/10 * * * * *", time.Date(2024, 1, 31, 10, 15, 40, 0, utc)},
+		{"0 9-17/4 * * *", time.Date(2024, 1, 31, 13, 0, 0, 0, utc)},
+		{"30 2 * * mon-fri", time.Date(2024, 2, 1, 2, 30, 0, 0, utc)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, utc)},
+		{"0 0 1,15 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, utc)},
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, utc)},
+		{"0 12 13 * 5", time.Date(2024, 2, 2, 12, 0, 0, 0, utc)}, // dom OR dow
+		{"@hourly", time.Date(2024, 1, 31, 11, 0, 0, 0, utc)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, utc)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		s, err := ParseCron(c.expr, utc)
+		if err != nil {
+			t.Errorf("%q: %v", c.expr, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(c.want) {
+			t.Errorf("%q: next is %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := ParseCron(expr, time.UTC); err == nil {
+			t.Errorf("%q should not parse", expr)
+		}
+	}
+}
+
+func TestParseCron_Location(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	s, err := ParseCron("0 9 * * *", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if want := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("next is %v, want %v", got, want)
+	}
+}
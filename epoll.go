@@ -2,6 +2,7 @@ package muduo
 
 import (
 	"golang.org/x/sys/unix"
+	"sync"
 	"unsafe"
 )
 
@@ -32,6 +33,46 @@ func epollWait(epfd int, events []epollevent, msec int) (int, error) {
 	return int(np), nil
 }
 
+// epollPwait2 is epoll_wait with a timespec timeout, available since linux 5.11.
+// A nil ts blocks indefinitely.
+func epollPwait2(epfd int, events []epollevent, ts *unix.Timespec) (int, error) {
+	var ep unsafe.Pointer
+	if len(events) > 0 {
+		ep = unsafe.Pointer(&events[0])
+	} else {
+		ep = unsafe.Pointer(&zero)
+	}
+	var (
+		np    uintptr
+		errno unix.Errno
+	)
+	if ts != nil && ts.Sec == 0 && ts.Nsec == 0 {
+		np, _, errno = unix.RawSyscall6(unix.SYS_EPOLL_PWAIT2, uintptr(epfd), uintptr(ep), uintptr(len(events)), uintptr(unsafe.Pointer(ts)), 0, 0)
+	} else {
+		np, _, errno = unix.Syscall6(unix.SYS_EPOLL_PWAIT2, uintptr(epfd), uintptr(ep), uintptr(len(events)), uintptr(unsafe.Pointer(ts)), 0, 0)
+	}
+	if errno != 0 {
+		return int(np), errnoErr(errno)
+	}
+	return int(np), nil
+}
+
+var (
+	pwait2Once      sync.Once
+	pwait2Supported bool
+)
+
+// epollPwait2Supported probes the kernel once. Calling epoll_pwait2 on an invalid
+// fd fails with EBADF when the syscall exists and ENOSYS (or EPERM under seccomp) when not.
+func epollPwait2Supported() bool {
+	pwait2Once.Do(func() {
+		var ts unix.Timespec
+		_, _, errno := unix.RawSyscall6(unix.SYS_EPOLL_PWAIT2, ^uintptr(0), 0, 0, uintptr(unsafe.Pointer(&ts)), 0, 0)
+		pwait2Supported = errno == unix.EBADF
+	})
+	return pwait2Supported
+}
+
 func epollCtl(epfd int, op int, fd int, event *epollevent) error {
 	_, _, errno := unix.RawSyscall6(unix.SYS_EPOLL_CTL, uintptr(epfd), uintptr(op), uintptr(fd), uintptr(unsafe.Pointer(event)), 0, 0)
 	if errno != 0 {
@@ -11,7 +11,7 @@ import (
 )
 
 const (
-	pollTimeoutMills = 10000
+	pollTimeout = 10 * time.Second
 )
 
 type Task func()
@@ -23,16 +23,51 @@ type Eventloop struct {
 	looping             int32
 	quit                int32
 	activeChannels      *list.List
-	poller              *Poller
+	poller              Poller
 	tq                  *timerQueue
 	pendingTasks        *list.List
 	taskMutex           sync.Mutex
 	evtFd               int
 	wakeupChannel       *Channel
 	runningPendingTasks bool
+	signals             *signalPipe
+	opts                []EventloopOption
+	pollTimers          bool
+	preciseTimeout      bool
+	ioUring             bool
+	clock               Clock
 }
 
-func NewEventloop(id string) *Eventloop {
+// EventloopOption configures an Eventloop when it is created.
+type EventloopOption func(el *Eventloop)
+
+// WithPollTimers drives timers from the poll timeout instead of a timerfd,
+// saving one fd and one wakeup per expiration.
+func WithPollTimers() EventloopOption {
+	return func(el *Eventloop) {
+		el.pollTimers = true
+	}
+}
+
+// WithPreciseTimeout waits with epoll_pwait2 so poll timeouts keep sub-millisecond
+// precision. It silently falls back to epoll_wait on kernels older than 5.11.
+func WithPreciseTimeout() EventloopOption {
+	return func(el *Eventloop) {
+		el.preciseTimeout = true
+	}
+}
+
+// WithIoUring backs the Eventloop with io_uring instead of epoll: listening sockets
+// use multishot accept and connections receive into a provided buffer ring and
+// send through the ring. If the kernel lacks io_uring or any of the features the
+// backend needs, the loop logs a warning and uses epoll.
+func WithIoUring() EventloopOption {
+	return func(el *Eventloop) {
+		el.ioUring = true
+	}
+}
+
+func NewEventloop(id string, opts ...EventloopOption) *Eventloop {
 	el := &Eventloop{
 		id:                  id,
 		looping:             0,
@@ -40,9 +75,24 @@ func NewEventloop(id string) *Eventloop {
 		activeChannels:      list.New(),
 		pendingTasks:        list.New(),
 		runningPendingTasks: false,
+		opts:                opts,
+		clock:               realClock{},
+	}
+	for _, opt := range opts {
+		opt(el)
+	}
+	if el.ioUring {
+		if p, err := newUringPoller(el); err == nil {
+			el.poller = p
+		} else {
+			logging.Warnf("eventloop[%s] io_uring is unavailable, fall back to epoll: %v", id, err)
+		}
+	}
+	if el.poller == nil {
+		el.poller, _ = newPoller(el)
 	}
-	el.poller, _ = newPoller(el)
-	el.tq = newTimerQueue(el)
+	_, fake := el.clock.(*FakeClock)
+	el.tq = newTimerQueue(el, !el.pollTimers && !fake)
 	el.evtFd = createEventFd()
 	wakeupChannel := NewChannel(el, el.evtFd)
 	el.wakeupChannel = wakeupChannel
@@ -68,6 +118,26 @@ func createEventFd() int {
 //	task()
 //}
 
+// runSync runs task on the loop goroutine and waits for it, or runs it right away
+// when the loop is not looping.
+func (el *Eventloop) runSync(task Task) {
+	if atomic.LoadInt32(&el.looping) == 0 {
+		task()
+		return
+	}
+	done := make(chan struct{})
+	el.AsyncExecute(func() {
+		task()
+		close(done)
+	})
+	<-done
+}
+
+// Now returns the current time of the loop's Clock.
+func (el *Eventloop) Now() time.Time {
+	return el.clock.Now()
+}
+
 func (el *Eventloop) AsyncExecute(task Task) {
 	logging.Infof("eventloop[%s] async execute task", el.id)
 	el.taskMutex.Lock()
@@ -96,11 +166,11 @@ func (el *Eventloop) runPendingTasks() {
 }
 
 func (el *Eventloop) Schedule(callback TimeoutCallback, t time.Time) *TimerTask {
-	return el.tq.addTask(callback, t, 0)
+	return el.tq.addTask(callback, el.tq.deadline(t), 0)
 }
 
 func (el *Eventloop) AsyncSchedule(callback TimeoutCallback, t time.Time) *TimerTask {
-	tt := newTimerTask(el.tq, callback, t, 0)
+	tt := newTimerTask(el.tq, callback, el.tq.deadline(t), 0)
 	el.AsyncExecute(func() {
 		el.tq.addTask0(tt)
 	})
@@ -108,31 +178,70 @@ func (el *Eventloop) AsyncSchedule(callback TimeoutCallback, t time.Time) *Timer
 }
 
 func (el *Eventloop) ScheduleDelay(callback TimeoutCallback, d time.Duration) *TimerTask {
-	return el.tq.addTask(callback, time.Now().Add(d), 0)
+	return el.tq.addTask(callback, el.tq.elapsed()+d, 0)
 }
 
 func (el *Eventloop) AsyncScheduleDelay(callback TimeoutCallback, d time.Duration) *TimerTask {
-	tt := newTimerTask(el.tq, callback, time.Now().Add(d), 0)
+	tt := newTimerTask(el.tq, callback, el.tq.elapsed()+d, 0)
 	el.AsyncExecute(func() {
 		el.tq.addTask0(tt)
 	})
 	return tt
 }
 
-func (el *Eventloop) ScheduleAtFixRate(callback TimeoutCallback, interval time.Duration) *TimerTask {
-	t := time.Now()
-	return el.tq.addTask(callback, t.Add(interval), interval)
+func (el *Eventloop) ScheduleAtFixRate(callback TimeoutCallback, interval time.Duration, opts ...ScheduleOption) *TimerTask {
+	tt := newTimerTask(el.tq, callback, el.tq.elapsed()+interval, interval).apply(opts...)
+	el.tq.addTask0(tt)
+	return tt
 }
 
-func (el *Eventloop) AsyncScheduleAtFixRate(callback TimeoutCallback, interval time.Duration) *TimerTask {
-	t := time.Now()
-	tt := newTimerTask(el.tq, callback, t.Add(interval), interval)
+func (el *Eventloop) AsyncScheduleAtFixRate(callback TimeoutCallback, interval time.Duration, opts ...ScheduleOption) *TimerTask {
+	tt := newTimerTask(el.tq, callback, el.tq.elapsed()+interval, interval).apply(opts...)
 	el.AsyncExecute(func() {
 		el.tq.addTask0(tt)
 	})
 	return tt
 }
 
+// ScheduleAtFixedDelay runs callback every delay, measured from the end of the
+// previous run rather than from its start.
+func (el *Eventloop) ScheduleAtFixedDelay(callback TimeoutCallback, delay time.Duration, opts ...ScheduleOption) *TimerTask {
+	tt := newFixedDelayTask(el.tq, callback, delay).apply(opts...)
+	el.tq.addTask0(tt)
+	return tt
+}
+
+func (el *Eventloop) AsyncScheduleAtFixedDelay(callback TimeoutCallback, delay time.Duration, opts ...ScheduleOption) *TimerTask {
+	tt := newFixedDelayTask(el.tq, callback, delay).apply(opts...)
+	el.AsyncExecute(func() {
+		el.tq.addTask0(tt)
+	})
+	return tt
+}
+
+// ScheduleCron runs callback at every activation of the cron expression expr,
+// evaluated in tz (time.Local when nil). See CronSchedule for the syntax.
+func (el *Eventloop) ScheduleCron(expr string, tz *time.Location, callback TimeoutCallback, opts ...ScheduleOption) (*TimerTask, error) {
+	tt, err := newCronTask(el.tq, expr, tz, callback)
+	if err != nil {
+		return nil, err
+	}
+	el.tq.addTask0(tt.apply(opts...))
+	return tt, nil
+}
+
+func (el *Eventloop) AsyncScheduleCron(expr string, tz *time.Location, callback TimeoutCallback, opts ...ScheduleOption) (*TimerTask, error) {
+	tt, err := newCronTask(el.tq, expr, tz, callback)
+	if err != nil {
+		return nil, err
+	}
+	tt.apply(opts...)
+	el.AsyncExecute(func() {
+		el.tq.addTask0(tt)
+	})
+	return tt, nil
+}
+
 func (el *Eventloop) Loop() {
 	atomic.StoreInt32(&el.looping, 1)
 	atomic.StoreInt32(&el.quit, 0)
@@ -142,24 +251,60 @@ func (el *Eventloop) Loop() {
 			break
 		}
 		el.activeChannels.Init()
-		retTs := el.poller.poll(pollTimeoutMills)
+		retTs := el.poller.poll(el.pollTimeout())
 		for e := el.activeChannels.Front(); e != nil; e = e.Next() {
 			channel := e.Value.(*Channel)
 			logging.Debugf("Eventloop[%s] handle event", el.id)
 			channel.handleEvent(retTs)
 		}
+		if el.tq.timerFd < 0 {
+			el.tq.runExpired()
+		}
 		el.runPendingTasks()
 	}
 
+	// tasks queued before the stop, e.g. connectDestroyed, still release their resources
+	el.runPendingTasks()
 	logging.Infof("Eventloop Stop looping")
 
 	atomic.StoreInt32(&el.looping, 0)
 	el.destroy()
 }
 
+// pollTimeout returns how long the next poll may block: not at all when tasks
+// are pending, and no longer than the earliest timer when there is no timerfd.
+func (el *Eventloop) pollTimeout() time.Duration {
+	el.taskMutex.Lock()
+	pending := el.pendingTasks.Len()
+	el.taskMutex.Unlock()
+	if pending > 0 {
+		return 0
+	}
+	timeout := pollTimeout
+	if el.tq.timerFd < 0 {
+		if d, ok := el.tq.nextTimeout(); ok {
+			if d < 0 {
+				d = 0
+			}
+			if _, fake := el.clock.(*FakeClock); fake && d > 0 {
+				// fake time only moves in FakeClock.Advance, which runs the timers
+				return timeout
+			}
+			if d < timeout {
+				timeout = d
+			}
+		}
+	}
+	return timeout
+}
+
 func (el *Eventloop) destroy() {
+	if el.signals != nil {
+		el.signals.close()
+	}
 	_ = unix.Close(el.evtFd)
 	el.tq.shutdown()
+	_ = el.poller.close()
 }
 
 func (el *Eventloop) Stop() {
@@ -178,3 +323,7 @@ func (el *Eventloop) updateChannel(channel *Channel) {
 func (el *Eventloop) removeChannel(channel *Channel) {
 	el.poller.removeChannel(channel)
 }
+
+func (el *Eventloop) hasChannel(fd int) bool {
+	return el.poller.hasChannel(fd)
+}
@@ -6,15 +6,17 @@ type Functor func()
 
 type EventloopEngine struct {
 	id   string
+	opts []EventloopOption
 	el   *Eventloop
 	f    Functor
 	mu   sync.Mutex
 	cond *sync.Cond
 }
 
-func NewEventloopEngine(id string) *EventloopEngine {
+func NewEventloopEngine(id string, opts ...EventloopOption) *EventloopEngine {
 	eb := &EventloopEngine{
-		id: id,
+		id:   id,
+		opts: opts,
 	}
 	eb.cond = sync.NewCond(&eb.mu)
 	return eb
@@ -32,7 +34,7 @@ func (eng *EventloopEngine) StartLoop() *Eventloop {
 }
 
 func (eng *EventloopEngine) run() {
-	el := NewEventloop(eng.id)
+	el := NewEventloop(eng.id, eng.opts...)
 
 	eng.mu.Lock()
 	eng.el = el
@@ -23,12 +23,17 @@ func NewEventloopEngineGroup(engineCnt int, boss *Eventloop) *EventloopEngineGro
 	return group
 }
 
+// Start starts the worker loops, which are configured like the boss loop.
 func (group *EventloopEngineGroup) Start() {
 	if !group.started {
 		group.started = true
 	}
+	var opts []EventloopOption
+	if group.boss != nil {
+		opts = group.boss.opts
+	}
 	for i := 0; i < group.engineCnt; i++ {
-		engine := NewEventloopEngine("worker-engine-" + strconv.Itoa(i))
+		engine := NewEventloopEngine("worker-engine-"+strconv.Itoa(i), opts...)
 		group.engines = append(group.engines, engine)
 		group.works = append(group.works, engine.StartLoop())
 	}
@@ -45,3 +50,13 @@ func (group *EventloopEngineGroup) GetNextLoop() *Eventloop {
 	group.next++
 	return next
 }
+
+// Stop asks every worker loop to quit.
+func (group *EventloopEngineGroup) Stop() {
+	for _, el := range group.works {
+		el.AsyncStop()
+	}
+	group.works = group.works[:0]
+	group.engines = group.engines[:0]
+	group.started = false
+}
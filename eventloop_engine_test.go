@@ -9,16 +9,21 @@ import (
 func TestNewEventloopEngine(t *testing.T) {
 	eb := NewEventloopEngine("worker")
 	el := eb.StartLoop()
+	executed := make(chan struct{})
 	el.AsyncExecute(func() {
 		logging.Infof(" ^_^ ^_^ ^_^ ^_^ ^_^ ^_^ hello world ^_^ ^_^ ^_^ ^_^ ^_^ ^_^ ")
+		close(executed)
 	})
-	time.Sleep(time.Second * 1)
-	el.AsyncScheduleDelay(func() {
-		logging.Infof(" ^_^ ^_^ ^_^ ^_^ ^_^ ^_^ hello world after 2 second ^_^ ^_^ ^_^ ^_^ ^_^ ^_^ ")
-	}, time.Second*2)
-	time.Sleep(time.Second * 3)
+	<-executed
+	fired := el.AsyncScheduleDelay(func() {
+		logging.Infof(" ^_^ ^_^ ^_^ ^_^ ^_^ ^_^ hello world after 20 milliseconds ^_^ ^_^ ^_^ ^_^ ^_^ ^_^ ")
+	}, time.Millisecond*20)
+	select {
+	case <-fired.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timer of the engine loop did not fire")
+	}
 	el.AsyncStop()
-	time.Sleep(time.Second * 1)
 
 	logging.Infof(" ^_^ ^_^ ^_^ ^_^ ^_^ ^_^ eventloop stopped ^_^ ^_^ ^_^ ^_^ ^_^ ^_^ ")
 }
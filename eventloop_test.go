@@ -4,13 +4,16 @@ import (
 	"golang.org/x/sys/unix"
 	"muduo/pkg/logging"
 	"muduo/pkg/util"
+	"sort"
 	"testing"
 	"time"
 	"unsafe"
 )
 
 func TestEventloop_Loop(t *testing.T) {
-	el := &Eventloop{}
+	el := NewEventloop("")
+	// a stop queued before Loop makes it run one iteration
+	el.AsyncExecute(el.Stop)
 	el.Loop()
 }
 
@@ -20,6 +23,7 @@ func TestEventloop_Timefd(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	fired := false
 	ch := NewChannel(el, timerFd)
 	ch.readCallback = func(ts time.Time) {
 		t.Log("timerfd readCallback")
@@ -29,41 +33,66 @@ func TestEventloop_Timefd(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		fired = true
+		ch.disableAll()
+		el.removeChannel(ch)
+		el.Stop()
 	}
 	ch.enableReading()
 	howlong := unix.ItimerSpec{}
-	howlong.Value.Sec = 5
+	howlong.Value.Nsec = int64(10 * time.Millisecond)
 	unix.TimerfdSettime(timerFd, 0, &howlong, nil)
+	el.ScheduleDelay(el.Stop, 5*time.Second)
 	el.Loop()
 	unix.Close(timerFd)
+	if !fired {
+		t.Fatal("timerfd did not fire")
+	}
 }
 
 func TestEventloop_Schedule(t *testing.T) {
-	el := NewEventloop("")
-	when := time.Now().Add(time.Second * 2)
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("", WithClock(clock))
+	fired := false
 	el.Schedule(func() {
 		logging.Infof("hello world")
-		el.Stop()
-	}, when)
-	el.Loop()
-
-	logging.Infof("eventloop stopped")
+		fired = true
+	}, clock.Now().Add(time.Second*2))
+	clock.Advance(time.Second)
+	if fired {
+		t.Fatal("task fired a second early")
+	}
+	clock.Advance(time.Second)
+	if !fired {
+		t.Fatal("task did not fire at its deadline")
+	}
 }
 
 func TestEventloop_ScheduleDelay(t *testing.T) {
-	el := NewEventloop("")
-	el.ScheduleDelay(func() {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("", WithClock(clock))
+	fired := false
+	tt := el.ScheduleDelay(func() {
 		logging.Infof("hello world")
-		el.Stop()
+		fired = true
 	}, time.Second*2)
-	el.Loop()
-
-	logging.Infof("eventloop stopped")
+	if r := tt.Remaining(); r != 2*time.Second {
+		t.Fatalf("remaining = %v, want 2s", r)
+	}
+	clock.Advance(1999 * time.Millisecond)
+	if fired {
+		t.Fatal("task fired early")
+	}
+	clock.Advance(time.Millisecond)
+	if !fired || tt.State() != TimerFired {
+		t.Fatalf("task did not fire, state %v", tt.State())
+	}
 }
 
 func TestEventloop_ScheduleAtFixRate(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
 	var count int
-	el := NewEventloop("")
+	el := NewEventloop("", WithClock(clock))
 	var tt *TimerTask
 	tt = el.ScheduleAtFixRate(func() {
 		count++
@@ -75,30 +104,38 @@ func TestEventloop_ScheduleAtFixRate(t *testing.T) {
 		}
 	}, time.Second*1)
 
-	el.ScheduleDelay(func() {
-		logging.Infof("stop eventloop")
-		el.Stop()
-	}, time.Second*8)
-
-	el.Loop()
-
-	logging.Infof("eventloop stopped")
+	for i := 0; i < 8; i++ {
+		clock.Advance(time.Second)
+	}
+	if count != 2 {
+		t.Fatalf("task ran %d times, want 2", count)
+	}
 }
 
 func TestEventloop_Execute(t *testing.T) {
-	el := NewEventloop("")
-	el.Schedule(func() {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("", WithClock(clock))
+	stop := startLoop(el)
+	defer stop()
+	done := make(chan struct{})
+	el.AsyncSchedule(func() {
 		el.AsyncExecute(func() {
 			logging.Infof("hello world")
+			close(done)
 		})
-	}, time.Now().Add(time.Second*2))
-	el.Loop()
-
-	logging.Infof("eventloop stopped")
+	}, clock.Now().Add(time.Second*2))
+	clock.Advance(2 * time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task queued by a timer did not run")
+	}
 }
 
 func TestEventloop_AsyncExecute(t *testing.T) {
-	el := NewEventloop("")
+	clock := NewFakeClock(time.Unix(1000, 0))
+	el := NewEventloop("", WithClock(clock))
+	stopped := make(chan struct{})
 	el.Schedule(func() {
 		el.AsyncExecute(func() {
 			logging.Infof("^_^ ^_^ ^_^ ^_^ ^_^ ^_^ async hello world ^_^ ^_^ ^_^ ^_^ ^_^ ^_^")
@@ -107,8 +144,161 @@ func TestEventloop_AsyncExecute(t *testing.T) {
 				el.AsyncStop()
 			}, time.Second*2)
 		})
-	}, time.Now().Add(time.Second*2))
-	el.Loop()
+	}, clock.Now().Add(time.Second*2))
+	looping := make(chan struct{})
+	el.AsyncExecute(func() { close(looping) })
+	go func() {
+		el.Loop()
+		close(stopped)
+	}()
+	<-looping
+	clock.Advance(2 * time.Second)
+	// the loop runs the queued task, which schedules the stop
+	synced := make(chan struct{})
+	el.AsyncExecute(func() { close(synced) })
+	<-synced
+	clock.Advance(2 * time.Second)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("eventloop did not stop")
+	}
 
 	logging.Infof("eventloop stopped")
 }
+
+// measureTimerJitter returns the 90th percentile of how late timers fire, the
+// worst case mostly measures scheduling noise of the test machine.
+func measureTimerJitter(t *testing.T, el *Eventloop, delay time.Duration, rounds int) time.Duration {
+	var jitters []time.Duration
+	var fire func(int)
+	fire = func(n int) {
+		start := time.Now()
+		el.ScheduleDelay(func() {
+			jitter := time.Since(start) - delay
+			if jitter < 0 {
+				t.Errorf("timer fired %v early", -jitter)
+			}
+			jitters = append(jitters, jitter)
+			if n+1 < rounds {
+				fire(n + 1)
+			} else {
+				el.Stop()
+			}
+		}, delay)
+	}
+	fire(0)
+	el.Loop()
+	sort.Slice(jitters, func(i, j int) bool { return jitters[i] < jitters[j] })
+	return jitters[len(jitters)*9/10]
+}
+
+func TestEventloop_PollTimers(t *testing.T) {
+	el := NewEventloop("", WithPollTimers())
+	if el.tq.timerFd >= 0 {
+		t.Fatal("poll driven loop should not create a timerfd")
+	}
+	p90 := measureTimerJitter(t, el, 5*time.Millisecond, 50)
+	t.Logf("epoll_wait p90 jitter: %v", p90)
+	if p90 > 20*time.Millisecond {
+		t.Errorf("p90 jitter %v is too large", p90)
+	}
+}
+
+func TestEventloop_PreciseTimeout(t *testing.T) {
+	if !epollPwait2Supported() {
+		t.Skip("epoll_pwait2 is not supported by this kernel")
+	}
+	el := NewEventloop("", WithPollTimers(), WithPreciseTimeout())
+	if !el.poller.(*epollPoller).precise {
+		t.Fatal("poller should use epoll_pwait2")
+	}
+	p90 := measureTimerJitter(t, el, 500*time.Microsecond, 200)
+	t.Logf("epoll_pwait2 p90 jitter: %v", p90)
+	if p90 > 10*time.Millisecond {
+		t.Errorf("p90 jitter %v is too large", p90)
+	}
+}
+
+func TestEventloop_PollTimeout(t *testing.T) {
+	el := NewEventloop("", WithPollTimers())
+	if d := el.pollTimeout(); d != pollTimeout {
+		t.Errorf("idle loop should wait %v, got %v", pollTimeout, d)
+	}
+	el.ScheduleDelay(func() {}, time.Second)
+	if d := el.pollTimeout(); d > time.Second || d < 900*time.Millisecond {
+		t.Errorf("timeout should follow the next timer, got %v", d)
+	}
+	el.AsyncExecute(func() {})
+	if d := el.pollTimeout(); d != 0 {
+		t.Errorf("pending tasks should not block, got %v", d)
+	}
+}
+
+func TestEventloop_ScheduleAtFixedDelay(t *testing.T) {
+	el := NewEventloop("")
+	var starts []time.Time
+	el.ScheduleAtFixedDelay(func() {
+		starts = append(starts, time.Now())
+		time.Sleep(20 * time.Millisecond)
+	}, 10*time.Millisecond, WithMaxRuns(3))
+	el.ScheduleDelay(el.Stop, 300*time.Millisecond)
+	el.Loop()
+	if len(starts) != 3 {
+		t.Fatalf("should run 3 times, ran %d", len(starts))
+	}
+	for i := 1; i < len(starts); i++ {
+		if d := starts[i].Sub(starts[i-1]); d < 30*time.Millisecond {
+			t.Errorf("run %d started %v after the previous one, want >= 30ms", i, d)
+		}
+	}
+}
+
+func TestEventloop_ScheduleAtFixRateJitter(t *testing.T) {
+	el := NewEventloop("")
+	count := 0
+	el.ScheduleAtFixRate(func() {
+		count++
+	}, 10*time.Millisecond, WithMaxRuns(5), WithJitter(5*time.Millisecond), WithSplay(10*time.Millisecond))
+	el.ScheduleDelay(el.Stop, 200*time.Millisecond)
+	el.Loop()
+	if count != 5 {
+		t.Errorf("should run 5 times, ran %d", count)
+	}
+}
+
+func TestEventloop_ScheduleCron(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 500*int(time.Millisecond), time.UTC))
+	el := NewEventloop("", WithClock(clock))
+	if _, err := el.ScheduleCron("bad", nil, func() {}); err == nil {
+		t.Error("invalid expression should be rejected")
+	}
+	var fired []time.Time
+	tt, err := el.ScheduleCron("*/10 * * * * *", time.UTC, func() {
+		fired = append(fired, clock.Now())
+	}, WithMaxRuns(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := tt.Remaining(); r != 9500*time.Millisecond {
+		t.Fatalf("remaining = %v, want 9.5s", r)
+	}
+	for i := 0; i < 60; i++ {
+		clock.Advance(500 * time.Millisecond)
+	}
+	want := []time.Time{
+		time.Date(2024, 3, 1, 12, 0, 10, 0, time.UTC),
+		time.Date(2024, 3, 1, 12, 0, 20, 0, time.UTC),
+	}
+	if len(fired) != len(want) {
+		t.Fatalf("fired at %v, want %v", fired, want)
+	}
+	for i := range want {
+		if !fired[i].Equal(want[i]) {
+			t.Errorf("run %d at %v, want %v", i, fired[i], want[i])
+		}
+	}
+	if tt.State() != TimerFired {
+		t.Errorf("state = %v, want fired", tt.State())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"muduo"
+	memcached_client "muduo/examples/memcached/client"
+	"muduo/pkg/logging"
+	"strings"
+	"time"
+)
+
+func main() {
+	listen := flag.String("l", "tcp4://:11211", "address to listen on")
+	backends := flag.String("backends", "127.0.0.1:11212", "comma separated memcached servers, host:port each")
+	threads := flag.Int("t", 4, "number of worker loops")
+	conns := flag.Int("conns", 2, "connections to each backend")
+	timeout := flag.Duration("timeout", 5*time.Second, "how long a request waits for the backends")
+	flag.Parse()
+
+	el := muduo.NewEventloop("memcached-proxy")
+	client, err := memcached_client.NewClient(el, strings.Split(*backends, ","),
+		memcached_client.WithConnsPerServer(*conns))
+	if err != nil {
+		logging.Fatalf("memcached proxy: %v", err)
+	}
+	// backends that are down are dialed in the background, the proxy serves
+	// with those that are up
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		if err := client.Connect(ctx); err != nil {
+			logging.Warnf("memcached proxy: some backends are down: %v", err)
+		}
+	}()
+	p := memcached_client.NewProxy(el, *listen, client,
+		memcached_client.WithProxyEngineCnt(*threads),
+		memcached_client.WithRequestTimeout(*timeout))
+	p.Start()
+	el.AsyncExecute(func() {
+		logging.Infof("memcached proxy listening on %s", p.Addr())
+	})
+	p.ShutdownOnSignal(5 * time.Second)
+	el.Loop()
+}
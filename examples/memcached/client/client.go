@@ -0,0 +1,580 @@
+package memcached_client
+
+import (
+	"bytes"
+	"context"
+	"muduo"
+	"muduo/pkg/errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Item is a value stored under a key.
+type Item struct {
+	Key   string
+	Value []byte
+	Flags uint32
+	// Expiration is the exptime of the protocol: 0 for never, seconds from now
+	// up to 30 days, a unix time beyond.
+	Expiration int32
+	// CAS is filled in by Get and GetMulti, CompareAndSwap requires it.
+	CAS uint64
+}
+
+// ServerError is the ERROR, CLIENT_ERROR or SERVER_ERROR response of a server.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "memcached: " + e.Message
+}
+
+type options struct {
+	conns   int
+	timeout time.Duration
+	retry   muduo.RetryPolicy
+}
+
+// Option configures a Client.
+type Option func(o *options)
+
+// WithConnsPerServer sets how many connections each server gets, calls are
+// spread over them. The default is 1.
+func WithConnsPerServer(n int) Option {
+	return func(o *options) {
+		o.conns = n
+	}
+}
+
+// WithTimeout bounds the calls whose context has no deadline, 0 (the default)
+// means no limit.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithRetry paces connecting and reconnecting to the servers,
+// muduo.DefaultRetryPolicy by default.
+func WithRetry(policy muduo.RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = policy
+	}
+}
+
+// Client speaks the text protocol to a set of servers and shards keys over them
+// with a ketama Ring. Calls to a server are pipelined on its connections, which
+// live on the Eventloop passed to NewClient, the caller runs that loop. A call
+// that finds its server down, or loses the connection, moves on to the next
+// server of the ring; servers are reconnected in the background.
+type Client struct {
+	el      *muduo.Eventloop
+	ring    *Ring
+	servers map[string]*server
+	addrs   []string
+
+	mu     sync.Mutex
+	dialed bool
+	closed bool
+}
+
+// server is a backend and its connections.
+type server struct {
+	addr  string
+	conns []*serverConn
+	next  uint32 // round robin, atomic
+}
+
+type serverConn struct {
+	tcp       *muduo.TcpClient
+	mu        sync.Mutex
+	mux       *muduo.Mux
+	connected chan struct{} // closed on the first connection
+	once      sync.Once
+}
+
+// NewClient creates a client of the servers at addrs, host:port each.
+func NewClient(el *muduo.Eventloop, addrs []string, opts ...Option) (*Client, error) {
+	o := options{conns: 1, retry: muduo.DefaultRetryPolicy()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	c := &Client{
+		el:      el,
+		ring:    NewRing(addrs...),
+		servers: make(map[string]*server, len(addrs)),
+		addrs:   addrs,
+	}
+	for _, addr := range addrs {
+		s := &server{addr: addr}
+		for i := 0; i < o.conns; i++ {
+			tcp, err := muduo.NewTcpClient(el, addr)
+			if err != nil {
+				return nil, err
+			}
+			sc := &serverConn{tcp: tcp, connected: make(chan struct{})}
+			tcp.SetRetry(o.retry)
+			timeout := o.timeout
+			tcp.SetOnConn(func(conn *muduo.TcpConn) {
+				sc.onConn(conn, timeout)
+			})
+			s.conns = append(s.conns, sc)
+		}
+		c.servers[addr] = s
+	}
+	return c, nil
+}
+
+func (sc *serverConn) onConn(conn *muduo.TcpConn, timeout time.Duration) {
+	if !conn.IsConnected() {
+		sc.mu.Lock()
+		sc.mux = nil
+		sc.mu.Unlock()
+		return
+	}
+	mux := muduo.NewMux(conn, muduo.FIFO(responseCodec{}))
+	mux.SetTimeout(timeout)
+	sc.mu.Lock()
+	sc.mux = mux
+	sc.mu.Unlock()
+	sc.once.Do(func() { close(sc.connected) })
+}
+
+func (sc *serverConn) getMux() *muduo.Mux {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.mux
+}
+
+func (s *server) alive() bool {
+	for _, sc := range s.conns {
+		if sc.getMux() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// call sends req on the next connected connection.
+func (s *server) call(ctx context.Context, req []byte) ([]byte, error) {
+	start := int(atomic.AddUint32(&s.next, 1))
+	for i := range s.conns {
+		if mux := s.conns[(start+i)%len(s.conns)].getMux(); mux != nil {
+			return mux.Call(ctx, req)
+		}
+	}
+	return nil, errors.ErrConnNotOpened
+}
+
+// Connect dials every server and waits until all of them are connected. When
+// ctx is done first it returns ctx.Err(), the servers left keep being dialed in
+// the background and calls go to those that are up.
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errors.ErrClientClosed
+	}
+	if !c.dialed {
+		c.dialed = true
+		for _, s := range c.servers {
+			for _, sc := range s.conns {
+				sc.tcp.Connect()
+			}
+		}
+	}
+	c.mu.Unlock()
+	for _, s := range c.servers {
+		for _, sc := range s.conns {
+			select {
+			case <-sc.connected:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes every connection, calls in flight fail with ErrConnDropped.
+func (c *Client) Close() {
+	c.mu.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	c.el.AsyncExecute(func() {
+		for _, s := range c.servers {
+			for _, sc := range s.conns {
+				sc.tcp.Stop()
+				if conn := sc.tcp.GetConn(); conn != nil {
+					conn.ForceClose()
+				}
+			}
+		}
+	})
+}
+
+// isDown tells the errors of a server that is not there, the call is tried on
+// the next one.
+func isDown(err error) bool {
+	return err == errors.ErrConnNotOpened || err == errors.ErrConnDropped
+}
+
+// pick returns the server of key, skipping those that are down or in tried.
+func (c *Client) pick(key string, tried map[string]bool) (*server, error) {
+	addr, ok := c.ring.Next(key, func(addr string) bool {
+		return tried[addr] || !c.servers[addr].alive()
+	})
+	if !ok {
+		return nil, errors.ErrNoEndpoints
+	}
+	return c.servers[addr], nil
+}
+
+// call sends req to the server of key and returns the response. When the
+// server is down, or the connection drops before the response, the next
+// server of the ring gets it; a request that was lost in a dropped connection
+// may have been applied.
+func (c *Client) call(ctx context.Context, key string, req []byte) ([]byte, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, errors.ErrClientClosed
+	}
+	tried := make(map[string]bool)
+	for {
+		s, err := c.pick(key, tried)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.call(ctx, req)
+		if !isDown(err) {
+			return resp, err
+		}
+		tried[s.addr] = true
+	}
+}
+
+// broadcast sends req to every server that is up, and returns their responses
+// by address.
+func (c *Client) broadcast(ctx context.Context, req []byte) (map[string][]byte, error) {
+	type result struct {
+		addr string
+		resp []byte
+		err  error
+	}
+	results := make(chan result, len(c.servers))
+	n := 0
+	for addr, s := range c.servers {
+		if !s.alive() {
+			continue
+		}
+		n++
+		go func(addr string, s *server) {
+			resp, err := s.call(ctx, req)
+			results <- result{addr, resp, err}
+		}(addr, s)
+	}
+	if n == 0 {
+		return nil, errors.ErrNoEndpoints
+	}
+	resps := make(map[string][]byte, n)
+	var firstErr error
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil && !isDown(r.err) {
+				firstErr = r.err
+			}
+			continue
+		}
+		resps[r.addr] = r.resp
+	}
+	return resps, firstErr
+}
+
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > 250 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// status turns a single line response into an error.
+func status(resp []byte) error {
+	line := string(bytes.TrimSuffix(resp, crlf))
+	switch line {
+	case "STORED", "DELETED", "TOUCHED", "OK":
+		return nil
+	case "NOT_STORED":
+		return errors.ErrNotStored
+	case "EXISTS":
+		return errors.ErrCasConflict
+	case "NOT_FOUND":
+		return errors.ErrKeyNotFound
+	}
+	return &ServerError{Message: line}
+}
+
+// Get returns the item of key, with its CAS.
+func (c *Client) Get(ctx context.Context, key string) (*Item, error) {
+	items, err := c.GetMulti(ctx, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	it, ok := items[key]
+	if !ok {
+		return nil, errors.ErrKeyNotFound
+	}
+	return it, nil
+}
+
+// GetMulti returns the items of keys that exist, with their CAS. Keys are
+// grouped by server and every server gets a single request, all of them in
+// flight at once.
+func (c *Client) GetMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	return c.fetch(ctx, "gets", keys)
+}
+
+// GetAndTouchMulti is GetMulti also setting the expiration of the items found.
+func (c *Client) GetAndTouchMulti(ctx context.Context, keys []string, expiration int32) (map[string]*Item, error) {
+	return c.fetch(ctx, "gats "+strconv.Itoa(int(expiration)), keys)
+}
+
+// fetch sends cmd, a retrieval command with its arguments before the keys, to
+// the servers of keys. Keys of a server that turns out to be down are asked
+// again from the next ones.
+func (c *Client) fetch(ctx context.Context, cmd string, keys []string) (map[string]*Item, error) {
+	for _, key := range keys {
+		if !validKey(key) {
+			return nil, errors.ErrMalformedKey
+		}
+	}
+	type result struct {
+		s     *server
+		keys  []string
+		items []*Item
+		err   error
+	}
+	items := make(map[string]*Item, len(keys))
+	tried := make(map[string]bool)
+	for len(keys) > 0 {
+		groups := make(map[*server][]string)
+		for _, key := range keys {
+			s, err := c.pick(key, tried)
+			if err != nil {
+				return items, err
+			}
+			groups[s] = append(groups[s], key)
+		}
+		results := make(chan result, len(groups))
+		for s, keys := range groups {
+			go func(s *server, keys []string) {
+				req := []byte(cmd)
+				for _, key := range keys {
+					req = append(append(req, ' '), key...)
+				}
+				resp, err := s.call(ctx, append(req, crlf...))
+				r := result{s: s, keys: keys, err: err}
+				if err == nil {
+					r.items, r.err = parseValues(resp)
+				}
+				results <- r
+			}(s, keys)
+		}
+		keys = nil
+		var firstErr error
+		for range groups {
+			r := <-results
+			if isDown(r.err) {
+				tried[r.s.addr] = true
+				keys = append(keys, r.keys...)
+				continue
+			}
+			if r.err != nil && firstErr == nil {
+				firstErr = r.err
+			}
+			for _, it := range r.items {
+				items[it.Key] = it
+			}
+		}
+		if firstErr != nil {
+			return items, firstErr
+		}
+	}
+	return items, nil
+}
+
+// parseValues parses the VALUE blocks of a retrieval response.
+func parseValues(resp []byte) ([]*Item, error) {
+	var items []*Item
+	for {
+		eol := bytes.Index(resp, crlf)
+		if eol < 0 {
+			return nil, errors.ErrBadFrame
+		}
+		line := resp[:eol]
+		resp = resp[eol+len(crlf):]
+		if bytes.Equal(line, []byte("END")) {
+			return items, nil
+		}
+		fields := bytes.Fields(line)
+		if len(fields) < 4 || string(fields[0]) != "VALUE" {
+			if len(items) == 0 {
+				return nil, status(line)
+			}
+			return nil, errors.ErrBadFrame
+		}
+		flags, err1 := strconv.ParseUint(string(fields[2]), 10, 32)
+		n, err2 := strconv.Atoi(string(fields[3]))
+		if err1 != nil || err2 != nil || len(resp) < n+len(crlf) {
+			return nil, errors.ErrBadFrame
+		}
+		it := &Item{
+			Key:   string(fields[1]),
+			Value: append([]byte(nil), resp[:n]...),
+			Flags: uint32(flags),
+		}
+		if len(fields) > 4 {
+			if it.CAS, err1 = strconv.ParseUint(string(fields[4]), 10, 64); err1 != nil {
+				return nil, errors.ErrBadFrame
+			}
+		}
+		resp = resp[n+len(crlf):]
+		items = append(items, it)
+	}
+}
+
+// store sends a storage command for it.
+func (c *Client) store(ctx context.Context, cmd string, it *Item) error {
+	if !validKey(it.Key) {
+		return errors.ErrMalformedKey
+	}
+	req := make([]byte, 0, len(cmd)+len(it.Key)+len(it.Value)+64)
+	req = append(req, cmd...)
+	req = append(append(req, ' '), it.Key...)
+	req = append(append(req, ' '), strconv.FormatUint(uint64(it.Flags), 10)...)
+	req = append(append(req, ' '), strconv.Itoa(int(it.Expiration))...)
+	req = append(append(req, ' '), strconv.Itoa(len(it.Value))...)
+	if cmd == "cas" {
+		req = append(append(req, ' '), strconv.FormatUint(it.CAS, 10)...)
+	}
+	req = append(req, crlf...)
+	req = append(append(req, it.Value...), crlf...)
+	resp, err := c.call(ctx, it.Key, req)
+	if err != nil {
+		return err
+	}
+	return status(resp)
+}
+
+// Set stores it.
+func (c *Client) Set(ctx context.Context, it *Item) error {
+	return c.store(ctx, "set", it)
+}
+
+// Add stores it unless its key exists, ErrNotStored tells it does.
+func (c *Client) Add(ctx context.Context, it *Item) error {
+	return c.store(ctx, "add", it)
+}
+
+// Replace stores it only if its key exists, ErrNotStored tells it does not.
+func (c *Client) Replace(ctx context.Context, it *Item) error {
+	return c.store(ctx, "replace", it)
+}
+
+// Append adds the value of it after the stored one.
+func (c *Client) Append(ctx context.Context, it *Item) error {
+	return c.store(ctx, "append", it)
+}
+
+// Prepend adds the value of it before the stored one.
+func (c *Client) Prepend(ctx context.Context, it *Item) error {
+	return c.store(ctx, "prepend", it)
+}
+
+// CompareAndSwap stores it if the item was not stored again since it.CAS was
+// read, ErrCasConflict tells it was and ErrKeyNotFound that it is gone.
+func (c *Client) CompareAndSwap(ctx context.Context, it *Item) error {
+	return c.store(ctx, "cas", it)
+}
+
+// simple sends a command on key that answers with a single line.
+func (c *Client) simple(ctx context.Context, key string, args ...string) ([]byte, error) {
+	if !validKey(key) {
+		return nil, errors.ErrMalformedKey
+	}
+	req := []byte(args[0])
+	req = append(append(req, ' '), key...)
+	for _, arg := range args[1:] {
+		req = append(append(req, ' '), arg...)
+	}
+	return c.call(ctx, key, append(req, crlf...))
+}
+
+// Delete removes the item of key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.simple(ctx, key, "delete")
+	if err != nil {
+		return err
+	}
+	return status(resp)
+}
+
+// Touch sets a new expiration on the item of key.
+func (c *Client) Touch(ctx context.Context, key string, expiration int32) error {
+	resp, err := c.simple(ctx, key, "touch", strconv.Itoa(int(expiration)))
+	if err != nil {
+		return err
+	}
+	return status(resp)
+}
+
+// Increment adds delta to the number stored under key and returns the result,
+// wrapping at 2^64.
+func (c *Client) Increment(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return c.incr(ctx, "incr", key, delta)
+}
+
+// Decrement subtracts delta from the number stored under key down to 0 and
+// returns the result.
+func (c *Client) Decrement(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return c.incr(ctx, "decr", key, delta)
+}
+
+func (c *Client) incr(ctx context.Context, cmd, key string, delta uint64) (uint64, error) {
+	resp, err := c.simple(ctx, key, cmd, strconv.FormatUint(delta, 10))
+	if err != nil {
+		return 0, err
+	}
+	if n, err := strconv.ParseUint(string(bytes.TrimSuffix(resp, crlf)), 10, 64); err == nil {
+		return n, nil
+	}
+	return 0, status(resp)
+}
+
+// FlushAll removes every item of every server that is up.
+func (c *Client) FlushAll(ctx context.Context) error {
+	resps, err := c.broadcast(ctx, []byte("flush_all\r\n"))
+	if err != nil {
+		return err
+	}
+	for _, resp := range resps {
+		if err := status(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
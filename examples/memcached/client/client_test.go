@@ -0,0 +1,428 @@
+package memcached_client
+
+import (
+	"context"
+	"fmt"
+	"muduo"
+	memcached_server "muduo/examples/memcached/server"
+	"muduo/internal/muduotest"
+	"muduo/pkg/errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHash(t *testing.T) {
+	// the first 4 bytes of md5("") read little endian
+	if got := Hash(""); got != 0xd98c1dd4 {
+		t.Fatalf("Hash(\"\") = %#x", got)
+	}
+}
+
+func TestRing(t *testing.T) {
+	addrs := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}
+	r := NewRing(addrs...)
+	if len(r.points) != 3*pointsPerServer*4 {
+		t.Fatalf("%d points", len(r.points))
+	}
+	owners := make(map[string]string)
+	count := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		addr, ok := r.Get(key)
+		if !ok {
+			t.Fatal("empty ring")
+		}
+		owners[key] = addr
+		count[addr]++
+	}
+	for _, addr := range addrs {
+		if count[addr] < 600 {
+			t.Fatalf("uneven distribution %v", count)
+		}
+	}
+
+	// only the keys of the removed server move
+	smaller := NewRing(addrs[0], addrs[1])
+	for key, addr := range owners {
+		got, _ := smaller.Get(key)
+		if addr != addrs[2] && got != addr {
+			t.Fatalf("%s moved from %s to %s", key, addr, got)
+		}
+	}
+
+	// Next skipping a server picks what the ring without it does
+	for key := range owners {
+		got, _ := r.Next(key, func(addr string) bool { return addr == addrs[2] })
+		want, _ := smaller.Get(key)
+		if got != want {
+			t.Fatalf("%s: Next %s, smaller ring %s", key, got, want)
+		}
+	}
+	if _, ok := r.Next("key", func(string) bool { return true }); ok {
+		t.Fatal("every server skipped")
+	}
+}
+
+func TestWeightedRing(t *testing.T) {
+	r := NewWeightedRing(map[string]int{"a:1": 1, "b:1": 3})
+	count := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		addr, _ := r.Get(fmt.Sprintf("key-%d", i))
+		count[addr]++
+	}
+	if count["b:1"] < 2*count["a:1"] {
+		t.Fatalf("weights ignored %v", count)
+	}
+}
+
+// startBackend runs a memcached on a loopback port until the test ends.
+func startBackend(t *testing.T) (*memcached_server.Memcached, <-chan struct{}) {
+	t.Helper()
+	el := muduo.NewEventloop("memcached-backend")
+	m, err := memcached_server.NewMemcached(el, memcached_server.WithHost("127.0.0.1"), memcached_server.WithPort(0), memcached_server.WithEngineCnt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	done := muduotest.RunLoop(t, el, func() { m.Shutdown(100 * time.Millisecond) })
+	return m, done
+}
+
+func stopBackend(m *memcached_server.Memcached, done <-chan struct{}) {
+	select {
+	case <-done:
+	default:
+		m.Shutdown(100 * time.Millisecond)
+		<-done
+	}
+}
+
+// startClient connects a client to n backends.
+func startClient(t *testing.T, n int) (*Client, []*memcached_server.Memcached, []<-chan struct{}) {
+	t.Helper()
+	var backends []*memcached_server.Memcached
+	var dones []<-chan struct{}
+	var addrs []string
+	for i := 0; i < n; i++ {
+		m, done := startBackend(t)
+		backends = append(backends, m)
+		dones = append(dones, done)
+		addrs = append(addrs, m.Addr())
+	}
+	el := muduo.NewEventloop("memcached-client")
+	c, err := NewClient(el, addrs, WithConnsPerServer(2), WithTimeout(5*time.Second),
+		WithRetry(muduo.RetryPolicy{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	muduotest.RunLoop(t, el, func() {
+		c.Close()
+		el.AsyncStop()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c, backends, dones
+}
+
+// waitDown returns once the client sees the server at addr down.
+func waitDown(t *testing.T, c *Client, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.servers[addr].alive() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still up", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient(t *testing.T) {
+	c, _, _ := startClient(t, 3)
+	ctx := context.Background()
+
+	if err := c.Set(ctx, &Item{Key: "foo", Value: []byte("bar"), Flags: 7}); err != nil {
+		t.Fatal(err)
+	}
+	it, err := c.Get(ctx, "foo")
+	if err != nil || string(it.Value) != "bar" || it.Flags != 7 || it.CAS == 0 {
+		t.Fatalf("Get %+v, %v", it, err)
+	}
+	if err := c.Add(ctx, &Item{Key: "foo", Value: []byte("x")}); err != errors.ErrNotStored {
+		t.Fatalf("Add %v", err)
+	}
+	if err := c.Replace(ctx, &Item{Key: "missing", Value: []byte("x")}); err != errors.ErrNotStored {
+		t.Fatalf("Replace %v", err)
+	}
+	if err := c.Append(ctx, &Item{Key: "foo", Value: []byte("!")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Prepend(ctx, &Item{Key: "foo", Value: []byte("<")}); err != nil {
+		t.Fatal(err)
+	}
+	if it, _ = c.Get(ctx, "foo"); string(it.Value) != "<bar!" {
+		t.Fatalf("value %q", it.Value)
+	}
+
+	// cas
+	stale := *it
+	it.Value = []byte("new")
+	if err := c.CompareAndSwap(ctx, it); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CompareAndSwap(ctx, &stale); err != errors.ErrCasConflict {
+		t.Fatalf("stale cas %v", err)
+	}
+
+	// incr, decr, touch, delete
+	if err := c.Set(ctx, &Item{Key: "n", Value: []byte("10")}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Increment(ctx, "n", 5); err != nil || n != 15 {
+		t.Fatalf("Increment %d, %v", n, err)
+	}
+	if n, err := c.Decrement(ctx, "n", 20); err != nil || n != 0 {
+		t.Fatalf("Decrement %d, %v", n, err)
+	}
+	if _, err := c.Increment(ctx, "missing", 1); err != errors.ErrKeyNotFound {
+		t.Fatalf("Increment missing %v", err)
+	}
+	if err := c.Touch(ctx, "n", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "n"); err != errors.ErrKeyNotFound {
+		t.Fatalf("Delete %v", err)
+	}
+	if _, err := c.Get(ctx, "n"); err != errors.ErrKeyNotFound {
+		t.Fatalf("Get deleted %v", err)
+	}
+
+	// malformed keys never leave the client
+	if err := c.Set(ctx, &Item{Key: "a b", Value: []byte("x")}); err != errors.ErrMalformedKey {
+		t.Fatalf("Set %v", err)
+	}
+	if _, err := c.Get(ctx, strings.Repeat("k", 251)); err != errors.ErrMalformedKey {
+		t.Fatalf("Get %v", err)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	c, backends, _ := startClient(t, 3)
+	ctx := context.Background()
+	keys := testKeys(100)
+	for i, key := range keys {
+		if i%2 == 0 {
+			if err := c.Set(ctx, &Item{Key: key, Value: []byte("v" + key)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	items, err := c.GetMulti(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 50 {
+		t.Fatalf("%d items", len(items))
+	}
+	for key, it := range items {
+		if string(it.Value) != "v"+key {
+			t.Fatalf("%s: %q", key, it.Value)
+		}
+	}
+
+	// the keys are spread over every backend
+	for _, m := range backends {
+		for _, st := range m.Stats() {
+			if st.Name == "curr_items" && st.Value == "0" {
+				t.Fatalf("backend %s holds nothing", m.Addr())
+			}
+		}
+	}
+
+	items, err = c.GetAndTouchMulti(ctx, keys[:10], 100)
+	if err != nil || len(items) != 5 {
+		t.Fatalf("GetAndTouchMulti %d, %v", len(items), err)
+	}
+
+	if err := c.FlushAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if items, err = c.GetMulti(ctx, keys); err != nil || len(items) != 0 {
+		t.Fatalf("after flush %d, %v", len(items), err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	c, backends, dones := startClient(t, 3)
+	ctx := context.Background()
+	down := backends[1].Addr()
+	var moved []string
+	for _, key := range testKeys(100) {
+		if err := c.Set(ctx, &Item{Key: key, Value: []byte(key)}); err != nil {
+			t.Fatal(err)
+		}
+		if addr, _ := c.ring.Get(key); addr == down {
+			moved = append(moved, key)
+		}
+	}
+	if len(moved) == 0 {
+		t.Fatal("no key on the stopped backend")
+	}
+	stopBackend(backends[1], dones[1])
+	waitDown(t, c, down)
+
+	// the keys of the stopped backend are missing, the others still there
+	items, err := c.GetMulti(ctx, testKeys(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 100-len(moved) {
+		t.Fatalf("%d items, %d moved", len(items), len(moved))
+	}
+	// and stored on the next backend of the ring
+	for _, key := range moved {
+		if err := c.Set(ctx, &Item{Key: key, Value: []byte("again")}); err != nil {
+			t.Fatal(err)
+		}
+		if it, err := c.Get(ctx, key); err != nil || string(it.Value) != "again" {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+}
+
+// testKeys returns key-0 to key-(n-1).
+func testKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestAllDown(t *testing.T) {
+	c, backends, dones := startClient(t, 1)
+	stopBackend(backends[0], dones[0])
+	waitDown(t, c, backends[0].Addr())
+	if _, err := c.Get(context.Background(), "foo"); err != errors.ErrNoEndpoints {
+		t.Fatalf("Get %v", err)
+	}
+	c.Close()
+	if err := c.Set(context.Background(), &Item{Key: "foo"}); err != errors.ErrClientClosed {
+		t.Fatalf("Set after Close %v", err)
+	}
+}
+
+// startProxy runs a proxy in front of n backends.
+func startProxy(t *testing.T, n int) (*Proxy, *Client, []*memcached_server.Memcached, []<-chan struct{}) {
+	t.Helper()
+	c, backends, dones := startClient(t, n)
+	el := muduo.NewEventloop("memcached-proxy")
+	p := NewProxy(el, "tcp4://127.0.0.1:0", c, WithProxyEngineCnt(2), WithRequestTimeout(2*time.Second))
+	p.Start()
+	muduotest.RunLoop(t, el, func() { p.Shutdown(100 * time.Millisecond) })
+	return p, c, backends, dones
+}
+
+func dialProxy(t *testing.T, p *Proxy) *muduotest.TextConn {
+	t.Helper()
+	return muduotest.DialText(t, p.Addr())
+}
+
+func TestProxy(t *testing.T) {
+	p, c, backends, _ := startProxy(t, 3)
+	pc := dialProxy(t, p)
+
+	pc.Do("set a 1 0 2\r\naa\r\n", "STORED")
+	pc.Do("set b 2 0 2 noreply\r\nbb\r\n")
+	pc.Do("add a 0 0 1\r\nx\r\n", "NOT_STORED")
+	pc.Do("set c 3 0 2\r\ncc\r\n", "STORED")
+	// merged in the order of the request, across backends
+	pc.Do("get c missing a b\r\n", "VALUE c 3 2", "cc", "VALUE a 1 2", "aa", "VALUE b 2 2", "bb", "END")
+	pc.Do("get missing\r\n", "END")
+
+	it, err := c.Get(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Do("gets a\r\n", fmt.Sprintf("VALUE a 1 2 %d", it.CAS), "aa", "END")
+	pc.Do(fmt.Sprintf("cas a 0 0 1 %d\r\nz\r\n", it.CAS), "STORED")
+	pc.Do(fmt.Sprintf("cas a 0 0 1 %d\r\nz\r\n", it.CAS), "EXISTS")
+	pc.Do("gat 100 a\r\n", "VALUE a 0 1", "z", "END")
+	pc.Do("gat\r\n", "ERROR")
+
+	pc.Do("set n 0 0 1\r\n5\r\n", "STORED")
+	pc.Do("incr n 10\r\n", "15")
+	pc.Do("decr n 100\r\n", "0")
+	pc.Do("incr nope 1\r\n", "NOT_FOUND")
+	pc.Do("incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument")
+	pc.Do("touch n 10\r\n", "TOUCHED")
+	pc.Do("delete n\r\n", "DELETED")
+	pc.Do("delete n noreply\r\n")
+	pc.Do("delete n\r\n", "NOT_FOUND")
+
+	// answered by the proxy
+	pc.Do("version\r\n", "VERSION "+version)
+	pc.Do("bogus\r\n", "ERROR")
+	pc.Do("\r\n", "ERROR")
+	pc.Do("set k 0 0 x\r\n", "CLIENT_ERROR bad command line format")
+	pc.Do("get "+strings.Repeat("k", 251)+"\r\n", "CLIENT_ERROR bad command line format")
+	var lines []string
+	for _, m := range backends {
+		lines = append(lines, "STAT backend:"+m.Addr()+" up")
+	}
+	pc.Do("stats\r\n", append(lines, "END")...)
+
+	// a value over the limit is skipped, the connection stays usable
+	pc.Do(fmt.Sprintf("set big 0 0 %d\r\n%s\r\n", maxValue+1, strings.Repeat("x", maxValue+1)), "SERVER_ERROR object too large for cache")
+	pc.Do("get big a\r\n", "VALUE a 0 1", "z", "END")
+
+	pc.Do("flush_all\r\n", "OK")
+	pc.Do("get a b c\r\n", "END")
+
+	pc.Send("quit\r\n")
+	pc.ExpectEOF()
+}
+
+func TestProxyPipeline(t *testing.T) {
+	p, _, _, _ := startProxy(t, 3)
+	pc := dialProxy(t, p)
+	var req strings.Builder
+	var want []string
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		fmt.Fprintf(&req, "set %s 0 0 %d\r\n%s\r\nget %s\r\n", key, len(key), key, key)
+		want = append(want, "STORED", fmt.Sprintf("VALUE %s 0 %d", key, len(key)), key, "END")
+	}
+	// more requests than maxPendingReplies, read while writing
+	go pc.Send(req.String())
+	pc.Expect(want...)
+}
+
+func TestProxyBackendDown(t *testing.T) {
+	p, c, backends, dones := startProxy(t, 2)
+	pc := dialProxy(t, p)
+	for i := 0; i < 20; i++ {
+		pc.Do(fmt.Sprintf("set key-%d 0 0 1\r\nv\r\n", i), "STORED")
+	}
+	down := backends[0].Addr()
+	stopBackend(backends[0], dones[0])
+	waitDown(t, c, down)
+
+	// keys of the stopped backend go to the other one
+	for i := 0; i < 20; i++ {
+		pc.Do(fmt.Sprintf("set key-%d 0 0 1\r\nw\r\n", i), "STORED")
+		pc.Do(fmt.Sprintf("get key-%d\r\n", i), fmt.Sprintf("VALUE key-%d 0 1", i), "w", "END")
+	}
+	pc.Do("stats\r\n", "STAT backend:"+down+" down", "STAT backend:"+backends[1].Addr()+" up", "END")
+
+	stopBackend(backends[1], dones[1])
+	waitDown(t, c, backends[1].Addr())
+	pc.Do("get key-0\r\n", "SERVER_ERROR "+errors.ErrNoEndpoints.Error())
+	pc.Do("version\r\n", "VERSION "+version)
+}
@@ -0,0 +1,69 @@
+package memcached_client
+
+import (
+	"bytes"
+	"muduo"
+	"muduo/pkg/errors"
+	"strconv"
+)
+
+var crlf = []byte("\r\n")
+
+// maxLine bounds a response line, a longer one is a broken server.
+const maxLine = 2048
+
+// responseCodec frames the responses of the text protocol. A response is a
+// single line, or VALUE and STAT lines up to END. Requests go out as they are.
+type responseCodec struct{}
+
+func (responseCodec) Decode(buf *muduo.Buffer) ([]byte, error) {
+	n, err := responseLen(buf.Peek())
+	if n == 0 || err != nil {
+		return nil, err
+	}
+	return buf.Next(n), nil
+}
+
+func (responseCodec) Encode(req []byte) []byte {
+	return req
+}
+
+// responseLen returns the length of the response data starts with, 0 when it
+// is incomplete.
+func responseLen(data []byte) (int, error) {
+	pos := 0
+	for {
+		eol := bytes.Index(data[pos:], crlf)
+		if eol < 0 {
+			if len(data)-pos > maxLine {
+				return 0, errors.ErrBadFrame
+			}
+			return 0, nil
+		}
+		line := data[pos : pos+eol]
+		next := pos + eol + len(crlf)
+		switch {
+		case bytes.HasPrefix(line, []byte("VALUE ")):
+			fields := bytes.Fields(line)
+			if len(fields) < 4 {
+				return 0, errors.ErrBadFrame
+			}
+			n, err := strconv.Atoi(string(fields[3]))
+			if err != nil || n < 0 {
+				return 0, errors.ErrBadFrame
+			}
+			next += n + len(crlf)
+			if next > len(data) {
+				return 0, nil
+			}
+		case bytes.HasPrefix(line, []byte("STAT ")):
+		case bytes.Equal(line, []byte("END")):
+			return next, nil
+		case pos != 0:
+			return 0, errors.ErrBadFrame
+		default:
+			return next, nil
+		}
+		pos = next
+	}
+}
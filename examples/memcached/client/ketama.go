@@ -0,0 +1,96 @@
+package memcached_client
+
+import (
+	"crypto/md5"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// pointsPerServer is how many points libketama gives a server of average
+// weight, 40 md5 digests of 4 points each.
+const pointsPerServer = 40
+
+// Ring maps keys to servers the way libketama does, so that clients in other
+// languages using ketama pick the same server for a key. A server gets points
+// on the ring in proportion to its weight, and a key belongs to the server of
+// the first point at or after its hash. Adding or removing a server only moves
+// the keys of its points.
+type Ring struct {
+	points []point
+}
+
+type point struct {
+	hash uint32
+	addr string
+}
+
+// NewRing builds a ring of addrs, all weighted the same.
+func NewRing(addrs ...string) *Ring {
+	weights := make(map[string]int, len(addrs))
+	for _, addr := range addrs {
+		weights[addr] = 1
+	}
+	return NewWeightedRing(weights)
+}
+
+// NewWeightedRing builds a ring of the servers in weights, a server with twice
+// the weight of another gets about twice its keys.
+func NewWeightedRing(weights map[string]int) *Ring {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	r := &Ring{}
+	for addr, w := range weights {
+		// the float32 share and its rounding are libketama's
+		share := float32(w) / float32(total)
+		n := int(math.Floor(float64(float32(float64(share) * pointsPerServer * float64(len(weights))))))
+		for k := 0; k < n; k++ {
+			digest := md5.Sum([]byte(addr + "-" + strconv.Itoa(k)))
+			for h := 0; h < 4; h++ {
+				r.points = append(r.points, point{hash: digestPoint(digest, h), addr: addr})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].addr < r.points[j].addr
+	})
+	return r
+}
+
+// digestPoint returns the h-th of the 4 points an md5 digest makes, read little
+// endian as libketama does.
+func digestPoint(digest [md5.Size]byte, h int) uint32 {
+	return uint32(digest[3+h*4])<<24 | uint32(digest[2+h*4])<<16 | uint32(digest[1+h*4])<<8 | uint32(digest[h*4])
+}
+
+// Hash is the position of key on the ring.
+func Hash(key string) uint32 {
+	return digestPoint(md5.Sum([]byte(key)), 0)
+}
+
+// Get returns the server of key, or false for an empty ring.
+func (r *Ring) Get(key string) (string, bool) {
+	return r.Next(key, nil)
+}
+
+// Next returns the server of key among those skip does not reject, walking the
+// ring on from the point of key. It returns false when every server is skipped.
+func (r *Ring) Next(key string, skip func(addr string) bool) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	h := Hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	for i := 0; i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if skip == nil || !skip(p.addr) {
+			return p.addr, true
+		}
+	}
+	return "", false
+}
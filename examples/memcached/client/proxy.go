@@ -0,0 +1,428 @@
+package memcached_client
+
+import (
+	"bytes"
+	"context"
+	"muduo"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxPendingReplies is how many requests of a connection can wait for the
+	// backends, reading stops beyond it.
+	maxPendingReplies = 1024
+	// maxValue is the largest value forwarded, as large as a server stores.
+	maxValue = 1024 * 1024
+)
+
+const version = "0.0.1 muduo-proxy"
+
+type proxyOptions struct {
+	engineCnt int
+	timeout   time.Duration
+}
+
+// ProxyOption configures a Proxy.
+type ProxyOption func(o *proxyOptions)
+
+// WithProxyEngineCnt sets the number of loops serving clients.
+func WithProxyEngineCnt(n int) ProxyOption {
+	return func(o *proxyOptions) {
+		o.engineCnt = n
+	}
+}
+
+// WithRequestTimeout bounds how long a request waits for the backends, 5s by
+// default.
+func WithRequestTimeout(d time.Duration) ProxyOption {
+	return func(o *proxyOptions) {
+		o.timeout = d
+	}
+}
+
+// Proxy is a memcached server that stores nothing: it hands every request to a
+// Client, which shards keys over the backends. A multi-key retrieval is split
+// by backend and the responses merged in the order of the keys, and requests
+// for a backend that is down go to the next one of the ring.
+type Proxy struct {
+	server  *muduo.TcpServer
+	el      *muduo.Eventloop
+	client  *Client
+	timeout time.Duration
+}
+
+// NewProxy creates a proxy listening on addr, e.g. "tcp4://:11211", and
+// forwarding to the backends of client.
+func NewProxy(el *muduo.Eventloop, addr string, client *Client, opts ...ProxyOption) *Proxy {
+	o := proxyOptions{timeout: 5 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	p := &Proxy{
+		server:  muduo.NewTcpServer(el, "memcached-proxy", addr, o.engineCnt),
+		el:      el,
+		client:  client,
+		timeout: o.timeout,
+	}
+	p.server.SetOnConn(p.onConn)
+	p.server.SetOnMsg(p.onMsg)
+	return p
+}
+
+func (p *Proxy) Start() {
+	p.server.Start()
+}
+
+// Addr returns the address the proxy listens on.
+func (p *Proxy) Addr() string {
+	return p.server.Addr()
+}
+
+func (p *Proxy) Shutdown(timeout time.Duration) {
+	p.server.Shutdown(timeout)
+}
+
+// ShutdownOnSignal shuts the proxy down on SIGTERM and SIGINT.
+func (p *Proxy) ShutdownOnSignal(timeout time.Duration) {
+	cb := func(sig os.Signal) {
+		p.server.Shutdown(timeout)
+	}
+	p.el.OnSignal(syscall.SIGTERM, cb)
+	p.el.OnSignal(syscall.SIGINT, cb)
+}
+
+func (p *Proxy) onConn(conn *muduo.TcpConn) {
+	if conn.IsConnected() {
+		conn.SetContext(&proxySession{p: p, conn: conn})
+	} else {
+		conn.GetContext().(*proxySession).closed = true
+	}
+}
+
+func (p *Proxy) onMsg(conn *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+	s := conn.GetContext().(*proxySession)
+	s.process(buf)
+	s.flush()
+}
+
+// proxySession is a client connection. Its requests are served concurrently
+// and the replies written in request order; a request on a key waits for the
+// earlier ones on that key, so a get sees the set sent before it. It is owned
+// by the loop of conn.
+type proxySession struct {
+	p         *Proxy
+	conn      *muduo.TcpConn
+	replies   []*proxyReply
+	inflight  map[string]int // keys of the requests at the backends
+	flushing  bool           // a flush_all is at the backends
+	waiting   []*request     // held back by requests in flight
+	discard   int            // bytes left of a value too large to forward
+	throttled bool           // stopped reading with maxPendingReplies replies pending
+	closing   bool
+	closed    bool
+}
+
+type proxyReply struct {
+	data    []byte
+	done    bool
+	noreply bool
+	quit    bool
+}
+
+// request is a parsed client request.
+type request struct {
+	cmd  string
+	keys []string
+	arg  string // exptime of gat and gats
+	raw  []byte // what goes to the backend, without noreply
+	r    *proxyReply
+}
+
+// process serves the complete requests in buf.
+func (s *proxySession) process(buf *muduo.Buffer) {
+	for !s.closing && buf.ReadableBytes() > 0 {
+		if s.discard > 0 {
+			n := s.discard
+			if n > buf.ReadableBytes() {
+				n = buf.ReadableBytes()
+			}
+			buf.Advance(n)
+			s.discard -= n
+			continue
+		}
+		if len(s.replies) >= maxPendingReplies {
+			s.throttled = true
+			return
+		}
+		eol := buf.Search(crlf)
+		if eol < 0 {
+			if buf.ReadableBytes() > maxLine {
+				s.reply([]byte("CLIENT_ERROR line too long\r\n"), false).quit = true
+			}
+			return
+		}
+		if !s.parse(buf, eol) {
+			return
+		}
+	}
+}
+
+// parse handles the request whose line ends at eol, and returns false when its
+// value has yet to come.
+func (s *proxySession) parse(buf *muduo.Buffer, eol int) bool {
+	line := buf.Peek()[:eol]
+	tokens := bytes.Fields(line)
+	noreply := len(tokens) > 1 && string(tokens[len(tokens)-1]) == "noreply"
+	if noreply {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) == 0 {
+		buf.Advance(eol + len(crlf))
+		s.reply([]byte("ERROR\r\n"), false)
+		return true
+	}
+	raw := append(bytes.Join(tokens, []byte(" ")), crlf...)
+	req := &request{cmd: string(tokens[0])}
+	for _, key := range tokens[1:] {
+		req.keys = append(req.keys, string(key))
+	}
+	consumed := eol + len(crlf)
+	switch req.cmd {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		argc := 5
+		if req.cmd == "cas" {
+			argc = 6
+		}
+		n, err := strconv.Atoi(string(tokens[len(tokens)-1]))
+		if req.cmd == "cas" && len(tokens) == argc {
+			n, err = strconv.Atoi(string(tokens[4]))
+		}
+		if len(tokens) != argc || err != nil || n < 0 || !validKey(req.keys[0]) {
+			buf.Advance(consumed)
+			s.reply([]byte("CLIENT_ERROR bad command line format\r\n"), noreply)
+			return true
+		}
+		if n > maxValue {
+			buf.Advance(consumed)
+			s.discard = n + len(crlf)
+			s.reply([]byte("SERVER_ERROR object too large for cache\r\n"), noreply)
+			return true
+		}
+		if buf.ReadableBytes() < consumed+n+len(crlf) {
+			return false
+		}
+		raw = append(raw, buf.Peek()[consumed:consumed+n+len(crlf)]...)
+		consumed += n + len(crlf)
+		req.keys = req.keys[:1]
+	case "gat", "gats":
+		if len(req.keys) < 2 {
+			buf.Advance(consumed)
+			s.reply([]byte("ERROR\r\n"), noreply)
+			return true
+		}
+		req.arg, req.keys = req.keys[0], req.keys[1:]
+	}
+	buf.Advance(consumed)
+	req.raw = raw
+	s.serve(req, noreply)
+	return true
+}
+
+// serve answers req, on the spot or from another goroutine once the backends
+// have.
+func (s *proxySession) serve(req *request, noreply bool) {
+	switch req.cmd {
+	case "get", "gets", "gat", "gats", "set", "add", "replace", "append", "prepend", "cas", "delete", "incr", "decr", "touch":
+		if len(req.keys) == 0 {
+			s.reply([]byte("ERROR\r\n"), noreply)
+			return
+		}
+		for _, key := range req.keys {
+			if !validKey(key) {
+				s.reply([]byte("CLIENT_ERROR bad command line format\r\n"), noreply)
+				return
+			}
+		}
+	case "flush_all":
+	case "version":
+		s.reply([]byte("VERSION "+version+"\r\n"), noreply)
+		return
+	case "verbosity":
+		s.reply([]byte("OK\r\n"), noreply)
+		return
+	case "stats":
+		s.reply(s.p.stats(), noreply)
+		return
+	case "quit":
+		s.reply(nil, true).quit = true
+		return
+	default:
+		s.reply([]byte("ERROR\r\n"), noreply)
+		return
+	}
+	req.r = &proxyReply{noreply: noreply}
+	s.replies = append(s.replies, req.r)
+	if len(s.waiting) > 0 || s.conflicts(req) {
+		s.waiting = append(s.waiting, req)
+		return
+	}
+	s.launch(req)
+}
+
+// conflicts tells whether req has to wait for the requests in flight.
+func (s *proxySession) conflicts(req *request) bool {
+	if s.flushing {
+		return true
+	}
+	if req.cmd == "flush_all" {
+		return len(s.inflight) > 0
+	}
+	for _, key := range req.keys {
+		if s.inflight[key] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// launch hands req to the backends from another goroutine.
+func (s *proxySession) launch(req *request) {
+	if req.cmd == "flush_all" {
+		s.flushing = true
+	} else {
+		if s.inflight == nil {
+			s.inflight = make(map[string]int)
+		}
+		for _, key := range req.keys {
+			s.inflight[key]++
+		}
+	}
+	go func() {
+		data := s.p.forward(req)
+		s.conn.Eventloop().AsyncExecute(func() {
+			req.r.data, req.r.done = data, true
+			s.release(req)
+			s.flush()
+		})
+	}()
+}
+
+// release forgets req once answered and launches the requests it held back.
+func (s *proxySession) release(req *request) {
+	if req.cmd == "flush_all" {
+		s.flushing = false
+	}
+	for _, key := range req.keys {
+		if s.inflight[key]--; s.inflight[key] == 0 {
+			delete(s.inflight, key)
+		}
+	}
+	for len(s.waiting) > 0 && !s.conflicts(s.waiting[0]) {
+		next := s.waiting[0]
+		s.waiting[0] = nil
+		s.waiting = s.waiting[1:]
+		s.launch(next)
+	}
+}
+
+// reply queues a reply that is ready.
+func (s *proxySession) reply(data []byte, noreply bool) *proxyReply {
+	r := &proxyReply{data: data, done: true, noreply: noreply}
+	s.replies = append(s.replies, r)
+	return r
+}
+
+// flush writes the replies that are ready and in turn.
+func (s *proxySession) flush() {
+	if s.closed {
+		return
+	}
+	for len(s.replies) > 0 && s.replies[0].done {
+		r := s.replies[0]
+		s.replies[0] = nil
+		s.replies = s.replies[1:]
+		if !r.noreply && len(r.data) > 0 {
+			_, _ = s.conn.Write(r.data)
+		}
+		if r.quit {
+			s.closing = true
+			s.replies = nil
+			s.conn.ShutdownWrite()
+			return
+		}
+	}
+	if s.throttled && len(s.replies) < maxPendingReplies {
+		s.throttled = false
+		s.process(s.conn.GetInboundBuffer())
+		s.flush()
+	}
+}
+
+// forward serves req with the backends and returns the reply.
+func (p *Proxy) forward(req *request) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	switch req.cmd {
+	case "get", "gets", "gat", "gats":
+		cmd := req.cmd
+		if req.arg != "" {
+			cmd += " " + req.arg
+		}
+		items, err := p.client.fetch(ctx, cmd, req.keys)
+		if err != nil {
+			return errorReply(err)
+		}
+		var out []byte
+		for _, key := range req.keys {
+			it, ok := items[key]
+			if !ok {
+				continue
+			}
+			out = append(out, "VALUE "+it.Key+" "+strconv.FormatUint(uint64(it.Flags), 10)+" "+strconv.Itoa(len(it.Value))...)
+			if req.cmd == "gets" || req.cmd == "gats" {
+				out = append(out, " "+strconv.FormatUint(it.CAS, 10)...)
+			}
+			out = append(append(append(out, crlf...), it.Value...), crlf...)
+		}
+		return append(out, "END\r\n"...)
+	case "flush_all":
+		resps, err := p.client.broadcast(ctx, req.raw)
+		if err != nil {
+			return errorReply(err)
+		}
+		for _, resp := range resps {
+			if err := status(resp); err != nil {
+				return errorReply(err)
+			}
+		}
+		return []byte("OK\r\n")
+	}
+	resp, err := p.client.call(ctx, req.keys[0], req.raw)
+	if err != nil {
+		return errorReply(err)
+	}
+	return resp
+}
+
+func errorReply(err error) []byte {
+	if e, ok := err.(*ServerError); ok {
+		return []byte(e.Message + "\r\n")
+	}
+	return []byte("SERVER_ERROR " + err.Error() + "\r\n")
+}
+
+// stats reports the backends, up or down.
+func (p *Proxy) stats() []byte {
+	var out []byte
+	for _, addr := range p.client.addrs {
+		state := "down"
+		if p.client.servers[addr].alive() {
+			state = "up"
+		}
+		out = append(out, "STAT backend:"+addr+" "+state+"\r\n"...)
+	}
+	return append(out, "END\r\n"...)
+}
@@ -1,7 +1,76 @@
 package main
 
-import "muduo/pkg/logging"
+import (
+	"flag"
+	"muduo"
+	memcached_server "muduo/examples/memcached/server"
+	"muduo/pkg/logging"
+	"strconv"
+	"time"
+)
+
+// verbosity counts how often -v is given, -vv counts twice.
+type verbosity int
+
+func (v *verbosity) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+func (v *verbosity) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err == nil && on {
+		*v++
+	}
+	return err
+}
+
+func (v *verbosity) IsBoolFlag() bool {
+	return true
+}
 
 func main() {
-	logging.Infof("hello world")
+	var verbose verbosity
+	port := flag.Int("p", 11211, "TCP port to listen on")
+	threads := flag.Int("t", 4, "number of worker loops")
+	memory := flag.Int64("m", 64, "item memory in megabytes")
+	maxConns := flag.Int("c", 1024, "max simultaneous connections")
+	udpPort := flag.Int("U", 0, "UDP port to listen on, 0 is off")
+	host := flag.String("l", "", "interface to listen on, default is every IPv4 address")
+	flag.Var(&verbose, "v", "verbose, print errors and connections")
+	vv := flag.Bool("vv", false, "very verbose, also print every request")
+	snapshot := flag.String("e", "", "snapshot file, items are reloaded from it on restart")
+	interval := flag.Duration("snapshot-interval", time.Minute, "how often the snapshot file is written")
+	flag.Parse()
+	if *vv {
+		verbose += 2
+	}
+
+	opts := []memcached_server.Option{
+		memcached_server.WithPort(*port),
+		memcached_server.WithEngineCnt(*threads),
+		memcached_server.WithMemoryLimit(*memory << 20),
+		memcached_server.WithMaxConns(*maxConns),
+		memcached_server.WithHost(*host),
+		memcached_server.WithVerbosity(int(verbose)),
+	}
+	if *snapshot != "" {
+		opts = append(opts, memcached_server.WithSnapshot(*snapshot, *interval))
+	}
+	if *udpPort != 0 {
+		opts = append(opts, memcached_server.WithUDPPort(*udpPort))
+	}
+	el := muduo.NewEventloop("memcached")
+	m, err := memcached_server.NewMemcached(el, opts...)
+	if err != nil {
+		logging.Fatalf("memcached: %v", err)
+	}
+	m.Start()
+	el.AsyncExecute(func() {
+		logging.Infof("memcached listening on %s", m.Addr())
+		if addr := m.UDPAddr(); addr != "" {
+			logging.Infof("memcached listening on udp %s", addr)
+		}
+	})
+	m.ShutdownOnSignal(5 * time.Second)
+	el.Loop()
 }
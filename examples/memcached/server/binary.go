@@ -0,0 +1,363 @@
+package memcached_server
+
+import (
+	"encoding/binary"
+	"muduo"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"strconv"
+	"sync/atomic"
+)
+
+// The binary protocol, https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped.
+// Every request and response starts with a 24 byte header:
+//
+//	0 magic, 1 opcode, 2 key length, 4 extras length, 5 data type,
+//	6 vbucket (requests) or status (responses), 8 total body length,
+//	12 opaque, 16 cas
+const binaryHeaderLen = 24
+
+const (
+	reqMagic byte = 0x80
+	resMagic byte = 0x81
+)
+
+type Opcode byte
+
+const (
+	OpGet        Opcode = 0x00
+	OpSet        Opcode = 0x01
+	OpAdd        Opcode = 0x02
+	OpReplace    Opcode = 0x03
+	OpDelete     Opcode = 0x04
+	OpIncrement  Opcode = 0x05
+	OpDecrement  Opcode = 0x06
+	OpQuit       Opcode = 0x07
+	OpFlush      Opcode = 0x08
+	OpGetQ       Opcode = 0x09
+	OpNoop       Opcode = 0x0a
+	OpVersion    Opcode = 0x0b
+	OpGetK       Opcode = 0x0c
+	OpGetKQ      Opcode = 0x0d
+	OpAppend     Opcode = 0x0e
+	OpPrepend    Opcode = 0x0f
+	OpStat       Opcode = 0x10
+	OpSetQ       Opcode = 0x11
+	OpAddQ       Opcode = 0x12
+	OpReplaceQ   Opcode = 0x13
+	OpDeleteQ    Opcode = 0x14
+	OpIncrementQ Opcode = 0x15
+	OpDecrementQ Opcode = 0x16
+	OpQuitQ      Opcode = 0x17
+	OpFlushQ     Opcode = 0x18
+	OpAppendQ    Opcode = 0x19
+	OpPrependQ   Opcode = 0x1a
+	OpVerbosity  Opcode = 0x1b
+	OpTouch      Opcode = 0x1c
+	OpGAT        Opcode = 0x1d
+	OpGATQ       Opcode = 0x1e
+	OpGATK       Opcode = 0x23
+	OpGATKQ      Opcode = 0x24
+)
+
+// quiet maps the quiet opcodes to their loud versions.
+var quiet = map[Opcode]Opcode{
+	OpGetQ:       OpGet,
+	OpGetKQ:      OpGetK,
+	OpSetQ:       OpSet,
+	OpAddQ:       OpAdd,
+	OpReplaceQ:   OpReplace,
+	OpDeleteQ:    OpDelete,
+	OpIncrementQ: OpIncrement,
+	OpDecrementQ: OpDecrement,
+	OpQuitQ:      OpQuit,
+	OpFlushQ:     OpFlush,
+	OpAppendQ:    OpAppend,
+	OpPrependQ:   OpPrepend,
+	OpGATQ:       OpGAT,
+	OpGATKQ:      OpGATK,
+}
+
+type Status uint16
+
+const (
+	StatusOK             Status = 0x00
+	StatusKeyNotFound    Status = 0x01
+	StatusKeyExists      Status = 0x02
+	StatusValueTooLarge  Status = 0x03
+	StatusInvalidArgs    Status = 0x04
+	StatusNotStored      Status = 0x05
+	StatusNonNumeric     Status = 0x06
+	StatusUnknownCommand Status = 0x81
+	StatusOutOfMemory    Status = 0x82
+)
+
+func (st Status) String() string {
+	switch st {
+	case StatusOK:
+		return "No error"
+	case StatusKeyNotFound:
+		return "Not found"
+	case StatusKeyExists:
+		return "Data exists for key."
+	case StatusValueTooLarge:
+		return "Too large."
+	case StatusInvalidArgs:
+		return "Invalid arguments"
+	case StatusNotStored:
+		return "Not stored."
+	case StatusNonNumeric:
+		return "Non-numeric server-side value for incr or decr"
+	case StatusUnknownCommand:
+		return "Unknown command"
+	case StatusOutOfMemory:
+		return "Out of memory"
+	}
+	return "Unknown error " + strconv.Itoa(int(st))
+}
+
+// binaryHeader is a request header.
+type binaryHeader struct {
+	opcode    Opcode
+	keyLen    int
+	extrasLen int
+	bodyLen   int
+	opaque    uint32
+	cas       uint64
+}
+
+func parseBinaryHeader(b []byte) binaryHeader {
+	return binaryHeader{
+		opcode:    Opcode(b[1]),
+		keyLen:    int(binary.BigEndian.Uint16(b[2:])),
+		extrasLen: int(b[4]),
+		bodyLen:   int(binary.BigEndian.Uint32(b[8:])),
+		opaque:    binary.BigEndian.Uint32(b[12:]),
+		cas:       binary.BigEndian.Uint64(b[16:]),
+	}
+}
+
+// maxBinaryBody bounds what is read into memory, larger requests are answered
+// with StatusValueTooLarge and skipped.
+const maxBinaryBody = 1024*1024 + 250 + 32
+
+// processBinary handles the next request in buf and reports whether it was
+// complete. Responses go to the output buffer, OnMsg writes them once the input
+// is drained, which batches the responses of quiet requests.
+func (s *Session) processBinary(buf *muduo.Buffer) bool {
+	data := buf.Peek()
+	if data[0] != reqMagic {
+		logging.Errorf("bad binary magic 0x%02x from %s", data[0], s.name())
+		buf.Reset(0)
+		s.quit()
+		return false
+	}
+	if len(data) < binaryHeaderLen {
+		return false
+	}
+	h := parseBinaryHeader(data)
+	if h.bodyLen > maxBinaryBody {
+		atomic.AddUint64(&s.reqProcessed, 1)
+		s.binaryError(h, StatusValueTooLarge)
+		buf.Advance(binaryHeaderLen)
+		s.bytesToDiscard = uint64(h.bodyLen)
+		s.state = DiscardValue
+		return true
+	}
+	if len(data) < binaryHeaderLen+h.bodyLen {
+		return false
+	}
+	atomic.AddUint64(&s.reqProcessed, 1)
+	body := data[binaryHeaderLen : binaryHeaderLen+h.bodyLen]
+	buf.Advance(binaryHeaderLen + h.bodyLen)
+	if h.extrasLen+h.keyLen > h.bodyLen || h.keyLen > LongestKeySize {
+		s.binaryError(h, StatusInvalidArgs)
+		return true
+	}
+	extras := body[:h.extrasLen]
+	key := body[h.extrasLen : h.extrasLen+h.keyLen]
+	value := body[h.extrasLen+h.keyLen:]
+	s.dispatchBinary(h, extras, key, value)
+	return true
+}
+
+func (s *Session) dispatchBinary(h binaryHeader, extras, key, value []byte) {
+	op, isQuiet := quiet[h.opcode]
+	if !isQuiet {
+		op = h.opcode
+	}
+	switch op {
+	case OpGet, OpGetK, OpGAT, OpGATK, OpTouch:
+		touch := op == OpGAT || op == OpGATK || op == OpTouch
+		if (touch && len(extras) != 4) || (!touch && len(extras) != 0) || len(key) == 0 || len(value) != 0 {
+			s.binaryError(h, StatusInvalidArgs)
+			return
+		}
+		var item *Item
+		var ok bool
+		if touch {
+			item, ok = s.m.Touch(string(key), int64(binary.BigEndian.Uint32(extras)))
+		} else {
+			item, ok = s.m.Get(string(key))
+		}
+		if !ok {
+			if !isQuiet {
+				s.binaryError(h, StatusKeyNotFound)
+			}
+			return
+		}
+		if op == OpTouch {
+			s.binaryResponse(h, StatusOK, item.cas, nil, nil, nil)
+			return
+		}
+		var flags [4]byte
+		binary.BigEndian.PutUint32(flags[:], item.flags)
+		if op == OpGet || op == OpGAT {
+			key = nil
+		}
+		s.binaryResponse(h, StatusOK, item.cas, flags[:], key, item.Value()[:item.valuelen-2])
+	case OpSet, OpAdd, OpReplace, OpAppend, OpPrepend:
+		s.binaryUpdate(h, op, isQuiet, extras, key, value)
+	case OpDelete:
+		if len(extras) != 0 || len(key) == 0 || len(value) != 0 {
+			s.binaryError(h, StatusInvalidArgs)
+			return
+		}
+		if !s.m.Delete(string(key)) {
+			s.binaryError(h, StatusKeyNotFound)
+		} else if !isQuiet {
+			s.binaryResponse(h, StatusOK, 0, nil, nil, nil)
+		}
+	case OpIncrement, OpDecrement:
+		if len(extras) != 20 || len(key) == 0 || len(value) != 0 {
+			s.binaryError(h, StatusInvalidArgs)
+			return
+		}
+		delta := binary.BigEndian.Uint64(extras)
+		initial := binary.BigEndian.Uint64(extras[8:])
+		exptime := binary.BigEndian.Uint32(extras[16:])
+		n, cas, err := s.m.Incr(string(key), delta, op == OpIncrement, initial, exptime != 0xffffffff, int64(exptime))
+		switch err {
+		case nil:
+			if !isQuiet {
+				var body [8]byte
+				binary.BigEndian.PutUint64(body[:], n)
+				s.binaryResponse(h, StatusOK, cas, nil, nil, body[:])
+			}
+		case errors.ErrKeyNotFound:
+			s.binaryError(h, StatusKeyNotFound)
+		default:
+			s.binaryError(h, StatusNonNumeric)
+		}
+	case OpQuit:
+		if !isQuiet {
+			s.binaryResponse(h, StatusOK, 0, nil, nil, nil)
+		}
+		s.quit()
+	case OpFlush:
+		if len(extras) != 0 && len(extras) != 4 {
+			s.binaryError(h, StatusInvalidArgs)
+			return
+		}
+		var delay int64
+		if len(extras) == 4 {
+			delay = int64(binary.BigEndian.Uint32(extras))
+		}
+		s.m.FlushAfter(delay)
+		if !isQuiet {
+			s.binaryResponse(h, StatusOK, 0, nil, nil, nil)
+		}
+	case OpNoop:
+		s.binaryResponse(h, StatusOK, 0, nil, nil, nil)
+	case OpVersion:
+		s.binaryResponse(h, StatusOK, 0, nil, nil, []byte(version))
+	case OpVerbosity:
+		if len(extras) != 4 || len(key) != 0 || len(value) != 0 {
+			s.binaryError(h, StatusInvalidArgs)
+			return
+		}
+		s.m.SetVerbosity(int(binary.BigEndian.Uint32(extras)))
+		s.binaryResponse(h, StatusOK, 0, nil, nil, nil)
+	case OpStat:
+		stats, _ := s.m.StatGroup(string(key))
+		for _, st := range stats {
+			s.binaryResponse(h, StatusOK, 0, nil, []byte(st.Name), []byte(st.Value))
+		}
+		// the last response has neither key nor value, unknown groups are empty
+		s.binaryResponse(h, StatusOK, 0, nil, nil, nil)
+	default:
+		s.binaryError(h, StatusUnknownCommand)
+	}
+}
+
+func (s *Session) binaryUpdate(h binaryHeader, op Opcode, isQuiet bool, extras, key, value []byte) {
+	var policy UpdatePolicy
+	switch op {
+	case OpSet:
+		policy = Set
+	case OpAdd:
+		policy = Add
+	case OpReplace:
+		policy = Replace
+	case OpAppend:
+		policy = Append
+	case OpPrepend:
+		policy = Prepend
+	}
+	wantExtras := 8
+	if policy == Append || policy == Prepend {
+		wantExtras = 0
+	}
+	if len(extras) != wantExtras || len(key) == 0 || (policy == Add && h.cas != 0) {
+		s.binaryError(h, StatusInvalidArgs)
+		return
+	}
+	if h.cas != 0 && (policy == Set || policy == Replace) {
+		policy = Cas
+	}
+	var flags uint32
+	var exptime int
+	if wantExtras == 8 {
+		flags = binary.BigEndian.Uint32(extras)
+		exptime = s.m.realtime(int64(binary.BigEndian.Uint32(extras[4:])))
+	}
+	item := NewItem(string(key), flags, exptime, len(value)+2, h.cas)
+	item.Append(value)
+	item.Append(crlf)
+	success, exist := s.m.Store(item, policy)
+	switch {
+	case success:
+		if !isQuiet {
+			s.binaryResponse(h, StatusOK, item.cas, nil, nil, nil)
+		}
+	case policy == Cas && !exist, policy == Replace:
+		s.binaryError(h, StatusKeyNotFound)
+	case policy == Cas, policy == Add:
+		s.binaryError(h, StatusKeyExists)
+	default:
+		s.binaryError(h, StatusNotStored)
+	}
+}
+
+var crlf = []byte("\r\n")
+
+// binaryError answers a request with status and its message as the value.
+func (s *Session) binaryError(h binaryHeader, status Status) {
+	s.binaryResponse(h, status, 0, nil, nil, []byte(status.String()))
+}
+
+func (s *Session) binaryResponse(h binaryHeader, status Status, cas uint64, extras, key, value []byte) {
+	var header [binaryHeaderLen]byte
+	header[0] = resMagic
+	header[1] = byte(h.opcode)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(header[6:], uint16(status))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:], h.opaque)
+	binary.BigEndian.PutUint64(header[16:], cas)
+	_, _ = s.outputBuffer.Write(header[:])
+	_, _ = s.outputBuffer.Write(extras)
+	_, _ = s.outputBuffer.Write(key)
+	_, _ = s.outputBuffer.Write(value)
+}
@@ -0,0 +1,332 @@
+package memcached_server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"muduo/internal/muduotest"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type binaryRequest struct {
+	op     Opcode
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  string
+}
+
+func (r binaryRequest) encode() []byte {
+	b := make([]byte, binaryHeaderLen, binaryHeaderLen+len(r.extras)+len(r.key)+len(r.value))
+	b[0] = reqMagic
+	b[1] = byte(r.op)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(r.key)))
+	b[4] = byte(len(r.extras))
+	binary.BigEndian.PutUint32(b[8:], uint32(len(r.extras)+len(r.key)+len(r.value)))
+	binary.BigEndian.PutUint32(b[12:], r.opaque)
+	binary.BigEndian.PutUint64(b[16:], r.cas)
+	b = append(b, r.extras...)
+	b = append(b, r.key...)
+	return append(b, r.value...)
+}
+
+type binaryResult struct {
+	op     Opcode
+	status Status
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  string
+}
+
+type binaryClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialBinary(t *testing.T, m *Memcached) *binaryClient {
+	t.Helper()
+	return &binaryClient{t: t, conn: muduotest.Dial(t, m.Addr())}
+}
+
+// send writes the requests in a single write.
+func (c *binaryClient) send(reqs ...binaryRequest) {
+	c.t.Helper()
+	var b []byte
+	for _, r := range reqs {
+		b = append(b, r.encode()...)
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *binaryClient) read() binaryResult {
+	c.t.Helper()
+	var header [binaryHeaderLen]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if header[0] != resMagic {
+		c.t.Fatalf("response magic 0x%02x", header[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		c.t.Fatal(err)
+	}
+	keyLen, extrasLen := int(binary.BigEndian.Uint16(header[2:])), int(header[4])
+	return binaryResult{
+		op:     Opcode(header[1]),
+		status: Status(binary.BigEndian.Uint16(header[6:])),
+		opaque: binary.BigEndian.Uint32(header[12:]),
+		cas:    binary.BigEndian.Uint64(header[16:]),
+		extras: body[:extrasLen],
+		key:    string(body[extrasLen : extrasLen+keyLen]),
+		value:  string(body[extrasLen+keyLen:]),
+	}
+}
+
+// do sends req and expects a response with status.
+func (c *binaryClient) do(req binaryRequest, status Status) binaryResult {
+	c.t.Helper()
+	c.send(req)
+	res := c.read()
+	if res.op != req.op || res.status != status || res.opaque != req.opaque {
+		c.t.Fatalf("%#x: got %+v, want status %v", req.op, res, status)
+	}
+	return res
+}
+
+func storeExtras(flags, exptime uint32) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, flags)
+	binary.BigEndian.PutUint32(b[4:], exptime)
+	return b
+}
+
+func incrExtras(delta, initial uint64, exptime uint32) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint64(b, delta)
+	binary.BigEndian.PutUint64(b[8:], initial)
+	binary.BigEndian.PutUint32(b[16:], exptime)
+	return b
+}
+
+func TestBinaryGet(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dialBinary(t, m)
+
+	for _, op := range []Opcode{OpGet, OpGetK} {
+		res := c.do(binaryRequest{op: op, opaque: 7, key: "k"}, StatusKeyNotFound)
+		if res.value != StatusKeyNotFound.String() {
+			t.Fatalf("%#x: miss %+v", op, res)
+		}
+	}
+	// quiet misses answer nothing, the noop comes first
+	c.send(binaryRequest{op: OpGetQ, key: "k"}, binaryRequest{op: OpGetKQ, key: "k"}, binaryRequest{op: OpNoop, opaque: 9})
+	if res := c.read(); res.op != OpNoop || res.opaque != 9 {
+		t.Fatalf("got %+v, want the noop", res)
+	}
+
+	set := c.do(binaryRequest{op: OpSet, extras: storeExtras(42, 0), key: "k", value: "v"}, StatusOK)
+	for _, op := range []Opcode{OpGet, OpGetK, OpGetQ, OpGetKQ} {
+		res := c.do(binaryRequest{op: op, opaque: uint32(op), key: "k"}, StatusOK)
+		wantKey := ""
+		if op == OpGetK || op == OpGetKQ {
+			wantKey = "k"
+		}
+		if res.value != "v" || res.key != wantKey || res.cas != set.cas || binary.BigEndian.Uint32(res.extras) != 42 {
+			t.Fatalf("%#x: hit %+v", op, res)
+		}
+	}
+	c.do(binaryRequest{op: OpGet}, StatusInvalidArgs)
+}
+
+func TestBinaryStoreCas(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dialBinary(t, m)
+	extras := storeExtras(0, 0)
+
+	c.do(binaryRequest{op: OpReplace, extras: extras, key: "k", value: "a"}, StatusKeyNotFound)
+	added := c.do(binaryRequest{op: OpAdd, extras: extras, key: "k", value: "a"}, StatusOK)
+	c.do(binaryRequest{op: OpAdd, extras: extras, key: "k", value: "b"}, StatusKeyExists)
+	c.do(binaryRequest{op: OpAdd, cas: added.cas, extras: extras, key: "other", value: "b"}, StatusInvalidArgs)
+
+	// a stale cas is refused, the current one replaces the value
+	c.do(binaryRequest{op: OpSet, cas: added.cas + 1000, extras: extras, key: "k", value: "b"}, StatusKeyExists)
+	set := c.do(binaryRequest{op: OpSet, cas: added.cas, extras: extras, key: "k", value: "b"}, StatusOK)
+	if set.cas == added.cas {
+		t.Fatalf("cas %d not renewed", set.cas)
+	}
+	c.do(binaryRequest{op: OpReplace, cas: added.cas, extras: extras, key: "k", value: "c"}, StatusKeyExists)
+	replaced := c.do(binaryRequest{op: OpReplace, cas: set.cas, extras: extras, key: "k", value: "c"}, StatusOK)
+	c.do(binaryRequest{op: OpReplace, cas: replaced.cas, extras: extras, key: "missing", value: "c"}, StatusKeyNotFound)
+	if res := c.do(binaryRequest{op: OpGet, key: "k"}, StatusOK); res.value != "c" || res.cas != replaced.cas {
+		t.Fatalf("get %+v", res)
+	}
+
+	// quiet stores answer errors only
+	c.send(binaryRequest{op: OpSetQ, extras: extras, key: "q", value: "1"},
+		binaryRequest{op: OpAddQ, opaque: 2, extras: extras, key: "q", value: "2"},
+		binaryRequest{op: OpNoop, opaque: 3})
+	if res := c.read(); res.op != OpAddQ || res.status != StatusKeyExists || res.opaque != 2 {
+		t.Fatalf("got %+v, want the failed add", res)
+	}
+	if res := c.read(); res.op != OpNoop {
+		t.Fatalf("got %+v, want the noop", res)
+	}
+}
+
+func TestBinaryIncr(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dialBinary(t, m)
+	value := func(res binaryResult) uint64 {
+		t.Helper()
+		if len(res.value) != 8 {
+			t.Fatalf("incr %+v", res)
+		}
+		return binary.BigEndian.Uint64([]byte(res.value))
+	}
+
+	// exptime 0xffffffff does not create a missing counter
+	c.do(binaryRequest{op: OpIncrement, extras: incrExtras(1, 10, 0xffffffff), key: "n"}, StatusKeyNotFound)
+	if n := value(c.do(binaryRequest{op: OpIncrement, extras: incrExtras(1, 10, 0), key: "n"}, StatusOK)); n != 10 {
+		t.Fatalf("created with %d, want the initial value", n)
+	}
+	if n := value(c.do(binaryRequest{op: OpIncrement, extras: incrExtras(5, 10, 0xffffffff), key: "n"}, StatusOK)); n != 15 {
+		t.Fatalf("incr to %d", n)
+	}
+	if n := value(c.do(binaryRequest{op: OpDecrement, extras: incrExtras(100, 0, 0), key: "n"}, StatusOK)); n != 0 {
+		t.Fatalf("decr below zero to %d", n)
+	}
+	if res := c.do(binaryRequest{op: OpGet, key: "n"}, StatusOK); res.value != "0" {
+		t.Fatalf("get %+v", res)
+	}
+
+	c.do(binaryRequest{op: OpSet, extras: storeExtras(0, 0), key: "s", value: "abc"}, StatusOK)
+	c.do(binaryRequest{op: OpIncrement, extras: incrExtras(1, 0, 0), key: "s"}, StatusNonNumeric)
+	c.do(binaryRequest{op: OpIncrement, extras: incrExtras(1, 0, 0)[:8], key: "s"}, StatusInvalidArgs)
+}
+
+func TestBinaryQuietBatch(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dialBinary(t, m)
+	for _, key := range []string{"a", "c"} {
+		c.do(binaryRequest{op: OpSet, extras: storeExtras(0, 0), key: key, value: key + key}, StatusOK)
+	}
+	c.send(binaryRequest{op: OpGetQ, opaque: 1, key: "a"},
+		binaryRequest{op: OpGetQ, opaque: 2, key: "b"},
+		binaryRequest{op: OpGetKQ, opaque: 3, key: "c"},
+		binaryRequest{op: OpGetKQ, opaque: 4, key: "d"},
+		binaryRequest{op: OpNoop, opaque: 5})
+	for _, want := range []binaryResult{
+		{op: OpGetQ, opaque: 1, value: "aa"},
+		{op: OpGetKQ, opaque: 3, key: "c", value: "cc"},
+		{op: OpNoop, opaque: 5},
+	} {
+		res := c.read()
+		if res.op != want.op || res.status != StatusOK || res.opaque != want.opaque || res.key != want.key || res.value != want.value {
+			t.Fatalf("got %+v, want %+v", res, want)
+		}
+	}
+}
+
+func TestBinaryFlushStatVersion(t *testing.T) {
+	m, clock, _ := startServer(t)
+	c := dialBinary(t, m)
+	c.do(binaryRequest{op: OpSet, extras: storeExtras(0, 0), key: "k", value: "v"}, StatusOK)
+	c.do(binaryRequest{op: OpFlush}, StatusOK)
+	c.do(binaryRequest{op: OpGet, key: "k"}, StatusKeyNotFound)
+
+	// a delayed flush
+	c.do(binaryRequest{op: OpSet, extras: storeExtras(0, 0), key: "k", value: "v"}, StatusOK)
+	delay := make([]byte, 4)
+	binary.BigEndian.PutUint32(delay, 10)
+	c.do(binaryRequest{op: OpFlush, extras: delay}, StatusOK)
+	c.do(binaryRequest{op: OpGet, key: "k"}, StatusOK)
+	clock.Advance(11 * time.Second)
+	drain(m.el)
+	c.do(binaryRequest{op: OpGet, key: "k"}, StatusKeyNotFound)
+
+	if res := c.do(binaryRequest{op: OpVersion}, StatusOK); res.value != version {
+		t.Fatalf("version %q", res.value)
+	}
+
+	c.send(binaryRequest{op: OpStat, opaque: 1})
+	stats := make(map[string]string)
+	for {
+		res := c.read()
+		if res.op != OpStat || res.status != StatusOK || res.opaque != 1 {
+			t.Fatalf("stat %+v", res)
+		}
+		if res.key == "" {
+			break
+		}
+		stats[res.key] = res.value
+	}
+	if stats["version"] != version || stats["cmd_flush"] != "2" {
+		t.Fatalf("stats %v", stats)
+	}
+	// every binary request so far, the stat one included
+	if n, _ := strconv.Atoi(stats["requests_processed"]); n != 9 {
+		t.Fatalf("requests_processed %s", stats["requests_processed"])
+	}
+	if res := c.do(binaryRequest{op: OpStat, key: "nonsense"}, StatusOK); res.key != "" {
+		t.Fatalf("unknown stat group %+v", res)
+	}
+}
+
+func TestBinaryOversizedBody(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dialBinary(t, m)
+	value := bytes.Repeat([]byte{'x'}, maxBinaryBody)
+	req := binaryRequest{op: OpSet, opaque: 1, extras: storeExtras(0, 0), key: "big"}
+	b := append(req.encode(), value...)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(req.extras)+len(req.key)+len(value)))
+	// the body arrives in pieces and is skipped as it comes
+	go func() {
+		for len(b) > 0 {
+			n := 64 << 10
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := c.conn.Write(b[:n]); err != nil {
+				return
+			}
+			b = b[n:]
+		}
+	}()
+	res := c.read()
+	if res.op != OpSet || res.status != StatusValueTooLarge || res.opaque != 1 {
+		t.Fatalf("got %+v", res)
+	}
+	// the connection carries on after the skipped body
+	c.do(binaryRequest{op: OpNoop, opaque: 2}, StatusOK)
+	c.do(binaryRequest{op: OpGet, key: "big"}, StatusKeyNotFound)
+}
+
+func TestBinaryAuto(t *testing.T) {
+	m, _, _ := startServer(t)
+	// a text connection and a binary one, told apart by their first byte
+	text := dial(t, m)
+	text.Do("set k 5 0 4\r\ntext\r\n", "STORED")
+	c := dialBinary(t, m)
+	if res := c.do(binaryRequest{op: OpGet, key: "k"}, StatusOK); res.value != "text" || binary.BigEndian.Uint32(res.extras) != 5 {
+		t.Fatalf("get %+v", res)
+	}
+	c.do(binaryRequest{op: OpSet, extras: storeExtras(0, 0), key: "k", value: "binary"}, StatusOK)
+	text.Do("get k\r\n", "VALUE k 0 6", "binary", "END")
+
+	// a binary connection stays binary
+	if _, err := c.conn.Write([]byte("get k\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(c.conn); err != nil || len(data) != 0 {
+		t.Fatalf("read %q, %v after a text request", data, err)
+	}
+}
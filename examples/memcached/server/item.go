@@ -1,6 +1,7 @@
 package memcached_server
 
 import (
+	"container/list"
 	"hash/crc64"
 	"muduo"
 	"strconv"
@@ -23,12 +24,13 @@ const (
 type Item struct {
 	keylen    int
 	flags     uint32
-	exptime   int
+	exptime   int // unix time, 0 when the item does not expire
 	valuelen  int
 	recvBytes int
 	cas       uint64
 	_hash     uint64
 	data      []byte
+	elem      *list.Element // in the LRU list of its slot
 }
 
 func NewItem(key string, flags uint32, exptime int, valuelen int, cas uint64) *Item {
@@ -43,6 +45,7 @@ func NewItem(key string, flags uint32, exptime int, valuelen int, cas uint64) *I
 		_hash:     hash(key),
 		data:      make([]byte, keylen+valuelen),
 	}
+	it.Append([]byte(key))
 	return it
 }
 
@@ -2,27 +2,43 @@ package memcached_server
 
 import (
 	"muduo"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
 	"muduo/pkg/util"
+	"net"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var _g_cas uint64
+const version = "0.0.1 muduo"
 
-type slot struct {
-	items map[string]*Item
-	mu    sync.Mutex
-}
+// shutdownTimeout is how long the "shutdown" command waits for connections to
+// close.
+const shutdownTimeout = time.Second
+
+var _g_cas uint64
 
 type Options struct {
 	engineCnt int
+	host      string
 	port      int
+	udp       bool
+	udpPort   int
+	protocol  ProtocolType
+	memLimit  int64
+	maxConns  int
+	verbosity int
+	snapshot  string
+	interval  time.Duration
 }
 
 func loadOptions(options ...Option) *Options {
-	opts := new(Options)
+	opts := &Options{protocol: Auto, memLimit: 64 << 20}
 	for _, option := range options {
 		option(opts)
 	}
@@ -39,6 +55,25 @@ type Memcached struct {
 	stime    time.Time
 	sessions map[string]*Session
 	mu       sync.Mutex
+	protocol ProtocolType
+	udp      *udpServer
+	maxConns int
+
+	limit        int64 // memory limit in bytes
+	used         int64 // bytes held by items, atomic
+	counters     *counters
+	reqProcessed uint64 // of closed sessions, guarded by mu
+	bytesRead    uint64 // of closed sessions, guarded by mu
+	verbosity    int32  // atomic
+	sweeper      *muduo.TimerTask
+	sweepNext    int              // owned by el
+	flushTimer   *muduo.TimerTask // pending delayed flush, owned by el
+
+	snapshotPath     string
+	snapshotInterval time.Duration
+	snapshotter      *muduo.TimerTask
+	snap             *snapshot // in progress, owned by el
+	nextSnapshot     time.Time // owned by el
 }
 
 func WithEngineCnt(engineCnt int) Option {
@@ -53,26 +88,177 @@ func WithPort(port int) Option {
 	}
 }
 
-func NewMemcached(el *muduo.Eventloop, opts ...Option) *Memcached {
+// WithHost sets the address to listen on, an IPv4 or IPv6 address or a host
+// name. The default is every IPv4 address.
+func WithHost(host string) Option {
+	return func(opts *Options) {
+		opts.host = host
+	}
+}
+
+// WithUDPPort serves requests over UDP on port too, 0 picks a free one. UDP is
+// off by default.
+func WithUDPPort(port int) Option {
+	return func(opts *Options) {
+		opts.udp = true
+		opts.udpPort = port
+	}
+}
+
+// WithMaxConns caps the connections served at once, 0 means no cap. Clients
+// beyond it are told so and disconnected.
+func WithMaxConns(maxConns int) Option {
+	return func(opts *Options) {
+		opts.maxConns = maxConns
+	}
+}
+
+// WithVerbosity sets the initial verbosity, see SetVerbosity.
+func WithVerbosity(level int) Option {
+	return func(opts *Options) {
+		opts.verbosity = level
+	}
+}
+
+// WithSnapshot saves every item to path every interval, and loads them back
+// when the server is created. Shutdown saves a last snapshot.
+func WithSnapshot(path string, interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.snapshot = path
+		opts.interval = interval
+	}
+}
+
+// WithMemoryLimit caps the memory items take, least recently used items
+// are evicted beyond it. The default is 64MiB.
+func WithMemoryLimit(bytes int64) Option {
+	return func(opts *Options) {
+		opts.memLimit = bytes
+	}
+}
+
+// WithProtocol sets the protocol clients speak, by default it is detected per
+// connection from the first byte.
+func WithProtocol(protocol ProtocolType) Option {
+	return func(opts *Options) {
+		opts.protocol = protocol
+	}
+}
+
+// NewMemcached creates a server on el, it fails when the UDP port cannot be
+// bound.
+func NewMemcached(el *muduo.Eventloop, opts ...Option) (*Memcached, error) {
 	options := loadOptions(opts...)
+	network := "tcp4"
+	if strings.Contains(options.host, ":") {
+		network = "tcp6"
+	}
 	m := &Memcached{
-		slotn:    1024,
-		slots:    make([]*slot, 1024),
-		server:   muduo.NewTcpServer(el, "memcached", "tcp4://:"+strconv.Itoa(options.port), options.engineCnt),
-		el:       el,
-		sessions: make(map[string]*Session),
+		slotn:     1024,
+		slots:     make([]*slot, 1024),
+		el:        el,
+		sessions:  make(map[string]*Session),
+		protocol:  options.protocol,
+		maxConns:  options.maxConns,
+		verbosity: int32(options.verbosity),
+		limit:     options.memLimit,
+		counters:  newCounters(),
+
+		snapshotPath:     options.snapshot,
+		snapshotInterval: options.interval,
+	}
+	if options.udp {
+		udp, err := newUdpServer(m, network, net.JoinHostPort(options.host, strconv.Itoa(options.udpPort)))
+		if err != nil {
+			return nil, err
+		}
+		m.udp = udp
 	}
+	m.server = muduo.NewTcpServer(el, "memcached", network+"://"+net.JoinHostPort(options.host, strconv.Itoa(options.port)), options.engineCnt)
 	for i := 0; i < m.slotn; i++ {
-		m.slots[i] = &slot{
-			items: make(map[string]*Item),
+		m.slots[i] = newSlot()
+	}
+	if m.snapshotPath != "" {
+		n, err := m.loadSnapshot(m.snapshotPath)
+		if err != nil {
+			logging.Errorf("memcached snapshot %s not loaded: %v", m.snapshotPath, err)
+		} else if n > 0 {
+			logging.Infof("memcached snapshot %s: %d items loaded", m.snapshotPath, n)
 		}
 	}
-	return m
+	m.server.SetOnConn(m.onConn)
+	m.server.SetOnMsg(m.onMsg)
+	return m, nil
 }
 
 func (m *Memcached) Start() {
 	m.stime = time.Now()
 	m.server.Start()
+	if m.udp != nil {
+		m.el.AsyncExecute(m.udp.start)
+	}
+	m.sweeper = m.el.AsyncScheduleAtFixRate(m.sweep, sweepInterval)
+	if m.snapshotPath != "" {
+		m.el.AsyncExecute(func() {
+			m.nextSnapshot = m.el.Now().Add(m.snapshotInterval)
+		})
+		m.snapshotter = m.el.AsyncScheduleAtFixRate(m.snapshotStep, snapshotTick)
+	}
+}
+
+// Addr returns the address the server listens on.
+func (m *Memcached) Addr() string {
+	return m.server.Addr()
+}
+
+// UDPAddr returns the address UDP requests are served on, empty without UDP.
+func (m *Memcached) UDPAddr() string {
+	if m.udp == nil {
+		return ""
+	}
+	return m.udp.addr()
+}
+
+// Shutdown stops accepting connections, closes the open ones within timeout
+// and then stops the server loop.
+func (m *Memcached) Shutdown(timeout time.Duration) {
+	if m.sweeper != nil {
+		m.sweeper.Cancel()
+	}
+	m.el.AsyncExecute(func() {
+		if m.flushTimer != nil {
+			m.flushTimer.Cancel()
+			m.flushTimer = nil
+		}
+		if m.udp != nil {
+			m.udp.close()
+		}
+		if m.snapshotter != nil {
+			m.snapshotter.Cancel()
+			m.snapshotNow()
+		}
+	})
+	m.server.Shutdown(timeout)
+}
+
+// ShutdownOnSignal shuts the server down on SIGTERM and SIGINT.
+func (m *Memcached) ShutdownOnSignal(timeout time.Duration) {
+	cb := func(sig os.Signal) {
+		logging.Infof("memcached shutting down on %v", sig)
+		m.Shutdown(timeout)
+	}
+	m.el.OnSignal(syscall.SIGTERM, cb)
+	m.el.OnSignal(syscall.SIGINT, cb)
+}
+
+// SetVerbosity sets how much the server logs: errors only at 0, connections
+// from 1 and every request from 2 on.
+func (m *Memcached) SetVerbosity(level int) {
+	atomic.StoreInt32(&m.verbosity, int32(level))
+}
+
+func (m *Memcached) verbose(level int) bool {
+	return atomic.LoadInt32(&m.verbosity) >= int32(level)
 }
 
 func (m *Memcached) setEngineCnt(engineCnt int) {
@@ -85,62 +271,58 @@ func (m *Memcached) startTime() time.Time {
 
 func (m *Memcached) Store(item *Item, policy UpdatePolicy) (success bool, exist bool) {
 	slot := m.slots[item._hash%uint64(m.slotn)]
-	items := slot.items
 	keyStr := string(item.Key())
-	success = false
 	slot.mu.Lock()
-	defer slot.mu.Unlock()
-	oldItem, exist := items[keyStr]
-	if policy == Set {
-		item.cas = atomic.AddUint64(&_g_cas, 1)
-		items[keyStr] = item
+	oldItem := m.live(slot, keyStr, m.now())
+	exist = oldItem != nil
+	stored := item
+	switch policy {
+	case Set:
 		success = true
-	} else {
-		if policy == Add {
-			if exist {
-				return
-			} else {
-				item.cas = atomic.AddUint64(&_g_cas, 1)
-				items[keyStr] = item
-				success = true
-			}
-		} else if policy == Replace {
-			if exist {
-				item.cas = atomic.AddUint64(&_g_cas, 1)
-				items[keyStr] = item
-				success = true
+	case Add:
+		success = !exist
+	case Replace:
+		success = exist
+	case Append, Prepend:
+		if exist {
+			newLen := item.valuelen + oldItem.valuelen - 2
+			stored = NewItem(keyStr, oldItem.flags, oldItem.exptime, newLen, 0)
+			if policy == Append {
+				stored.Append(oldItem.Value()[:oldItem.valuelen-2])
+				stored.Append(item.Value())
 			} else {
-				return
+				stored.Append(item.Value()[:item.valuelen-2])
+				stored.Append(oldItem.Value())
 			}
-		} else if policy == Append || policy == Prepend {
-			if exist {
-				newLen := item.valuelen + oldItem.valuelen - 2
-				newItem := NewItem(string(item.Key()), item.flags, item.exptime, newLen, atomic.AddUint64(&_g_cas, 1))
-				if policy == Append {
-					newItem.Append(oldItem.Value()[:oldItem.valuelen-2])
-					newItem.Append(item.Value())
-				} else {
-					newItem.Append(item.Value()[:item.valuelen-2])
-					newItem.Append(oldItem.Value())
-				}
-				util.Assert(newItem.keylen+newItem.valuelen-newItem.recvBytes == 0, "newItem.keylen+newItem.valuelen-newItem.recvBytes == 0")
-				util.Assert(newItem.EndWithCRLF(), "newItem.EndWithCRLF()")
-				items[keyStr] = newItem
-				success = true
-			} else {
-				return
-			}
-		} else if policy == Cas {
-			if exist && oldItem.cas == item.cas {
-				item.cas = atomic.AddUint64(&_g_cas, 1)
-				items[keyStr] = item
-				success = true
-			} else {
-				return
-			}
-		} else {
-			util.Assert(false, "invalid policy")
+			util.Assert(stored.keylen+stored.valuelen-stored.recvBytes == 0, "stored.keylen+stored.valuelen-stored.recvBytes == 0")
+			util.Assert(stored.EndWithCRLF(), "stored.EndWithCRLF()")
+			success = true
+		}
+	case Cas:
+		success = exist && oldItem.cas == item.cas
+	default:
+		util.Assert(false, "invalid policy")
+	}
+	if policy == Cas {
+		switch {
+		case !exist:
+			count(&m.counters.casMisses)
+		case success:
+			count(&m.counters.casHits)
+		default:
+			count(&m.counters.casBadval)
 		}
+	} else {
+		count(&m.counters.cmdSet)
+	}
+	if success {
+		stored.cas = atomic.AddUint64(&_g_cas, 1)
+		item.cas = stored.cas
+		m.link(slot, stored)
+	}
+	slot.mu.Unlock()
+	if success {
+		m.reclaim(stored._hash%uint64(m.slotn), stored)
 	}
 	return
 }
@@ -148,37 +330,166 @@ func (m *Memcached) Store(item *Item, policy UpdatePolicy) (success bool, exist
 func (m *Memcached) Get(key string) (item *Item, exist bool) {
 	hash := hash(key)
 	slot := m.slots[hash%uint64(m.slotn)]
-	items := slot.items
 	slot.mu.Lock()
 	defer slot.mu.Unlock()
-	item, exist = items[key]
-	return
+	if item = m.live(slot, key, m.now()); item != nil {
+		slot.touch(item)
+	}
+	count(&m.counters.cmdGet)
+	hitOrMiss(item != nil, &m.counters.getHits, &m.counters.getMisses)
+	return item, item != nil
+}
+
+// Touch sets a new exptime on the item of key and returns it.
+func (m *Memcached) Touch(key string, exptime int64) (item *Item, exist bool) {
+	slot := m.slots[hash(key)%uint64(m.slotn)]
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if item = m.live(slot, key, m.now()); item != nil {
+		item.exptime = m.realtime(exptime)
+		slot.touch(item)
+	}
+	count(&m.counters.cmdTouch)
+	hitOrMiss(item != nil, &m.counters.touchHits, &m.counters.touchMisses)
+	return item, item != nil
 }
 
 func (m *Memcached) Delete(key string) (success bool) {
 	hash := hash(key)
 	slot := m.slots[hash%uint64(m.slotn)]
-	items := slot.items
 	slot.mu.Lock()
 	defer slot.mu.Unlock()
-	_, exist := items[key]
-	if exist {
-		delete(items, key)
+	if item := m.live(slot, key, m.now()); item != nil {
+		m.unlink(slot, item)
 		success = true
 	}
+	hitOrMiss(success, &m.counters.deleteHits, &m.counters.deleteMisses)
 	return
 }
 
+// Incr adds delta to the number stored under key, or subtracts it down to 0
+// when incr is false. A missing key is created with initial when create is
+// set, and reported with ErrKeyNotFound otherwise. Increments wrap at 2^64.
+func (m *Memcached) Incr(key string, delta uint64, incr bool, initial uint64, create bool, exptime int64) (value uint64, cas uint64, err error) {
+	slot := m.slots[hash(key)%uint64(m.slotn)]
+	slot.mu.Lock()
+	var flags uint32
+	realtime := m.realtime(exptime)
+	oldItem := m.live(slot, key, m.now())
+	if incr {
+		hitOrMiss(oldItem != nil, &m.counters.incrHits, &m.counters.incrMisses)
+	} else {
+		hitOrMiss(oldItem != nil, &m.counters.decrHits, &m.counters.decrMisses)
+	}
+	if oldItem != nil {
+		digits := oldItem.Value()[:oldItem.valuelen-2]
+		value, err = strconv.ParseUint(string(digits), 10, 64)
+		if err != nil {
+			slot.mu.Unlock()
+			return 0, 0, errors.ErrNotInteger
+		}
+		if incr {
+			value += delta
+		} else if delta > value {
+			value = 0
+		} else {
+			value -= delta
+		}
+		flags, realtime = oldItem.flags, oldItem.exptime
+	} else if create {
+		value = initial
+	} else {
+		slot.mu.Unlock()
+		return 0, 0, errors.ErrKeyNotFound
+	}
+	digits := strconv.FormatUint(value, 10)
+	item := NewItem(key, flags, realtime, len(digits)+2, atomic.AddUint64(&_g_cas, 1))
+	item.Append([]byte(digits))
+	item.Append(crlf)
+	m.link(slot, item)
+	slot.mu.Unlock()
+	// a value grown by its digits, or a created one, counts against the limit
+	m.reclaim(item._hash%uint64(m.slotn), item)
+	return value, item.cas, nil
+}
+
+// Flush removes every item.
+func (m *Memcached) Flush() {
+	for _, slot := range m.slots {
+		slot.mu.Lock()
+		for _, item := range slot.items {
+			m.unlink(slot, item)
+		}
+		slot.mu.Unlock()
+	}
+}
+
+// FlushAfter removes every item once delay, an exptime of the protocol, has
+// passed. Items stored meanwhile are removed too, and a later flush replaces a
+// pending one.
+func (m *Memcached) FlushAfter(delay int64) {
+	count(&m.counters.cmdFlush)
+	var d time.Duration
+	if delay > 0 {
+		d = time.Duration(int64(m.realtime(delay))-m.now()) * time.Second
+	}
+	if d <= 0 {
+		m.Flush()
+	}
+	m.el.AsyncExecute(func() {
+		if m.flushTimer != nil {
+			m.flushTimer.Cancel()
+			m.flushTimer = nil
+		}
+		if d > 0 {
+			m.flushTimer = m.el.ScheduleDelay(func() {
+				m.flushTimer = nil
+				m.Flush()
+			}, d)
+		}
+	})
+}
+
 func (m *Memcached) onConn(conn *muduo.TcpConn) {
 	if conn.IsConnected() {
-		sess := NewSession(m, conn)
 		m.mu.Lock()
-		defer m.mu.Unlock()
+		if m.maxConns > 0 && len(m.sessions) >= m.maxConns {
+			m.mu.Unlock()
+			count(&m.counters.rejectedConns)
+			_, _ = conn.Write([]byte("ERROR Too many open connections\r\n"))
+			conn.ShutdownWrite()
+			return
+		}
+		sess := NewSession(m, conn)
+		conn.SetContext(sess)
 		util.Assert(m.sessions[conn.Name()] == nil, "m.sessions[conn.Name()] == nil")
 		m.sessions[conn.Name()] = sess
+		m.mu.Unlock()
+		count(&m.counters.totalConns)
+		if m.verbose(1) {
+			logging.Infof("new connection %s from %s", conn.Name(), conn.GetPeerAddr())
+		}
 	} else {
+		sess, ok := conn.GetContext().(*Session)
+		if !ok {
+			return
+		}
+		if m.verbose(1) {
+			logging.Infof("connection %s closed", conn.Name())
+		}
 		m.mu.Lock()
 		defer m.mu.Unlock()
+		m.reqProcessed += atomic.LoadUint64(&sess.reqProcessed)
+		m.bytesRead += atomic.LoadUint64(&sess.bytesRead)
 		delete(m.sessions, conn.Name())
 	}
 }
+
+func (m *Memcached) onMsg(conn *muduo.TcpConn, buf *muduo.Buffer, t time.Time) {
+	if sess, ok := conn.GetContext().(*Session); ok {
+		sess.OnMsg(conn, buf, t)
+	} else {
+		// a rejected connection, waiting to be closed
+		buf.Reset(0)
+	}
+}
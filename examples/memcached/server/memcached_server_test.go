@@ -0,0 +1,422 @@
+package memcached_server
+
+import (
+	"encoding/binary"
+	"muduo"
+	"muduo/internal/muduotest"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer runs a memcached on a loopback port with a fake clock, so that
+// expiry is driven by the test. It is shut down when the test ends.
+func startServer(t *testing.T, opts ...Option) (*Memcached, *muduo.FakeClock, <-chan struct{}) {
+	t.Helper()
+	el, clock := muduotest.FakeLoop("memcached-test")
+	m, err := NewMemcached(el, append([]Option{WithHost("127.0.0.1"), WithPort(0), WithEngineCnt(2)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	done := muduotest.RunLoop(t, el, func() { m.Shutdown(100 * time.Millisecond) })
+	return m, clock, done
+}
+
+// drain returns once the tasks queued on el so far have run.
+func drain(el *muduo.Eventloop) {
+	done := make(chan struct{})
+	el.AsyncExecute(func() { close(done) })
+	<-done
+}
+
+// client speaks the text protocol to the server.
+type client struct {
+	*muduotest.TextConn
+	t *testing.T
+}
+
+func dial(t *testing.T, m *Memcached) *client {
+	t.Helper()
+	return &client{TextConn: muduotest.DialText(t, m.Addr()), t: t}
+}
+
+// stats returns the statistics of "stats <group>" by name.
+func (c *client) stats(group string) map[string]string {
+	c.t.Helper()
+	c.Send(strings.TrimSpace("stats "+group) + "\r\n")
+	stats := make(map[string]string)
+	for {
+		line := c.Line()
+		if line == "END" {
+			return stats
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			c.t.Fatalf("bad stat line %q", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+}
+
+func TestStorageCommands(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set k 5 0 3\r\nabc\r\n", "STORED")
+	c.Do("get k\r\n", "VALUE k 5 3", "abc", "END")
+	c.Do("add k 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.Do("add n 0 0 1\r\nx\r\n", "STORED")
+	c.Do("replace nope 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.Do("replace n 7 0 1\r\ny\r\n", "STORED")
+	c.Do("append k 9 0 2\r\nde\r\n", "STORED")
+	c.Do("prepend k 9 0 2\r\n01\r\n", "STORED")
+	c.Do("append nope 0 0 1\r\nx\r\n", "NOT_STORED")
+	c.Do("get k n nope\r\n", "VALUE k 5 7", "01abcde", "VALUE n 7 1", "y", "END")
+	c.Do("set empty 0 0 0\r\n\r\n", "STORED")
+	c.Do("get empty\r\n", "VALUE empty 0 0", "", "END")
+}
+
+func TestCas(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set k 0 0 1\r\na\r\n", "STORED")
+	c.Send("gets k\r\n")
+	fields := strings.Fields(c.Line())
+	c.Expect("a", "END")
+	if len(fields) != 5 {
+		t.Fatalf("gets returned %v", fields)
+	}
+	cas := fields[4]
+	c.Do("cas k 0 0 1 "+cas+"\r\nb\r\n", "STORED")
+	c.Do("cas k 0 0 1 "+cas+"\r\nc\r\n", "EXISTS")
+	c.Do("cas nope 0 0 1 "+cas+"\r\nc\r\n", "NOT_FOUND")
+	c.Do("get k\r\n", "VALUE k 0 1", "b", "END")
+	stats := c.stats("")
+	if stats["cas_hits"] != "1" || stats["cas_badval"] != "1" || stats["cas_misses"] != "1" {
+		t.Fatalf("cas stats %v %v %v", stats["cas_hits"], stats["cas_badval"], stats["cas_misses"])
+	}
+}
+
+func TestDelete(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set k 0 0 1\r\na\r\n", "STORED")
+	c.Do("delete k\r\n", "DELETED")
+	c.Do("delete k\r\n", "NOT_FOUND")
+	c.Do("set k 0 0 1\r\na\r\n", "STORED")
+	c.Do("delete k 0\r\n", "DELETED")
+	c.Do("delete k 10\r\n", "CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]")
+	c.Do("delete\r\n", "ERROR")
+	c.Do("get k\r\n", "END")
+}
+
+func TestIncrDecr(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set n 3 0 2\r\n10\r\n", "STORED")
+	c.Do("incr n 5\r\n", "15")
+	c.Do("decr n 6\r\n", "9")
+	c.Do("decr n 100\r\n", "0")
+	c.Do("set n 3 0 20\r\n18446744073709551615\r\n", "STORED")
+	c.Do("incr n 2\r\n", "1")
+	c.Do("get n\r\n", "VALUE n 3 1", "1", "END")
+	c.Do("incr nope 1\r\n", "NOT_FOUND")
+	c.Do("decr nope 1\r\n", "NOT_FOUND")
+	c.Do("incr n -1\r\n", "CLIENT_ERROR invalid numeric delta argument")
+	c.Do("incr n\r\n", "ERROR")
+	c.Do("set s 0 0 3\r\nabc\r\n", "STORED")
+	c.Do("incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value")
+}
+
+func TestExpiry(t *testing.T) {
+	m, clock, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set k 0 10 1\r\na\r\n", "STORED")
+	c.Do("set abs 0 "+strconv.FormatInt(clock.Now().Unix()+5, 10)+" 1\r\nb\r\n", "STORED")
+	c.Do("set past 0 -1 1\r\nc\r\n", "STORED")
+	c.Do("get k abs past\r\n", "VALUE k 0 1", "a", "VALUE abs 0 1", "b", "END")
+	clock.Advance(5 * time.Second)
+	c.Do("get k abs\r\n", "VALUE k 0 1", "a", "END")
+	clock.Advance(5 * time.Second)
+	c.Do("get k\r\n", "END")
+	if stats := c.stats(""); stats["get_expired"] == "0" {
+		t.Fatal("get_expired is 0")
+	}
+}
+
+func TestTouchAndGat(t *testing.T) {
+	m, clock, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set k 1 10 1\r\na\r\n", "STORED")
+	c.Do("touch k 100\r\n", "TOUCHED")
+	c.Do("touch nope 100\r\n", "NOT_FOUND")
+	c.Do("touch k\r\n", "CLIENT_ERROR bad command line format")
+	clock.Advance(50 * time.Second)
+	c.Do("gat 0 k nope\r\n", "VALUE k 1 1", "a", "END")
+	clock.Advance(time.Hour)
+	c.Send("gats 1 k\r\n")
+	if fields := strings.Fields(c.Line()); len(fields) != 5 || fields[1] != "k" {
+		t.Fatalf("gats returned %v", fields)
+	}
+	c.Expect("a", "END")
+	clock.Advance(time.Second)
+	c.Do("get k\r\n", "END")
+	c.Do("gat\r\n", "ERROR")
+	c.Do("gat x k\r\n", "CLIENT_ERROR invalid exptime argument")
+}
+
+func TestFlushAll(t *testing.T) {
+	m, clock, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set a 0 0 1\r\na\r\n", "STORED")
+	c.Do("flush_all\r\n", "OK")
+	c.Do("get a\r\n", "END")
+	c.Do("set a 0 0 1\r\na\r\n", "STORED")
+	c.Do("flush_all 10\r\n", "OK")
+	drain(m.el)
+	c.Do("get a\r\n", "VALUE a 0 1", "a", "END")
+	clock.Advance(10 * time.Second)
+	c.Do("get a\r\n", "END")
+	c.Do("flush_all x\r\n", "CLIENT_ERROR bad command line format")
+}
+
+func TestNoreply(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Send("set k 0 0 1 noreply\r\na\r\n")
+	c.Send("add k 0 0 1 noreply\r\nb\r\n")
+	c.Send("replace k 0 0 1 noreply\r\nc\r\n")
+	c.Send("append k 0 0 1 noreply\r\nd\r\n")
+	c.Send("prepend k 0 0 1 noreply\r\ne\r\n")
+	c.Send("set n 0 0 1 noreply\r\n1\r\n")
+	c.Send("incr n 5 noreply\r\n")
+	c.Send("decr n 1 noreply\r\n")
+	c.Send("touch k 100 noreply\r\n")
+	c.Send("delete nope noreply\r\n")
+	c.Send("verbosity 0 noreply\r\n")
+	c.Do("get k n\r\n", "VALUE k 0 3", "ecd", "VALUE n 0 1", "5", "END")
+	c.Send("flush_all noreply\r\n")
+	c.Do("get k\r\n", "END")
+}
+
+func TestOversizedValue(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set big 0 0 1\r\na\r\n", "STORED")
+	value := strings.Repeat("x", 1024*1024+1)
+	c.Do("set big 0 0 "+strconv.Itoa(len(value))+"\r\n"+value+"\r\n", "SERVER_ERROR object too large for cache")
+	c.Do("get big\r\n", "END")
+	value = strings.Repeat("y", 1024*1024)
+	c.Do("set big 0 0 "+strconv.Itoa(len(value))+"\r\n"+value+"\r\n", "STORED")
+	c.Do("get big\r\n", "VALUE big 0 1048576", value, "END")
+}
+
+func TestBadDataChunk(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set k 0 0 1\r\nabc\r\n", "CLIENT_ERROR bad data chunk", "ERROR")
+	c.Do("get k\r\n", "END")
+	c.Do("version\r\n", "VERSION "+version)
+}
+
+func TestBadCommandLines(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("\r\n", "ERROR")
+	c.Do("bogus\r\n", "ERROR")
+	c.Do("set k\r\n", "ERROR")
+	c.Do("cas k 0 0 1\r\n", "ERROR")
+	c.Do("set k x 0 1\r\n", "CLIENT_ERROR bad command line format")
+	c.Do("set k 0 0 -1\r\n", "CLIENT_ERROR bad command line format")
+	long := strings.Repeat("k", 251)
+	c.Do("set "+long+" 0 0 1\r\n", "CLIENT_ERROR bad command line format")
+	c.Do("get "+long+"\r\n", "CLIENT_ERROR bad command line format")
+	c.Do("version\r\n", "VERSION "+version)
+}
+
+func TestStats(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("set a 0 0 1\r\na\r\n", "STORED")
+	c.Do("get a b\r\n", "VALUE a 0 1", "a", "END")
+	stats := c.stats("")
+	for name, want := range map[string]string{
+		"version":          version,
+		"curr_connections": "1",
+		"cmd_get":          "2",
+		"cmd_set":          "1",
+		"get_hits":         "1",
+		"get_misses":       "1",
+		"curr_items":       "1",
+		"bytes":            strconv.Itoa(1 + 1 + 2 + itemOverhead),
+		"limit_maxbytes":   strconv.Itoa(64 << 20),
+	} {
+		if stats[name] != want {
+			t.Errorf("stat %s is %q, want %q", name, stats[name], want)
+		}
+	}
+	if stats["requests_processed"] != "3" {
+		t.Errorf("requests_processed is %q", stats["requests_processed"])
+	}
+	class := strconv.Itoa(slabClass(1+1+2+itemOverhead) + 1)
+	items := c.stats("items")
+	if items["items:"+class+":number"] != "1" {
+		t.Errorf("stats items %v", items)
+	}
+	slabs := c.stats("slabs")
+	if slabs[class+":used_chunks"] != "1" || slabs["active_slabs"] != "1" {
+		t.Errorf("stats slabs %v", slabs)
+	}
+	c.Do("stats bogus\r\n", "ERROR")
+}
+
+func TestVerbosity(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Do("verbosity 2\r\n", "OK")
+	c.Do("get a\r\n", "END")
+	c.Do("verbosity 0\r\n", "OK")
+	c.Do("verbosity\r\n", "ERROR")
+	c.Do("verbosity x\r\n", "CLIENT_ERROR bad command line format")
+}
+
+func TestMemoryLimit(t *testing.T) {
+	m, _, _ := startServer(t, WithMemoryLimit(10*(itemOverhead+16)))
+	c := dial(t, m)
+	for i := 0; i < 20; i++ {
+		c.Do("set key"+strconv.Itoa(i)+" 0 0 8\r\n01234567\r\n", "STORED")
+		c.Do("get key0\r\n", "VALUE key0 0 8", "01234567", "END")
+	}
+	c.Do("get key0 key19\r\n", "VALUE key0 0 8", "01234567", "VALUE key19 0 8", "01234567", "END")
+	c.Do("get key1\r\n", "END")
+	stats := c.stats("")
+	if stats["evictions"] == "0" {
+		t.Fatal("nothing was evicted")
+	}
+	if used, _ := strconv.Atoi(stats["bytes"]); used > 10*(itemOverhead+16) {
+		t.Fatalf("%d bytes used over the limit", used)
+	}
+}
+
+func TestMemoryLimitIncr(t *testing.T) {
+	m, _, _ := startServer(t, WithMemoryLimit(10*(itemOverhead+16)))
+	c := dial(t, m)
+	// ten small counters fit, grown to 19 digits they do not
+	for i := 0; i < 10; i++ {
+		c.Do("set key"+strconv.Itoa(i)+" 0 0 1\r\n0\r\n", "STORED")
+	}
+	if stats := c.stats(""); stats["evictions"] != "0" {
+		t.Fatalf("%s evictions before incr", stats["evictions"])
+	}
+	for i := 0; i < 10; i++ {
+		// a counter yet to grow may be evicted by the growth of another
+		c.Send("incr key" + strconv.Itoa(i) + " 1000000000000000000\r\n")
+		if got := c.Line(); got != "1000000000000000000" && got != "NOT_FOUND" {
+			t.Fatalf("incr key%d: %q", i, got)
+		}
+	}
+	c.Do("get key9\r\n", "VALUE key9 0 19", "1000000000000000000", "END")
+	stats := c.stats("")
+	if stats["evictions"] == "0" {
+		t.Fatal("nothing was evicted")
+	}
+	if used, _ := strconv.Atoi(stats["bytes"]); used > 10*(itemOverhead+16) {
+		t.Fatalf("%d bytes used over the limit", used)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	m, _, _ := startServer(t, WithMaxConns(1))
+	c := dial(t, m)
+	c.Do("version\r\n", "VERSION "+version)
+	rejected := dial(t, m)
+	rejected.Expect("ERROR Too many open connections")
+	rejected.ExpectEOF()
+	c.Do("version\r\n", "VERSION "+version)
+}
+
+func TestQuit(t *testing.T) {
+	m, _, _ := startServer(t)
+	c := dial(t, m)
+	c.Send("set k 0 0 1\r\na\r\nquit\r\nget k\r\n")
+	c.Expect("STORED")
+	c.ExpectEOF()
+}
+
+func TestShutdown(t *testing.T) {
+	m, _, done := startServer(t)
+	c := dial(t, m)
+	c.Send("shutdown\r\n")
+	c.ExpectEOF()
+	_ = c.Conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running")
+	}
+}
+
+func TestUDP(t *testing.T) {
+	m, _, _ := startServer(t, WithUDPPort(0))
+	conn, err := net.Dial("udp", m.UDPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := func(id uint16, req string) string {
+		t.Helper()
+		frame := make([]byte, udpHeaderLen, udpHeaderLen+len(req))
+		binary.BigEndian.PutUint16(frame, id)
+		binary.BigEndian.PutUint16(frame[4:], 1)
+		if _, err := conn.Write(append(frame, req...)); err != nil {
+			t.Fatal(err)
+		}
+		parts := make(map[uint16]string)
+		buf := make([]byte, udpMaxDatagram)
+		for total := 1; len(parts) < total; {
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if binary.BigEndian.Uint16(buf) != id {
+				t.Fatalf("response to request %d", binary.BigEndian.Uint16(buf))
+			}
+			total = int(binary.BigEndian.Uint16(buf[4:]))
+			parts[binary.BigEndian.Uint16(buf[2:])] = string(buf[udpHeaderLen:n])
+		}
+		var res strings.Builder
+		for seq := 0; seq < len(parts); seq++ {
+			res.WriteString(parts[uint16(seq)])
+		}
+		return res.String()
+	}
+	if res := request(1, "set k 0 0 3\r\nabc\r\n"); res != "STORED\r\n" {
+		t.Fatalf("set returned %q", res)
+	}
+	if res := request(2, "get k\r\n"); res != "VALUE k 0 3\r\nabc\r\nEND\r\n" {
+		t.Fatalf("get returned %q", res)
+	}
+	value := strings.Repeat("v", 5000)
+	if res := request(3, "set big 0 0 5000\r\n"+value+"\r\n"); res != "STORED\r\n" {
+		t.Fatalf("set returned %q", res)
+	}
+	if res := request(4, "get big\r\n"); res != "VALUE big 0 5000\r\n"+value+"\r\nEND\r\n" {
+		t.Fatalf("get returned %d bytes", len(res))
+	}
+}
+
+func TestUDPBindFailed(t *testing.T) {
+	taken, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+	el := muduo.NewEventloop("memcached-test")
+	if _, err := NewMemcached(el, WithHost("127.0.0.1"), WithPort(0), WithUDPPort(port)); err == nil {
+		t.Fatal("NewMemcached bound a UDP port in use")
+	}
+}
@@ -3,9 +3,11 @@ package memcached_server
 import (
 	"bytes"
 	"muduo"
+	"muduo/pkg/errors"
 	"muduo/pkg/logging"
 	"muduo/pkg/util"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,8 +39,9 @@ type Session struct {
 	bytesToDiscard uint64
 	needle         *Item
 	outputBuffer   *muduo.Buffer
-	bytesRead      uint64
-	reqProcessed   uint64
+	bytesRead      uint64 // atomic, Stats reads it
+	reqProcessed   uint64 // atomic, Stats reads it
+	closing        bool
 }
 
 var LongestKeySize = 250
@@ -49,7 +52,7 @@ func NewSession(m *Memcached, conn *muduo.TcpConn) *Session {
 		m:              m,
 		conn:           conn,
 		state:          NewCommand,
-		protocol:       Ascii,
+		protocol:       m.protocol,
 		noreply:        false,
 		policy:         Invalid,
 		bytesToDiscard: 0,
@@ -62,10 +65,10 @@ func NewSession(m *Memcached, conn *muduo.TcpConn) *Session {
 
 func (s *Session) OnMsg(conn *muduo.TcpConn, buf *muduo.Buffer, t time.Time) {
 	initialReadable := buf.ReadableBytes()
-	for buf.ReadableBytes() > 0 {
+	for buf.ReadableBytes() > 0 && !s.closing {
 		if s.state == NewCommand {
 			if s.protocol == Auto {
-				util.Assert(s.bytesRead == 0, "bytesRead should be zero")
+				util.Assert(atomic.LoadUint64(&s.bytesRead) == 0, "bytesRead should be zero")
 				if IsBinaryProtocol(buf.Peek()[0]) {
 					s.protocol = Binary
 				} else {
@@ -75,7 +78,7 @@ func (s *Session) OnMsg(conn *muduo.TcpConn, buf *muduo.Buffer, t time.Time) {
 			util.Assert(s.protocol == Ascii || s.protocol == Binary, "protocol should be ascii or binary")
 			if s.protocol == Ascii {
 				search := buf.Search(util.CRLF)
-				if search > 0 {
+				if search >= 0 {
 					data := buf.Peek()[:search]
 					// TODO process ascii command
 					if s.processRequest(data) {
@@ -84,10 +87,12 @@ func (s *Session) OnMsg(conn *muduo.TcpConn, buf *muduo.Buffer, t time.Time) {
 					buf.Advance(search + len(util.CRLF))
 				} else {
 					if buf.ReadableBytes() > 1024 {
-						conn.ShutdownWrite()
+						s.quit()
 					}
 					break
 				}
+			} else if !s.processBinary(buf) {
+				break
 			}
 		} else if s.state == RecvValue {
 			s.recvValue(buf)
@@ -97,7 +102,33 @@ func (s *Session) OnMsg(conn *muduo.TcpConn, buf *muduo.Buffer, t time.Time) {
 			util.Assert(false, "invalid state")
 		}
 	}
-	s.bytesRead += uint64(initialReadable - buf.ReadableBytes())
+	atomic.AddUint64(&s.bytesRead, uint64(initialReadable-buf.ReadableBytes()))
+	s.flush()
+}
+
+// flush writes the buffered responses. A session serving a UDP datagram has no
+// conn, its responses stay buffered for the datagram reply.
+func (s *Session) flush() {
+	if s.conn != nil && s.outputBuffer.ReadableBytes() > 0 {
+		_, _ = s.conn.Write(s.outputBuffer.Next(-1))
+	}
+}
+
+// quit stops reading requests and closes the connection after the pending
+// responses.
+func (s *Session) quit() {
+	s.flush()
+	s.closing = true
+	if s.conn != nil {
+		s.conn.ShutdownWrite()
+	}
+}
+
+func (s *Session) name() string {
+	if s.conn == nil {
+		return "udp"
+	}
+	return s.conn.Name()
 }
 
 func (s *Session) recvValue(buf *muduo.Buffer) {
@@ -153,7 +184,10 @@ func (s *Session) processRequest(buf []byte) bool {
 	util.Assert(s.policy == Invalid, "policy should be invalid")
 	util.Assert(s.currItem == nil, "currItem should be nil")
 	util.Assert(s.bytesToDiscard == 0, "bytesToDiscard should be zero")
-	s.reqProcessed++
+	atomic.AddUint64(&s.reqProcessed, 1)
+	if s.m.verbose(2) {
+		logging.Infof("<%s %s", s.name(), buf)
+	}
 	bufLen := len(buf)
 	if bufLen >= 8 {
 		if string(buf[bufLen-8:]) == " noreply" {
@@ -189,20 +223,34 @@ func (s *Session) processRequest(buf []byte) bool {
 			}
 		}
 		_, _ = s.outputBuffer.Write([]byte("END\r\n"))
-		if s.conn.GetOutboundBuffer().WritableBytes() > 65536+s.outputBuffer.ReadableBytes() {
-			logging.Debugf("shrink output buffer from %d to %d", s.outputBuffer.Capacity(), 65536+s.outputBuffer.ReadableBytes())
-			s.outputBuffer.Shrink(65536 + s.outputBuffer.ReadableBytes())
+		if s.conn != nil {
+			if s.conn.GetOutboundBuffer().WritableBytes() > 65536+s.outputBuffer.ReadableBytes() {
+				logging.Debugf("shrink output buffer from %d to %d", s.outputBuffer.Capacity(), 65536+s.outputBuffer.ReadableBytes())
+				s.outputBuffer.Shrink(65536 + s.outputBuffer.ReadableBytes())
+			}
+			s.flush()
 		}
-		_, _ = s.conn.Write(s.outputBuffer.Next(-1))
+	case "gat", "gats":
+		s.DoGat(tokens[idx:])
+	case "touch":
+		s.DoTouch(tokens[idx:])
 	case "delete":
 		s.DoDelete(tokens[idx:])
+	case "incr", "decr":
+		s.DoIncr(tokens[idx:])
+	case "flush_all":
+		s.DoFlush(tokens[idx:])
+	case "stats":
+		s.DoStats(tokens[idx:])
+	case "verbosity":
+		s.DoVerbosity(tokens[idx:])
 	case "version":
-		s.Replay([]byte("VERSION 0.0.1 muduo\r\n"))
+		s.Replay([]byte("VERSION " + version + "\r\n"))
 	case "quit":
-		s.conn.ShutdownWrite()
+		s.quit()
 	case "shutdown":
-		s.conn.ShutdownWrite()
-		// TODO s.m.Stop()
+		s.quit()
+		s.m.Shutdown(shutdownTimeout)
 	default:
 		s.Replay([]byte("ERROR\r\n"))
 		logging.Errorf("Unknown command: %s", s.command)
@@ -235,6 +283,14 @@ func (s *Session) DoUpdate(tokens [][]byte) bool {
 	default:
 		util.Assert(false, "invalid policy")
 	}
+	argc := 4
+	if s.policy == Cas {
+		argc = 5
+	}
+	if len(tokens) != argc {
+		s.Replay([]byte("ERROR\r\n"))
+		return true
+	}
 
 	idx := 0
 	key := tokens[idx]
@@ -248,14 +304,8 @@ func (s *Session) DoUpdate(tokens [][]byte) bool {
 	b, e3 := strconv.ParseInt(string(tokens[idx]), 10, 32)
 	idx++
 
-	good = good && e1 == nil && e2 == nil && e3 == nil
+	good = good && e1 == nil && e2 == nil && e3 == nil && b >= 0
 
-	if exptime > 60*60*24*30 {
-		exptime = exptime - s.m.startTime().UnixMilli()
-		if exptime < 1 {
-			exptime = 1
-		}
-	}
 	var cas uint64
 	var e4 error
 	if good && s.policy == Cas {
@@ -275,24 +325,26 @@ func (s *Session) DoUpdate(tokens [][]byte) bool {
 		s.m.Delete(string(key))
 		s.bytesToDiscard = uint64(b + 2)
 		s.state = DiscardValue
-		return true
+		return false
 	} else {
-		s.currItem = NewItem(string(key), uint32(flags), int(exptime), int(b)+2, cas)
+		s.currItem = NewItem(string(key), uint32(flags), s.m.realtime(exptime), int(b)+2, cas)
 		s.state = RecvValue
 		return false
 	}
 }
 
 func (s *Session) DoDelete(tokens [][]byte) {
-	idx := 0
-	key := tokens[idx]
-	idx++
+	if len(tokens) == 0 {
+		s.Replay([]byte("ERROR\r\n"))
+		return
+	}
+	key := tokens[0]
 	good := len(key) <= 250
 	if !good {
 		s.Replay([]byte("CLIENT_ERROR bad command line format\r\n"))
 		return
-	} else if idx >= len(tokens) && string(tokens[idx]) != "0" {
-		s.Replay([]byte("CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]\\r\\n"))
+	} else if len(tokens) > 2 || (len(tokens) == 2 && string(tokens[1]) != "0") {
+		s.Replay([]byte("CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]\r\n"))
 		return
 	} else {
 		s.needle.ResetKey(key)
@@ -305,9 +357,131 @@ func (s *Session) DoDelete(tokens [][]byte) {
 
 }
 
+// DoGat handles "gat <exptime> <key>*" and "gats", a get that also sets a new
+// exptime on the items it finds.
+func (s *Session) DoGat(tokens [][]byte) {
+	if len(tokens) < 2 {
+		s.Replay([]byte("ERROR\r\n"))
+		return
+	}
+	exptime, err := strconv.ParseInt(string(tokens[0]), 10, 64)
+	if err != nil {
+		s.Replay([]byte("CLIENT_ERROR invalid exptime argument\r\n"))
+		return
+	}
+	cas := s.command == "gats"
+	for _, key := range tokens[1:] {
+		if len(key) > 250 {
+			s.Replay([]byte("CLIENT_ERROR bad command line format\r\n"))
+			return
+		}
+		if item, ok := s.m.Touch(string(key), exptime); ok {
+			item.Output(s.outputBuffer, cas)
+		}
+	}
+	s.Replay([]byte("END\r\n"))
+}
+
+// DoTouch handles "touch <key> <exptime> [noreply]".
+func (s *Session) DoTouch(tokens [][]byte) {
+	if len(tokens) != 2 || len(tokens[0]) > 250 {
+		s.Replay([]byte("CLIENT_ERROR bad command line format\r\n"))
+		return
+	}
+	exptime, err := strconv.ParseInt(string(tokens[1]), 10, 64)
+	if err != nil {
+		s.Replay([]byte("CLIENT_ERROR invalid exptime argument\r\n"))
+		return
+	}
+	if _, ok := s.m.Touch(string(tokens[0]), exptime); ok {
+		s.Replay([]byte("TOUCHED\r\n"))
+	} else {
+		s.Replay([]byte("NOT_FOUND\r\n"))
+	}
+}
+
+// DoFlush handles "flush_all [delay] [noreply]".
+func (s *Session) DoFlush(tokens [][]byte) {
+	var delay int64
+	if len(tokens) > 1 {
+		s.Replay([]byte("CLIENT_ERROR bad command line format\r\n"))
+		return
+	}
+	if len(tokens) == 1 {
+		var err error
+		if delay, err = strconv.ParseInt(string(tokens[0]), 10, 64); err != nil {
+			s.Replay([]byte("CLIENT_ERROR bad command line format\r\n"))
+			return
+		}
+	}
+	s.m.FlushAfter(delay)
+	s.Replay([]byte("OK\r\n"))
+}
+
+// DoIncr handles "incr <key> <delta> [noreply]" and "decr". Increments wrap
+// at 2^64, decrements stop at 0.
+func (s *Session) DoIncr(tokens [][]byte) {
+	if len(tokens) != 2 {
+		s.Replay([]byte("ERROR\r\n"))
+		return
+	}
+	if len(tokens[0]) > 250 {
+		s.Replay([]byte("CLIENT_ERROR bad command line format\r\n"))
+		return
+	}
+	delta, err := strconv.ParseUint(string(tokens[1]), 10, 64)
+	if err != nil {
+		s.Replay([]byte("CLIENT_ERROR invalid numeric delta argument\r\n"))
+		return
+	}
+	value, _, err := s.m.Incr(string(tokens[0]), delta, s.command == "incr", 0, false, 0)
+	switch err {
+	case nil:
+		s.Replay([]byte(strconv.FormatUint(value, 10) + "\r\n"))
+	case errors.ErrKeyNotFound:
+		s.Replay([]byte("NOT_FOUND\r\n"))
+	default:
+		s.Replay([]byte("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"))
+	}
+}
+
+// DoStats handles "stats [items|slabs]".
+func (s *Session) DoStats(tokens [][]byte) {
+	var group string
+	if len(tokens) > 0 {
+		group = string(tokens[0])
+	}
+	stats, ok := s.m.StatGroup(group)
+	if !ok || len(tokens) > 1 {
+		s.Replay([]byte("ERROR\r\n"))
+		return
+	}
+	for _, st := range stats {
+		s.Replay([]byte("STAT " + st.Name + " " + st.Value + "\r\n"))
+	}
+	s.Replay([]byte("END\r\n"))
+}
+
+// DoVerbosity handles "verbosity <level> [noreply]".
+func (s *Session) DoVerbosity(tokens [][]byte) {
+	if len(tokens) != 1 {
+		s.Replay([]byte("ERROR\r\n"))
+		return
+	}
+	level, err := strconv.Atoi(string(tokens[0]))
+	if err != nil {
+		s.Replay([]byte("CLIENT_ERROR bad command line format\r\n"))
+		return
+	}
+	s.m.SetVerbosity(level)
+	s.Replay([]byte("OK\r\n"))
+}
+
+// Replay queues msg behind the responses of earlier requests, OnMsg writes
+// them once the input is drained.
 func (s *Session) Replay(msg []byte) {
 	if !s.noreply {
-		_ = s.conn.AsyncWrite(msg, nil)
+		_, _ = s.outputBuffer.Write(msg)
 	}
 }
 
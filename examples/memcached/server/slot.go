@@ -0,0 +1,148 @@
+package memcached_server
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// itemOverhead approximates what an item costs besides its key and value: the
+// Item itself, its map entry and its LRU element.
+const itemOverhead = 96
+
+// maxRelativeExptime is the largest exptime taken as seconds from now, larger
+// ones are unix times.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+// sweepInterval is how often a few slots are swept for expired items.
+const sweepInterval = 100 * time.Millisecond
+
+// sweepSlots is how many slots a sweep looks at.
+const sweepSlots = 16
+
+// slot is a shard of the cache with its own lock and LRU list, most recently
+// used first.
+type slot struct {
+	items map[string]*Item
+	lru   *list.List
+	mu    sync.Mutex
+}
+
+func newSlot() *slot {
+	return &slot{
+		items: make(map[string]*Item),
+		lru:   list.New(),
+	}
+}
+
+func (it *Item) size() int64 {
+	return int64(len(it.data)) + itemOverhead
+}
+
+func (it *Item) expired(now int64) bool {
+	return it.exptime != 0 && int64(it.exptime) <= now
+}
+
+// now is the current unix time in seconds, on the server loop's clock.
+func (m *Memcached) now() int64 {
+	return m.el.Now().Unix()
+}
+
+// realtime turns an exptime of the protocol into a unix time, 0 means never.
+// Up to 30 days it counts from now, beyond it is a unix time already, and a
+// negative exptime has expired.
+func (m *Memcached) realtime(exptime int64) int {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return 1
+	case exptime > maxRelativeExptime:
+		return int(exptime)
+	}
+	return int(m.now() + exptime)
+}
+
+// live returns the item of key unless it expired, expired items are unlinked
+// on the way. The slot must be locked.
+func (m *Memcached) live(s *slot, key string, now int64) *Item {
+	it, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if it.expired(now) {
+		m.unlink(s, it)
+		count(&m.counters.reclaimed[slabClass(it.size())])
+		count(&m.counters.getExpired)
+		return nil
+	}
+	return it
+}
+
+// link stores it in the slot as the most recently used item, replacing the
+// item of the same key. The slot must be locked.
+func (m *Memcached) link(s *slot, it *Item) {
+	key := string(it.Key())
+	if old, ok := s.items[key]; ok {
+		m.unlink(s, old)
+	}
+	s.items[key] = it
+	it.elem = s.lru.PushFront(it)
+	atomic.AddInt64(&m.used, it.size())
+}
+
+// unlink removes it from the slot. The slot must be locked.
+func (m *Memcached) unlink(s *slot, it *Item) {
+	delete(s.items, string(it.Key()))
+	s.lru.Remove(it.elem)
+	it.elem = nil
+	atomic.AddInt64(&m.used, -it.size())
+}
+
+// touch marks it as the most recently used. The slot must be locked.
+func (s *slot) touch(it *Item) {
+	s.lru.MoveToFront(it.elem)
+}
+
+// reclaim evicts least recently used items while the cache is over its memory
+// limit: first from the slot that just grew, sparing keep, the item stored
+// there, then from the slots after it. An item larger than the limit evicts
+// everything else and stays.
+func (m *Memcached) reclaim(start uint64, keep *Item) {
+	for i := 0; i < m.slotn && atomic.LoadInt64(&m.used) > m.limit; i++ {
+		s := m.slots[(int(start)+i)%m.slotn]
+		s.mu.Lock()
+		for atomic.LoadInt64(&m.used) > m.limit {
+			e := s.lru.Back()
+			if e == nil || e.Value.(*Item) == keep {
+				break
+			}
+			it := e.Value.(*Item)
+			m.unlink(s, it)
+			count(&m.counters.evictions[slabClass(it.size())])
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sweep unlinks the expired items of the next few slots, items nobody asks
+// for again would hold their memory until evicted otherwise. It runs on the
+// server loop.
+func (m *Memcached) sweep() {
+	now := m.now()
+	for i := 0; i < sweepSlots; i++ {
+		s := m.slots[m.sweepNext]
+		m.sweepNext = (m.sweepNext + 1) % m.slotn
+		s.mu.Lock()
+		for e := s.lru.Back(); e != nil; {
+			it := e.Value.(*Item)
+			e = e.Prev()
+			if it.expired(now) {
+				m.unlink(s, it)
+				count(&m.counters.reclaimed[slabClass(it.size())])
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,264 @@
+package memcached_server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot file holds every item of the cache:
+//
+//	header:  "MCSNAP" version:uint16
+//	item:    'I' keylen:uint8 flags:uint32 exptime:int64 cas:uint64 valuelen:uint32 key value
+//	trailer: 'E' items:uint64 cas:uint64 crc:uint32
+//
+// Integers are big endian, exptime is a unix time or 0 and cas in the trailer is
+// the global CAS counter once every item was written. crc is the CRC-32 of all
+// the bytes before it, a file without a valid trailer is not loaded.
+const (
+	snapshotMagic   = "MCSNAP"
+	snapshotVersion = 1
+	snapshotItem    = 'I'
+	snapshotEnd     = 'E'
+)
+
+// snapshotTick is how often a snapshot in progress writes the next few slots,
+// and snapshotSlots how many.
+const (
+	snapshotTick  = 10 * time.Millisecond
+	snapshotSlots = 64
+)
+
+// snapshot is a snapshot being written to a temporary file, renamed over the
+// previous one once complete. It is owned by the server loop.
+type snapshot struct {
+	path  string
+	f     *os.File
+	w     *bufio.Writer
+	crc   uint32 // of everything written
+	next  int    // next slot to write
+	items uint64
+	chunk []byte
+}
+
+func newSnapshot(path string) (*snapshot, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{path: path, f: f, w: bufio.NewWriter(f)}
+	header := make([]byte, len(snapshotMagic)+2)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint16(header[len(snapshotMagic):], snapshotVersion)
+	if err = s.write(header); err != nil {
+		s.abort()
+		return nil, err
+	}
+	return s, nil
+}
+
+// writeSlot writes the items of sl, it only holds the slot lock while copying
+// them.
+func (s *snapshot) writeSlot(sl *slot) error {
+	s.chunk = s.chunk[:0]
+	sl.mu.Lock()
+	for _, it := range sl.items {
+		s.chunk = appendItem(s.chunk, it)
+		s.items++
+	}
+	sl.mu.Unlock()
+	return s.write(s.chunk)
+}
+
+func (s *snapshot) write(p []byte) error {
+	s.crc = crc32.Update(s.crc, crc32.IEEETable, p)
+	_, err := s.w.Write(p)
+	return err
+}
+
+func appendItem(b []byte, it *Item) []byte {
+	var fixed [1 + 1 + 4 + 8 + 8 + 4]byte
+	value := it.Value()[:it.valuelen-2]
+	fixed[0] = snapshotItem
+	fixed[1] = byte(it.keylen)
+	binary.BigEndian.PutUint32(fixed[2:], it.flags)
+	binary.BigEndian.PutUint64(fixed[6:], uint64(it.exptime))
+	binary.BigEndian.PutUint64(fixed[14:], it.cas)
+	binary.BigEndian.PutUint32(fixed[22:], uint32(len(value)))
+	b = append(b, fixed[:]...)
+	b = append(b, it.Key()...)
+	return append(b, value...)
+}
+
+// finish writes the trailer and puts the file in place of the previous
+// snapshot.
+func (s *snapshot) finish() error {
+	var trailer [1 + 8 + 8 + 4]byte
+	trailer[0] = snapshotEnd
+	binary.BigEndian.PutUint64(trailer[1:], s.items)
+	binary.BigEndian.PutUint64(trailer[9:], atomic.LoadUint64(&_g_cas))
+	binary.BigEndian.PutUint32(trailer[17:], crc32.Update(s.crc, crc32.IEEETable, trailer[:17]))
+	if _, err := s.w.Write(trailer[:]); err != nil {
+		s.abort()
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.abort()
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		s.abort()
+		return err
+	}
+	if err := s.f.Close(); err != nil {
+		_ = os.Remove(s.f.Name())
+		return err
+	}
+	return os.Rename(s.f.Name(), s.path)
+}
+
+func (s *snapshot) abort() {
+	_ = s.f.Close()
+	_ = os.Remove(s.f.Name())
+}
+
+// snapshotStep runs every snapshotTick on the server loop. It starts a snapshot
+// when one is due and writes the next slots of the one in progress, so a
+// snapshot never holds more than one slot lock nor stalls the loop for long.
+func (m *Memcached) snapshotStep() {
+	if m.snap == nil {
+		if m.el.Now().Before(m.nextSnapshot) {
+			return
+		}
+		snap, err := newSnapshot(m.snapshotPath)
+		if err != nil {
+			logging.Errorf("memcached snapshot %s: %v", m.snapshotPath, err)
+			m.nextSnapshot = m.el.Now().Add(m.snapshotInterval)
+			return
+		}
+		m.snap = snap
+	}
+	end := m.snap.next + snapshotSlots
+	if end > m.slotn {
+		end = m.slotn
+	}
+	m.snapshotSlots(end)
+}
+
+// snapshotSlots writes the slots of the snapshot in progress up to end, and
+// finishes it with the last one.
+func (m *Memcached) snapshotSlots(end int) {
+	snap := m.snap
+	for ; snap.next < end; snap.next++ {
+		if err := snap.writeSlot(m.slots[snap.next]); err != nil {
+			logging.Errorf("memcached snapshot %s: %v", m.snapshotPath, err)
+			snap.abort()
+			m.snap = nil
+			m.nextSnapshot = m.el.Now().Add(m.snapshotInterval)
+			return
+		}
+	}
+	if snap.next < m.slotn {
+		return
+	}
+	m.snap = nil
+	m.nextSnapshot = m.el.Now().Add(m.snapshotInterval)
+	if err := snap.finish(); err != nil {
+		logging.Errorf("memcached snapshot %s: %v", m.snapshotPath, err)
+		return
+	}
+	atomic.AddUint64(&m.counters.snapshots, 1)
+	if m.verbose(1) {
+		logging.Infof("memcached snapshot %s: %d items", m.snapshotPath, snap.items)
+	}
+}
+
+// snapshotNow completes the snapshot in progress, or writes a whole new one. It
+// runs on the server loop.
+func (m *Memcached) snapshotNow() {
+	if m.snap == nil {
+		m.nextSnapshot = time.Time{}
+		m.snapshotStep()
+	}
+	if m.snap != nil {
+		m.snapshotSlots(m.slotn)
+	}
+}
+
+// loadSnapshot stores the items of the snapshot at path, skipping the expired
+// ones, and moves the CAS counter past the one saved. A missing file is an empty
+// cache.
+func (m *Memcached) loadSnapshot(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	header := len(snapshotMagic) + 2
+	const trailer = 1 + 8 + 8 + 4
+	if len(data) < header+trailer || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, errors.ErrBadSnapshot
+	}
+	if binary.BigEndian.Uint16(data[len(snapshotMagic):]) != snapshotVersion {
+		return 0, errors.ErrBadSnapshot
+	}
+	tail := data[len(data)-trailer:]
+	if tail[0] != snapshotEnd || crc32.ChecksumIEEE(data[:len(data)-4]) != binary.BigEndian.Uint32(tail[17:]) {
+		return 0, errors.ErrBadSnapshot
+	}
+	count := binary.BigEndian.Uint64(tail[1:])
+	cas := binary.BigEndian.Uint64(tail[9:])
+
+	// parse everything before storing anything, a file is loaded whole or not at all
+	var items []*Item
+	now := m.now()
+	body := data[header : len(data)-trailer]
+	for n := uint64(0); n < count; n++ {
+		const fixed = 1 + 1 + 4 + 8 + 8 + 4
+		if len(body) < fixed || body[0] != snapshotItem {
+			return 0, errors.ErrBadSnapshot
+		}
+		keylen := int(body[1])
+		flags := binary.BigEndian.Uint32(body[2:])
+		exptime := int64(binary.BigEndian.Uint64(body[6:]))
+		itemCas := binary.BigEndian.Uint64(body[14:])
+		valuelen := int(binary.BigEndian.Uint32(body[22:]))
+		body = body[fixed:]
+		if keylen == 0 || len(body) < keylen+valuelen {
+			return 0, errors.ErrBadSnapshot
+		}
+		key, value := body[:keylen], body[keylen:keylen+valuelen]
+		body = body[keylen+valuelen:]
+		it := NewItem(string(key), flags, int(exptime), valuelen+2, itemCas)
+		if it.expired(now) {
+			continue
+		}
+		it.Append(value)
+		it.Append(crlf)
+		items = append(items, it)
+	}
+	if len(body) != 0 {
+		return 0, errors.ErrBadSnapshot
+	}
+
+	for {
+		old := atomic.LoadUint64(&_g_cas)
+		if old >= cas || atomic.CompareAndSwapUint64(&_g_cas, old, cas) {
+			break
+		}
+	}
+	for _, it := range items {
+		sl := m.slots[it._hash%uint64(m.slotn)]
+		sl.mu.Lock()
+		m.link(sl, it)
+		sl.mu.Unlock()
+	}
+	m.reclaim(0, nil)
+	return len(items), nil
+}
@@ -0,0 +1,102 @@
+package memcached_server
+
+import (
+	"muduo/pkg/errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotWarmRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	m, _, done := startServer(t, WithSnapshot(path, time.Hour))
+	c := dial(t, m)
+	c.Do("set a 3 0 5\r\nhello\r\n", "STORED")
+	c.Do("set b 0 1000 0\r\n\r\n", "STORED")
+	c.Do("set past 0 -1 1\r\nx\r\n", "STORED")
+	c.Send("gets a\r\n")
+	fields := strings.Fields(c.Line())
+	c.Expect("hello", "END")
+	saved, _ := strconv.ParseUint(fields[4], 10, 64)
+	_ = c.Conn.Close()
+	m.Shutdown(100 * time.Millisecond)
+	<-done
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left: %v", err)
+	}
+
+	atomic.StoreUint64(&_g_cas, 0)
+	m, _, _ = startServer(t, WithSnapshot(path, time.Hour))
+	c = dial(t, m)
+	c.Do("gets a\r\n", "VALUE a 3 5 "+fields[4], "hello", "END")
+	c.Do("get b past\r\n", "VALUE b 0 0", "", "END")
+	c.Do("set n 0 0 1\r\n1\r\n", "STORED")
+	c.Send("gets n\r\n")
+	fields = strings.Fields(c.Line())
+	c.Expect("1", "END")
+	if cas, _ := strconv.ParseUint(fields[4], 10, 64); cas <= saved {
+		t.Fatalf("cas %d reused after restart, %d was saved", cas, saved)
+	}
+}
+
+func TestSnapshotIncremental(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	m, clock, _ := startServer(t, WithSnapshot(path, 10*time.Second))
+	c := dial(t, m)
+	for i := 0; i < 100; i++ {
+		c.Do("set key"+strconv.Itoa(i)+" 0 0 1\r\nx\r\n", "STORED")
+	}
+	drain(m.el)
+	clock.Advance(10 * time.Second)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("snapshot written in a single step")
+	}
+	for i := 0; i < m.slotn/snapshotSlots; i++ {
+		clock.Advance(snapshotTick)
+	}
+	if stats := c.stats(""); stats["snapshots"] != "1" {
+		t.Fatalf("%s snapshots written", stats["snapshots"])
+	}
+	c.Do("flush_all\r\n", "OK")
+	if n, err := m.loadSnapshot(path); n != 100 || err != nil {
+		t.Fatalf("loaded %d items, %v", n, err)
+	}
+	c.Do("get key42\r\n", "VALUE key42 0 1", "x", "END")
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	m, _, done := startServer(t, WithSnapshot(path, time.Hour))
+	c := dial(t, m)
+	c.Do("set a 0 0 5\r\nhello\r\n", "STORED")
+	_ = c.Conn.Close()
+	m.Shutdown(100 * time.Millisecond)
+	<-done
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bad := range map[string][]byte{
+		"flipped":   append(append([]byte{}, data[:20]...), append([]byte{data[20] ^ 1}, data[21:]...)...),
+		"truncated": data[:len(data)-1],
+		"empty":     nil,
+	} {
+		if err := os.WriteFile(path, bad, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := m.loadSnapshot(path); err != errors.ErrBadSnapshot {
+			t.Errorf("%s: loaded %d items, %v", name, n, err)
+		}
+	}
+	if err := os.WriteFile(path, data[:len(data)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, _, _ = startServer(t, WithSnapshot(path, time.Hour))
+	c = dial(t, m)
+	c.Do("get a\r\n", "END")
+}
@@ -0,0 +1,224 @@
+package memcached_server
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// maxItemSize is the size of the largest item a client can store.
+const maxItemSize = 1024*1024 + 2 + 250 + itemOverhead
+
+// slabSizes are the size classes "stats items" and "stats slabs" group items
+// by. Items are not allocated from slabs here, the classes only mirror those of
+// memcached with its default growth factor of 1.25 so tools reading them keep
+// working.
+var slabSizes = func() []int64 {
+	var sizes []int64
+	for size := int64(itemOverhead); size < maxItemSize; size = (size*5/4 + 7) &^ 7 {
+		sizes = append(sizes, size)
+	}
+	return append(sizes, maxItemSize)
+}()
+
+// slabClass returns the index of the smallest class an item of size fits in.
+func slabClass(size int64) int {
+	return sort.Search(len(slabSizes), func(i int) bool { return slabSizes[i] >= size })
+}
+
+// counters are the command statistics, all of them atomic.
+type counters struct {
+	cmdGet        uint64
+	cmdSet        uint64
+	cmdTouch      uint64
+	cmdFlush      uint64
+	getHits       uint64
+	getMisses     uint64
+	getExpired    uint64
+	touchHits     uint64
+	touchMisses   uint64
+	deleteHits    uint64
+	deleteMisses  uint64
+	incrHits      uint64
+	incrMisses    uint64
+	decrHits      uint64
+	decrMisses    uint64
+	casHits       uint64
+	casMisses     uint64
+	casBadval     uint64
+	totalConns    uint64
+	rejectedConns uint64
+	snapshots     uint64
+	evictions     []uint64 // by slab class
+	reclaimed     []uint64 // expired items unlinked, by slab class
+}
+
+func newCounters() *counters {
+	return &counters{
+		evictions: make([]uint64, len(slabSizes)),
+		reclaimed: make([]uint64, len(slabSizes)),
+	}
+}
+
+func count(c *uint64) {
+	atomic.AddUint64(c, 1)
+}
+
+// hitOrMiss counts a lookup on hit or on miss.
+func hitOrMiss(ok bool, hit, miss *uint64) {
+	if ok {
+		count(hit)
+	} else {
+		count(miss)
+	}
+}
+
+func sum(counts []uint64) (n uint64) {
+	for i := range counts {
+		n += atomic.LoadUint64(&counts[i])
+	}
+	return
+}
+
+type Stat struct {
+	Name  string
+	Value string
+}
+
+func u64(v *uint64) string {
+	return strconv.FormatUint(atomic.LoadUint64(v), 10)
+}
+
+// StatGroup returns the statistics "stats <group>" prints, the general purpose
+// ones for an empty group, and false for a group it does not know.
+func (m *Memcached) StatGroup(group string) ([]Stat, bool) {
+	switch group {
+	case "":
+		return m.Stats(), true
+	case "items":
+		return m.ItemStats(), true
+	case "slabs":
+		return m.SlabStats(), true
+	}
+	return nil, false
+}
+
+// Stats returns the general purpose statistics, in the order "stats" prints them.
+func (m *Memcached) Stats() []Stat {
+	now := time.Now()
+	m.mu.Lock()
+	conns := len(m.sessions)
+	reqs, read := m.reqProcessed, m.bytesRead
+	for _, sess := range m.sessions {
+		reqs += atomic.LoadUint64(&sess.reqProcessed)
+		read += atomic.LoadUint64(&sess.bytesRead)
+	}
+	m.mu.Unlock()
+	items := 0
+	for _, slot := range m.slots {
+		slot.mu.Lock()
+		items += len(slot.items)
+		slot.mu.Unlock()
+	}
+	c := m.counters
+	return []Stat{
+		{"pid", strconv.Itoa(os.Getpid())},
+		{"uptime", strconv.Itoa(int(now.Sub(m.stime).Seconds()))},
+		{"time", strconv.FormatInt(now.Unix(), 10)},
+		{"version", version},
+		{"pointer_size", "64"},
+		{"curr_connections", strconv.Itoa(conns)},
+		{"total_connections", u64(&c.totalConns)},
+		{"rejected_connections", u64(&c.rejectedConns)},
+		{"max_connections", strconv.Itoa(m.maxConns)},
+		{"cmd_get", u64(&c.cmdGet)},
+		{"cmd_set", u64(&c.cmdSet)},
+		{"cmd_flush", u64(&c.cmdFlush)},
+		{"cmd_touch", u64(&c.cmdTouch)},
+		{"get_hits", u64(&c.getHits)},
+		{"get_misses", u64(&c.getMisses)},
+		{"get_expired", u64(&c.getExpired)},
+		{"delete_misses", u64(&c.deleteMisses)},
+		{"delete_hits", u64(&c.deleteHits)},
+		{"incr_misses", u64(&c.incrMisses)},
+		{"incr_hits", u64(&c.incrHits)},
+		{"decr_misses", u64(&c.decrMisses)},
+		{"decr_hits", u64(&c.decrHits)},
+		{"cas_misses", u64(&c.casMisses)},
+		{"cas_hits", u64(&c.casHits)},
+		{"cas_badval", u64(&c.casBadval)},
+		{"touch_hits", u64(&c.touchHits)},
+		{"touch_misses", u64(&c.touchMisses)},
+		{"bytes_read", strconv.FormatUint(read, 10)},
+		{"requests_processed", strconv.FormatUint(reqs, 10)},
+		{"curr_items", strconv.Itoa(items)},
+		{"bytes", strconv.FormatInt(atomic.LoadInt64(&m.used), 10)},
+		{"limit_maxbytes", strconv.FormatInt(m.limit, 10)},
+		{"evictions", strconv.FormatUint(sum(c.evictions), 10)},
+		{"reclaimed", strconv.FormatUint(sum(c.reclaimed), 10)},
+		{"snapshots", u64(&c.snapshots)},
+	}
+}
+
+// classUsage counts the items of each slab class and the bytes they take.
+func (m *Memcached) classUsage() (number, bytes []int64) {
+	number = make([]int64, len(slabSizes))
+	bytes = make([]int64, len(slabSizes))
+	for _, slot := range m.slots {
+		slot.mu.Lock()
+		for _, item := range slot.items {
+			class := slabClass(item.size())
+			number[class]++
+			bytes[class] += item.size()
+		}
+		slot.mu.Unlock()
+	}
+	return
+}
+
+// ItemStats returns what "stats items" prints, by slab class. Classes that
+// never held an item are left out.
+func (m *Memcached) ItemStats() []Stat {
+	number, _ := m.classUsage()
+	var stats []Stat
+	for class := range slabSizes {
+		evicted := atomic.LoadUint64(&m.counters.evictions[class])
+		reclaimed := atomic.LoadUint64(&m.counters.reclaimed[class])
+		if number[class] == 0 && evicted == 0 && reclaimed == 0 {
+			continue
+		}
+		prefix := "items:" + strconv.Itoa(class+1) + ":"
+		stats = append(stats,
+			Stat{prefix + "number", strconv.FormatInt(number[class], 10)},
+			Stat{prefix + "evicted", strconv.FormatUint(evicted, 10)},
+			Stat{prefix + "reclaimed", strconv.FormatUint(reclaimed, 10)},
+		)
+	}
+	return stats
+}
+
+// SlabStats returns what "stats slabs" prints, by slab class and then in
+// total. Classes without items are left out.
+func (m *Memcached) SlabStats() []Stat {
+	number, bytes := m.classUsage()
+	var stats []Stat
+	active := 0
+	for class, size := range slabSizes {
+		if number[class] == 0 {
+			continue
+		}
+		active++
+		prefix := strconv.Itoa(class+1) + ":"
+		stats = append(stats,
+			Stat{prefix + "chunk_size", strconv.FormatInt(size, 10)},
+			Stat{prefix + "used_chunks", strconv.FormatInt(number[class], 10)},
+			Stat{prefix + "mem_requested", strconv.FormatInt(bytes[class], 10)},
+		)
+	}
+	return append(stats,
+		Stat{"active_slabs", strconv.Itoa(active)},
+		Stat{"total_malloced", strconv.FormatInt(atomic.LoadInt64(&m.used), 10)},
+	)
+}
@@ -0,0 +1,138 @@
+package memcached_server
+
+import (
+	"encoding/binary"
+	"muduo"
+	"muduo/pkg/logging"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// udpHeaderLen is the size of the frame header every datagram starts with:
+// request id, sequence number, datagram count and a reserved field, 16 bits
+// each.
+const udpHeaderLen = 8
+
+// udpMaxDatagram bounds the datagrams of a response, header included. Larger
+// responses are split, the client orders them by sequence number.
+const udpMaxDatagram = 1400
+
+// udpServer answers requests that fit in a single datagram, the way memcached
+// does over UDP. It runs on the server loop.
+type udpServer struct {
+	m   *Memcached
+	fd  int
+	w   *muduo.Watcher
+	buf []byte
+	out []byte
+}
+
+// newUdpServer binds a socket to address, network is "tcp4" or "tcp6" as the
+// TCP listener has it.
+func newUdpServer(m *Memcached, network, address string) (*udpServer, error) {
+	sa, family, _, _, err := muduo.GetTCPSockAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.Bind(fd, sa); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return &udpServer{
+		m:   m,
+		fd:  fd,
+		buf: make([]byte, 64*1024),
+		out: make([]byte, udpMaxDatagram),
+	}, nil
+}
+
+// addr returns the address the socket is bound to.
+func (u *udpServer) addr() string {
+	sa, err := unix.Getsockname(u.fd)
+	if err != nil {
+		return ""
+	}
+	return muduo.SockaddrToTCPOrUnixAddr(sa).String()
+}
+
+// start watches the socket, it must be called on the loop.
+func (u *udpServer) start() {
+	w, err := u.m.el.Watch(u.fd, muduo.Readable, u.handleRead)
+	if err != nil {
+		logging.Errorf("memcached udp watch: %v", err)
+		return
+	}
+	u.w = w
+}
+
+// close stops serving and closes the socket, it must be called on the loop.
+func (u *udpServer) close() {
+	if u.w != nil {
+		u.w.Unwatch()
+		u.w = nil
+	}
+	_ = unix.Close(u.fd)
+}
+
+func (u *udpServer) handleRead(w *muduo.Watcher, events muduo.WatchEvent, ts time.Time) {
+	for {
+		n, from, err := unix.Recvfrom(u.fd, u.buf, 0)
+		if err != nil {
+			if err != unix.EAGAIN && err != unix.EINTR {
+				logging.Errorf("memcached udp recvfrom: %v", err)
+			}
+			return
+		}
+		if n < udpHeaderLen {
+			continue
+		}
+		id := binary.BigEndian.Uint16(u.buf)
+		if binary.BigEndian.Uint16(u.buf[2:]) != 0 || binary.BigEndian.Uint16(u.buf[4:]) != 1 {
+			u.reply(from, id, []byte("SERVER_ERROR multi-packet request not supported\r\n"))
+			continue
+		}
+		u.reply(from, id, u.serve(u.buf[udpHeaderLen:n], ts))
+	}
+}
+
+// serve runs the requests of one datagram through a session of its own, a
+// request cut short by the end of the datagram is dropped.
+func (u *udpServer) serve(req []byte, ts time.Time) []byte {
+	sess := NewSession(u.m, nil)
+	buf := muduo.NewBuffer()
+	_, _ = buf.Write(req)
+	sess.OnMsg(nil, buf, ts)
+	u.m.mu.Lock()
+	u.m.reqProcessed += atomic.LoadUint64(&sess.reqProcessed)
+	u.m.bytesRead += atomic.LoadUint64(&sess.bytesRead)
+	u.m.mu.Unlock()
+	return sess.outputBuffer.Next(-1)
+}
+
+// reply sends res in as many datagrams as it takes, nothing for an empty one.
+// Datagrams the socket has no room for are dropped, clients retry on timeout.
+func (u *udpServer) reply(to unix.Sockaddr, id uint16, res []byte) {
+	const chunk = udpMaxDatagram - udpHeaderLen
+	total := (len(res) + chunk - 1) / chunk
+	for seq := 0; seq < total; seq++ {
+		part := res[seq*chunk:]
+		if len(part) > chunk {
+			part = part[:chunk]
+		}
+		binary.BigEndian.PutUint16(u.out, id)
+		binary.BigEndian.PutUint16(u.out[2:], uint16(seq))
+		binary.BigEndian.PutUint16(u.out[4:], uint16(total))
+		binary.BigEndian.PutUint16(u.out[6:], 0)
+		n := copy(u.out[udpHeaderLen:], part)
+		if err := unix.Sendto(u.fd, u.out[:udpHeaderLen+n], 0, to); err != nil {
+			logging.Debugf("memcached udp sendto: %v", err)
+			return
+		}
+	}
+}
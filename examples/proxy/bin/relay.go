@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"muduo"
+	"muduo/examples/proxy"
+	"muduo/pkg/logging"
+	"strings"
+	"time"
+)
+
+func main() {
+	listen := flag.String("l", "tcp4://:8080", "address to listen on")
+	backends := flag.String("backends", "tcp4://127.0.0.1:8081", "comma separated backend addresses, used round robin")
+	threads := flag.Int("t", 4, "number of worker loops")
+	highWaterMark := flag.Int("hwm", 1<<20, "bytes waiting to be written to one side before the other is not read")
+	connectTimeout := flag.Duration("connect-timeout", 5*time.Second, "timeout of connecting to a backend")
+	sendProxy := flag.Int("send-proxy", 0, "PROXY protocol version sent to the backends, 0 is none")
+	acceptProxy := flag.Bool("accept-proxy", false, "expect a PROXY protocol header from the clients")
+	flag.Parse()
+
+	opts := []proxy.Option{
+		proxy.WithEngineCnt(*threads),
+		proxy.WithHighWaterMark(*highWaterMark),
+		proxy.WithConnectTimeout(*connectTimeout),
+		proxy.WithSendProxyHeader(*sendProxy),
+	}
+	if *acceptProxy {
+		opts = append(opts, proxy.WithAcceptProxyHeader(5*time.Second))
+	}
+	el := muduo.NewEventloop("relay")
+	r, err := proxy.NewRelay(el, *listen, strings.Split(*backends, ","), opts...)
+	if err != nil {
+		logging.Fatalf("relay: %v", err)
+	}
+	r.Start()
+	el.AsyncExecute(func() {
+		logging.Infof("relay listening on %s", r.Addr())
+	})
+	r.ShutdownOnSignal(5 * time.Second)
+	el.Loop()
+}
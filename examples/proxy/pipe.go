@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"muduo"
+	"sync/atomic"
+	"time"
+)
+
+// PipeBytes counts the bytes pumped by pipes. It is updated atomically, so
+// the pipes of every loop may share one.
+type PipeBytes struct {
+	ToOut int64
+	ToIn  int64
+}
+
+// pipe pumps the bytes of two connections of one loop both ways.
+type pipe struct {
+	in, out *muduo.TcpConn
+	bytes   *PipeBytes
+}
+
+// Pipe relays the bytes of in and out both ways, from the loop they share.
+// Reading from one stops while the other has more than highWaterMark bytes
+// waiting to be written, so a slow reader holds back the writer through TCP
+// flow control. A side shutting down its writing is passed on to the other.
+// Pipe takes over the message, write complete, high water mark and half close
+// callbacks of both connections, closing them is left to the caller.
+//
+// in is a connection whose reading was stopped while out was connecting: what
+// it has buffered is sent first, and inEOF tells that its peer shut down its
+// writing meanwhile. bytes may be nil.
+func Pipe(in, out *muduo.TcpConn, highWaterMark int, inEOF bool, bytes *PipeBytes) {
+	p := &pipe{in: in, out: out, bytes: bytes}
+	in.SetOnMsg(p.onInMsg)
+	in.SetOnWriteComplete(p.onInWriteComplete)
+	in.SetHighWaterMark(p.onInHighWaterMark, highWaterMark)
+	in.SetOnHalfClose(p.onInHalfClose)
+	out.SetOnMsg(p.onOutMsg)
+	out.SetOnWriteComplete(p.onOutWriteComplete)
+	out.SetHighWaterMark(p.onOutHighWaterMark, highWaterMark)
+	out.SetOnHalfClose(p.onOutHalfClose)
+	if buf := in.GetInboundBuffer(); buf.ReadableBytes() > 0 {
+		p.onInMsg(in, buf, time.Time{})
+	}
+	if inEOF {
+		out.ShutdownWrite()
+		return
+	}
+	in.StartRead()
+}
+
+func (p *pipe) onInMsg(in *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+	if p.bytes != nil {
+		atomic.AddInt64(&p.bytes.ToOut, int64(buf.ReadableBytes()))
+	}
+	_, _ = p.out.Write(buf.Next(-1))
+}
+
+func (p *pipe) onOutMsg(out *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+	if p.bytes != nil {
+		atomic.AddInt64(&p.bytes.ToIn, int64(buf.ReadableBytes()))
+	}
+	_, _ = p.in.Write(buf.Next(-1))
+}
+
+func (p *pipe) onInWriteComplete(in *muduo.TcpConn) {
+	// in caught up, read from out again
+	p.out.StartRead()
+}
+
+func (p *pipe) onOutWriteComplete(out *muduo.TcpConn) {
+	// out caught up, read from in again
+	p.in.StartRead()
+}
+
+func (p *pipe) onInHighWaterMark(in *muduo.TcpConn, n int) {
+	p.out.StopRead()
+}
+
+func (p *pipe) onOutHighWaterMark(out *muduo.TcpConn, n int) {
+	p.in.StopRead()
+}
+
+func (p *pipe) onInHalfClose(in *muduo.TcpConn) {
+	p.out.ShutdownWrite()
+}
+
+func (p *pipe) onOutHalfClose(out *muduo.TcpConn) {
+	p.in.ShutdownWrite()
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"muduo"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"muduo/proxyproto"
+	"sync/atomic"
+	"time"
+)
+
+type options struct {
+	engineCnt      int
+	highWaterMark  int
+	connectTimeout time.Duration
+	sendHeader     int
+	headerTimeout  time.Duration
+}
+
+// Option configures a Relay.
+type Option func(o *options)
+
+// WithEngineCnt sets the number of loops relaying connections.
+func WithEngineCnt(n int) Option {
+	return func(o *options) {
+		o.engineCnt = n
+	}
+}
+
+// WithHighWaterMark sets how many bytes may wait to be written to one side
+// before reading from the other side stops, 1MiB by default.
+func WithHighWaterMark(n int) Option {
+	return func(o *options) {
+		o.highWaterMark = n
+	}
+}
+
+// WithConnectTimeout bounds connecting to each backend, 5s by default.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.connectTimeout = d
+	}
+}
+
+// WithSendProxyHeader sends the backends a PROXY protocol header of version 1
+// or 2 with the addresses of the client connection.
+func WithSendProxyHeader(version int) Option {
+	return func(o *options) {
+		o.sendHeader = version
+	}
+}
+
+// WithAcceptProxyHeader expects every client connection to start with a PROXY
+// protocol header, as it does behind another proxy, and closes those that have
+// none within timeout. The addresses of the header are the ones sent on with
+// WithSendProxyHeader.
+func WithAcceptProxyHeader(timeout time.Duration) Option {
+	return func(o *options) {
+		o.headerTimeout = timeout
+	}
+}
+
+// Stats counts the connections and bytes of a Relay.
+type Stats struct {
+	Accepted       int64
+	Active         int64
+	ConnectFailed  int64
+	BytesToBackend int64
+	BytesToClient  int64
+}
+
+// Relay is a transparent TCP proxy. Every client connection is paired with a
+// connection to a backend, on the same loop, and bytes are pumped both ways.
+// Reading from one side stops while the other has more than the high water
+// mark waiting to be written, so a slow reader holds back the writer through
+// TCP flow control instead of filling the proxy's memory. A side shutting
+// down its writing is passed on to the other, and the pair closes once both
+// directions are done. Backends are used round robin, the next one is tried
+// when connecting fails.
+type Relay struct {
+	server   *muduo.TcpServer
+	backends []string
+	opts     options
+	next     uint32
+	stats    Stats     // atomic
+	bytes    PipeBytes // to the backends and to the clients
+}
+
+// NewRelay creates a relay listening on addr, e.g. "tcp4://:8080", to the
+// backends, e.g. "tcp4://10.0.0.1:80".
+func NewRelay(el *muduo.Eventloop, addr string, backends []string, opts ...Option) (*Relay, error) {
+	if len(backends) == 0 {
+		return nil, errors.ErrNoEndpoints
+	}
+	for _, backend := range backends {
+		if _, err := muduo.NewConnector(el, backend, nil); err != nil {
+			return nil, err
+		}
+	}
+	o := options{highWaterMark: 1 << 20, connectTimeout: 5 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r := &Relay{
+		server:   muduo.NewTcpServer(el, "relay", addr, o.engineCnt),
+		backends: backends,
+		opts:     o,
+	}
+	r.server.SetOnConn(r.onConn)
+	r.server.SetOnMsg(r.onMsg)
+	if o.headerTimeout > 0 {
+		r.server.SetProxyProtocol(o.headerTimeout)
+	}
+	return r, nil
+}
+
+func (r *Relay) Start() {
+	r.server.Start()
+}
+
+// Addr returns the address the relay listens on.
+func (r *Relay) Addr() string {
+	return r.server.Addr()
+}
+
+func (r *Relay) Shutdown(timeout time.Duration) {
+	r.server.Shutdown(timeout)
+}
+
+// ShutdownOnSignal shuts the relay down on SIGTERM and SIGINT.
+func (r *Relay) ShutdownOnSignal(timeout time.Duration) {
+	r.server.ShutdownOnSignal(timeout)
+}
+
+// Stats returns the counters of the relay so far.
+func (r *Relay) Stats() Stats {
+	return Stats{
+		Accepted:       atomic.LoadInt64(&r.stats.Accepted),
+		Active:         atomic.LoadInt64(&r.stats.Active),
+		ConnectFailed:  atomic.LoadInt64(&r.stats.ConnectFailed),
+		BytesToBackend: atomic.LoadInt64(&r.bytes.ToOut),
+		BytesToClient:  atomic.LoadInt64(&r.bytes.ToIn),
+	}
+}
+
+// pair is a client connection and the backend connection relaying it. It is
+// owned by the loop of the client connection, which the backend one shares.
+type pair struct {
+	r      *Relay
+	in     *muduo.TcpConn
+	out    *muduo.TcpConn
+	client *muduo.TcpClient
+	header *proxyproto.Header // received from the client
+	inEOF  bool               // the client was done before the backend connected
+	closed bool
+}
+
+func (r *Relay) onConn(in *muduo.TcpConn) {
+	if !in.IsConnected() {
+		p := in.GetContext().(*pair)
+		p.closed = true
+		if p.client != nil {
+			p.client.Stop()
+		}
+		// unless it is already shutting down, the backend connection is left
+		// with nobody to talk to
+		if p.out != nil && p.out.IsConnected() {
+			p.out.ForceClose()
+		}
+		atomic.AddInt64(&r.stats.Active, -1)
+		return
+	}
+	atomic.AddInt64(&r.stats.Accepted, 1)
+	atomic.AddInt64(&r.stats.Active, 1)
+	p := &pair{r: r, in: in, header: in.ProxyHeader()}
+	in.SetContext(p)
+	in.SetOnHalfClose(p.onInHalfClose)
+	p.dial()
+}
+
+// onMsg leaves what the client sends before the backend connects, with its
+// PROXY header or while reading stops, in the buffer: the pipe sends it on.
+func (r *Relay) onMsg(in *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {}
+
+// dial connects to the next backend, reading from the client stops meanwhile.
+func (p *pair) dial() {
+	r := p.r
+	p.in.StopRead()
+	n := int(atomic.AddUint32(&r.next, 1))
+	endpoints := make([]string, 0, len(r.backends))
+	for i := range r.backends {
+		endpoints = append(endpoints, r.backends[(n+i)%len(r.backends)])
+	}
+	client, _ := muduo.NewTcpClient(p.in.Eventloop(), endpoints[0])
+	_ = client.SetEndpoints(endpoints...)
+	client.SetConnectTimeout(r.opts.connectTimeout)
+	client.SetOnConnectFailed(func(err error, attempt int) {
+		// every backend has been tried
+		logging.Warnf("relay %s: no backend: %v", p.in.GetPeerAddr(), err)
+		atomic.AddInt64(&r.stats.ConnectFailed, 1)
+		client.Stop()
+		p.in.ForceClose()
+	})
+	client.SetOnConn(p.onOutConn)
+	p.client = client
+	client.Connect()
+}
+
+func (p *pair) onOutConn(out *muduo.TcpConn) {
+	if !out.IsConnected() {
+		if p.in.IsConnected() {
+			p.in.ForceClose()
+		}
+		return
+	}
+	if p.closed {
+		out.ForceClose()
+		return
+	}
+	p.out = out
+	if version := p.r.opts.sendHeader; version != 0 {
+		header, err := p.proxyHeader(version).Append(nil)
+		if err != nil {
+			logging.Errorf("relay %s: %v", p.in.GetPeerAddr(), err)
+			p.in.ForceClose()
+			return
+		}
+		_, _ = out.Write(header)
+	}
+	Pipe(p.in, out, p.r.opts.highWaterMark, p.inEOF, &p.r.bytes)
+}
+
+// proxyHeader returns the header telling the backend about the client: the
+// addresses of its connection, or those of the header it came with.
+func (p *pair) proxyHeader(version int) *proxyproto.Header {
+	h := &proxyproto.Header{
+		Version:     version,
+		Command:     proxyproto.Proxy,
+		Source:      p.in.GetPeerAddr(),
+		Destination: p.in.GetLocalAddr(),
+	}
+	if p.header != nil {
+		h.Command, h.Source, h.Destination = p.header.Command, p.header.Source, p.header.Destination
+		h.TLVs = p.header.TLVs
+	}
+	return h
+}
+
+// onInHalfClose is replaced by the pipe once the backend connects.
+func (p *pair) onInHalfClose(in *muduo.TcpConn) {
+	p.inEOF = true
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"muduo"
+	"muduo/internal/muduotest"
+	"muduo/proxyproto"
+	"net"
+	"testing"
+	"time"
+)
+
+// startBackend serves every connection to a loopback listener with handle.
+func startBackend(t *testing.T, handle func(c net.Conn)) string {
+	t.Helper()
+	return "tcp4://" + muduotest.Serve(t, handle).String()
+}
+
+// deadBackend returns the address of a port nobody listens on.
+func deadBackend(t *testing.T) string {
+	t.Helper()
+	return "tcp4://" + muduotest.DeadAddr(t).String()
+}
+
+func startRelay(t *testing.T, backends []string, opts ...Option) *Relay {
+	t.Helper()
+	el := muduo.NewEventloop("relay-test")
+	r, err := NewRelay(el, "tcp4://127.0.0.1:0", backends, append([]Option{WithEngineCnt(2)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	muduotest.RunLoop(t, el, func() { r.Shutdown(100 * time.Millisecond) })
+	return r
+}
+
+func TestRelayEcho(t *testing.T) {
+	r := startRelay(t, []string{startBackend(t, muduotest.Echo)})
+	for i := 0; i < 5; i++ {
+		c := muduotest.Dial(t, r.Addr())
+		msg := bytes.Repeat([]byte{byte('a' + i)}, 100000)
+		go func() { _, _ = c.Write(msg) }()
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("echo %v", err)
+		}
+	}
+	if s := r.Stats(); s.Accepted != 5 || s.BytesToBackend != 500000 || s.BytesToClient != 500000 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+func TestRelayRoundRobin(t *testing.T) {
+	name := func(s string) func(net.Conn) {
+		return func(c net.Conn) { _, _ = c.Write([]byte(s)) }
+	}
+	r := startRelay(t, []string{startBackend(t, name("a")), startBackend(t, name("b"))})
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		data, err := io.ReadAll(muduotest.Dial(t, r.Addr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(data)]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Fatalf("backends used %v", seen)
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	// the backend answers once the client is done sending
+	r := startRelay(t, []string{startBackend(t, func(c net.Conn) {
+		data, err := io.ReadAll(c)
+		if err != nil {
+			return
+		}
+		_, _ = c.Write(append(data, " bye"...))
+	})})
+	c := muduotest.Dial(t, r.Addr())
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(c)
+	if err != nil || string(data) != "hello bye" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	// and the other way round: the backend is done sending first
+	r = startRelay(t, []string{startBackend(t, func(c net.Conn) {
+		_, _ = c.Write([]byte("hello"))
+		_ = c.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(c)
+		_, _ = c.Write(data)
+	})})
+	c = muduotest.Dial(t, r.Addr())
+	data, err = io.ReadAll(io.LimitReader(c, 5))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	// still open for writing
+	if _, err := c.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.CloseWrite()
+	if data, err := io.ReadAll(c); err != nil || len(data) != 0 {
+		t.Fatalf("read %q, %v after half-close", data, err)
+	}
+}
+
+func TestRelayBackpressure(t *testing.T) {
+	const size = 64 << 20
+	written := make(chan int, 1)
+	r := startRelay(t, []string{startBackend(t, func(c net.Conn) {
+		chunk := make([]byte, 64<<10)
+		n := 0
+		for n < size {
+			for i := range chunk {
+				chunk[i] = byte(n + i)
+			}
+			m, err := c.Write(chunk)
+			n += m
+			if err != nil {
+				break
+			}
+			select {
+			case <-written:
+			default:
+			}
+			written <- n
+		}
+	})}, WithHighWaterMark(256<<10))
+	c := muduotest.Dial(t, r.Addr())
+
+	// the client does not read, the backend ends up blocked
+	last := 0
+	for {
+		select {
+		case n := <-written:
+			last = n
+			continue
+		case <-time.After(300 * time.Millisecond):
+		}
+		break
+	}
+	// kernel buffers on the way aside, the relay holds about the high water mark
+	if last >= 40<<20 {
+		t.Fatalf("backend wrote %d bytes to a client that does not read", last)
+	}
+	got := make([]byte, size)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if got[i] != byte(i) {
+			t.Fatalf("byte %d is %d", i, got[i])
+		}
+	}
+}
+
+func TestRelayFailover(t *testing.T) {
+	r := startRelay(t, []string{deadBackend(t), startBackend(t, muduotest.Echo)}, WithConnectTimeout(time.Second))
+	for i := 0; i < 2; i++ {
+		c := muduotest.Dial(t, r.Addr())
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+			t.Fatalf("read %q, %v", got, err)
+		}
+	}
+}
+
+func TestRelayNoBackend(t *testing.T) {
+	r := startRelay(t, []string{deadBackend(t)})
+	c := muduotest.Dial(t, r.Addr())
+	if data, err := io.ReadAll(c); err != nil && !isReset(err) || len(data) != 0 {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Stats().ConnectFailed != 1 || r.Stats().Active != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v", r.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func isReset(err error) bool {
+	op, ok := err.(*net.OpError)
+	return ok && op.Err != nil && bytes.Contains([]byte(op.Err.Error()), []byte("reset"))
+}
+
+// headerBackend reports the PROXY header each connection starts with, and
+// echoes what follows it.
+func headerBackend(t *testing.T, headers chan<- *proxyproto.Header) string {
+	return startBackend(t, func(c net.Conn) {
+		var buf []byte
+		chunk := make([]byte, 512)
+		for {
+			n, err := c.Read(chunk)
+			if err != nil {
+				headers <- nil
+				return
+			}
+			buf = append(buf, chunk[:n]...)
+			h, l, err := proxyproto.Parse(buf)
+			if err != nil {
+				headers <- nil
+				return
+			}
+			if h != nil {
+				headers <- h
+				_, _ = c.Write(buf[l:])
+				muduotest.Echo(c)
+				return
+			}
+		}
+	})
+}
+
+func TestRelaySendProxyHeader(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		headers := make(chan *proxyproto.Header, 1)
+		r := startRelay(t, []string{headerBackend(t, headers)}, WithSendProxyHeader(version))
+		c := muduotest.Dial(t, r.Addr())
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		h := <-headers
+		if h == nil || h.Version != version {
+			t.Fatalf("header %+v", h)
+		}
+		local := c.LocalAddr().(*net.TCPAddr)
+		src := h.Source.(*net.TCPAddr)
+		dst := h.Destination.(*net.TCPAddr)
+		if !src.IP.Equal(local.IP) || src.Port != local.Port || dst.String() != r.Addr() {
+			t.Fatalf("v%d header %v -> %v, client %v -> %v", version, src, dst, local, r.Addr())
+		}
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+			t.Fatalf("read %q, %v", got, err)
+		}
+	}
+}
+
+func TestRelayAcceptProxyHeader(t *testing.T) {
+	headers := make(chan *proxyproto.Header, 1)
+	r := startRelay(t, []string{headerBackend(t, headers)},
+		WithAcceptProxyHeader(200*time.Millisecond), WithSendProxyHeader(2))
+
+	// the addresses and TLVs of the client's header are passed on
+	in := &proxyproto.Header{
+		Version:     2,
+		Command:     proxyproto.Proxy,
+		Source:      &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242},
+		Destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+		TLVs:        []proxyproto.TLV{{Type: proxyproto.TypeAuthority, Value: []byte("example.com")}},
+	}
+	header, _ := in.Append(nil)
+	c := muduotest.Dial(t, r.Addr())
+	// the header and data in a single segment
+	if _, err := c.Write(append(header, "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+	h := <-headers
+	if h == nil || h.Source.String() != "203.0.113.7:4242" || h.Destination.String() != "198.51.100.1:443" {
+		t.Fatalf("header %+v", h)
+	}
+	if v, _ := h.TLV(proxyproto.TypeAuthority); string(v) != "example.com" {
+		t.Fatalf("authority %q", v)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+
+	// no header
+	c = muduotest.Dial(t, r.Addr())
+	_, _ = c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	if data, _ := io.ReadAll(c); len(data) != 0 {
+		t.Fatalf("read %q without a header", data)
+	}
+	// a header that never completes
+	c = muduotest.Dial(t, r.Addr())
+	_, _ = c.Write([]byte("PROXY TCP4 "))
+	if data, _ := io.ReadAll(c); len(data) != 0 {
+		t.Fatalf("read %q with a partial header", data)
+	}
+	if s := r.Stats(); s.Accepted != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
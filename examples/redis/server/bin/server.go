@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"muduo"
+	redis_server "muduo/examples/redis/server"
+	"muduo/pkg/logging"
+	"time"
+)
+
+func main() {
+	port := flag.Int("p", 6379, "TCP port to listen on")
+	threads := flag.Int("t", 4, "number of worker loops")
+	flag.Parse()
+
+	el := muduo.NewEventloop("redis")
+	r := redis_server.NewRedis(el, redis_server.WithPort(*port), redis_server.WithEngineCnt(*threads))
+	r.Start()
+	el.AsyncExecute(func() {
+		logging.Infof("redis listening on %s", r.Addr())
+	})
+	r.ShutdownOnSignal(5 * time.Second)
+	el.Loop()
+}
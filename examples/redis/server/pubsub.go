@@ -0,0 +1,162 @@
+package redis_server
+
+import "sync"
+
+// pubsub knows the subscribers of every channel and pattern. Sessions keep
+// their own subscriptions too, those are owned by their loop.
+type pubsub struct {
+	mu       sync.Mutex
+	channels map[string]map[*Session]struct{}
+	patterns map[string]map[*Session]struct{}
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*Session]struct{}),
+		patterns: make(map[string]map[*Session]struct{}),
+	}
+}
+
+func subscribe(subs map[string]map[*Session]struct{}, name string, s *Session) {
+	set, ok := subs[name]
+	if !ok {
+		set = make(map[*Session]struct{})
+		subs[name] = set
+	}
+	set[s] = struct{}{}
+}
+
+func unsubscribe(subs map[string]map[*Session]struct{}, name string, s *Session) {
+	if set, ok := subs[name]; ok {
+		delete(set, s)
+		if len(set) == 0 {
+			delete(subs, name)
+		}
+	}
+}
+
+func (ps *pubsub) subscribe(channel string, s *Session) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subscribe(ps.channels, channel, s)
+}
+
+func (ps *pubsub) unsubscribe(channel string, s *Session) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	unsubscribe(ps.channels, channel, s)
+}
+
+func (ps *pubsub) psubscribe(pattern string, s *Session) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subscribe(ps.patterns, pattern, s)
+}
+
+func (ps *pubsub) punsubscribe(pattern string, s *Session) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	unsubscribe(ps.patterns, pattern, s)
+}
+
+// publish hands message to the subscribers of channel on their own loops and
+// returns how many receive it. A session subscribed to several matching
+// patterns receives it once per pattern, as in Redis.
+func (ps *pubsub) publish(channel string, message []byte) int {
+	ps.mu.Lock()
+	var receivers []*Session
+	for s := range ps.channels[channel] {
+		receivers = append(receivers, s)
+	}
+	var matched []*Session
+	var matchedBy []string
+	for pattern, set := range ps.patterns {
+		if !match(pattern, channel) {
+			continue
+		}
+		for s := range set {
+			matched = append(matched, s)
+			matchedBy = append(matchedBy, pattern)
+		}
+	}
+	ps.mu.Unlock()
+
+	for _, s := range receivers {
+		s.deliver("", channel, message)
+	}
+	for i, s := range matched {
+		s.deliver(matchedBy[i], channel, message)
+	}
+	return len(receivers) + len(matched)
+}
+
+// match reports whether s matches the glob pattern, which knows *, ?, [...]
+// with ranges and ^ negation, and backslash escapes.
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					matched = matched || pattern[1] == s[0]
+					pattern = pattern[2:]
+				case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || (s[0] >= lo && s[0] <= hi)
+					pattern = pattern[3:]
+				default:
+					matched = matched || pattern[0] == s[0]
+					pattern = pattern[1:]
+				}
+			}
+			if len(pattern) == 0 || matched == negate {
+				// an unterminated class matches nothing
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,107 @@
+package redis_server
+
+import (
+	"muduo"
+	"strconv"
+	"time"
+)
+
+type Options struct {
+	engineCnt int
+	port      int
+}
+
+func loadOptions(options ...Option) *Options {
+	opts := new(Options)
+	for _, option := range options {
+		option(opts)
+	}
+	return opts
+}
+
+type Option func(opts *Options)
+
+func WithEngineCnt(engineCnt int) Option {
+	return func(opts *Options) {
+		opts.engineCnt = engineCnt
+	}
+}
+
+func WithPort(port int) Option {
+	return func(opts *Options) {
+		opts.port = port
+	}
+}
+
+// sweepInterval is the period of the sweeper, see sweep.
+const sweepInterval = 100 * time.Millisecond
+
+// Redis is a key-value server speaking RESP2 and RESP3. Keys are spread over
+// slots that are locked on their own, the same way the memcached example does.
+type Redis struct {
+	slots     []*slot
+	slotn     int
+	server    *muduo.TcpServer
+	el        *muduo.Eventloop
+	pubsub    *pubsub
+	sweeper   *muduo.TimerTask
+	sweepNext int // owned by el
+}
+
+func NewRedis(el *muduo.Eventloop, opts ...Option) *Redis {
+	options := loadOptions(opts...)
+	r := &Redis{
+		slotn:  1024,
+		slots:  make([]*slot, 1024),
+		server: muduo.NewTcpServer(el, "redis", "tcp4://:"+strconv.Itoa(options.port), options.engineCnt),
+		el:     el,
+		pubsub: newPubsub(),
+	}
+	for i := 0; i < r.slotn; i++ {
+		r.slots[i] = &slot{
+			items: make(map[string]*entry),
+		}
+	}
+	r.server.SetOnConn(r.onConn)
+	r.server.SetOnMsg(r.onMsg)
+	return r
+}
+
+func (r *Redis) Start() {
+	r.server.Start()
+	r.sweeper = r.el.AsyncScheduleAtFixRate(r.sweep, sweepInterval)
+}
+
+// Addr returns the address the server listens on.
+func (r *Redis) Addr() string {
+	return r.server.Addr()
+}
+
+func (r *Redis) Shutdown(timeout time.Duration) {
+	if r.sweeper != nil {
+		r.sweeper.Cancel()
+	}
+	r.server.Shutdown(timeout)
+}
+
+// ShutdownOnSignal shuts the server down on SIGTERM and SIGINT.
+func (r *Redis) ShutdownOnSignal(timeout time.Duration) {
+	r.server.ShutdownOnSignal(timeout)
+}
+
+// now returns the time of the server loop's clock, expiry is measured with it.
+func (r *Redis) now() time.Time {
+	return r.el.Now()
+}
+
+func (r *Redis) onConn(conn *muduo.TcpConn) {
+	if conn.IsConnected() {
+		conn.SetContext(NewSession(r, conn))
+	} else {
+		conn.GetContext().(*Session).onClose()
+	}
+}
+
+func (r *Redis) onMsg(conn *muduo.TcpConn, buf *muduo.Buffer, t time.Time) {
+	conn.GetContext().(*Session).OnMsg(conn, buf, t)
+}
@@ -0,0 +1,332 @@
+package redis_server
+
+import (
+	"io"
+	"muduo"
+	"muduo/internal/muduotest"
+	"muduo/resp"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer runs a Redis with two engine loops on a loopback port, TTLs and
+// the sweeper only move on with clock.Advance. Shutdown stops it after the test.
+func startServer(t *testing.T) (*Redis, *muduo.FakeClock) {
+	t.Helper()
+	el, clock := muduotest.FakeLoop("redis-test")
+	r := NewRedis(el, WithPort(0), WithEngineCnt(2))
+	r.Start()
+	muduotest.RunLoop(t, el, func() { r.Shutdown(100 * time.Millisecond) })
+	return r, clock
+}
+
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	buf    *muduo.Buffer
+	parser resp.Parser
+}
+
+func dial(t *testing.T, r *Redis) *client {
+	t.Helper()
+	return &client{t: t, conn: muduotest.Dial(t, r.Addr()), buf: muduo.NewBuffer()}
+}
+
+// send writes a command as an array of bulk strings.
+func (c *client) send(args ...string) {
+	c.t.Helper()
+	w := resp.NewWriter(2)
+	w.Array(len(args))
+	for _, arg := range args {
+		w.BulkString(arg)
+	}
+	c.write(w.Bytes())
+}
+
+func (c *client) write(b []byte) {
+	c.t.Helper()
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next value written out by format.
+func (c *client) read() string {
+	c.t.Helper()
+	b := make([]byte, 4096)
+	for {
+		v, err := c.parser.ReadValue(c.buf)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if v != nil {
+			// the value aliases buf, format it before reading on
+			return format(v)
+		}
+		n, err := c.conn.Read(b)
+		if err != nil {
+			c.t.Fatalf("read: %v", err)
+		}
+		_, _ = c.buf.Write(b[:n])
+	}
+}
+
+// do sends a command and compares its reply.
+func (c *client) do(want string, args ...string) {
+	c.t.Helper()
+	c.send(args...)
+	if got := c.read(); got != want {
+		c.t.Fatalf("%q: got %s, want %s", args, got, want)
+	}
+}
+
+// format writes v the way the tests compare it: strings are quoted, numbers
+// are bare, errors start with - and aggregates are bracketed after their type.
+func format(v *resp.Value) string {
+	switch v.Type {
+	case resp.SimpleString, resp.BulkString:
+		return strconv.Quote(string(v.Str))
+	case resp.Error:
+		return "-" + string(v.Str)
+	case resp.Integer:
+		return strconv.FormatInt(v.Int, 10)
+	case resp.Null:
+		return "nil"
+	case resp.Array, resp.Map, resp.Push, resp.Set:
+		elems := make([]string, len(v.Elems))
+		for i := range v.Elems {
+			elems[i] = format(&v.Elems[i])
+		}
+		return string(v.Type) + "[" + strings.Join(elems, " ") + "]"
+	}
+	return v.Type.String()
+}
+
+func TestStrings(t *testing.T) {
+	r, _ := startServer(t)
+	c := dial(t, r)
+	c.do(`"PONG"`, "PING")
+	c.do("nil", "GET", "k")
+	c.do(`"OK"`, "SET", "k", "v")
+	c.do(`"v"`, "GET", "k")
+	c.do("nil", "SET", "k", "w", "NX")
+	c.do(`"OK"`, "SET", "k", "w", "XX")
+	c.do("nil", "SET", "other", "w", "XX")
+	c.do(`*["w" nil "w"]`, "MGET", "k", "missing", "k")
+	c.do("2", "EXISTS", "k", "k", "missing")
+	c.do("1", "DEL", "k", "missing")
+	c.do("0", "DEL", "k")
+	c.do("-ERR syntax error", "SET", "k", "v", "NX", "XX")
+	c.do("-ERR unknown command 'NOPE'", "NOPE")
+	c.do("-ERR wrong number of arguments for 'get' command", "get")
+
+	// inline commands, quoted as redis-cli does
+	c.write([]byte("set \"a b\" 'it\\'s'\r\nget \"a b\"\r\n"))
+	if got, want := c.read()+" "+c.read(), `"OK" "it's"`; got != want {
+		t.Fatalf("inline: got %s, want %s", got, want)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	r, _ := startServer(t)
+	c := dial(t, r)
+	c.do("1", "INCR", "n")
+	c.do("11", "INCRBY", "n", "10")
+	c.do("10", "DECR", "n")
+	c.do("-5", "DECRBY", "n", "15")
+	c.do(`"-5"`, "GET", "n")
+
+	c.do(`"OK"`, "SET", "n", strconv.FormatInt(maxInt64, 10))
+	c.do("-ERR increment or decrement would overflow", "INCR", "n")
+	c.do(`"OK"`, "SET", "n", strconv.FormatInt(minInt64, 10))
+	c.do("-ERR increment or decrement would overflow", "DECR", "n")
+	c.do("-ERR decrement would overflow", "DECRBY", "n", strconv.FormatInt(minInt64, 10))
+	c.do(strconv.FormatInt(minInt64, 10), "INCRBY", "n", "0")
+
+	c.do(`"OK"`, "SET", "s", "abc")
+	c.do("-ERR value is not an integer or out of range", "INCR", "s")
+	c.do("-ERR value is not an integer or out of range", "INCRBY", "n", "x")
+}
+
+func TestExpiry(t *testing.T) {
+	r, clock := startServer(t)
+	c := dial(t, r)
+	c.do(`"OK"`, "SET", "k", "v", "EX", "10")
+	c.do(`"OK"`, "SET", "p", "v", "PX", "1500")
+	c.do(`"OK"`, "SET", "forever", "v")
+	c.do("10", "TTL", "k")
+	c.do("-1", "TTL", "forever")
+	c.do("-2", "TTL", "missing")
+	c.do("-ERR invalid expire time in 'set' command", "SET", "k", "v", "EX", "0")
+
+	clock.Advance(2 * time.Second)
+	c.do("nil", "GET", "p")
+	c.do("8", "TTL", "k")
+	c.do("1", "EXPIRE", "forever", "5")
+	c.do("0", "EXPIRE", "missing", "5")
+	c.do("5", "TTL", "forever")
+
+	clock.Advance(8 * time.Second)
+	c.do("nil", "GET", "k")
+	c.do("-2", "TTL", "k")
+	c.do("nil", "GET", "forever")
+
+	// a key nobody reads again is swept
+	c.do(`"OK"`, "SET", "unread", "v", "EX", "1")
+	clock.Advance(2 * time.Second)
+	for i := 0; i < len(r.slots)/sweepSlots; i++ {
+		clock.Advance(sweepInterval)
+	}
+	s := r.slotOf("unread")
+	s.mu.Lock()
+	_, ok := s.items["unread"]
+	s.mu.Unlock()
+	if ok {
+		t.Fatal("expired key not swept")
+	}
+}
+
+func TestResp3(t *testing.T) {
+	r, _ := startServer(t)
+	c := dial(t, r)
+	c.do("-NOPROTO unsupported protocol version", "HELLO", "4")
+	c.do(`%["server" "redis" "version" "7.0.0" "proto" 3 "mode" "standalone" "role" "master"]`, "HELLO", "3")
+	c.do("nil", "GET", "k")
+
+	// pushes come as such, and a subscribed RESP3 client may run any command
+	c.do(`>["subscribe" "ch" 1]`, "SUBSCRIBE", "ch")
+	c.do(`"OK"`, "SET", "k", "v")
+	c.do("1", "PUBLISH", "ch", "hi")
+	if got := c.read(); got != `>["message" "ch" "hi"]` {
+		t.Fatalf("got %s", got)
+	}
+	c.do(`>["unsubscribe" "ch" 0]`, "UNSUBSCRIBE")
+	// RESP2 has no maps, it gets the pairs in an array
+	c.do(`*["server" "redis" "version" "7.0.0" "proto" 2 "mode" "standalone" "role" "master"]`, "HELLO", "2")
+}
+
+func TestPubsub(t *testing.T) {
+	r, _ := startServer(t)
+	// with two loops the subscribers and the publisher do not all share one
+	patterns := dial(t, r)
+	channels := dial(t, r)
+	publisher := dial(t, r)
+	patterns.do(`*["psubscribe" "news.*" 1]`, "PSUBSCRIBE", "news.*")
+	patterns.do(`*["psubscribe" "news.[ab]" 2]`, "PSUBSCRIBE", "news.[ab]")
+	channels.do(`*["subscribe" "news.a" 1]`, "SUBSCRIBE", "news.a")
+	channels.do(`*["subscribe" "other" 2]`, "SUBSCRIBE", "other")
+
+	// RESP2 subscribers are limited to the subscription commands
+	channels.do("-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", "GET", "k")
+	channels.do(`*["pong" ""]`, "PING")
+
+	publisher.do("3", "PUBLISH", "news.a", "first")
+	channels.read()
+	got := []string{patterns.read(), patterns.read()}
+	if got[0] > got[1] {
+		got[0], got[1] = got[1], got[0]
+	}
+	if want := []string{`*["pmessage" "news.*" "news.a" "first"]`, `*["pmessage" "news.[ab]" "news.a" "first"]`}; got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("pattern subscriber got %q", got)
+	}
+	publisher.do("1", "PUBLISH", "news.c", "second")
+	if got := patterns.read(); got != `*["pmessage" "news.*" "news.c" "second"]` {
+		t.Fatalf("got %s", got)
+	}
+	publisher.do("1", "PUBLISH", "other", "third")
+	if got := channels.read(); got != `*["message" "other" "third"]` {
+		t.Fatalf("got %s", got)
+	}
+
+	patterns.do(`*["punsubscribe" "news.*" 1]`, "PUNSUBSCRIBE", "news.*")
+	publisher.do("1", "PUBLISH", "news.b", "fourth")
+	if got := patterns.read(); got != `*["pmessage" "news.[ab]" "news.b" "fourth"]` {
+		t.Fatalf("got %s", got)
+	}
+	// a closed subscriber is forgotten
+	_ = channels.conn.Close()
+	for i := 0; ; i++ {
+		publisher.send("PUBLISH", "other", "fifth")
+		if publisher.read() == "0" {
+			break
+		}
+		if i == 100 {
+			t.Fatal("closed subscriber still receives")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	r, _ := startServer(t)
+	for _, input := range []string{
+		"set \"a b\r\n",
+		"set 'a'b\r\n",
+		"*1\r\n:1\r\n",
+	} {
+		c := dial(t, r)
+		c.write([]byte(input))
+		if got := c.read(); !strings.HasPrefix(got, "-ERR Protocol error: ") {
+			t.Fatalf("%q: got %s", input, got)
+		}
+		if data, err := io.ReadAll(c.conn); err != nil || len(data) != 0 {
+			t.Fatalf("%q: read %q, %v after the error", input, data, err)
+		}
+	}
+	c := dial(t, r)
+	c.write([]byte("set \"a b\r\n"))
+	if got := c.read(); got != "-ERR Protocol error: unbalanced quotes in request" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestShutdownBeforeStart(t *testing.T) {
+	el := muduo.NewEventloop("redis-test")
+	r := NewRedis(el, WithPort(0))
+	r.Shutdown(0)
+	done := make(chan struct{})
+	go func() {
+		el.Loop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop still running after Shutdown")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"news.*", "news.a", true},
+		{"news.*", "news", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeello", true},
+		{"h**o", "ho", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h[ab", "ha", false},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"*.log", "x.log.1", false},
+	} {
+		if got := match(c.pattern, c.s); got != c.want {
+			t.Errorf("match(%q, %q) = %v", c.pattern, c.s, got)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package redis_server
+
+import (
+	"bytes"
+	"muduo"
+	"muduo/pkg/logging"
+	"muduo/resp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Session is one client connection. Its fields are owned by the connection's
+// loop, replies to pipelined commands are written together.
+type Session struct {
+	r        *Redis
+	conn     *muduo.TcpConn
+	parser   resp.Parser
+	w        *resp.Writer
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	quit     bool
+}
+
+func NewSession(r *Redis, conn *muduo.TcpConn) *Session {
+	return &Session{
+		r:        r,
+		conn:     conn,
+		w:        resp.NewWriter(2),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+func (s *Session) OnMsg(conn *muduo.TcpConn, buf *muduo.Buffer, t time.Time) {
+	for !s.quit {
+		args, err := s.parser.ReadCommand(buf)
+		if err != nil {
+			logging.Debugf("redis: %s: %v", conn.Name(), err)
+			s.w.Error("ERR " + err.Error())
+			s.close()
+			return
+		}
+		if args == nil {
+			break
+		}
+		s.dispatch(args)
+	}
+	s.flush()
+}
+
+func (s *Session) flush() {
+	if s.w.Len() > 0 {
+		_, _ = s.conn.Write(s.w.Bytes())
+		s.w.Reset()
+	}
+}
+
+// close sends what is written and closes the connection.
+func (s *Session) close() {
+	s.flush()
+	s.quit = true
+	s.conn.ShutdownWrite()
+}
+
+func (s *Session) onClose() {
+	s.quit = true
+	for channel := range s.channels {
+		s.r.pubsub.unsubscribe(channel, s)
+	}
+	for pattern := range s.patterns {
+		s.r.pubsub.punsubscribe(pattern, s)
+	}
+}
+
+type command struct {
+	// arity counts the command name, -n means at least n
+	arity int
+	fn    func(s *Session, args [][]byte)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":         {-1, (*Session).ping},
+		"echo":         {2, (*Session).echo},
+		"hello":        {-1, (*Session).hello},
+		"quit":         {1, (*Session).quitCmd},
+		"command":      {-1, (*Session).command},
+		"select":       {2, (*Session).selectCmd},
+		"get":          {2, (*Session).get},
+		"set":          {-3, (*Session).set},
+		"del":          {-2, (*Session).del},
+		"exists":       {-2, (*Session).exists},
+		"expire":       {3, (*Session).expire},
+		"ttl":          {2, (*Session).ttl},
+		"incr":         {2, (*Session).incr},
+		"decr":         {2, (*Session).incr},
+		"incrby":       {3, (*Session).incr},
+		"decrby":       {3, (*Session).incr},
+		"mget":         {-2, (*Session).mget},
+		"subscribe":    {-2, (*Session).subscribe},
+		"unsubscribe":  {-1, (*Session).unsubscribe},
+		"psubscribe":   {-2, (*Session).psubscribe},
+		"punsubscribe": {-1, (*Session).punsubscribe},
+		"publish":      {3, (*Session).publish},
+	}
+}
+
+// subscribedOnly are the commands RESP2 clients may send while subscribed.
+var subscribedOnly = map[string]bool{
+	"subscribe": true, "unsubscribe": true, "psubscribe": true, "punsubscribe": true, "ping": true, "quit": true,
+}
+
+func (s *Session) subscribed() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+func (s *Session) dispatch(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		s.w.Error("ERR unknown command '" + string(args[0]) + "'")
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		s.w.Error("ERR wrong number of arguments for '" + name + "' command")
+		return
+	}
+	if s.w.Proto < 3 && s.subscribed() > 0 && !subscribedOnly[name] {
+		s.w.Error("ERR Can't execute '" + name + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+		return
+	}
+	args[0] = []byte(name)
+	cmd.fn(s, args)
+}
+
+func (s *Session) ping(args [][]byte) {
+	if len(args) > 2 {
+		s.w.Error("ERR wrong number of arguments for 'ping' command")
+		return
+	}
+	if s.w.Proto < 3 && s.subscribed() > 0 {
+		s.w.Array(2)
+		s.w.BulkString("pong")
+		if len(args) == 2 {
+			s.w.Bulk(args[1])
+		} else {
+			s.w.BulkString("")
+		}
+		return
+	}
+	if len(args) == 2 {
+		s.w.Bulk(args[1])
+	} else {
+		s.w.SimpleString("PONG")
+	}
+}
+
+func (s *Session) echo(args [][]byte) {
+	s.w.Bulk(args[1])
+}
+
+// hello switches the protocol version, other HELLO options are ignored.
+func (s *Session) hello(args [][]byte) {
+	proto := s.w.Proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil || v < 2 || v > 3 {
+			s.w.Error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	s.w.Proto = proto
+	s.w.Map(5)
+	s.w.BulkString("server")
+	s.w.BulkString("redis")
+	s.w.BulkString("version")
+	s.w.BulkString("7.0.0")
+	s.w.BulkString("proto")
+	s.w.Integer(int64(proto))
+	s.w.BulkString("mode")
+	s.w.BulkString("standalone")
+	s.w.BulkString("role")
+	s.w.BulkString("master")
+}
+
+func (s *Session) quitCmd(args [][]byte) {
+	s.w.SimpleString("OK")
+	s.close()
+}
+
+// command answers redis-cli's COMMAND DOCS with nothing to document.
+func (s *Session) command(args [][]byte) {
+	s.w.Array(0)
+}
+
+func (s *Session) selectCmd(args [][]byte) {
+	if string(args[1]) != "0" {
+		s.w.Error("ERR DB index is out of range")
+		return
+	}
+	s.w.SimpleString("OK")
+}
+
+func (s *Session) get(args [][]byte) {
+	if value, ok := s.r.Get(string(args[1])); ok {
+		s.w.Bulk(value)
+	} else {
+		s.w.Null()
+	}
+}
+
+// set handles SET key value [EX seconds | PX milliseconds] [NX | XX].
+func (s *Session) set(args [][]byte) {
+	policy := SetAlways
+	var expireAt time.Time
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "NX" && policy == SetAlways:
+			policy = SetIfAbsent
+		case opt == "XX" && policy == SetAlways:
+			policy = SetIfPresent
+		case (opt == "EX" || opt == "PX") && expireAt.IsZero() && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 {
+				s.w.Error("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			expireAt = s.r.now().Add(time.Duration(n) * unit)
+		default:
+			s.w.Error("ERR syntax error")
+			return
+		}
+	}
+	value := append([]byte(nil), args[2]...)
+	if s.r.Set(string(args[1]), value, expireAt, policy) {
+		s.w.SimpleString("OK")
+	} else {
+		s.w.Null()
+	}
+}
+
+func (s *Session) del(args [][]byte) {
+	n := 0
+	for _, key := range args[1:] {
+		if s.r.Delete(string(key)) {
+			n++
+		}
+	}
+	s.w.Integer(int64(n))
+}
+
+func (s *Session) exists(args [][]byte) {
+	n := 0
+	for _, key := range args[1:] {
+		if _, ok := s.r.Get(string(key)); ok {
+			n++
+		}
+	}
+	s.w.Integer(int64(n))
+}
+
+func (s *Session) expire(args [][]byte) {
+	seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		s.w.Error("ERR value is not an integer or out of range")
+		return
+	}
+	if s.r.Expire(string(args[1]), s.r.now().Add(time.Duration(seconds)*time.Second)) {
+		s.w.Integer(1)
+	} else {
+		s.w.Integer(0)
+	}
+}
+
+func (s *Session) ttl(args [][]byte) {
+	d := s.r.TTL(string(args[1]))
+	if d < 0 {
+		s.w.Integer(int64(d))
+		return
+	}
+	// rounded up, a key about to expire still has a second
+	s.w.Integer(int64((d + time.Second - 1) / time.Second))
+}
+
+// incr handles INCR, DECR, INCRBY and DECRBY.
+func (s *Session) incr(args [][]byte) {
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		if delta, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+			s.w.Error("ERR value is not an integer or out of range")
+			return
+		}
+	}
+	if bytes.HasPrefix(args[0], []byte("decr")) {
+		if delta == minInt64 {
+			s.w.Error("ERR decrement would overflow")
+			return
+		}
+		delta = -delta
+	}
+	n, err := s.r.Incr(string(args[1]), delta)
+	if err != nil {
+		s.w.Error("ERR " + err.Error())
+		return
+	}
+	s.w.Integer(n)
+}
+
+func (s *Session) mget(args [][]byte) {
+	s.w.Array(len(args) - 1)
+	for _, key := range args[1:] {
+		if value, ok := s.r.Get(string(key)); ok {
+			s.w.Bulk(value)
+		} else {
+			s.w.Null()
+		}
+	}
+}
+
+// subscription writes the reply of a (un)subscribe for one channel or
+// pattern, name is nil when there was nothing to unsubscribe from.
+func (s *Session) subscription(kind string, name []byte) {
+	s.w.Push(3)
+	s.w.BulkString(kind)
+	if name == nil {
+		s.w.Null()
+	} else {
+		s.w.Bulk(name)
+	}
+	s.w.Integer(int64(s.subscribed()))
+}
+
+func (s *Session) subscribe(args [][]byte) {
+	for _, channel := range args[1:] {
+		name := string(channel)
+		if _, ok := s.channels[name]; !ok {
+			s.channels[name] = struct{}{}
+			s.r.pubsub.subscribe(name, s)
+		}
+		s.subscription("subscribe", channel)
+	}
+}
+
+func (s *Session) unsubscribe(args [][]byte) {
+	channels := args[1:]
+	if len(channels) == 0 {
+		for name := range s.channels {
+			channels = append(channels, []byte(name))
+		}
+		if len(channels) == 0 {
+			s.subscription("unsubscribe", nil)
+			return
+		}
+	}
+	for _, channel := range channels {
+		name := string(channel)
+		if _, ok := s.channels[name]; ok {
+			delete(s.channels, name)
+			s.r.pubsub.unsubscribe(name, s)
+		}
+		s.subscription("unsubscribe", channel)
+	}
+}
+
+func (s *Session) psubscribe(args [][]byte) {
+	for _, pattern := range args[1:] {
+		name := string(pattern)
+		if _, ok := s.patterns[name]; !ok {
+			s.patterns[name] = struct{}{}
+			s.r.pubsub.psubscribe(name, s)
+		}
+		s.subscription("psubscribe", pattern)
+	}
+}
+
+func (s *Session) punsubscribe(args [][]byte) {
+	patterns := args[1:]
+	if len(patterns) == 0 {
+		for name := range s.patterns {
+			patterns = append(patterns, []byte(name))
+		}
+		if len(patterns) == 0 {
+			s.subscription("punsubscribe", nil)
+			return
+		}
+	}
+	for _, pattern := range patterns {
+		name := string(pattern)
+		if _, ok := s.patterns[name]; ok {
+			delete(s.patterns, name)
+			s.r.pubsub.punsubscribe(name, s)
+		}
+		s.subscription("punsubscribe", pattern)
+	}
+}
+
+func (s *Session) publish(args [][]byte) {
+	message := append([]byte(nil), args[2]...)
+	s.w.Integer(int64(s.r.pubsub.publish(string(args[1]), message)))
+}
+
+// deliver sends a published message on the session's loop, pattern is empty
+// when the session subscribed to the channel itself.
+func (s *Session) deliver(pattern, channel string, message []byte) {
+	s.conn.Eventloop().AsyncExecute(func() {
+		if s.quit {
+			return
+		}
+		if pattern == "" {
+			s.w.Push(3)
+			s.w.BulkString("message")
+		} else {
+			s.w.Push(4)
+			s.w.BulkString("pmessage")
+			s.w.BulkString(pattern)
+		}
+		s.w.BulkString(channel)
+		s.w.Bulk(message)
+		s.flush()
+	})
+}
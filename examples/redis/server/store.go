@@ -0,0 +1,177 @@
+package redis_server
+
+import (
+	"hash/crc64"
+	"muduo/pkg/errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var table = crc64.MakeTable(crc64.ISO)
+
+func hash(key string) uint64 {
+	return crc64.Checksum([]byte(key), table)
+}
+
+type SetPolicy int
+
+const (
+	SetAlways SetPolicy = iota
+	SetIfAbsent
+	SetIfPresent
+)
+
+type entry struct {
+	// value is replaced, never modified, so it can be read after the slot is unlocked
+	value    []byte
+	expireAt time.Time // zero when the key does not expire
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+type slot struct {
+	items map[string]*entry
+	mu    sync.Mutex
+}
+
+// live returns the entry of key, or nil when it has none or it has expired; an
+// expired entry is deleted right away. The caller holds s.mu.
+func (s *slot) live(key string, now time.Time) *entry {
+	e, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(now) {
+		delete(s.items, key)
+		return nil
+	}
+	return e
+}
+
+func (r *Redis) slotOf(key string) *slot {
+	return r.slots[hash(key)%uint64(r.slotn)]
+}
+
+func (r *Redis) Get(key string) (value []byte, exist bool) {
+	slot := r.slotOf(key)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if e := slot.live(key, r.now()); e != nil {
+		return e.value, true
+	}
+	return nil, false
+}
+
+// Set stores value under key, expireAt is zero for a key that does not expire.
+func (r *Redis) Set(key string, value []byte, expireAt time.Time, policy SetPolicy) (success bool) {
+	slot := r.slotOf(key)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	exist := slot.live(key, r.now()) != nil
+	if (policy == SetIfAbsent && exist) || (policy == SetIfPresent && !exist) {
+		return false
+	}
+	slot.items[key] = &entry{value: value, expireAt: expireAt}
+	return true
+}
+
+func (r *Redis) Delete(key string) (success bool) {
+	slot := r.slotOf(key)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.live(key, r.now()) == nil {
+		return false
+	}
+	delete(slot.items, key)
+	return true
+}
+
+// Expire sets when key expires, a time in the past deletes it.
+func (r *Redis) Expire(key string, at time.Time) (success bool) {
+	slot := r.slotOf(key)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	now := r.now()
+	e := slot.live(key, now)
+	if e == nil {
+		return false
+	}
+	if !now.Before(at) {
+		delete(slot.items, key)
+	} else {
+		e.expireAt = at
+	}
+	return true
+}
+
+// TTL returns how long key lives, -1 when it does not expire and -2 when it
+// does not exist.
+func (r *Redis) TTL(key string) time.Duration {
+	slot := r.slotOf(key)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	now := r.now()
+	e := slot.live(key, now)
+	switch {
+	case e == nil:
+		return -2
+	case e.expireAt.IsZero():
+		return -1
+	}
+	return e.expireAt.Sub(now)
+}
+
+// Incr adds delta to the integer stored under key, a missing key counts as 0.
+func (r *Redis) Incr(key string, delta int64) (int64, error) {
+	slot := r.slotOf(key)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	e := slot.live(key, r.now())
+	var n int64
+	if e != nil {
+		var err error
+		if n, err = strconv.ParseInt(string(e.value), 10, 64); err != nil {
+			return 0, errors.ErrNotInteger
+		}
+	}
+	if (delta > 0 && n > maxInt64-delta) || (delta < 0 && n < minInt64-delta) {
+		return 0, errors.ErrOverflow
+	}
+	n += delta
+	value := strconv.AppendInt(nil, n, 10)
+	if e == nil {
+		slot.items[key] = &entry{value: value}
+	} else {
+		e.value = value
+	}
+	return n, nil
+}
+
+const (
+	maxInt64 = 1<<63 - 1
+	minInt64 = -1 << 63
+)
+
+// sweepSlots bounds the work of one sweep, the whole keyspace is walked once
+// every slotn/sweepSlots sweeps.
+const sweepSlots = 16
+
+// sweep deletes the expired keys of the next sweepSlots slots. Reads delete the
+// keys they find expired, sweep catches the ones nobody reads.
+func (r *Redis) sweep() {
+	now := r.now()
+	for i := 0; i < sweepSlots; i++ {
+		slot := r.slots[r.sweepNext]
+		r.sweepNext = (r.sweepNext + 1) % r.slotn
+		slot.mu.Lock()
+		for key, e := range slot.items {
+			if e.expired(now) {
+				delete(slot.items, key)
+			}
+		}
+		slot.mu.Unlock()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"muduo"
+	socks5_server "muduo/examples/socks5/server"
+	"muduo/pkg/logging"
+	"strings"
+	"time"
+)
+
+func main() {
+	listen := flag.String("l", "tcp4://:1080", "address to listen on")
+	threads := flag.Int("t", 4, "number of worker loops")
+	users := flag.String("users", "", "comma separated user:password pairs, empty is no authentication")
+	connectTimeout := flag.Duration("connect-timeout", 5*time.Second, "timeout of connecting to a destination")
+	flag.Parse()
+
+	opts := []socks5_server.Option{
+		socks5_server.WithEngineCnt(*threads),
+		socks5_server.WithConnectTimeout(*connectTimeout),
+	}
+	if *users != "" {
+		m := make(map[string]string)
+		for _, pair := range strings.Split(*users, ",") {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) != 2 {
+				logging.Fatalf("socks5: -users wants user:password, got %q", pair)
+			}
+			m[kv[0]] = kv[1]
+		}
+		opts = append(opts, socks5_server.WithUsers(m))
+	}
+	el := muduo.NewEventloop("socks5")
+	s, err := socks5_server.NewServer(el, *listen, opts...)
+	if err != nil {
+		logging.Fatalf("socks5: %v", err)
+	}
+	s.Start()
+	el.AsyncExecute(func() {
+		logging.Infof("socks5 listening on %s", s.Addr())
+	})
+	s.ShutdownOnSignal(5 * time.Second)
+	el.Loop()
+}
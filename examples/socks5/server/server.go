@@ -0,0 +1,414 @@
+package socks5_server
+
+import (
+	"crypto/subtle"
+	"muduo"
+	"muduo/examples/proxy"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"muduo/socks5"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type options struct {
+	engineCnt        int
+	users            map[string]string
+	handshakeTimeout time.Duration
+	connectTimeout   time.Duration
+	highWaterMark    int
+	resolver         muduo.Resolver
+}
+
+// Option configures a Server.
+type Option func(o *options)
+
+// WithEngineCnt sets the number of loops serving connections.
+func WithEngineCnt(n int) Option {
+	return func(o *options) {
+		o.engineCnt = n
+	}
+}
+
+// WithUsers requires clients to authenticate with one of the usernames and its
+// password, by default no authentication is asked for.
+func WithUsers(users map[string]string) Option {
+	return func(o *options) {
+		o.users = users
+	}
+}
+
+// WithHandshakeTimeout closes connections whose request has not succeeded
+// within d, 10s by default.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.handshakeTimeout = d
+	}
+}
+
+// WithConnectTimeout bounds connecting to the destination of a CONNECT, 5s by
+// default.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.connectTimeout = d
+	}
+}
+
+// WithHighWaterMark sets how many bytes may wait to be written to one side of
+// a CONNECT before reading from the other side stops, 1MiB by default.
+func WithHighWaterMark(n int) Option {
+	return func(o *options) {
+		o.highWaterMark = n
+	}
+}
+
+// WithResolver replaces net.DefaultResolver for the host names of requests and
+// datagrams.
+func WithResolver(r muduo.Resolver) Option {
+	return func(o *options) {
+		o.resolver = r
+	}
+}
+
+// Stats counts the connections and requests of a Server.
+type Stats struct {
+	Accepted      int64
+	Active        int64
+	AuthFailed    int64
+	Connects      int64
+	ConnectFailed int64
+	Associations  int64
+}
+
+// Server is a SOCKS5 proxy. It serves CONNECT, relaying the bytes of the
+// client and the destination the way examples/proxy does, and UDP ASSOCIATE,
+// relaying the datagrams of the client through a UDP socket for as long as the
+// connection of the request stays open. BIND is not supported.
+type Server struct {
+	server *muduo.TcpServer
+	opts   options
+	stats  Stats // atomic
+}
+
+// NewServer creates a server listening on addr, e.g. "tcp4://:1080".
+func NewServer(el *muduo.Eventloop, addr string, opts ...Option) (*Server, error) {
+	o := options{
+		handshakeTimeout: 10 * time.Second,
+		connectTimeout:   5 * time.Second,
+		highWaterMark:    1 << 20,
+		resolver:         net.DefaultResolver,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	for user, password := range o.users {
+		if _, err := (&socks5.UserPass{Username: user, Password: password}).Append(nil); err != nil {
+			return nil, err
+		}
+	}
+	s := &Server{
+		server: muduo.NewTcpServer(el, "socks5", addr, o.engineCnt),
+		opts:   o,
+	}
+	s.server.SetOnConn(s.onConn)
+	s.server.SetOnMsg(s.onMsg)
+	return s, nil
+}
+
+func (s *Server) Start() {
+	s.server.Start()
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.server.Addr()
+}
+
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.server.Shutdown(timeout)
+}
+
+// ShutdownOnSignal shuts the server down on SIGTERM and SIGINT.
+func (s *Server) ShutdownOnSignal(timeout time.Duration) {
+	s.server.ShutdownOnSignal(timeout)
+}
+
+// Stats returns the counters of the server so far.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Accepted:      atomic.LoadInt64(&s.stats.Accepted),
+		Active:        atomic.LoadInt64(&s.stats.Active),
+		AuthFailed:    atomic.LoadInt64(&s.stats.AuthFailed),
+		Connects:      atomic.LoadInt64(&s.stats.Connects),
+		ConnectFailed: atomic.LoadInt64(&s.stats.ConnectFailed),
+		Associations:  atomic.LoadInt64(&s.stats.Associations),
+	}
+}
+
+const (
+	stateGreeting = iota
+	stateAuth
+	stateRequest
+	stateConnecting
+	stateConnected
+	stateAssociated
+	// the request failed, the answer is on its way and the client is
+	// expected to close
+	stateRefused
+)
+
+// session is a client connection, and the destination connection or the UDP
+// association of its request. It is owned by the loop of the client
+// connection, which the destination connection shares.
+type session struct {
+	s      *Server
+	in     *muduo.TcpConn
+	out    *muduo.TcpConn
+	client *muduo.TcpClient
+	assoc  *association
+	state  int
+	timer  *muduo.TimerTask
+	inEOF  bool // the client was done before the destination connected
+	closed bool
+}
+
+func (s *Server) onConn(in *muduo.TcpConn) {
+	if !in.IsConnected() {
+		sess := in.GetContext().(*session)
+		sess.closed = true
+		if sess.timer != nil {
+			sess.timer.Cancel()
+		}
+		if sess.client != nil {
+			sess.client.Stop()
+		}
+		if sess.out != nil && sess.out.IsConnected() {
+			sess.out.ForceClose()
+		}
+		if sess.assoc != nil {
+			sess.assoc.close()
+		}
+		atomic.AddInt64(&s.stats.Active, -1)
+		return
+	}
+	atomic.AddInt64(&s.stats.Accepted, 1)
+	atomic.AddInt64(&s.stats.Active, 1)
+	sess := &session{s: s, in: in}
+	in.SetContext(sess)
+	in.SetOnHalfClose(sess.onInHalfClose)
+	sess.timer = in.Eventloop().ScheduleDelay(func() {
+		sess.timer = nil
+		logging.Warnf("socks5 %s: no request in %v", in.GetPeerAddr(), s.opts.handshakeTimeout)
+		in.ForceClose()
+	}, s.opts.handshakeTimeout)
+}
+
+func (s *Server) onMsg(in *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+	in.GetContext().(*session).onMsg(buf)
+}
+
+func (sess *session) onMsg(buf *muduo.Buffer) {
+	for buf.ReadableBytes() > 0 {
+		switch sess.state {
+		case stateGreeting:
+			g, n, err := socks5.ParseGreeting(buf.Peek())
+			if err != nil {
+				logging.Warnf("socks5 %s: %v", sess.in.GetPeerAddr(), err)
+				sess.in.ForceClose()
+				return
+			}
+			if g == nil {
+				return
+			}
+			buf.Advance(n)
+			sess.greet(g)
+		case stateAuth:
+			u, n, err := socks5.ParseUserPass(buf.Peek())
+			if err != nil {
+				logging.Warnf("socks5 %s: %v", sess.in.GetPeerAddr(), err)
+				sess.in.ForceClose()
+				return
+			}
+			if u == nil {
+				return
+			}
+			buf.Advance(n)
+			sess.auth(u)
+		case stateRequest:
+			req, n, err := socks5.ParseRequest(buf.Peek())
+			if err != nil {
+				logging.Warnf("socks5 %s: %v", sess.in.GetPeerAddr(), err)
+				sess.reply(socks5.ReplyGeneralFailure, socks5.Addr{})
+				sess.refuse()
+				return
+			}
+			if req == nil {
+				return
+			}
+			buf.Advance(n)
+			sess.request(req)
+		case stateConnecting:
+			// reading is stopped until the destination connects, the pipe
+			// then sends on what is buffered
+			return
+		default:
+			// nothing is expected on the connection of an association, nor
+			// after a refusal
+			buf.Next(-1)
+		}
+	}
+}
+
+// greet selects the authentication method.
+func (sess *session) greet(g *socks5.Greeting) {
+	switch {
+	case sess.s.opts.users == nil && g.Has(socks5.MethodNoAuth):
+		sess.state = stateRequest
+		_, _ = sess.in.Write(socks5.AppendMethod(nil, socks5.MethodNoAuth))
+	case sess.s.opts.users != nil && g.Has(socks5.MethodUserPass):
+		sess.state = stateAuth
+		_, _ = sess.in.Write(socks5.AppendMethod(nil, socks5.MethodUserPass))
+	default:
+		atomic.AddInt64(&sess.s.stats.AuthFailed, 1)
+		_, _ = sess.in.Write(socks5.AppendMethod(nil, socks5.MethodNoAcceptable))
+		sess.refuse()
+	}
+}
+
+func (sess *session) auth(u *socks5.UserPass) {
+	password, ok := sess.s.opts.users[u.Username]
+	ok = ok && subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) == 1
+	_, _ = sess.in.Write(socks5.AppendAuthStatus(nil, ok))
+	if !ok {
+		logging.Warnf("socks5 %s: authentication of %q failed", sess.in.GetPeerAddr(), u.Username)
+		atomic.AddInt64(&sess.s.stats.AuthFailed, 1)
+		sess.refuse()
+		return
+	}
+	sess.state = stateRequest
+}
+
+func (sess *session) request(req *socks5.Request) {
+	switch req.Command {
+	case socks5.CmdConnect:
+		sess.connect(req.Addr)
+	case socks5.CmdUDPAssociate:
+		sess.associate(req.Addr)
+	default:
+		sess.reply(socks5.ReplyCommandNotSupported, socks5.Addr{})
+		sess.refuse()
+	}
+}
+
+func (sess *session) reply(code byte, addr socks5.Addr) {
+	b, _ := (&socks5.Reply{Code: code, Addr: addr}).Append(nil)
+	_, _ = sess.in.Write(b)
+}
+
+// refuse ends the session once the answer is written, the handshake timeout
+// closes the connection of a client that does not close it.
+func (sess *session) refuse() {
+	sess.state = stateRefused
+	sess.in.StartRead()
+	sess.in.ShutdownWrite()
+}
+
+// connect dials the destination, reading from the client stops meanwhile.
+func (sess *session) connect(addr socks5.Addr) {
+	s := sess.s
+	client, err := muduo.NewTcpClient(sess.in.Eventloop(), "tcp://"+addr.String())
+	if err != nil {
+		sess.reply(socks5.ReplyAddrNotSupported, socks5.Addr{})
+		sess.refuse()
+		return
+	}
+	sess.state = stateConnecting
+	sess.in.StopRead()
+	client.SetResolver(s.opts.resolver)
+	client.SetConnectTimeout(s.opts.connectTimeout)
+	client.SetOnConnectFailed(func(err error, attempt int) {
+		logging.Warnf("socks5 %s: connect to %s failed: %v", sess.in.GetPeerAddr(), addr, err)
+		atomic.AddInt64(&s.stats.ConnectFailed, 1)
+		client.Stop()
+		if sess.closed {
+			return
+		}
+		sess.reply(replyCode(err), socks5.Addr{})
+		sess.refuse()
+	})
+	client.SetOnConn(sess.onOutConn)
+	sess.client = client
+	client.Connect()
+}
+
+// replyCode tells the client why connecting failed.
+func replyCode(err error) byte {
+	switch err {
+	case unix.ECONNREFUSED:
+		return socks5.ReplyConnectionRefused
+	case unix.ENETUNREACH:
+		return socks5.ReplyNetworkUnreachable
+	case unix.EHOSTUNREACH, errors.ErrConnectTimeout:
+		return socks5.ReplyHostUnreachable
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return socks5.ReplyHostUnreachable
+	}
+	return socks5.ReplyGeneralFailure
+}
+
+func (sess *session) onOutConn(out *muduo.TcpConn) {
+	if !out.IsConnected() {
+		if sess.in.IsConnected() {
+			sess.in.ForceClose()
+		}
+		return
+	}
+	if sess.closed {
+		out.ForceClose()
+		return
+	}
+	sess.out = out
+	sess.state = stateConnected
+	sess.stopTimer()
+	atomic.AddInt64(&sess.s.stats.Connects, 1)
+	sess.reply(socks5.ReplySucceeded, socks5.AddrOf(out.GetLocalAddr()))
+	// what the client sent right after its request goes first
+	proxy.Pipe(sess.in, out, sess.s.opts.highWaterMark, sess.inEOF, nil)
+}
+
+// onInHalfClose is replaced by the pipe once the destination connects.
+func (sess *session) onInHalfClose(in *muduo.TcpConn) {
+	if sess.state == stateConnecting {
+		sess.inEOF = true
+		return
+	}
+	// the handshake is cut short, or an association ends
+	in.ForceClose()
+}
+
+func (sess *session) stopTimer() {
+	if sess.timer != nil {
+		sess.timer.Cancel()
+		sess.timer = nil
+	}
+}
+
+// associate opens the UDP socket of an association.
+func (sess *session) associate(addr socks5.Addr) {
+	assoc, err := newAssociation(sess, addr)
+	if err != nil {
+		logging.Errorf("socks5 %s: UDP ASSOCIATE: %v", sess.in.GetPeerAddr(), err)
+		sess.reply(socks5.ReplyGeneralFailure, socks5.Addr{})
+		sess.refuse()
+		return
+	}
+	sess.assoc = assoc
+	sess.state = stateAssociated
+	sess.stopTimer()
+	atomic.AddInt64(&sess.s.stats.Associations, 1)
+	sess.reply(socks5.ReplySucceeded, assoc.addr())
+}
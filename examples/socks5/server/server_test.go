@@ -0,0 +1,299 @@
+package socks5_server
+
+import (
+	"bytes"
+	"io"
+	"muduo"
+	"muduo/internal/muduotest"
+	"muduo/socks5"
+	"net"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	el := muduo.NewEventloop("socks5-test")
+	s, err := NewServer(el, "tcp4://127.0.0.1:0", append([]Option{WithEngineCnt(2)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	muduotest.RunLoop(t, el, func() { s.Shutdown(100 * time.Millisecond) })
+	return s
+}
+
+// read reads one message off c with parse, which returns its length once
+// complete.
+func read(t *testing.T, c net.Conn, parse func([]byte) (int, error)) []byte {
+	t.Helper()
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := c.Read(b); err != nil {
+			t.Fatalf("read %q: %v", buf, err)
+		}
+		buf = append(buf, b[0])
+		n, err := parse(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 {
+			return buf
+		}
+	}
+}
+
+func readMethod(t *testing.T, c net.Conn) byte {
+	m, _, _ := socks5.ParseMethod(read(t, c, func(b []byte) (int, error) { _, n, err := socks5.ParseMethod(b); return n, err }))
+	return m
+}
+
+func readReply(t *testing.T, c net.Conn) *socks5.Reply {
+	r, _, _ := socks5.ParseReply(read(t, c, func(b []byte) (int, error) { _, n, err := socks5.ParseReply(b); return n, err }))
+	return r
+}
+
+// handshake greets the server without authentication and sends req.
+func handshake(t *testing.T, c net.Conn, req *socks5.Request) *socks5.Reply {
+	t.Helper()
+	greeting, _ := (&socks5.Greeting{Methods: []byte{socks5.MethodNoAuth}}).Append(nil)
+	b, err := req.Append(greeting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if m := readMethod(t, c); m != socks5.MethodNoAuth {
+		t.Fatalf("method %x", m)
+	}
+	return readReply(t, c)
+}
+
+func echo(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != msg {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	backend := muduotest.EchoBackend(t)
+	s := startServer(t, WithResolver(muduo.StaticResolver{"backend.test": {"127.0.0.1"}}))
+
+	for _, host := range []string{"127.0.0.1", "backend.test"} {
+		c := muduotest.Dial(t, s.Addr())
+		r := handshake(t, c, &socks5.Request{Command: socks5.CmdConnect, Addr: socks5.NewAddr(host, backend.Port)})
+		if r.Code != socks5.ReplySucceeded || !r.Addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || r.Addr.Port == 0 {
+			t.Fatalf("%s: reply %+v", host, r)
+		}
+		echo(t, c, "ping "+host)
+	}
+
+	// the greeting, request and data in a single segment
+	c := muduotest.Dial(t, s.Addr())
+	b, _ := (&socks5.Greeting{Methods: []byte{socks5.MethodNoAuth}}).Append(nil)
+	b, _ = (&socks5.Request{Command: socks5.CmdConnect, Addr: socks5.NewAddr("127.0.0.1", backend.Port)}).Append(b)
+	if _, err := c.Write(append(b, "early"...)); err != nil {
+		t.Fatal(err)
+	}
+	readMethod(t, c)
+	if r := readReply(t, c); r.Code != socks5.ReplySucceeded {
+		t.Fatalf("reply %+v", r)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "early" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if st := s.Stats(); st.Connects != 3 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestConnectHalfClose(t *testing.T) {
+	// the backend answers once the client is done
+	backend := muduotest.Serve(t, func(c net.Conn) {
+		data, _ := io.ReadAll(c)
+		_, _ = c.Write(bytes.ToUpper(data))
+	})
+	s := startServer(t)
+	c := muduotest.Dial(t, s.Addr())
+	if r := handshake(t, c, &socks5.Request{Command: socks5.CmdConnect, Addr: socks5.AddrOf(backend)}); r.Code != socks5.ReplySucceeded {
+		t.Fatalf("reply %+v", r)
+	}
+	_, _ = c.Write([]byte("half"))
+	_ = c.CloseWrite()
+	if data, err := io.ReadAll(c); err != nil || string(data) != "HALF" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+}
+
+func TestConnectFailed(t *testing.T) {
+	s := startServer(t, WithResolver(muduo.StaticResolver{}))
+	dead := muduotest.DeadAddr(t)
+	for _, c := range []struct {
+		addr socks5.Addr
+		code byte
+	}{
+		{socks5.Addr{IP: dead.IP, Port: dead.Port}, socks5.ReplyConnectionRefused},
+		{socks5.Addr{Host: "nowhere.test", Port: 80}, socks5.ReplyHostUnreachable},
+	} {
+		conn := muduotest.Dial(t, s.Addr())
+		if r := handshake(t, conn, &socks5.Request{Command: socks5.CmdConnect, Addr: c.addr}); r.Code != c.code {
+			t.Fatalf("%v: reply %+v", c.addr, r)
+		}
+		if data, err := io.ReadAll(conn); err != nil || len(data) != 0 {
+			t.Fatalf("%v: read %q, %v", c.addr, data, err)
+		}
+	}
+	if st := s.Stats(); st.ConnectFailed != 2 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	s := startServer(t)
+	c := muduotest.Dial(t, s.Addr())
+	if r := handshake(t, c, &socks5.Request{Command: socks5.CmdBind}); r.Code != socks5.ReplyCommandNotSupported {
+		t.Fatalf("reply %+v", r)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	backend := muduotest.EchoBackend(t)
+	s := startServer(t, WithUsers(map[string]string{"alice": "s3cret"}))
+
+	// through the client side of the library
+	el := muduo.NewEventloop("client")
+	client, _ := muduo.NewTcpClient(el, "tcp4://"+backend.String())
+	if err := client.SetSocks5("tcp4://"+s.Addr(), "alice", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 4)
+	client.SetOnConn(func(conn *muduo.TcpConn) {
+		if conn.IsConnected() {
+			_, _ = conn.Write([]byte("hello"))
+		}
+	})
+	client.SetOnMsg(func(conn *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+		received <- string(buf.Next(-1))
+	})
+	client.Connect()
+	muduotest.RunLoop(t, el, nil)
+	got := ""
+	for got != "hello" {
+		select {
+		case s := <-received:
+			got += s
+		case <-time.After(5 * time.Second):
+			t.Fatalf("read %q", got)
+		}
+	}
+	el.AsyncExecute(client.Stop)
+
+	// a wrong password
+	c := muduotest.Dial(t, s.Addr())
+	b, _ := (&socks5.Greeting{Methods: []byte{socks5.MethodNoAuth, socks5.MethodUserPass}}).Append(nil)
+	b, _ = (&socks5.UserPass{Username: "alice", Password: "guess"}).Append(b)
+	_, _ = c.Write(b)
+	if m := readMethod(t, c); m != socks5.MethodUserPass {
+		t.Fatalf("method %x", m)
+	}
+	status := read(t, c, func(b []byte) (int, error) { _, n, err := socks5.ParseAuthStatus(b); return n, err })
+	if ok, _, _ := socks5.ParseAuthStatus(status); ok {
+		t.Fatal("wrong password accepted")
+	}
+	if data, _ := io.ReadAll(c); len(data) != 0 {
+		t.Fatalf("read %q after a failed authentication", data)
+	}
+
+	// no authentication offered
+	c = muduotest.Dial(t, s.Addr())
+	b, _ = (&socks5.Greeting{Methods: []byte{socks5.MethodNoAuth}}).Append(nil)
+	_, _ = c.Write(b)
+	if m := readMethod(t, c); m != socks5.MethodNoAcceptable {
+		t.Fatalf("method %x", m)
+	}
+	if st := s.Stats(); st.AuthFailed != 2 || st.Connects != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	s := startServer(t, WithHandshakeTimeout(100*time.Millisecond))
+	c := muduotest.Dial(t, s.Addr())
+	_, _ = c.Write([]byte{socks5.Version})
+	if data, err := io.ReadAll(c); err != nil || len(data) != 0 {
+		t.Fatalf("read %q, %v", data, err)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echoUDP, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoUDP.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echoUDP.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echoUDP.WriteTo(bytes.ToUpper(buf[:n]), from)
+		}
+	}()
+	echoAddr := echoUDP.LocalAddr().(*net.UDPAddr)
+	s := startServer(t, WithResolver(muduo.StaticResolver{"echo.test": {"127.0.0.1"}}))
+
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	_ = udp.SetDeadline(time.Now().Add(5 * time.Second))
+	c := muduotest.Dial(t, s.Addr())
+	r := handshake(t, c, &socks5.Request{Command: socks5.CmdUDPAssociate, Addr: socks5.AddrOf(udp.LocalAddr())})
+	if r.Code != socks5.ReplySucceeded {
+		t.Fatalf("reply %+v", r)
+	}
+	relay := &net.UDPAddr{IP: r.Addr.IP, Port: r.Addr.Port}
+
+	for _, to := range []socks5.Addr{{IP: echoAddr.IP, Port: echoAddr.Port}, {Host: "echo.test", Port: echoAddr.Port}} {
+		b, _ := (&socks5.Datagram{Addr: to, Data: []byte("ping " + to.String())}).Append(nil)
+		if _, err := udp.WriteTo(b, relay); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2048)
+		n, from, err := udp.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.String() != relay.String() {
+			t.Fatalf("datagram from %v", from)
+		}
+		d, err := socks5.ParseDatagram(buf[:n])
+		if err != nil || d.Addr.String() != echoAddr.String() || string(d.Data) != "PING "+string(bytes.ToUpper([]byte(to.String()))) {
+			t.Fatalf("datagram %+v, %v", d, err)
+		}
+	}
+
+	// the association ends with the connection
+	_ = c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Active != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v", s.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := s.Stats(); st.Associations != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+}
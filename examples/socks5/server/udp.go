@@ -0,0 +1,183 @@
+package socks5_server
+
+import (
+	"context"
+	"muduo"
+	"muduo/pkg/logging"
+	"muduo/socks5"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// udpLookupTimeout bounds resolving the host name of a datagram.
+const udpLookupTimeout = 5 * time.Second
+
+// association relays the datagrams of a client through a UDP socket bound to
+// the address its request came in on. Only datagrams from the address of the
+// client connection go out, and only those from addresses the client has sent
+// to come back. It runs on the loop of the session.
+type association struct {
+	sess       *session
+	fd         int
+	family     int
+	w          *muduo.Watcher
+	clientIP   net.IP
+	clientPort int // 0 until the first datagram when the request did not tell
+	peers      map[string]bool
+	buf        []byte
+	closed     bool
+}
+
+// newAssociation binds the socket and watches it, from, the address of the
+// request, is where the client sends from.
+func newAssociation(sess *session, from socks5.Addr) (*association, error) {
+	local, ok1 := sess.in.GetLocalAddr().(*net.TCPAddr)
+	peer, ok2 := sess.in.GetPeerAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, unix.EAFNOSUPPORT
+	}
+	family := unix.AF_INET6
+	if local.IP.To4() != nil {
+		family = unix.AF_INET
+	}
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.Bind(fd, sockaddr(family, local.IP, 0)); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	a := &association{
+		sess:       sess,
+		fd:         fd,
+		family:     family,
+		clientIP:   peer.IP,
+		clientPort: from.Port,
+		peers:      make(map[string]bool),
+		buf:        make([]byte, 64*1024),
+	}
+	if a.w, err = sess.in.Eventloop().Watch(fd, muduo.Readable, a.handleRead); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return a, nil
+}
+
+// addr returns the address the socket is bound to.
+func (a *association) addr() socks5.Addr {
+	sa, err := unix.Getsockname(a.fd)
+	if err != nil {
+		return socks5.Addr{}
+	}
+	return socks5.AddrOf(muduo.SockaddrToTCPOrUnixAddr(sa))
+}
+
+func (a *association) close() {
+	if a.closed {
+		return
+	}
+	a.closed = true
+	a.w.Unwatch()
+	_ = unix.Close(a.fd)
+}
+
+func (a *association) handleRead(w *muduo.Watcher, events muduo.WatchEvent, ts time.Time) {
+	for !a.closed {
+		n, sa, err := unix.Recvfrom(a.fd, a.buf, 0)
+		if err != nil {
+			if err != unix.EAGAIN && err != unix.EINTR {
+				logging.Errorf("socks5 udp recvfrom: %v", err)
+			}
+			return
+		}
+		from, ok := muduo.SockaddrToTCPOrUnixAddr(sa).(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		if from.IP.Equal(a.clientIP) && (a.clientPort == 0 || from.Port == a.clientPort) {
+			a.clientPort = from.Port
+			a.fromClient(a.buf[:n])
+		} else if a.peers[from.String()] {
+			a.toClient(from, a.buf[:n])
+		}
+	}
+}
+
+// fromClient sends the data of a datagram of the client to its destination.
+// Fragments are dropped, as the RFC allows.
+func (a *association) fromClient(data []byte) {
+	d, err := socks5.ParseDatagram(data)
+	if err != nil || d.Frag != 0 {
+		return
+	}
+	if d.Addr.IP != nil {
+		a.send(d.Addr.IP, d.Addr.Port, d.Data)
+		return
+	}
+	host, port, data := d.Addr.Host, d.Addr.Port, append([]byte(nil), d.Data...)
+	el := a.sess.in.Eventloop()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), udpLookupTimeout)
+		defer cancel()
+		addrs, err := a.sess.s.opts.resolver.LookupIPAddr(ctx, host)
+		el.AsyncExecute(func() {
+			if err != nil {
+				logging.Debugf("socks5 udp resolve %s: %v", host, err)
+				return
+			}
+			for _, ip := range addrs {
+				if !a.closed && sockaddr(a.family, ip.IP, port) != nil {
+					a.send(ip.IP, port, data)
+					return
+				}
+			}
+		})
+	}()
+}
+
+func (a *association) send(ip net.IP, port int, data []byte) {
+	to := sockaddr(a.family, ip, port)
+	if to == nil {
+		return
+	}
+	a.peers[(&net.TCPAddr{IP: ip, Port: port}).String()] = true
+	if err := unix.Sendto(a.fd, data, 0, to); err != nil {
+		logging.Debugf("socks5 udp sendto: %v", err)
+	}
+}
+
+// toClient passes a datagram back to the client, with the address it came
+// from.
+func (a *association) toClient(from *net.TCPAddr, data []byte) {
+	ip := from.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	b, err := (&socks5.Datagram{Addr: socks5.Addr{IP: ip, Port: from.Port}, Data: data}).Append(nil)
+	if err != nil {
+		return
+	}
+	if err := unix.Sendto(a.fd, b, 0, sockaddr(a.family, a.clientIP, a.clientPort)); err != nil {
+		logging.Debugf("socks5 udp sendto: %v", err)
+	}
+}
+
+// sockaddr returns the address of ip and port for a socket of family, nil
+// when an IPv4 socket cannot reach ip.
+func sockaddr(family int, ip net.IP, port int) unix.Sockaddr {
+	if family == unix.AF_INET {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil
+		}
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return sa
+	}
+	sa := &unix.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return sa
+}
@@ -0,0 +1,181 @@
+// Package http is an HTTP/1.1 server on top of muduo.TcpServer, in the spirit of
+// muduo's net/http. Requests are parsed incrementally from the connection's
+// input buffer, connections are kept alive and pipelined requests are answered
+// in order. Handlers run on the connection's loop; a handler that calls
+// ResponseWriter.Async may finish its response later from any goroutine.
+package http
+
+import (
+	"net/textproto"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Header maps canonical header names to their values.
+type Header map[string][]string
+
+func (h Header) Get(key string) string {
+	if v := h[textproto.CanonicalMIMEHeaderKey(key)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (h Header) Set(key, value string) {
+	h[textproto.CanonicalMIMEHeaderKey(key)] = []string{value}
+}
+
+func (h Header) Add(key, value string) {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+func (h Header) Del(key string) {
+	delete(h, textproto.CanonicalMIMEHeaderKey(key))
+}
+
+// appendTo writes the header lines in key order.
+func (h Header) appendTo(b []byte) []byte {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			b = append(b, k...)
+			b = append(b, ": "...)
+			b = append(b, v...)
+			b = append(b, "\r\n"...)
+		}
+	}
+	return b
+}
+
+const (
+	StatusContinue              = 100
+	StatusOK                    = 200
+	StatusNoContent             = 204
+	StatusNotModified           = 304
+	StatusBadRequest            = 400
+	StatusNotFound              = 404
+	StatusMethodNotAllowed      = 405
+	StatusRequestTimeout        = 408
+	StatusRequestEntityTooLarge = 413
+	StatusExpectationFailed     = 417
+	StatusHeaderFieldsTooLarge  = 431
+	StatusInternalServerError   = 500
+	StatusNotImplemented        = 501
+	StatusVersionNotSupported   = 505
+)
+
+var statusText = map[int]string{
+	100: "Continue",
+	200: "OK",
+	201: "Created",
+	202: "Accepted",
+	204: "No Content",
+	206: "Partial Content",
+	301: "Moved Permanently",
+	302: "Found",
+	304: "Not Modified",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	408: "Request Timeout",
+	409: "Conflict",
+	413: "Request Entity Too Large",
+	414: "URI Too Long",
+	417: "Expectation Failed",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase of code, or "" when it is unknown.
+func StatusText(code int) string {
+	return statusText[code]
+}
+
+// bodyAllowed reports whether a response with status may carry a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != StatusNoContent && status != StatusNotModified
+}
+
+func appendStatusLine(b []byte, status int) []byte {
+	b = append(b, "HTTP/1.1 "...)
+	b = strconv.AppendInt(b, int64(status), 10)
+	b = append(b, ' ')
+	if text := statusText[status]; text != "" {
+		b = append(b, text...)
+	} else {
+		b = append(b, "Status"...)
+	}
+	return append(b, "\r\n"...)
+}
+
+type options struct {
+	maxHeaderBytes int
+	maxBodyBytes   int64
+	maxPipelined   int
+	idleTimeout    time.Duration
+}
+
+// Option configures a Server.
+type Option func(o *options)
+
+// WithMaxHeaderBytes bounds the request line and headers of a request, 64KiB by
+// default. Longer requests are answered with 431 and the connection is closed.
+func WithMaxHeaderBytes(n int) Option {
+	return func(o *options) {
+		o.maxHeaderBytes = n
+	}
+}
+
+// WithMaxBodyBytes bounds request bodies, 8MiB by default. Longer bodies are
+// answered with 413 and the connection is closed.
+func WithMaxBodyBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBodyBytes = n
+	}
+}
+
+// WithMaxPipelined bounds the requests of one connection that are answered or
+// waiting to be, 32 by default. Further requests are parsed once earlier
+// responses are written.
+func WithMaxPipelined(n int) Option {
+	return func(o *options) {
+		o.maxPipelined = n
+	}
+}
+
+// WithIdleTimeout closes keep-alive connections that stay idle for d between
+// requests, 60s by default. 0 keeps them open.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = d
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		maxHeaderBytes: 64 << 10,
+		maxBodyBytes:   8 << 20,
+		maxPipelined:   32,
+		idleTimeout:    60 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
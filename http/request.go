@@ -0,0 +1,321 @@
+package http
+
+import (
+	"bytes"
+	"muduo"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Request is a parsed HTTP request, its body is read completely before the
+// handler runs.
+type Request struct {
+	Method     string
+	Target     string // as sent on the request line
+	Path       string
+	RawQuery   string
+	Proto      string
+	ProtoMinor int // HTTP/1.ProtoMinor
+	Header     Header
+	Body       []byte
+	// ContentLength is the length of the body, -1 when it is chunked.
+	ContentLength int64
+	// Close is set when the connection closes after the response.
+	Close      bool
+	RemoteAddr string
+	// Params holds the values of the route's path parameters.
+	Params map[string]string
+
+	chunked bool
+	expect  bool // wants 100 Continue before sending the body
+}
+
+// Query parses RawQuery.
+func (r *Request) Query() url.Values {
+	v, _ := url.ParseQuery(r.RawQuery)
+	return v
+}
+
+// statusError is a malformed request, answered with status before closing.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return strconv.Itoa(e.status) + " " + e.msg
+}
+
+func badRequest(msg string) *statusError {
+	return &statusError{status: StatusBadRequest, msg: msg}
+}
+
+type parseState int
+
+const (
+	stRequestLine parseState = iota
+	stHeader
+	stBody
+	stChunkSize
+	stChunkData
+	stChunkEnd
+	stTrailer
+	stDone
+)
+
+// event is what parser.next found in the buffer.
+type event int
+
+const (
+	evNone    event = iota // more input is needed
+	evHeaders              // the request's headers are complete, its body follows
+	evRequest              // the request is complete
+)
+
+var crlf = []byte("\r\n")
+
+// parser reads requests incrementally, it keeps its place between calls.
+type parser struct {
+	opts        *options
+	state       parseState
+	req         *Request
+	headerBytes int
+	remain      int64 // of the body or the current chunk
+}
+
+// next consumes buf until an event happens or the input runs out.
+func (p *parser) next(buf *muduo.Buffer) (event, error) {
+	for {
+		switch p.state {
+		case stRequestLine, stHeader, stChunkSize, stChunkEnd, stTrailer:
+			line, ok, err := p.line(buf)
+			if !ok || err != nil {
+				return evNone, err
+			}
+			if ev, err := p.handleLine(line); ev != evNone || err != nil {
+				return ev, err
+			}
+		case stBody, stChunkData:
+			if buf.ReadableBytes() == 0 {
+				return evNone, nil
+			}
+			n := int64(buf.ReadableBytes())
+			if n > p.remain {
+				n = p.remain
+			}
+			p.req.Body = append(p.req.Body, buf.Next(int(n))...)
+			p.remain -= n
+			if p.remain > 0 {
+				return evNone, nil
+			}
+			if p.state == stChunkData {
+				p.state = stChunkEnd
+				continue
+			}
+			p.state = stDone
+		case stDone:
+			p.state = stRequestLine
+			p.headerBytes = 0
+			return evRequest, nil
+		}
+	}
+}
+
+// line returns the next CRLF terminated line without the CRLF. Lines of the
+// request head count against the header limit.
+func (p *parser) line(buf *muduo.Buffer) ([]byte, bool, error) {
+	head := p.state == stRequestLine || p.state == stHeader || p.state == stTrailer
+	i := buf.Search(crlf)
+	if i < 0 {
+		if head && p.headerBytes+buf.ReadableBytes() > p.opts.maxHeaderBytes {
+			return nil, false, &statusError{status: StatusHeaderFieldsTooLarge, msg: "request header is too large"}
+		}
+		if !head && buf.ReadableBytes() > 1024 {
+			return nil, false, badRequest("chunk size line is too long")
+		}
+		return nil, false, nil
+	}
+	if head {
+		p.headerBytes += i + 2
+		if p.headerBytes > p.opts.maxHeaderBytes {
+			return nil, false, &statusError{status: StatusHeaderFieldsTooLarge, msg: "request header is too large"}
+		}
+	}
+	line := buf.Next(i + 2)
+	return line[:i], true, nil
+}
+
+func (p *parser) handleLine(line []byte) (event, error) {
+	switch p.state {
+	case stRequestLine:
+		if len(line) == 0 {
+			// RFC 7230 3.5: ignore empty lines before the request line
+			return evNone, nil
+		}
+		return evNone, p.requestLine(line)
+	case stHeader:
+		if len(line) == 0 {
+			return p.headersDone()
+		}
+		return evNone, p.header(line)
+	case stChunkSize:
+		if i := bytes.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+		if err != nil || size < 0 {
+			return evNone, badRequest("bad chunk size")
+		}
+		if size == 0 {
+			p.state = stTrailer
+			return evNone, nil
+		}
+		if int64(len(p.req.Body))+size > p.opts.maxBodyBytes {
+			return evNone, &statusError{status: StatusRequestEntityTooLarge, msg: "request body is too large"}
+		}
+		p.remain = size
+		p.state = stChunkData
+	case stChunkEnd:
+		if len(line) != 0 {
+			return evNone, badRequest("chunk data is not followed by CRLF")
+		}
+		p.state = stChunkSize
+	case stTrailer:
+		if len(line) == 0 {
+			p.state = stDone
+			return evNone, nil
+		}
+		// trailers are accepted but not exposed
+	}
+	return evNone, nil
+}
+
+func (p *parser) requestLine(line []byte) error {
+	s := string(line)
+	i := strings.IndexByte(s, ' ')
+	j := strings.LastIndexByte(s, ' ')
+	if i <= 0 || j <= i+1 {
+		return badRequest("malformed request line")
+	}
+	req := &Request{
+		Method:        s[:i],
+		Target:        s[i+1 : j],
+		Proto:         s[j+1:],
+		Header:        make(Header),
+		ContentLength: 0,
+	}
+	switch req.Proto {
+	case "HTTP/1.1":
+		req.ProtoMinor = 1
+	case "HTTP/1.0":
+		req.Close = true
+	default:
+		if strings.HasPrefix(req.Proto, "HTTP/") {
+			return &statusError{status: StatusVersionNotSupported, msg: "unsupported protocol version"}
+		}
+		return badRequest("malformed request line")
+	}
+	switch {
+	case strings.HasPrefix(req.Target, "/"):
+		req.Path = req.Target
+		if k := strings.IndexByte(req.Path, '?'); k >= 0 {
+			req.Path, req.RawQuery = req.Path[:k], req.Path[k+1:]
+		}
+	case req.Target == "*" && req.Method == "OPTIONS":
+		req.Path = "*"
+	default:
+		u, err := url.ParseRequestURI(req.Target)
+		if err != nil || u.Host == "" {
+			return badRequest("malformed request target")
+		}
+		req.Path, req.RawQuery = u.EscapedPath(), u.RawQuery
+		if req.Path == "" {
+			req.Path = "/"
+		}
+	}
+	p.req = req
+	p.headerBytes = len(line) + 2
+	p.state = stHeader
+	return nil
+}
+
+func (p *parser) header(line []byte) error {
+	if line[0] == ' ' || line[0] == '\t' {
+		return badRequest("obsolete line folding")
+	}
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 || bytes.IndexAny(line[:i], " \t") >= 0 {
+		return badRequest("malformed header line")
+	}
+	key := textproto.CanonicalMIMEHeaderKey(string(line[:i]))
+	value := string(bytes.TrimSpace(line[i+1:]))
+	p.req.Header[key] = append(p.req.Header[key], value)
+	return nil
+}
+
+// headersDone works out how the body is framed and whether the connection
+// stays open.
+func (p *parser) headersDone() (event, error) {
+	req := p.req
+	if req.ProtoMinor == 1 && len(req.Header["Host"]) != 1 {
+		return evNone, badRequest("missing or repeated Host header")
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(token)) {
+			case "close":
+				req.Close = true
+			case "keep-alive":
+				if req.ProtoMinor == 0 {
+					req.Close = false
+				}
+			}
+		}
+	}
+	te, cl := req.Header["Transfer-Encoding"], req.Header["Content-Length"]
+	switch {
+	case len(te) > 0:
+		if len(cl) > 0 {
+			return evNone, badRequest("both Transfer-Encoding and Content-Length")
+		}
+		codings := strings.Split(strings.Join(te, ","), ",")
+		if len(codings) != 1 || !strings.EqualFold(strings.TrimSpace(codings[0]), "chunked") {
+			return evNone, &statusError{status: StatusNotImplemented, msg: "unsupported transfer coding"}
+		}
+		req.chunked = true
+		req.ContentLength = -1
+		p.state = stChunkSize
+	case len(cl) > 0:
+		n, err := strconv.ParseInt(cl[0], 10, 64)
+		for _, v := range cl[1:] {
+			if v != cl[0] {
+				err = strconv.ErrSyntax
+			}
+		}
+		if err != nil || n < 0 {
+			return evNone, badRequest("bad Content-Length")
+		}
+		if n > p.opts.maxBodyBytes {
+			return evNone, &statusError{status: StatusRequestEntityTooLarge, msg: "request body is too large"}
+		}
+		req.ContentLength = n
+		if n > 0 {
+			req.Body = make([]byte, 0, n)
+			p.remain = n
+			p.state = stBody
+		} else {
+			p.state = stDone
+		}
+	default:
+		p.state = stDone
+	}
+	if expect := req.Header.Get("Expect"); expect != "" {
+		if !strings.EqualFold(expect, "100-continue") {
+			return evNone, &statusError{status: StatusExpectationFailed, msg: "unsupported expectation"}
+		}
+		req.expect = req.ProtoMinor == 1 && p.state != stDone
+	}
+	return evHeaders, nil
+}
@@ -0,0 +1,89 @@
+package http
+
+import (
+	"muduo"
+	"strings"
+	"testing"
+)
+
+// feed writes input into a parser one byte at a time and collects the requests.
+func feed(t *testing.T, opts *options, input string) ([]*Request, error) {
+	t.Helper()
+	p := &parser{opts: opts}
+	buf := muduo.NewBuffer()
+	var reqs []*Request
+	for i := 0; i < len(input); i++ {
+		_, _ = buf.Write([]byte{input[i]})
+		for {
+			ev, err := p.next(buf)
+			if err != nil {
+				return reqs, err
+			}
+			if ev == evNone {
+				break
+			}
+			if ev == evRequest {
+				reqs = append(reqs, p.req)
+			}
+		}
+	}
+	return reqs, nil
+}
+
+func TestParser(t *testing.T) {
+	input := "\r\nGET /a/b?x=1&y=2 HTTP/1.1\r\nHost: example.com\r\nX-Multi: 1\r\nx-multi: 2\r\n\r\n" +
+		"POST /upload HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\n\r\nhello" +
+		"PUT /chunked HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3;ext=1\r\nabc\r\n2\r\nde\r\n0\r\nTrailer: x\r\n\r\n" +
+		"GET http://example.com/abs?q HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"
+	reqs, err := feed(t, newOptions(nil), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 4 {
+		t.Fatalf("parsed %d requests", len(reqs))
+	}
+	get := reqs[0]
+	if get.Method != "GET" || get.Path != "/a/b" || get.RawQuery != "x=1&y=2" || get.Query().Get("y") != "2" {
+		t.Errorf("GET = %+v", get)
+	}
+	if got := get.Header["X-Multi"]; len(got) != 2 || get.Header.Get("host") != "example.com" || get.Close {
+		t.Errorf("GET header = %v", get.Header)
+	}
+	if post := reqs[1]; string(post.Body) != "hello" || post.ContentLength != 5 {
+		t.Errorf("POST body = %q", post.Body)
+	}
+	if put := reqs[2]; string(put.Body) != "abcde" || put.ContentLength != -1 {
+		t.Errorf("PUT body = %q", put.Body)
+	}
+	if abs := reqs[3]; abs.Path != "/abs" || abs.RawQuery != "q" || abs.ProtoMinor != 0 || abs.Close {
+		t.Errorf("absolute form = %+v", abs)
+	}
+}
+
+func TestParser_Errors(t *testing.T) {
+	small := newOptions([]Option{WithMaxHeaderBytes(128), WithMaxBodyBytes(4)})
+	for _, tc := range []struct {
+		name   string
+		input  string
+		status int
+	}{
+		{"request line", "GET /\r\n", StatusBadRequest},
+		{"version", "GET / HTTP/2.0\r\n", StatusVersionNotSupported},
+		{"no host", "GET / HTTP/1.1\r\n\r\n", StatusBadRequest},
+		{"folding", "GET / HTTP/1.1\r\nHost: h\r\n x\r\n", StatusBadRequest},
+		{"bad header", "GET / HTTP/1.1\r\nHost : h\r\n", StatusBadRequest},
+		{"header size", "GET / HTTP/1.1\r\nHost: h\r\nX: " + strings.Repeat("a", 128), StatusHeaderFieldsTooLarge},
+		{"body size", "POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\n\r\n", StatusRequestEntityTooLarge},
+		{"chunked size", "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n", StatusRequestEntityTooLarge},
+		{"chunk size", "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", StatusBadRequest},
+		{"both lengths", "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\nContent-Length: 1\r\n\r\n", StatusBadRequest},
+		{"coding", "POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: gzip\r\n\r\n", StatusNotImplemented},
+		{"expect", "POST / HTTP/1.1\r\nHost: h\r\nExpect: magic\r\n\r\n", StatusExpectationFailed},
+	} {
+		_, err := feed(t, small, tc.input)
+		if se, ok := err.(*statusError); !ok || se.status != tc.status {
+			t.Errorf("%s: err = %v, want status %d", tc.name, err, tc.status)
+		}
+	}
+}
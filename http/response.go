@@ -0,0 +1,188 @@
+package http
+
+import (
+	"muduo"
+	"muduo/pkg/errors"
+	"strconv"
+	"sync"
+)
+
+// ResponseWriter builds the response to one request. Written body bytes are
+// buffered until Flush or Finish. A response that is finished without an
+// earlier Flush is sent with a Content-Length, a flushed one is chunked unless
+// the handler set Content-Length itself.
+//
+// The handler runs on the connection's loop and the response is finished when
+// it returns, unless it called Async. Then the response may be written and must
+// be finished later from any goroutine, though from one at a time.
+type ResponseWriter struct {
+	cs         *connState
+	req        *Request
+	header     Header
+	status     int
+	body       []byte // written and not sent yet
+	committed  bool   // the header is produced
+	chunked    bool
+	closeAfter bool
+	async      bool
+	finished   bool
+	bodyDone   bool // the whole request body is read
+
+	mu      sync.Mutex
+	head    bool   // first in the connection's queue, output goes straight to the connection
+	pending []byte // output produced while earlier responses were still being written
+	done    bool   // the final output is produced
+}
+
+func newResponseWriter(cs *connState, req *Request) *ResponseWriter {
+	return &ResponseWriter{
+		cs:         cs,
+		req:        req,
+		header:     make(Header),
+		closeAfter: req.Close,
+	}
+}
+
+func (w *ResponseWriter) Header() Header {
+	return w.header
+}
+
+// WriteHeader sets the status code, 200 when it is not called. Only the first
+// call before the header is sent counts.
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && !w.committed {
+		w.status = status
+	}
+}
+
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	if w.finished {
+		return 0, errors.ErrResponseFinished
+	}
+	w.WriteHeader(StatusOK)
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
+
+// Flush sends the header and the body written so far.
+func (w *ResponseWriter) Flush() {
+	if w.finished {
+		return
+	}
+	var out []byte
+	if !w.committed {
+		out = w.appendHeader(out, false)
+	}
+	w.emit(w.appendBody(out), false)
+}
+
+// Async keeps the response open after the handler returns, it must be called by
+// the handler. Finish completes the response.
+func (w *ResponseWriter) Async() {
+	w.async = true
+}
+
+// Finish sends what is left of the response. Later calls do nothing.
+func (w *ResponseWriter) Finish() {
+	if w.finished {
+		return
+	}
+	w.finished = true
+	var out []byte
+	if !w.committed {
+		out = w.appendHeader(out, true)
+	}
+	out = w.appendBody(out)
+	if w.chunked {
+		out = append(out, "0\r\n\r\n"...)
+	}
+	w.emit(out, true)
+}
+
+// Error replies with status and msg as plain text.
+func Error(w *ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(msg + "\n"))
+}
+
+// appendHeader commits the status line and header. When the response is final
+// its body length is known, otherwise it is chunked, or close delimited for
+// HTTP/1.0 clients.
+func (w *ResponseWriter) appendHeader(b []byte, final bool) []byte {
+	w.committed = true
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+	h := w.header
+	if bodyAllowed(w.status) {
+		if _, ok := h["Content-Length"]; !ok {
+			switch {
+			case final:
+				h.Set("Content-Length", strconv.Itoa(len(w.body)))
+			case w.req.ProtoMinor == 1:
+				h.Set("Transfer-Encoding", "chunked")
+				w.chunked = true
+			default:
+				w.closeAfter = true
+			}
+		}
+	} else {
+		h.Del("Content-Length")
+		h.Del("Transfer-Encoding")
+	}
+	if w.closeAfter {
+		h.Set("Connection", "close")
+	} else if w.req.ProtoMinor == 0 {
+		h.Set("Connection", "keep-alive")
+	}
+	b = appendStatusLine(b, w.status)
+	b = h.appendTo(b)
+	return append(b, "\r\n"...)
+}
+
+func (w *ResponseWriter) appendBody(b []byte) []byte {
+	body := w.body
+	w.body = w.body[:0]
+	if len(body) == 0 || w.req.Method == "HEAD" || !bodyAllowed(w.status) {
+		return b
+	}
+	if !w.chunked {
+		return append(b, body...)
+	}
+	b = strconv.AppendInt(b, int64(len(body)), 16)
+	b = append(b, "\r\n"...)
+	b = append(b, body...)
+	return append(b, "\r\n"...)
+}
+
+// emit hands output to the connection in request order. Responses behind the
+// head of the queue keep it until they get there.
+func (w *ResponseWriter) emit(out []byte, last bool) {
+	w.mu.Lock()
+	if !w.head {
+		w.pending = append(w.pending, out...)
+		w.done = w.done || last
+		w.mu.Unlock()
+		return
+	}
+	w.mu.Unlock()
+	cs := w.cs
+	if !w.async {
+		// on the loop
+		cs.write(out)
+		if last {
+			cs.finished(w)
+		}
+		return
+	}
+	_ = cs.conn.AsyncWrite(out, func(_ *muduo.TcpConn, err error) error {
+		if last {
+			cs.finished(w)
+		}
+		if err == errors.ErrConnNotOpened {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"sort"
+	"strings"
+)
+
+type route struct {
+	method   string
+	segments []string
+	handler  Handler
+}
+
+// Router dispatches requests by method and path. Patterns are matched segment by
+// segment: ":name" matches any one segment and "*name", which must come last,
+// matches the rest of the path; the values are put in Request.Params. Routes
+// are tried in the order they were added.
+type Router struct {
+	routes []*route
+	// NotFound answers requests no route matches, a plain 404 when nil.
+	NotFound Handler
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle adds a route, an empty method matches every method. GET routes answer
+// HEAD requests as well.
+func (rt *Router) Handle(method string, pattern string, h Handler) {
+	rt.routes = append(rt.routes, &route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  h,
+	})
+}
+
+func (rt *Router) HandleFunc(method string, pattern string, f func(w *ResponseWriter, r *Request)) {
+	rt.Handle(method, pattern, HandlerFunc(f))
+}
+
+func (rt *Router) ServeHTTP(w *ResponseWriter, r *Request) {
+	path := splitPath(r.Path)
+	var allowed []string
+	for _, rte := range rt.routes {
+		params, ok := rte.match(path)
+		if !ok {
+			continue
+		}
+		if rte.method != "" && rte.method != r.Method && !(rte.method == "GET" && r.Method == "HEAD") {
+			allowed = append(allowed, rte.method)
+			continue
+		}
+		r.Params = params
+		rte.handler.ServeHTTP(w, r)
+		return
+	}
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		Error(w, StatusMethodNotAllowed, StatusText(StatusMethodNotAllowed))
+		return
+	}
+	if rt.NotFound != nil {
+		rt.NotFound.ServeHTTP(w, r)
+		return
+	}
+	Error(w, StatusNotFound, StatusText(StatusNotFound))
+}
+
+func (rte *route) match(path []string) (map[string]string, bool) {
+	var params map[string]string
+	set := func(name, value string) {
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = value
+	}
+	for i, seg := range rte.segments {
+		if strings.HasPrefix(seg, "*") {
+			set(seg[1:], strings.Join(path[i:], "/"))
+			return params, true
+		}
+		if i >= len(path) {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, ":") {
+			set(seg[1:], path[i])
+		} else if seg != path[i] {
+			return nil, false
+		}
+	}
+	return params, len(path) == len(rte.segments)
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
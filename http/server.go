@@ -0,0 +1,243 @@
+package http
+
+import (
+	"muduo"
+	"muduo/pkg/logging"
+	"time"
+)
+
+// Handler answers a request, see ResponseWriter for when the response is sent.
+type Handler interface {
+	ServeHTTP(w *ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts a function to Handler.
+type HandlerFunc func(w *ResponseWriter, r *Request)
+
+func (f HandlerFunc) ServeHTTP(w *ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+type Server struct {
+	svr     *muduo.TcpServer
+	handler Handler
+	opts    *options
+}
+
+func NewServer(el *muduo.Eventloop, name string, addr string, engineCnt int, handler Handler, opts ...Option) *Server {
+	s := &Server{
+		svr:     muduo.NewTcpServer(el, name, addr, engineCnt),
+		handler: handler,
+		opts:    newOptions(opts),
+	}
+	s.svr.SetOnConn(s.onConn)
+	s.svr.SetOnMsg(s.onMsg)
+	return s
+}
+
+func (s *Server) Start() {
+	s.svr.Start()
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.svr.Addr()
+}
+
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.svr.Shutdown(timeout)
+}
+
+func (s *Server) onConn(conn *muduo.TcpConn) {
+	if conn.IsConnected() {
+		cs := &connState{
+			srv:    s,
+			conn:   conn,
+			parser: parser{opts: s.opts},
+		}
+		conn.SetContext(cs)
+		cs.armIdle()
+		return
+	}
+	cs := conn.GetContext().(*connState)
+	cs.closing = true
+	cs.queue = nil
+	cs.stopIdle()
+}
+
+func (s *Server) onMsg(conn *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+	cs := conn.GetContext().(*connState)
+	cs.stopIdle()
+	cs.parse(buf)
+	cs.armIdle()
+}
+
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// connState is the HTTP side of one connection, it lives on the connection's loop.
+type connState struct {
+	srv     *Server
+	conn    *muduo.TcpConn
+	parser  parser
+	queue   []*ResponseWriter // in request order, the head is being written
+	cur     *ResponseWriter   // whose request body is being read
+	parsing bool
+	closing bool // no more requests are read
+	idle    *muduo.TimerTask
+}
+
+// parse reads the requests in buf, up to the pipelining limit.
+func (cs *connState) parse(buf *muduo.Buffer) {
+	if cs.parsing {
+		return
+	}
+	cs.parsing = true
+	defer func() {
+		cs.parsing = false
+	}()
+	for !cs.closing && (cs.cur != nil || len(cs.queue) < cs.srv.opts.maxPipelined) {
+		ev, err := cs.parser.next(buf)
+		if err != nil {
+			cs.reject(err.(*statusError))
+			return
+		}
+		switch ev {
+		case evNone:
+			return
+		case evHeaders:
+			req := cs.parser.req
+			req.RemoteAddr = cs.conn.GetPeerAddr().String()
+			w := newResponseWriter(cs, req)
+			cs.cur = w
+			cs.queue = append(cs.queue, w)
+			if len(cs.queue) == 1 {
+				w.head = true
+				if req.expect {
+					cs.write(continueResponse)
+				}
+			}
+		case evRequest:
+			w := cs.cur
+			cs.cur = nil
+			w.bodyDone = true
+			if w.req.Close {
+				cs.closing = true
+			}
+			cs.serve(w)
+		}
+	}
+}
+
+func (cs *connState) serve(w *ResponseWriter) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Errorf("http: handler for %s %s panicked: %v", w.req.Method, w.req.Path, r)
+			w.async = false
+			w.closeAfter = true
+			if !w.committed {
+				w.header = make(Header)
+				w.status = 0
+				w.body = nil
+				Error(w, StatusInternalServerError, StatusText(StatusInternalServerError))
+			}
+			w.Finish()
+		}
+	}()
+	cs.srv.handler.ServeHTTP(w, w.req)
+	if !w.async {
+		w.Finish()
+	}
+}
+
+// reject answers a malformed request and closes the connection after it.
+func (cs *connState) reject(err *statusError) {
+	logging.Debugf("http: bad request from %s: %v", cs.conn.Name(), err)
+	cs.closing = true
+	w := cs.cur
+	if w == nil {
+		w = newResponseWriter(cs, &Request{Method: "GET", ProtoMinor: 1, Header: make(Header)})
+		cs.queue = append(cs.queue, w)
+		w.head = len(cs.queue) == 1
+	}
+	cs.cur = nil
+	w.async = false
+	w.closeAfter = true
+	Error(w, err.status, err.msg)
+	w.Finish()
+}
+
+func (cs *connState) write(out []byte) {
+	if len(out) == 0 {
+		return
+	}
+	if _, err := cs.conn.Write(out); err != nil {
+		logging.Debugf("http: write to %s: %v", cs.conn.Name(), err)
+	}
+}
+
+// finished is called on the loop once the head's final output is written, the
+// next responses in line go out.
+func (cs *connState) finished(w *ResponseWriter) {
+	if len(cs.queue) == 0 || cs.queue[0] != w {
+		// the connection is gone
+		return
+	}
+	cs.queue[0] = nil
+	cs.queue = cs.queue[1:]
+	if w.closeAfter {
+		cs.close()
+		return
+	}
+	for len(cs.queue) > 0 {
+		next := cs.queue[0]
+		next.mu.Lock()
+		next.head = true
+		out, done := next.pending, next.done
+		next.pending = nil
+		next.mu.Unlock()
+		cs.write(out)
+		if !next.bodyDone && next.req.expect {
+			cs.write(continueResponse)
+		}
+		if !done {
+			break
+		}
+		cs.queue[0] = nil
+		cs.queue = cs.queue[1:]
+		if next.closeAfter {
+			cs.close()
+			return
+		}
+	}
+	cs.parse(cs.conn.GetInboundBuffer())
+	cs.armIdle()
+}
+
+// close stops reading requests and closes the connection once the output is written.
+func (cs *connState) close() {
+	cs.closing = true
+	cs.queue = nil
+	cs.stopIdle()
+	cs.conn.ShutdownWrite()
+}
+
+// armIdle starts the idle timeout when no request is being answered, a request
+// that is only partly received does not stop it.
+func (cs *connState) armIdle() {
+	d := cs.srv.opts.idleTimeout
+	if d <= 0 || cs.closing || cs.parsing || len(cs.queue) > 0 || cs.idle != nil {
+		return
+	}
+	cs.idle = cs.conn.Eventloop().ScheduleDelay(func() {
+		cs.idle = nil
+		logging.Debugf("http: close idle connection %s", cs.conn.Name())
+		cs.close()
+	}, d)
+}
+
+func (cs *connState) stopIdle() {
+	if cs.idle != nil {
+		cs.idle.Cancel()
+		cs.idle = nil
+	}
+}
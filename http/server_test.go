@@ -0,0 +1,244 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"muduo"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, h Handler, opts ...Option) (*Server, func()) {
+	el := muduo.NewEventloop("http")
+	s := NewServer(el, "http", "tcp4://127.0.0.1:0", 2, h, opts...)
+	s.Start()
+	listening := make(chan struct{})
+	el.AsyncExecute(func() { close(listening) })
+	stopped := make(chan struct{})
+	go func() {
+		el.Loop()
+		close(stopped)
+	}()
+	<-listening
+	return s, func() {
+		s.Shutdown(100 * time.Millisecond)
+		<-stopped
+	}
+}
+
+func dial(t *testing.T, s *Server) (net.Conn, *bufio.Reader) {
+	c, err := net.DialTimeout("tcp", s.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c, bufio.NewReader(c)
+}
+
+func readResponse(t *testing.T, r *bufio.Reader, method string) (*nethttp.Response, string) {
+	t.Helper()
+	resp, err := nethttp.ReadResponse(r, &nethttp.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func testRouter() *Router {
+	rt := NewRouter()
+	rt.HandleFunc("GET", "/hello/:name", func(w *ResponseWriter, r *Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("hello " + r.Params["name"]))
+	})
+	rt.HandleFunc("GET", "/files/*path", func(w *ResponseWriter, r *Request) {
+		_, _ = w.Write([]byte(r.Params["path"]))
+	})
+	rt.HandleFunc("POST", "/echo", func(w *ResponseWriter, r *Request) {
+		_, _ = w.Write(r.Body)
+	})
+	rt.HandleFunc("GET", "/slow", func(w *ResponseWriter, r *Request) {
+		w.Async()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, _ = w.Write([]byte("slow"))
+			w.Finish()
+		}()
+	})
+	rt.HandleFunc("GET", "/stream", func(w *ResponseWriter, r *Request) {
+		w.Async()
+		go func() {
+			for _, part := range []string{"one ", "two ", "three"} {
+				_, _ = w.Write([]byte(part))
+				w.Flush()
+				time.Sleep(5 * time.Millisecond)
+			}
+			w.Finish()
+		}()
+	})
+	rt.HandleFunc("GET", "/panic", func(w *ResponseWriter, r *Request) {
+		panic("boom")
+	})
+	return rt
+}
+
+func TestServer_Routing(t *testing.T) {
+	s, stop := startServer(t, testRouter())
+	defer stop()
+	c, r := dial(t, s)
+	defer c.Close()
+
+	for _, tc := range []struct {
+		req    string
+		method string
+		status int
+		body   string
+	}{
+		{"GET /hello/muduo HTTP/1.1\r\nHost: h\r\n\r\n", "GET", 200, "hello muduo"},
+		{"HEAD /hello/muduo HTTP/1.1\r\nHost: h\r\n\r\n", "HEAD", 200, ""},
+		{"GET /files/a/b/c.txt HTTP/1.1\r\nHost: h\r\n\r\n", "GET", 200, "a/b/c.txt"},
+		{"POST /echo HTTP/1.1\r\nHost: h\r\nContent-Length: 4\r\n\r\nping", "POST", 200, "ping"},
+		{"POST /echo HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n2\r\npi\r\n2\r\nng\r\n0\r\n\r\n", "POST", 200, "ping"},
+		{"GET /missing HTTP/1.1\r\nHost: h\r\n\r\n", "GET", 404, "Not Found\n"},
+		{"DELETE /echo HTTP/1.1\r\nHost: h\r\n\r\n", "DELETE", 405, "Method Not Allowed\n"},
+	} {
+		if _, err := io.WriteString(c, tc.req); err != nil {
+			t.Fatal(err)
+		}
+		resp, body := readResponse(t, r, tc.method)
+		if resp.StatusCode != tc.status || body != tc.body {
+			t.Errorf("%q = %d %q", tc.req, resp.StatusCode, body)
+		}
+		if tc.method == "HEAD" && resp.ContentLength != int64(len("hello muduo")) {
+			t.Errorf("HEAD Content-Length = %d", resp.ContentLength)
+		}
+		if tc.status == 405 && resp.Header.Get("Allow") != "POST" {
+			t.Errorf("Allow = %q", resp.Header.Get("Allow"))
+		}
+	}
+
+	// a panicking handler gets a 500 and the connection is closed
+	_, _ = io.WriteString(c, "GET /panic HTTP/1.1\r\nHost: h\r\n\r\n")
+	if resp, _ := readResponse(t, r, "GET"); resp.StatusCode != 500 || !resp.Close {
+		t.Fatalf("panic = %d, close %v", resp.StatusCode, resp.Close)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("read after close = %v", err)
+	}
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	s, stop := startServer(t, testRouter())
+	defer stop()
+	c, r := dial(t, s)
+	defer c.Close()
+
+	// the slow async response holds back the ones behind it
+	_, _ = io.WriteString(c, "GET /slow HTTP/1.1\r\nHost: h\r\n\r\n"+
+		"GET /hello/1 HTTP/1.1\r\nHost: h\r\n\r\n"+
+		"GET /stream HTTP/1.1\r\nHost: h\r\n\r\n"+
+		"GET /hello/2 HTTP/1.1\r\nHost: h\r\nConnection: close\r\n\r\n"+
+		"GET /hello/3 HTTP/1.1\r\nHost: h\r\n\r\n")
+	for _, want := range []string{"slow", "hello 1", "one two three", "hello 2"} {
+		resp, body := readResponse(t, r, "GET")
+		if resp.StatusCode != 200 || body != want {
+			t.Fatalf("got %d %q, want %q", resp.StatusCode, body, want)
+		}
+		if want == "one two three" && (len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked") {
+			t.Fatalf("stream is not chunked: %v", resp.TransferEncoding)
+		}
+	}
+	// nothing is answered after Connection: close
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("read after close = %v", err)
+	}
+}
+
+func TestServer_ExpectContinue(t *testing.T) {
+	s, stop := startServer(t, testRouter())
+	defer stop()
+	c, r := dial(t, s)
+	defer c.Close()
+
+	_, _ = io.WriteString(c, "POST /echo HTTP/1.1\r\nHost: h\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	line, err := r.ReadString('\n')
+	if err != nil || line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("read %q, %v", line, err)
+	}
+	if line, _ = r.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("read %q", line)
+	}
+	_, _ = io.WriteString(c, "hello")
+	if resp, body := readResponse(t, r, "POST"); resp.StatusCode != 200 || body != "hello" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestServer_HTTP10(t *testing.T) {
+	s, stop := startServer(t, testRouter())
+	defer stop()
+
+	c, r := dial(t, s)
+	defer c.Close()
+	_, _ = io.WriteString(c, "GET /hello/a HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	if resp, body := readResponse(t, r, "GET"); body != "hello a" || resp.Header.Get("Connection") != "keep-alive" {
+		t.Fatalf("got %q %v", body, resp.Header)
+	}
+	// a streamed response is delimited by closing the connection
+	_, _ = io.WriteString(c, "GET /stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	resp, body := readResponse(t, r, "GET")
+	if body != "one two three" || !resp.Close {
+		t.Fatalf("got %q, close %v", body, resp.Close)
+	}
+}
+
+func TestServer_Limits(t *testing.T) {
+	s, stop := startServer(t, testRouter(), WithMaxBodyBytes(8), WithIdleTimeout(50*time.Millisecond))
+	defer stop()
+
+	c, r := dial(t, s)
+	defer c.Close()
+	_, _ = io.WriteString(c, "POST /echo HTTP/1.1\r\nHost: h\r\nContent-Length: 100\r\n\r\n")
+	resp, _ := readResponse(t, r, "POST")
+	if resp.StatusCode != StatusRequestEntityTooLarge || !resp.Close {
+		t.Fatalf("got %d, close %v", resp.StatusCode, resp.Close)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("read after close = %v", err)
+	}
+
+	// an idle keep-alive connection is closed
+	idle, ir := dial(t, s)
+	defer idle.Close()
+	_, _ = io.WriteString(idle, "GET /hello/x HTTP/1.1\r\nHost: h\r\n\r\n")
+	readResponse(t, ir, "GET")
+	start := time.Now()
+	if _, err := ir.ReadByte(); err != io.EOF {
+		t.Fatalf("read on idle connection = %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("idle connection closed after %v", d)
+	}
+}
+
+func TestServer_BadRequest(t *testing.T) {
+	s, stop := startServer(t, testRouter())
+	defer stop()
+	c, r := dial(t, s)
+	defer c.Close()
+	_, _ = io.WriteString(c, "GET /hello/a HTTP/1.1\r\nHost: h\r\n\r\nNONSENSE\r\n\r\n")
+	if _, body := readResponse(t, r, "GET"); body != "hello a" {
+		t.Fatalf("got %q", body)
+	}
+	resp, body := readResponse(t, r, "GET")
+	if resp.StatusCode != StatusBadRequest || !strings.Contains(body, "malformed") {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,175 @@
+// Package muduotest holds the fixtures the test suites of the examples share:
+// running an Eventloop for the length of a test and plain net backends to
+// point servers and proxies at.
+package muduotest
+
+import (
+	"bufio"
+	"io"
+	"muduo"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Timeout bounds every read and write of the connections made here, a test
+// that hangs fails instead.
+const Timeout = 10 * time.Second
+
+// RunLoop runs el on its own goroutine and returns once it is looping. When the
+// test ends, stop shuts down what runs on el and must make the loop return, a
+// nil stop stops the loop itself. The returned channel is closed when the loop
+// has returned, stop is not called again when a test stopped it already.
+func RunLoop(t testing.TB, el *muduo.Eventloop, stop func()) <-chan struct{} {
+	t.Helper()
+	if stop == nil {
+		stop = el.AsyncStop
+	}
+	looping := make(chan struct{})
+	el.AsyncExecute(func() { close(looping) })
+	done := make(chan struct{})
+	go func() {
+		el.Loop()
+		close(done)
+	}()
+	<-looping
+	t.Cleanup(func() {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		stop()
+		<-done
+	})
+	return done
+}
+
+// FakeLoop returns an Eventloop whose timers only fire when the returned clock
+// is advanced, so that a test decides when items expire and sweepers run.
+func FakeLoop(name string) (*muduo.Eventloop, *muduo.FakeClock) {
+	clock := muduo.NewFakeClock(time.Unix(1700000000, 0))
+	return muduo.NewEventloop(name, muduo.WithClock(clock)), clock
+}
+
+// Serve hands every connection to a loopback listener to handle on its own
+// goroutine, and closes it once handle returns.
+func Serve(t testing.TB, handle func(c net.Conn)) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = c.SetDeadline(time.Now().Add(Timeout))
+				handle(c)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// Echo writes back what it reads until the peer closes.
+func Echo(c net.Conn) {
+	_, _ = io.Copy(c, c)
+}
+
+// EchoBackend serves Echo on a loopback port.
+func EchoBackend(t testing.TB) *net.TCPAddr {
+	t.Helper()
+	return Serve(t, Echo)
+}
+
+// DeadAddr returns a loopback address nobody listens on.
+func DeadAddr(t testing.TB) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	_ = ln.Close()
+	return addr
+}
+
+// Dial connects to addr, the connection is closed when the test ends.
+func Dial(t testing.TB, addr string) *net.TCPConn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	_ = c.SetDeadline(time.Now().Add(Timeout))
+	return c.(*net.TCPConn)
+}
+
+// TextConn is a client of a line based protocol like the memcached text
+// protocol, whose methods fail the test when the server does not answer as
+// expected.
+type TextConn struct {
+	t    testing.TB
+	Conn *net.TCPConn
+	r    *bufio.Reader
+}
+
+// DialText connects to addr, the connection is closed when the test ends.
+func DialText(t testing.TB, addr string) *TextConn {
+	t.Helper()
+	c := Dial(t, addr)
+	return &TextConn{t: t, Conn: c, r: bufio.NewReader(c)}
+}
+
+// Send writes req as it is, several requests may be pipelined in it.
+func (c *TextConn) Send(req string) {
+	c.t.Helper()
+	if _, err := c.Conn.Write([]byte(req)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Line returns the next line without its CRLF.
+func (c *TextConn) Line() string {
+	c.t.Helper()
+	_ = c.Conn.SetReadDeadline(time.Now().Add(Timeout))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read: %v after %q", err, line)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// Expect fails the test unless the next lines are lines, in order.
+func (c *TextConn) Expect(lines ...string) {
+	c.t.Helper()
+	for _, want := range lines {
+		if got := c.Line(); got != want {
+			c.t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+// Do sends req and expects lines in response.
+func (c *TextConn) Do(req string, lines ...string) {
+	c.t.Helper()
+	c.Send(req)
+	c.Expect(lines...)
+}
+
+// ExpectEOF fails the test unless the server closes the connection next.
+func (c *TextConn) ExpectEOF() {
+	c.t.Helper()
+	_ = c.Conn.SetReadDeadline(time.Now().Add(Timeout))
+	if b, err := c.r.ReadByte(); err != io.EOF {
+		c.t.Fatalf("got %q, %v, want EOF", b, err)
+	}
+}
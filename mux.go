@@ -0,0 +1,287 @@
+package muduo
+
+import (
+	"context"
+	"encoding/binary"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"time"
+)
+
+// MuxCodec frames the requests and responses of a multiplexed protocol.
+type MuxCodec interface {
+	// EncodeRequest returns the wire form of req, tagged with the correlation id.
+	EncodeRequest(id uint64, req []byte) []byte
+	// DecodeResponse removes the next response from buf and returns its
+	// correlation id and payload, or a nil payload when it is incomplete.
+	DecodeResponse(buf *Buffer) (id uint64, resp []byte, err error)
+}
+
+// orderedCodec is implemented by codecs whose responses come back in request order.
+type orderedCodec interface {
+	ordered()
+}
+
+type fifoCodec struct {
+	codec Codec
+}
+
+// FIFO adapts a Codec for protocols without correlation ids that answer in
+// request order, like the memcached text protocol.
+func FIFO(codec Codec) MuxCodec {
+	return fifoCodec{codec: codec}
+}
+
+func (c fifoCodec) EncodeRequest(_ uint64, req []byte) []byte {
+	return c.codec.Encode(req)
+}
+
+func (c fifoCodec) DecodeResponse(buf *Buffer) (uint64, []byte, error) {
+	resp, err := c.codec.Decode(buf)
+	return 0, resp, err
+}
+
+func (fifoCodec) ordered() {}
+
+// IDLengthCodec frames messages as an 8 byte correlation id and a 4 byte length,
+// both big endian, followed by the payload.
+type IDLengthCodec struct {
+	// MaxFrame rejects longer payloads, 0 means no limit.
+	MaxFrame int
+}
+
+const idLengthHeaderSize = 12
+
+func (c IDLengthCodec) EncodeRequest(id uint64, req []byte) []byte {
+	frame := make([]byte, idLengthHeaderSize+len(req))
+	binary.BigEndian.PutUint64(frame, id)
+	binary.BigEndian.PutUint32(frame[8:], uint32(len(req)))
+	copy(frame[idLengthHeaderSize:], req)
+	return frame
+}
+
+func (c IDLengthCodec) DecodeResponse(buf *Buffer) (uint64, []byte, error) {
+	if buf.ReadableBytes() < idLengthHeaderSize {
+		return 0, nil, nil
+	}
+	header := buf.Peek()
+	id := binary.BigEndian.Uint64(header)
+	n := int(binary.BigEndian.Uint32(header[8:]))
+	if c.MaxFrame > 0 && n > c.MaxFrame {
+		return 0, nil, errors.ErrFrameTooLarge
+	}
+	if buf.ReadableBytes() < idLengthHeaderSize+n {
+		return 0, nil, nil
+	}
+	buf.Advance(idLengthHeaderSize)
+	return id, buf.Next(n), nil
+}
+
+type muxResult struct {
+	resp []byte
+	err  error
+}
+
+type muxCall struct {
+	id    uint64
+	done  chan muxResult
+	timer *TimerTask
+	over  bool // answered, timed out or canceled
+}
+
+// giveUpWait bounds how long Call waits for the loop to abandon a call whose
+// context is done.
+const giveUpWait = time.Second
+
+// Mux pipelines calls on one connection and matches the responses to them. All
+// of its state lives on the connection's loop.
+type Mux struct {
+	conn    *TcpConn
+	el      *Eventloop
+	codec   MuxCodec
+	ordered bool
+	timeout time.Duration
+	nextID  uint64
+	pending map[uint64]*muxCall // by correlation id
+	queue   []*muxCall          // in request order, for ordered codecs
+	err     error               // set once the connection is unusable
+	onConn  func(*TcpConn)
+	abandon func(conn *TcpConn, id uint64, err error)
+}
+
+// NewMux takes over the message callback of conn, the connection callback still
+// runs. Responses that arrive before it is installed on the loop are lost, so
+// create the Mux before the first call is written, e.g. in the OnConn callback.
+func NewMux(conn *TcpConn, codec MuxCodec) *Mux {
+	_, ordered := codec.(orderedCodec)
+	m := &Mux{
+		conn:    conn,
+		el:      conn.Eventloop(),
+		codec:   codec,
+		ordered: ordered,
+		nextID:  1,
+		pending: make(map[uint64]*muxCall),
+	}
+	m.el.AsyncExecute(m.install)
+	return m
+}
+
+// SetTimeout bounds the calls whose context has no deadline, 0 (the default)
+// means no limit. It must be called before the first Call.
+func (m *Mux) SetTimeout(d time.Duration) {
+	m.timeout = d
+}
+
+// SetOnAbandon is called on the loop when a call stops waiting for its response
+// because it timed out or its context was canceled, err tells which. Protocols use
+// it to tell the peer. It must be called before the first Call.
+func (m *Mux) SetOnAbandon(cb func(conn *TcpConn, id uint64, err error)) {
+	m.abandon = cb
+}
+
+func (m *Mux) install() {
+	if !m.conn.IsConnected() {
+		m.fail(errors.ErrConnDropped)
+		return
+	}
+	m.onConn = m.conn.onConn
+	m.conn.SetOnConn(m.handleConn)
+	m.conn.SetOnMsg(m.handleMsg)
+}
+
+// Call sends req and waits for its response. It fails with ErrCallTimeout when
+// ctx's deadline, or the Mux timeout, passes first, with ErrConnDropped when the
+// connection goes away, and with ctx.Err() when ctx is canceled.
+func (m *Mux) Call(ctx context.Context, req []byte) ([]byte, error) {
+	timeout := m.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return nil, errors.ErrCallTimeout
+		}
+	}
+	c := &muxCall{done: make(chan muxResult, 1)}
+	m.el.AsyncExecute(func() {
+		m.start(c, req, timeout)
+	})
+	select {
+	case r := <-c.done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		err := ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = errors.ErrCallTimeout
+		}
+		m.el.AsyncExecute(func() {
+			m.giveUp(c, err)
+		})
+		// the loop reports it, unless the response won the race, but a loop
+		// that is stuck or has stopped never runs giveUp
+		select {
+		case r := <-c.done:
+			return r.resp, r.err
+		case <-time.After(giveUpWait):
+			return nil, err
+		}
+	}
+}
+
+// Pending returns the number of calls waiting for a response, on the loop goroutine.
+func (m *Mux) Pending() int {
+	return len(m.pending)
+}
+
+func (m *Mux) start(c *muxCall, req []byte, timeout time.Duration) {
+	if m.err != nil {
+		c.over = true
+		c.done <- muxResult{err: m.err}
+		return
+	}
+	c.id = m.nextID
+	m.nextID++
+	m.pending[c.id] = c
+	if m.ordered {
+		m.queue = append(m.queue, c)
+	}
+	if timeout > 0 {
+		c.timer = m.el.ScheduleDelay(func() {
+			c.timer = nil
+			m.giveUp(c, errors.ErrCallTimeout)
+		}, timeout)
+	}
+	if _, err := m.conn.Write(m.codec.EncodeRequest(c.id, req)); err != nil {
+		m.finish(c, muxResult{err: err})
+	}
+}
+
+func (m *Mux) giveUp(c *muxCall, err error) {
+	if m.finish(c, muxResult{err: err}) && m.abandon != nil && m.err == nil {
+		m.abandon(m.conn, c.id, err)
+	}
+}
+
+// finish completes c once and reports whether it did. With an ordered codec a finished call keeps its place
+// in the queue, so that its late response is skipped.
+func (m *Mux) finish(c *muxCall, r muxResult) bool {
+	if c.over {
+		return false
+	}
+	c.over = true
+	delete(m.pending, c.id)
+	if c.timer != nil {
+		c.timer.Cancel()
+		c.timer = nil
+	}
+	c.done <- r
+	return true
+}
+
+func (m *Mux) handleMsg(conn *TcpConn, buf *Buffer, _ time.Time) {
+	for {
+		id, resp, err := m.codec.DecodeResponse(buf)
+		if err != nil {
+			logging.Errorf("Mux[%s] decode error: %v", conn.Name(), err)
+			m.fail(err)
+			conn.ForceClose()
+			return
+		}
+		if resp == nil {
+			return
+		}
+		var c *muxCall
+		if m.ordered {
+			if len(m.queue) == 0 {
+				logging.Warnf("Mux[%s] unexpected response", conn.Name())
+				continue
+			}
+			c = m.queue[0]
+			m.queue[0] = nil
+			m.queue = m.queue[1:]
+		} else if c = m.pending[id]; c == nil {
+			// timed out or canceled before the response came
+			logging.Debugf("Mux[%s] drop response of call %d", conn.Name(), id)
+			continue
+		}
+		m.finish(c, muxResult{resp: append([]byte(nil), resp...)})
+	}
+}
+
+func (m *Mux) handleConn(conn *TcpConn) {
+	if m.onConn != nil {
+		m.onConn(conn)
+	}
+	if !conn.IsConnected() {
+		m.fail(errors.ErrConnDropped)
+	}
+}
+
+// fail completes every outstanding call with err, and the later ones too.
+func (m *Mux) fail(err error) {
+	if m.err == nil {
+		m.err = err
+	}
+	for _, c := range m.pending {
+		m.finish(c, muxResult{err: err})
+	}
+	m.queue = nil
+}
@@ -0,0 +1,214 @@
+package muduo
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"muduo/pkg/errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dialMux connects to addr on a loop of its own and wraps the connection in a Mux.
+func dialMux(t *testing.T, addr string, codec MuxCodec, opts ...EventloopOption) (*Mux, func()) {
+	el := NewEventloop("mux", opts...)
+	stop := startLoop(el)
+	client, err := NewTcpClient(el, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxes := make(chan *Mux, 1)
+	client.SetOnConn(func(conn *TcpConn) {
+		if conn.IsConnected() {
+			muxes <- NewMux(conn, codec)
+		}
+	})
+	client.Connect()
+	select {
+	case m := <-muxes:
+		return m, func() {
+			el.AsyncExecute(client.Destroy)
+			stop()
+		}
+	case <-time.After(5 * time.Second):
+		stop()
+		t.Fatal("connect timed out")
+		return nil, nil
+	}
+}
+
+func TestMux_CorrelationID(t *testing.T) {
+	// the server answers every batch of requests in reverse order
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "mux", "tcp4://127.0.0.1:0", 1)
+	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, _ time.Time) {
+		var frames [][]byte
+		for buffer.ReadableBytes() >= idLengthHeaderSize {
+			n := int(binary.BigEndian.Uint32(buffer.Peek()[8:]))
+			if buffer.ReadableBytes() < idLengthHeaderSize+n {
+				break
+			}
+			frames = append(frames, append([]byte(nil), buffer.Next(idLengthHeaderSize+n)...))
+		}
+		for i := len(frames) - 1; i >= 0; i-- {
+			_, _ = conn.Write(frames[i])
+		}
+	})
+	stop := startTestServer(t, el, svr)
+	defer stop()
+
+	m, closeMux := dialMux(t, "tcp4://"+svr.addr, IDLengthCodec{})
+	defer closeMux()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := fmt.Sprintf("req-%d", i)
+			resp, err := m.Call(ctx, []byte(req))
+			if err != nil || string(resp) != req {
+				t.Errorf("call %d = %q, %v", i, resp, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMux_FIFO(t *testing.T) {
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "mux", "tcp4://127.0.0.1:0", 1)
+	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, _ time.Time) {
+		_, _ = conn.Write(buffer.Next(-1))
+	})
+	stop := startTestServer(t, el, svr)
+	defer stop()
+
+	m, closeMux := dialMux(t, "tcp4://"+svr.addr, FIFO(LineCodec{}))
+	defer closeMux()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := fmt.Sprintf("line %d", i)
+			resp, err := m.Call(ctx, []byte(req))
+			if err != nil || string(resp) != req {
+				t.Errorf("call %d = %q, %v", i, resp, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMux_TimeoutAndDrop(t *testing.T) {
+	// the server answers "slow" only after "release", and closes on "bye"
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "mux", "tcp4://127.0.0.1:0", 1)
+	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, _ time.Time) {
+		codec := LineCodec{}
+		for {
+			line, _ := codec.Decode(buffer)
+			if line == nil {
+				return
+			}
+			switch string(line) {
+			case "slow":
+				conn.SetContext(true)
+			case "release":
+				if conn.GetContext() != nil {
+					_, _ = conn.Write(codec.Encode([]byte("slow")))
+				}
+				_, _ = conn.Write(codec.Encode(line))
+			case "hang":
+			case "bye":
+				conn.ForceClose()
+			default:
+				_, _ = conn.Write(codec.Encode(line))
+			}
+		}
+	})
+	stop := startTestServer(t, el, svr)
+	defer stop()
+
+	clock := NewFakeClock(time.Now())
+	m, closeMux := dialMux(t, "tcp4://"+svr.addr, FIFO(LineCodec{}), WithClock(clock))
+	defer closeMux()
+	m.SetTimeout(time.Second)
+
+	ctx := context.Background()
+	slow := make(chan error, 1)
+	go func() {
+		_, err := m.Call(ctx, []byte("slow"))
+		slow <- err
+	}()
+	waitFor(t, "the pending call", func() bool {
+		n := make(chan int)
+		m.el.AsyncExecute(func() { n <- m.Pending() })
+		return <-n == 1
+	})
+	clock.Advance(2 * time.Second)
+	if err := <-slow; err != errors.ErrCallTimeout {
+		t.Fatalf("err = %v, want ErrCallTimeout", err)
+	}
+	// the late answer to "slow" is skipped
+	if resp, err := m.Call(ctx, []byte("release")); err != nil || string(resp) != "release" {
+		t.Fatalf("call = %q, %v", resp, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := m.Call(canceled, []byte("hang")); err != context.Canceled {
+		t.Fatalf("err = %v, want Canceled", err)
+	}
+
+	hung := make(chan error, 1)
+	go func() {
+		_, err := m.Call(ctx, []byte("hang"))
+		hung <- err
+	}()
+	if _, err := m.Call(ctx, []byte("bye")); err != errors.ErrConnDropped {
+		t.Fatalf("err = %v, want ErrConnDropped", err)
+	}
+	if err := <-hung; err != errors.ErrConnDropped {
+		t.Fatalf("err = %v, want ErrConnDropped", err)
+	}
+	if _, err := m.Call(ctx, []byte("after")); err != errors.ErrConnDropped {
+		t.Fatalf("err = %v, want ErrConnDropped", err)
+	}
+}
+
+func TestMux_StuckLoop(t *testing.T) {
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "mux", "tcp4://127.0.0.1:0", 1)
+	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, _ time.Time) {
+		_, _ = conn.Write(buffer.Next(-1))
+	})
+	stop := startTestServer(t, el, svr)
+	defer stop()
+
+	m, closeMux := dialMux(t, "tcp4://"+svr.addr, FIFO(LineCodec{}))
+	defer closeMux()
+	// neither the call nor its timer runs while the loop is held
+	release := make(chan struct{})
+	m.el.AsyncExecute(func() { <-release })
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.Call(ctx, []byte("deadline")); err != errors.ErrCallTimeout {
+		t.Fatalf("err = %v, want ErrCallTimeout", err)
+	}
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := m.Call(canceled, []byte("canceled")); err != context.Canceled {
+		t.Fatalf("err = %v, want Canceled", err)
+	}
+}
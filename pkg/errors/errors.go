@@ -7,4 +7,31 @@ var (
 	ErrUnsupportedTCPProtocol = errors.New("unsupported TCP protocol")
 	ErrAcceptSocket           = errors.New("accept a new connection error")
 	ErrConnNotOpened          = errors.New("connection is not opened")
+	ErrFdAlreadyWatched       = errors.New("fd is already registered on the eventloop")
+	ErrWatcherClosed          = errors.New("watcher is unwatched")
+	ErrConnectTimeout         = errors.New("connect timed out")
+	ErrSelfConnect            = errors.New("connected to itself")
+	ErrNoEndpoints            = errors.New("no endpoints")
+	ErrFrameTooLarge          = errors.New("frame is too large")
+	ErrClientClosed           = errors.New("client is closed")
+	ErrPoolClosed             = errors.New("connection pool is closed")
+	ErrCallTimeout            = errors.New("call timed out")
+	ErrConnDropped            = errors.New("connection dropped")
+	ErrBadFrame               = errors.New("malformed frame")
+	ErrResponseFinished       = errors.New("response is finished")
+	ErrUnsupportedOpcode      = errors.New("unsupported opcode")
+	ErrConnClosing            = errors.New("connection is closing")
+	ErrBadHandshake           = errors.New("bad handshake")
+	ErrNotInteger             = errors.New("value is not an integer or out of range")
+	ErrOverflow               = errors.New("increment or decrement would overflow")
+	ErrKeyNotFound            = errors.New("key not found")
+	ErrBadSnapshot            = errors.New("malformed snapshot")
+	ErrNotStored              = errors.New("item not stored")
+	ErrCasConflict            = errors.New("item was modified since it was read")
+	ErrMalformedKey           = errors.New("key is too long or contains invalid characters")
+	ErrNoProxyHeader          = errors.New("no PROXY protocol header")
+	ErrBadProxyHeader         = errors.New("malformed PROXY protocol header")
+	ErrBadSocksMessage        = errors.New("malformed SOCKS5 message")
+	ErrSocksNoMethod          = errors.New("no acceptable SOCKS5 authentication method")
+	ErrSocksAuthFailed        = errors.New("SOCKS5 authentication failed")
 )
@@ -6,7 +6,6 @@ import (
 	"muduo/pkg/logging"
 	"muduo/pkg/util"
 	"os"
-	"runtime"
 	"strconv"
 	"time"
 	"unsafe"
@@ -18,15 +17,42 @@ const (
 	channelDel = 2
 )
 
-type Poller struct {
+// Poller is the I/O multiplexer behind an Eventloop. It keeps the Channels of its
+// loop registered with the kernel and reports which of them became active.
+type Poller interface {
+	poll(timeout time.Duration) time.Time
+	updateChannel(channel *Channel)
+	removeChannel(channel *Channel)
+	hasChannel(fd int) bool
+	close() error
+}
+
+// ioPoller is implemented by completion based pollers, which perform socket I/O
+// themselves instead of reporting readiness. Callbacks run on the loop goroutine.
+type ioPoller interface {
+	Poller
+	// accept keeps accepting on the listening channel until it is removed.
+	accept(channel *Channel, cb func(fd int, err error))
+	// recv keeps receiving on the channel until it is removed, EOF is reported
+	// as empty data with a nil error. data is only valid during the callback.
+	recv(channel *Channel, cb func(data []byte, err error))
+	// stopRecv ends the receiving started by recv. Data the kernel has already
+	// received may still be passed to its callback.
+	stopRecv(channel *Channel)
+	// send writes data, which must not be modified until cb is called.
+	send(channel *Channel, data []byte, cb func(n int, err error))
+}
+
+type epollPoller struct {
 	el         *Eventloop
 	epollFd    int
 	eventList  []epollevent
 	channelMap map[int]*Channel
+	precise    bool // use epoll_pwait2 for sub-millisecond timeouts
 }
 
-func newPoller(el *Eventloop) (poller *Poller, err error) {
-	poller = new(Poller)
+func newPoller(el *Eventloop) (poller *epollPoller, err error) {
+	poller = new(epollPoller)
 	if poller.epollFd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC); err != nil {
 		poller = nil
 		err = os.NewSyscallError("epoll_create1", err)
@@ -35,15 +61,24 @@ func newPoller(el *Eventloop) (poller *Poller, err error) {
 	poller.eventList = make([]epollevent, 16)
 	poller.channelMap = make(map[int]*Channel)
 	poller.el = el
+	poller.precise = el.preciseTimeout && epollPwait2Supported()
 	return
 }
 
-func (p *Poller) poll(timeoutMills int) (now time.Time) {
-	numEvents, err := epollWait(p.epollFd, p.eventList, timeoutMills)
-	now = time.Now()
+func (p *epollPoller) poll(timeout time.Duration) (now time.Time) {
+	var (
+		numEvents int
+		err       error
+	)
+	if p.precise {
+		ts := unix.NsecToTimespec(timeout.Nanoseconds())
+		numEvents, err = epollPwait2(p.epollFd, p.eventList, &ts)
+	} else {
+		numEvents, err = epollWait(p.epollFd, p.eventList, durationToMills(timeout))
+	}
+	now = p.el.Now()
 	if numEvents == 0 || (numEvents < 0 && err == unix.EINTR) {
-		logging.Debugf("nothing happened, timeout %d ms", timeoutMills)
-		runtime.Gosched()
+		logging.Debugf("nothing happened, timeout %v", timeout)
 		return
 	} else if err != nil {
 		logging.Errorf("error occurs in epoll: %v", os.NewSyscallError("epoll_wait", err))
@@ -59,7 +94,16 @@ func (p *Poller) poll(timeoutMills int) (now time.Time) {
 	return
 }
 
-func (p *Poller) fillActiveChannels(numEvents int, activeChannels *list.List) {
+// durationToMills rounds d up to whole milliseconds, so that a timer due in
+// 300us does not turn into a busy epoll_wait(0) loop until it expires.
+func durationToMills(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+func (p *epollPoller) fillActiveChannels(numEvents int, activeChannels *list.List) {
 	util.Assert(numEvents <= len(p.eventList), "numEvents should not be greater than len(p.eventList)")
 	for i := 0; i < numEvents; i++ {
 		epollEvt := &p.eventList[i]
@@ -70,7 +114,7 @@ func (p *Poller) fillActiveChannels(numEvents int, activeChannels *list.List) {
 	}
 }
 
-func (p *Poller) updateChannel(channel *Channel) {
+func (p *epollPoller) updateChannel(channel *Channel) {
 	logging.Debugf("fd %d events %d", channel.fd, channel.events)
 	idx := channel.index
 	logging.Debugf("fd = %d index = %d events = %d", channel.fd, idx, channel.events)
@@ -97,7 +141,7 @@ func (p *Poller) updateChannel(channel *Channel) {
 	}
 }
 
-func (p *Poller) removeChannel(channel *Channel) {
+func (p *epollPoller) removeChannel(channel *Channel) {
 	fd := channel.fd
 	idx := channel.index
 	util.Assert(p.channelMap[fd] == channel, "channelMap should have fd %d", fd)
@@ -109,7 +153,15 @@ func (p *Poller) removeChannel(channel *Channel) {
 	channel.index = channelNew
 }
 
-func (p *Poller) update(op int, channel *Channel) {
+func (p *epollPoller) hasChannel(fd int) bool {
+	return p.channelMap[fd] != nil
+}
+
+func (p *epollPoller) close() error {
+	return unix.Close(p.epollFd)
+}
+
+func (p *epollPoller) update(op int, channel *Channel) {
 	var ev epollevent
 	ev.events = channel.events
 	fd := channel.fd
@@ -0,0 +1,361 @@
+// Package proxyproto reads and writes the headers of the PROXY protocol, by
+// which a proxy or load balancer tells the server behind it the addresses of
+// the connection it relays. Version 1 is a text line, version 2 is binary and
+// carries extensions as TLVs.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"muduo/pkg/errors"
+	"net"
+	"strconv"
+)
+
+// Command tells whether a version 2 header relays a connection.
+type Command byte
+
+const (
+	// Local is a connection of the proxy itself, e.g. a health check; the
+	// addresses are those of the connection.
+	Local Command = 0
+	// Proxy is a relayed connection, the header has its addresses.
+	Proxy Command = 1
+)
+
+// Types of the TLVs defined by the specification.
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02
+	TypeCRC32C    byte = 0x03
+	TypeNoop      byte = 0x04
+	TypeUniqueID  byte = 0x05
+	TypeSSL       byte = 0x20
+	TypeNetNS     byte = 0x30
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	castagnoli  = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	// v1MaxLen is the longest version 1 line, CRLF included.
+	v1MaxLen = 107
+	// v2HeaderLen is the fixed part of a version 2 header.
+	v2HeaderLen = 16
+	unixPathLen = 108
+)
+
+// TLV is a type-length-value extension of a version 2 header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a PROXY protocol header.
+type Header struct {
+	// Version is 1 or 2.
+	Version int
+	Command Command
+	// Source and Destination are the addresses of the relayed connection:
+	// *net.TCPAddr, *net.UDPAddr or *net.UnixAddr. Both are nil when the
+	// addresses are unknown or the command is Local.
+	Source      net.Addr
+	Destination net.Addr
+	// TLVs are the extensions of a version 2 header.
+	TLVs []TLV
+}
+
+// TLV returns the value of the first TLV of type typ.
+func (h *Header) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Parse reads the header data starts with and returns it with its length. It
+// returns a nil header and 0 when data is a header yet incomplete,
+// ErrNoProxyHeader when data does not start with one and ErrBadProxyHeader
+// when the header is malformed, or its CRC32C TLV does not match.
+func Parse(data []byte) (*Header, int, error) {
+	switch {
+	case hasPrefix(data, v2Signature):
+		if len(data) < len(v2Signature) {
+			return nil, 0, nil
+		}
+		return parseV2(data)
+	case hasPrefix(data, v1Prefix):
+		if len(data) < len(v1Prefix) {
+			return nil, 0, nil
+		}
+		return parseV1(data)
+	}
+	return nil, 0, errors.ErrNoProxyHeader
+}
+
+// hasPrefix tells whether data and prefix agree up to the shorter of them.
+func hasPrefix(data, prefix []byte) bool {
+	if len(data) < len(prefix) {
+		return bytes.HasPrefix(prefix, data)
+	}
+	return bytes.HasPrefix(data, prefix)
+}
+
+func parseV1(data []byte) (*Header, int, error) {
+	eol := bytes.Index(data, []byte("\r\n"))
+	if eol < 0 {
+		if len(data) >= v1MaxLen {
+			return nil, 0, errors.ErrBadProxyHeader
+		}
+		return nil, 0, nil
+	}
+	n := eol + 2
+	if n > v1MaxLen {
+		return nil, 0, errors.ErrBadProxyHeader
+	}
+	fields := bytes.Split(data[len(v1Prefix):eol], []byte(" "))
+	h := &Header{Version: 1, Command: Proxy}
+	switch string(fields[0]) {
+	case "UNKNOWN":
+		// whatever follows is ignored
+		return h, n, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, 0, errors.ErrBadProxyHeader
+	}
+	if len(fields) != 5 {
+		return nil, 0, errors.ErrBadProxyHeader
+	}
+	v4 := string(fields[0]) == "TCP4"
+	src, err1 := parseV1Addr(fields[1], fields[3], v4)
+	dst, err2 := parseV1Addr(fields[2], fields[4], v4)
+	if err1 != nil || err2 != nil {
+		return nil, 0, errors.ErrBadProxyHeader
+	}
+	h.Source, h.Destination = src, dst
+	return h, n, nil
+}
+
+func parseV1Addr(host, port []byte, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(string(host))
+	colon := bytes.IndexByte(host, ':') >= 0
+	if ip == nil || v4 == colon {
+		return nil, errors.ErrBadProxyHeader
+	}
+	// no leading zeros
+	if len(port) > 1 && port[0] == '0' {
+		return nil, errors.ErrBadProxyHeader
+	}
+	p, err := strconv.ParseUint(string(port), 10, 16)
+	if err != nil {
+		return nil, errors.ErrBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func parseV2(data []byte) (*Header, int, error) {
+	if len(data) < v2HeaderLen {
+		return nil, 0, nil
+	}
+	verCmd, fam := data[12], data[13]
+	n := v2HeaderLen + int(binary.BigEndian.Uint16(data[14:]))
+	if verCmd>>4 != 2 || verCmd&0xf > byte(Proxy) {
+		return nil, 0, errors.ErrBadProxyHeader
+	}
+	if len(data) < n {
+		return nil, 0, nil
+	}
+	h := &Header{Version: 2, Command: Command(verCmd & 0xf)}
+	body := data[v2HeaderLen:n]
+	var addrLen int
+	switch fam >> 4 {
+	case 0x0: // AF_UNSPEC
+	case 0x1: // AF_INET
+		addrLen = 2*net.IPv4len + 4
+	case 0x2: // AF_INET6
+		addrLen = 2*net.IPv6len + 4
+	case 0x3: // AF_UNIX
+		addrLen = 2 * unixPathLen
+	default:
+		return nil, 0, errors.ErrBadProxyHeader
+	}
+	transport := fam & 0xf
+	if transport > 2 || len(body) < addrLen {
+		return nil, 0, errors.ErrBadProxyHeader
+	}
+	// a LOCAL header keeps its addresses, if any, to itself
+	if h.Command == Proxy && addrLen > 0 && transport != 0 {
+		h.Source, h.Destination = v2Addrs(fam>>4, transport, body[:addrLen])
+	}
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, 0, errors.ErrBadProxyHeader
+		}
+		l := 3 + int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < l {
+			return nil, 0, errors.ErrBadProxyHeader
+		}
+		tlv := TLV{Type: tlvs[0], Value: append([]byte(nil), tlvs[3:l]...)}
+		if tlv.Type == TypeCRC32C && !checksumMatches(data[:n], n-len(tlvs)+3, tlv.Value) {
+			return nil, 0, errors.ErrBadProxyHeader
+		}
+		h.TLVs = append(h.TLVs, tlv)
+		tlvs = tlvs[l:]
+	}
+	return h, n, nil
+}
+
+func v2Addrs(family, transport byte, b []byte) (net.Addr, net.Addr) {
+	switch family {
+	case 0x1, 0x2:
+		l := net.IPv4len
+		if family == 0x2 {
+			l = net.IPv6len
+		}
+		srcIP := net.IP(append([]byte(nil), b[:l]...))
+		dstIP := net.IP(append([]byte(nil), b[l:2*l]...))
+		srcPort := int(binary.BigEndian.Uint16(b[2*l:]))
+		dstPort := int(binary.BigEndian.Uint16(b[2*l+2:]))
+		if transport == 2 {
+			return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+		}
+		return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+	default:
+		network := "unix"
+		if transport == 2 {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: unixPath(b[:unixPathLen]), Net: network},
+			&net.UnixAddr{Name: unixPath(b[unixPathLen:]), Net: network}
+	}
+}
+
+func unixPath(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// checksumMatches checks the CRC32C of header, whose value is at off.
+func checksumMatches(header []byte, off int, value []byte) bool {
+	if len(value) != 4 {
+		return false
+	}
+	b := append([]byte(nil), header...)
+	copy(b[off:off+4], make([]byte, 4))
+	return crc32.Checksum(b, castagnoli) == binary.BigEndian.Uint32(value)
+}
+
+// Append appends the encoding of h to b. A version 1 header can only carry TCP
+// addresses, other ones are sent as UNKNOWN. A TLV of type TypeCRC32C gets the
+// checksum of the header whatever its value.
+func (h *Header) Append(b []byte) ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.appendV1(b), nil
+	case 2:
+		return h.appendV2(b)
+	}
+	return b, errors.ErrBadProxyHeader
+}
+
+func (h *Header) appendV1(b []byte) []byte {
+	b = append(b, v1Prefix...)
+	src, ok1 := h.Source.(*net.TCPAddr)
+	dst, ok2 := h.Destination.(*net.TCPAddr)
+	v4 := ok1 && ok2 && src.IP.To4() != nil && dst.IP.To4() != nil
+	v6 := ok1 && ok2 && src.IP.To4() == nil && dst.IP.To4() == nil
+	switch {
+	case h.Command == Proxy && v4:
+		b = append(b, "TCP4 "+src.IP.To4().String()+" "+dst.IP.To4().String()...)
+	case h.Command == Proxy && v6:
+		b = append(b, "TCP6 "+src.IP.String()+" "+dst.IP.String()...)
+	default:
+		return append(b, "UNKNOWN\r\n"...)
+	}
+	return append(b, " "+strconv.Itoa(src.Port)+" "+strconv.Itoa(dst.Port)+"\r\n"...)
+}
+
+func (h *Header) appendV2(b []byte) ([]byte, error) {
+	start := len(b)
+	b = append(b, v2Signature...)
+	b = append(b, 0x20|byte(h.Command), 0, 0, 0)
+	if h.Command == Proxy {
+		fam, addrs := v2Family(h.Source, h.Destination)
+		b[start+13] = fam
+		b = append(b, addrs...)
+	}
+	crcOff := -1
+	for _, tlv := range h.TLVs {
+		value := tlv.Value
+		if tlv.Type == TypeCRC32C {
+			value = make([]byte, 4)
+			crcOff = len(b) + 3
+		}
+		if len(value) > 0xffff {
+			return b[:start], errors.ErrBadProxyHeader
+		}
+		b = append(b, tlv.Type, byte(len(value)>>8), byte(len(value)))
+		b = append(b, value...)
+	}
+	l := len(b) - start - v2HeaderLen
+	if l > 0xffff {
+		return b[:start], errors.ErrBadProxyHeader
+	}
+	binary.BigEndian.PutUint16(b[start+14:], uint16(l))
+	if crcOff >= 0 {
+		sum := crc32.Checksum(b[start:], castagnoli)
+		binary.BigEndian.PutUint32(b[crcOff:], sum)
+	}
+	return b, nil
+}
+
+// v2Family returns the family and transport byte and the address block of a
+// version 2 header, AF_UNSPEC and none for addresses it cannot carry.
+func v2Family(src, dst net.Addr) (byte, []byte) {
+	switch src := src.(type) {
+	case *net.TCPAddr:
+		if dst, ok := dst.(*net.TCPAddr); ok {
+			return v2InetAddrs(src.IP, dst.IP, src.Port, dst.Port, 0x1)
+		}
+	case *net.UDPAddr:
+		if dst, ok := dst.(*net.UDPAddr); ok {
+			return v2InetAddrs(src.IP, dst.IP, src.Port, dst.Port, 0x2)
+		}
+	case *net.UnixAddr:
+		if dst, ok := dst.(*net.UnixAddr); ok && len(src.Name) <= unixPathLen && len(dst.Name) <= unixPathLen {
+			transport := byte(0x1)
+			if src.Net == "unixgram" {
+				transport = 0x2
+			}
+			b := make([]byte, 2*unixPathLen)
+			copy(b, src.Name)
+			copy(b[unixPathLen:], dst.Name)
+			return 0x30 | transport, b
+		}
+	}
+	return 0, nil
+}
+
+func v2InetAddrs(src, dst net.IP, srcPort, dstPort int, transport byte) (byte, []byte) {
+	var b []byte
+	fam := byte(0x10)
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		b = append(append(b, src4...), dst4...)
+	} else if src.To16() != nil && dst.To16() != nil {
+		fam = 0x20
+		b = append(append(b, src.To16()...), dst.To16()...)
+	} else {
+		return 0, nil
+	}
+	b = append(b, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	return fam | transport, b
+}
@@ -0,0 +1,205 @@
+package proxyproto
+
+import (
+	"bytes"
+	"muduo/pkg/errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func tcp(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func TestV1(t *testing.T) {
+	cases := []struct {
+		h    Header
+		line string
+	}{
+		{Header{Version: 1, Command: Proxy, Source: tcp("192.168.0.1", 56324), Destination: tcp("192.168.0.11", 443)},
+			"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"},
+		{Header{Version: 1, Command: Proxy, Source: tcp("2001:db8::1", 1), Destination: tcp("::1", 65535)},
+			"PROXY TCP6 2001:db8::1 ::1 1 65535\r\n"},
+		{Header{Version: 1, Command: Proxy},
+			"PROXY UNKNOWN\r\n"},
+	}
+	for _, c := range cases {
+		b, err := c.h.Append(nil)
+		if err != nil || string(b) != c.line {
+			t.Fatalf("Append %q, %v, want %q", b, err, c.line)
+		}
+		h, n, err := Parse(append(b, "payload"...))
+		if err != nil || n != len(c.line) {
+			t.Fatalf("Parse %q: %d, %v", c.line, n, err)
+		}
+		if h.Version != 1 || !sameAddr(h.Source, c.h.Source) || !sameAddr(h.Destination, c.h.Destination) {
+			t.Fatalf("Parse %q: %+v", c.line, h)
+		}
+	}
+
+	// addresses a v1 header cannot carry
+	h := Header{Version: 1, Command: Proxy, Source: tcp("10.0.0.1", 1), Destination: tcp("::1", 2)}
+	if b, _ := h.Append(nil); string(b) != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("mixed families %q", b)
+	}
+	h = Header{Version: 1, Command: Proxy, Source: &net.UnixAddr{Name: "/a"}, Destination: &net.UnixAddr{Name: "/b"}}
+	if b, _ := h.Append(nil); string(b) != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("unix %q", b)
+	}
+	// anything after UNKNOWN is ignored
+	if h, n, err := Parse([]byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")); err != nil || n != 35 || h.Source != nil {
+		t.Fatalf("UNKNOWN with addresses: %+v, %d, %v", h, n, err)
+	}
+}
+
+func TestV1Malformed(t *testing.T) {
+	for _, line := range []string{
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443 1\r\n",
+		"PROXY TCP5 192.168.0.1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 ::1 ::1 56324 443\r\n",
+		"PROXY TCP6 192.168.0.1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 056324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 -1 443\r\n",
+		"PROXY TCP4 192.168.0.1  192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 host 192.168.0.11 56324 443\r\n",
+		"PROXY UNKNOWN " + string(bytes.Repeat([]byte("x"), 100)) + "\r\n",
+		"PROXY " + string(bytes.Repeat([]byte("x"), 110)),
+	} {
+		if _, _, err := Parse([]byte(line)); err != errors.ErrBadProxyHeader {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+}
+
+func TestV2(t *testing.T) {
+	cases := []Header{
+		{Version: 2, Command: Proxy, Source: tcp("192.168.0.1", 56324), Destination: tcp("192.168.0.11", 443)},
+		{Version: 2, Command: Proxy, Source: tcp("2001:db8::1", 1), Destination: tcp("::1", 65535)},
+		{Version: 2, Command: Proxy,
+			Source:      &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53},
+			Destination: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353}},
+		{Version: 2, Command: Proxy,
+			Source:      &net.UnixAddr{Name: "/run/client.sock", Net: "unix"},
+			Destination: &net.UnixAddr{Name: "/run/server.sock", Net: "unix"}},
+		{Version: 2, Command: Local},
+		{Version: 2, Command: Proxy, Source: tcp("10.0.0.1", 1), Destination: tcp("10.0.0.2", 2),
+			TLVs: []TLV{{TypeALPN, []byte("h2")}, {TypeAuthority, []byte("example.com")}, {TypeNoop, nil}, {TypeUniqueID, []byte{1, 2, 3}}}},
+	}
+	for _, c := range cases {
+		b, err := c.Append([]byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = b[1:]
+		h, n, err := Parse(append(b, "payload"...))
+		if err != nil || n != len(b) {
+			t.Fatalf("Parse %+v: %d, %v", c, n, err)
+		}
+		if h.Version != 2 || h.Command != c.Command || !sameAddr(h.Source, c.Source) || !sameAddr(h.Destination, c.Destination) {
+			t.Fatalf("Parse %+v: %+v", c, h)
+		}
+		if len(c.TLVs) > 0 && !reflect.DeepEqual(h.TLVs, c.TLVs) {
+			t.Fatalf("TLVs %+v, want %+v", h.TLVs, c.TLVs)
+		}
+	}
+
+	// the specification's TCP4 example, byte for byte
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12, 127, 0, 0, 1, 127, 0, 0, 2, 0x1f, 0x90, 0x00, 0x50)
+	h := Header{Version: 2, Command: Proxy, Source: tcp("127.0.0.1", 8080), Destination: tcp("127.0.0.2", 80)}
+	if b, _ := h.Append(nil); !bytes.Equal(b, want) {
+		t.Fatalf("Append % x", b)
+	}
+
+	// a LOCAL header may carry addresses, they are not the client's
+	local := append([]byte(nil), want...)
+	local[12] = 0x20
+	if h, _, err := Parse(local); err != nil || h.Command != Local || h.Source != nil {
+		t.Fatalf("LOCAL %+v, %v", h, err)
+	}
+}
+
+func TestV2Checksum(t *testing.T) {
+	h := Header{Version: 2, Command: Proxy, Source: tcp("10.0.0.1", 1), Destination: tcp("10.0.0.2", 2),
+		TLVs: []TLV{{Type: TypeCRC32C}, {TypeAuthority, []byte("example.com")}}}
+	b, err := h.Append(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, ok := parsed.TLV(TypeCRC32C); !ok || len(sum) != 4 {
+		t.Fatalf("checksum %x", sum)
+	}
+	if v, _ := parsed.TLV(TypeAuthority); string(v) != "example.com" {
+		t.Fatalf("authority %q", v)
+	}
+	b[len(b)-1] ^= 1
+	if _, _, err := Parse(b); err != errors.ErrBadProxyHeader {
+		t.Fatalf("corrupt header %v", err)
+	}
+}
+
+func TestV2Malformed(t *testing.T) {
+	valid, _ := (&Header{Version: 2, Command: Proxy, Source: tcp("10.0.0.1", 1), Destination: tcp("10.0.0.2", 2),
+		TLVs: []TLV{{TypeNoop, []byte("xx")}}}).Append(nil)
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+	for i, b := range [][]byte{
+		corrupt(func(b []byte) []byte { b[12] = 0x11; return b }),                     // version 1
+		corrupt(func(b []byte) []byte { b[12] = 0x22; return b }),                     // command 2
+		corrupt(func(b []byte) []byte { b[13] = 0x41; return b }),                     // family 4
+		corrupt(func(b []byte) []byte { b[13] = 0x13; return b }),                     // transport 3
+		corrupt(func(b []byte) []byte { b[15] = 4; return b[:20] }),                   // addresses cut
+		corrupt(func(b []byte) []byte { b[15]--; return b[:len(b)-1] }),               // TLV cut
+		corrupt(func(b []byte) []byte { b[len(b)-3] = 0; b[len(b)-2] = 9; return b }), // TLV too long
+	} {
+		if _, _, err := Parse(b); err != errors.ErrBadProxyHeader {
+			t.Fatalf("case %d: %v", i, err)
+		}
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	v1, _ := (&Header{Version: 1, Command: Proxy, Source: tcp("10.0.0.1", 1), Destination: tcp("10.0.0.2", 2)}).Append(nil)
+	v2, _ := (&Header{Version: 2, Command: Proxy, Source: tcp("10.0.0.1", 1), Destination: tcp("10.0.0.2", 2),
+		TLVs: []TLV{{TypeALPN, []byte("http/1.1")}}}).Append(nil)
+	for _, header := range [][]byte{v1, v2} {
+		for i := 0; i < len(header); i++ {
+			if h, n, err := Parse(header[:i]); h != nil || n != 0 || err != nil {
+				t.Fatalf("%q: %+v, %d, %v", header[:i], h, n, err)
+			}
+		}
+		if _, n, err := Parse(header); n != len(header) || err != nil {
+			t.Fatalf("%q: %d, %v", header, n, err)
+		}
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	for _, data := range []string{"GET / HTTP/1.1\r\n", "PROXI", "\r\n\r\n\x01", "proxy TCP4"} {
+		if _, _, err := Parse([]byte(data)); err != errors.ErrNoProxyHeader {
+			t.Fatalf("%q: %v", data, err)
+		}
+	}
+}
+
+func sameAddr(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		b, ok := b.(*net.TCPAddr)
+		return ok && a.IP.Equal(b.IP) && a.Port == b.Port
+	case *net.UDPAddr:
+		b, ok := b.(*net.UDPAddr)
+		return ok && a.IP.Equal(b.IP) && a.Port == b.Port
+	}
+	return a.String() == b.String() && a.Network() == b.Network()
+}
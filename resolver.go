@@ -0,0 +1,58 @@
+package muduo
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Resolver looks up the IP addresses of a host. *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// StaticResolver resolves host names from a fixed table, e.g. in tests.
+type StaticResolver map[string][]string
+
+func (r StaticResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	for _, s := range r[host] {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("static resolver: invalid address %q for %s", s, host)
+		}
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// happyEyeballsOrder interleaves address families the way RFC 8305 section 4
+// sorts destination addresses: the family of the first address goes first, then
+// the families alternate, each keeping the resolver's order.
+func happyEyeballsOrder(addrs []net.IPAddr) []net.IPAddr {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	firstV4 := addrs[0].IP.To4() != nil
+	var first, second []net.IPAddr
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == firstV4 {
+			first = append(first, a)
+		} else {
+			second = append(second, a)
+		}
+	}
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,32 @@
+package muduo
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestHappyEyeballsOrder(t *testing.T) {
+	r := StaticResolver{"dual.test": {"2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2"}}
+	addrs, err := r.LookupIPAddr(context.Background(), "dual.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"}
+	got := happyEyeballsOrder(addrs)
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].IP.String() != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestStaticResolver_NotFound(t *testing.T) {
+	_, err := StaticResolver{}.LookupIPAddr(context.Background(), "missing.test")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Fatalf("err = %v, want a not found DNSError", err)
+	}
+}
@@ -0,0 +1,381 @@
+package resp
+
+import (
+	"bytes"
+	"muduo"
+	"strconv"
+)
+
+const (
+	defaultMaxInline = 64 << 10
+	defaultMaxBulk   = 512 << 20
+	defaultMaxElems  = 1 << 20
+	// maxDepth bounds the nesting of aggregate replies.
+	maxDepth = 128
+)
+
+var crlf = []byte("\r\n")
+
+// Parser reads commands and values from a Buffer. A command or value is only
+// removed from the buffer once it is complete. ReadCommand remembers how far it
+// got into a partial array, so a Parser reads from a single buffer; ReadValue
+// rescans the headers of a partial value, not its payloads. Zero limits take
+// the defaults Redis uses.
+type Parser struct {
+	// MaxInline bounds inline commands and header lines, 64KiB by default.
+	MaxInline int
+	// MaxBulk bounds bulk strings, 512MiB by default.
+	MaxBulk int
+	// MaxElems bounds the elements of one aggregate, 1M by default.
+	MaxElems int
+
+	// the partial array command: its length, the start and end offsets of the
+	// arguments read so far and where the next one starts
+	count int
+	offs  []int
+	pos   int
+}
+
+func (p *Parser) maxInline() int {
+	if p.MaxInline > 0 {
+		return p.MaxInline
+	}
+	return defaultMaxInline
+}
+
+func (p *Parser) maxBulk() int {
+	if p.MaxBulk > 0 {
+		return p.MaxBulk
+	}
+	return defaultMaxBulk
+}
+
+func (p *Parser) maxElems() int {
+	if p.MaxElems > 0 {
+		return p.MaxElems
+	}
+	return defaultMaxElems
+}
+
+// ReadCommand removes the next command from buf and returns its arguments, or
+// returns nil and leaves buf untouched when the command is incomplete.
+// Commands are arrays of bulk strings, or inline lines of space separated and
+// optionally quoted words. Empty commands are skipped. The arguments alias
+// buf, copy them to keep them past the next read.
+func (p *Parser) ReadCommand(buf *muduo.Buffer) ([][]byte, error) {
+	for buf.ReadableBytes() > 0 {
+		data := buf.Peek()
+		var (
+			args [][]byte
+			n    int
+			err  error
+		)
+		if p.count > 0 || data[0] == byte(Array) {
+			args, n, err = p.multibulk(data)
+		} else {
+			args, n, err = p.inline(data)
+		}
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		buf.Advance(n)
+		if len(args) > 0 {
+			return args, nil
+		}
+	}
+	return nil, nil
+}
+
+// line returns the line starting at pos without its CRLF and the position
+// after it, or next 0 when the line is incomplete.
+func (p *Parser) line(data []byte, pos int) (line []byte, next int, err error) {
+	i := bytes.Index(data[pos:], crlf)
+	if i < 0 {
+		if len(data)-pos > p.maxInline() {
+			return nil, 0, protocolError("too big header line")
+		}
+		return nil, 0, nil
+	}
+	return data[pos : pos+i], pos + i + 2, nil
+}
+
+func (p *Parser) multibulk(data []byte) (args [][]byte, n int, err error) {
+	if p.count == 0 {
+		line, pos, err := p.line(data, 0)
+		if err != nil || pos == 0 {
+			return nil, 0, err
+		}
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count > p.maxElems() {
+			return nil, 0, protocolError("invalid multibulk length")
+		}
+		if count <= 0 {
+			return nil, pos, nil
+		}
+		p.count, p.pos, p.offs = count, pos, p.offs[:0]
+	}
+	for len(p.offs) < 2*p.count {
+		if p.pos == len(data) {
+			return nil, 0, nil
+		}
+		if data[p.pos] != byte(BulkString) {
+			p.count = 0
+			return nil, 0, protocolError("expected '$', got " + strconv.QuoteRune(rune(data[p.pos])))
+		}
+		bulk, next, err := p.bulk(data, p.pos)
+		if err == nil && next > 0 && bulk == nil {
+			err = protocolError("invalid bulk length")
+		}
+		if err != nil {
+			p.count = 0
+			return nil, 0, err
+		}
+		if next == 0 {
+			return nil, 0, nil
+		}
+		end := next - 2
+		p.offs = append(p.offs, end-len(bulk), end)
+		p.pos = next
+	}
+	args = make([][]byte, p.count)
+	for i := range args {
+		args[i] = data[p.offs[2*i]:p.offs[2*i+1]:p.offs[2*i+1]]
+	}
+	p.count = 0
+	return args, p.pos, nil
+}
+
+// bulk reads a length prefixed string at pos, whose type byte is not checked.
+// A negative length reads as a nil string.
+func (p *Parser) bulk(data []byte, pos int) (b []byte, next int, err error) {
+	line, pos, err := p.line(data, pos)
+	if err != nil || pos == 0 {
+		return nil, 0, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > p.maxBulk() {
+		return nil, 0, protocolError("invalid bulk length")
+	}
+	if n < 0 {
+		return nil, pos, nil
+	}
+	if len(data)-pos < n+2 {
+		return nil, 0, nil
+	}
+	if !bytes.Equal(data[pos+n:pos+n+2], crlf) {
+		return nil, 0, protocolError("expected CRLF after bulk data")
+	}
+	return data[pos : pos+n : pos+n], pos + n + 2, nil
+}
+
+func (p *Parser) inline(data []byte) (args [][]byte, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > p.maxInline() {
+			return nil, 0, protocolError("too big inline request")
+		}
+		return nil, 0, nil
+	}
+	line := bytes.TrimSuffix(data[:i], []byte{'\r'})
+	if args, err = splitArgs(line); err != nil {
+		return nil, 0, err
+	}
+	return args, i + 1, nil
+}
+
+// splitArgs splits an inline command the way redis-cli quotes its words:
+// double quoted words take backslash escapes, single quoted words only \'.
+// Unquoted words alias line.
+func splitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		switch line[i] {
+		case '"':
+			arg = []byte{}
+			for i++; ; i++ {
+				if i == len(line) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				c := line[i]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch c = line[i]; c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					case 'x':
+						if i+2 < len(line) {
+							if v, err := strconv.ParseUint(string(line[i+1:i+3]), 16, 8); err == nil {
+								c = byte(v)
+								i += 2
+							}
+						}
+					}
+				}
+				arg = append(arg, c)
+			}
+			i++
+		case '\'':
+			arg = []byte{}
+			for i++; ; i++ {
+				if i == len(line) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				c := line[i]
+				if c == '\'' {
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					c = '\''
+				}
+				arg = append(arg, c)
+			}
+			i++
+		default:
+			start := i
+			for i < len(line) && !isSpace(line[i]) {
+				i++
+			}
+			arg = line[start:i:i]
+		}
+		if i < len(line) && !isSpace(line[i]) {
+			// a closing quote must end the word
+			return nil, protocolError("unbalanced quotes in request")
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+// ReadValue removes the next value from buf, or returns nil and leaves buf
+// untouched when the value is incomplete. The strings of the value alias buf.
+func (p *Parser) ReadValue(buf *muduo.Buffer) (*Value, error) {
+	if buf.ReadableBytes() == 0 {
+		return nil, nil
+	}
+	v, n, err := p.value(buf.Peek(), 0, 0)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	buf.Advance(n)
+	return &v, nil
+}
+
+func (p *Parser) value(data []byte, pos int, depth int) (v Value, next int, err error) {
+	if pos == len(data) {
+		return v, 0, nil
+	}
+	v.Type = Type(data[pos])
+	switch v.Type {
+	case BulkString, BulkError, VerbatimString:
+		if v.Str, next, err = p.bulk(data, pos); err != nil || next == 0 {
+			return v, 0, err
+		}
+		if v.Str == nil {
+			if v.Type != BulkString {
+				return v, 0, protocolError("invalid bulk length")
+			}
+			v.Type = Null
+		} else if v.Type == VerbatimString && (len(v.Str) < 4 || v.Str[3] != ':') {
+			return v, 0, protocolError("invalid verbatim string")
+		}
+		return v, next, nil
+	case Array, Set, Push, Map, Attribute:
+		return p.aggregate(data, pos, depth, v)
+	}
+
+	line, next, err := p.line(data, pos)
+	if err != nil || next == 0 {
+		return v, 0, err
+	}
+	line = line[1:]
+	switch v.Type {
+	case SimpleString, Error, BigNumber:
+		v.Str = line
+	case Integer:
+		if v.Int, err = strconv.ParseInt(string(line), 10, 64); err != nil {
+			return v, 0, protocolError("invalid integer")
+		}
+	case Double:
+		if v.Float, err = strconv.ParseFloat(string(line), 64); err != nil {
+			return v, 0, protocolError("invalid double")
+		}
+	case Boolean:
+		switch string(line) {
+		case "t":
+			v.Bool = true
+		case "f":
+		default:
+			return v, 0, protocolError("invalid boolean")
+		}
+	case Null:
+		if len(line) != 0 {
+			return v, 0, protocolError("invalid null")
+		}
+	default:
+		return v, 0, protocolError("unknown type " + strconv.QuoteRune(rune(v.Type)))
+	}
+	return v, next, nil
+}
+
+func (p *Parser) aggregate(data []byte, pos int, depth int, v Value) (Value, int, error) {
+	if depth == maxDepth {
+		return v, 0, protocolError("too deeply nested")
+	}
+	line, pos, err := p.line(data, pos)
+	if err != nil || pos == 0 {
+		return v, 0, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > p.maxElems() {
+		return v, 0, protocolError("invalid aggregate length")
+	}
+	if n < 0 {
+		if v.Type != Array {
+			return v, 0, protocolError("invalid aggregate length")
+		}
+		v.Type = Null
+		return v, pos, nil
+	}
+	if v.Type == Map || v.Type == Attribute {
+		n *= 2
+	}
+	v.Elems = make([]Value, 0, minInt(n, 64))
+	for i := 0; i < n; i++ {
+		var elem Value
+		if elem, pos, err = p.value(data, pos, depth+1); err != nil || pos == 0 {
+			return v, 0, err
+		}
+		v.Elems = append(v.Elems, elem)
+	}
+	return v, pos, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+// Package resp implements RESP, the Redis serialization protocol, in both its
+// RESP2 and RESP3 versions. Parser reads commands and replies incrementally
+// from a muduo.Buffer, Writer encodes replies for either protocol version.
+package resp
+
+import (
+	"strconv"
+)
+
+// Type is the first byte of an encoded value.
+type Type byte
+
+const (
+	SimpleString   Type = '+'
+	Error          Type = '-'
+	Integer        Type = ':'
+	BulkString     Type = '$'
+	Array          Type = '*'
+	Null           Type = '_' // also what RESP2's null bulk string and null array decode to
+	Boolean        Type = '#'
+	Double         Type = ','
+	BigNumber      Type = '('
+	BulkError      Type = '!'
+	VerbatimString Type = '='
+	Map            Type = '%'
+	Set            Type = '~'
+	Attribute      Type = '|'
+	Push           Type = '>'
+)
+
+func (t Type) String() string {
+	switch t {
+	case SimpleString:
+		return "simple string"
+	case Error:
+		return "error"
+	case Integer:
+		return "integer"
+	case BulkString:
+		return "bulk string"
+	case Array:
+		return "array"
+	case Null:
+		return "null"
+	case Boolean:
+		return "boolean"
+	case Double:
+		return "double"
+	case BigNumber:
+		return "big number"
+	case BulkError:
+		return "bulk error"
+	case VerbatimString:
+		return "verbatim string"
+	case Map:
+		return "map"
+	case Set:
+		return "set"
+	case Attribute:
+		return "attribute"
+	case Push:
+		return "push"
+	}
+	return "type " + strconv.Quote(string(t))
+}
+
+// Value is a decoded value.
+type Value struct {
+	Type Type
+	// Str holds strings, errors and big numbers. A verbatim string keeps its
+	// three letter format and the colon in front of the text.
+	Str []byte
+	Int int64
+	// Float holds doubles.
+	Float float64
+	Bool  bool
+	// Elems holds the elements of arrays, sets and pushes. Maps and attributes
+	// hold their keys and values alternately.
+	Elems []Value
+}
+
+// ProtocolError is returned for malformed input. Servers answer it with
+// "-ERR Protocol error: ..." and close the connection.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+func protocolError(msg string) error {
+	return &ProtocolError{msg: msg}
+}
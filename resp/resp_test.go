@@ -0,0 +1,237 @@
+package resp
+
+import (
+	"math"
+	"muduo"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func bufferOf(s string) *muduo.Buffer {
+	buf := muduo.NewBuffer()
+	_, _ = buf.Write([]byte(s))
+	return buf
+}
+
+func toStrings(args [][]byte) []string {
+	s := make([]string, len(args))
+	for i, a := range args {
+		s[i] = string(a)
+	}
+	return s
+}
+
+func TestParser_ReadCommand(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nva\r\nl\r\n" +
+		"\r\n" +
+		"*0\r\n" +
+		"get key\r\n" +
+		"  set  \"a b\\r\\n\\x41\" 'it\\'s' ''\n" +
+		"*1\r\n$4\r\nPING\r\n"
+	want := [][]string{
+		{"SET", "key", "va\r\nl"},
+		{"get", "key"},
+		{"set", "a b\r\nA", "it's", ""},
+		{"PING"},
+	}
+	var p Parser
+	// byte by byte, every prefix is incomplete until a command ends
+	buf := muduo.NewBuffer()
+	var got [][]string
+	for i := 0; i < len(input); i++ {
+		_, _ = buf.Write([]byte{input[i]})
+		for {
+			args, err := p.ReadCommand(buf)
+			if err != nil {
+				t.Fatalf("at %d: %v", i, err)
+			}
+			if args == nil {
+				break
+			}
+			got = append(got, toStrings(args))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if buf.ReadableBytes() != 0 {
+		t.Fatalf("%d bytes left", buf.ReadableBytes())
+	}
+
+	// pipelined commands in one read
+	buf = bufferOf(strings.Repeat("*2\r\n$4\r\nINCR\r\n$1\r\nn\r\n", 3))
+	for i := 0; i < 3; i++ {
+		if args, err := p.ReadCommand(buf); err != nil || len(args) != 2 {
+			t.Fatalf("command %d: %q %v", i, args, err)
+		}
+	}
+}
+
+func TestParser_ReadCommandProgress(t *testing.T) {
+	var p Parser
+	input := "*1\r\n$4\r\nPING\r\n*1000\r\n"
+	var want []string
+	for i := 0; i < 1000; i++ {
+		arg := strings.Repeat("v", i%20)
+		want = append(want, arg)
+		input += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	// in small reads, the PING leaves room at the front that later writes reclaim
+	buf := muduo.NewBuffer()
+	var got [][]string
+	for i := 0; i < len(input); i += 7 {
+		_, _ = buf.Write([]byte(input[i:minInt(i+7, len(input))]))
+		args, err := p.ReadCommand(buf)
+		if err != nil {
+			t.Fatalf("at %d: %v", i, err)
+		}
+		if args != nil {
+			got = append(got, toStrings(args))
+		} else if len(got) == 1 && i > len(input)/2 && len(p.offs) < 2*500 {
+			t.Fatalf("at %d: %d arguments kept of the partial command", i, len(p.offs)/2)
+		}
+	}
+	if len(got) != 2 || !reflect.DeepEqual(got[0], []string{"PING"}) || !reflect.DeepEqual(got[1], want) {
+		t.Fatalf("got %d commands", len(got))
+	}
+}
+
+func TestParser_ReadCommandErrors(t *testing.T) {
+	p := Parser{MaxInline: 16, MaxBulk: 8, MaxElems: 4}
+	for _, input := range []string{
+		"*x\r\n",
+		"*5\r\n",
+		"*1\r\n:1\r\n",
+		"*1\r\n$9\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$2\r\nabc\r\n",
+		"set \"a\n",
+		"set 'a'b\n",
+		strings.Repeat("x", 17),
+		"*1\r\n$" + strings.Repeat("1", 16),
+	} {
+		if _, err := p.ReadCommand(bufferOf(input)); err == nil {
+			t.Errorf("%q: no error", input)
+		} else if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("%q: %T", input, err)
+		}
+	}
+}
+
+func TestParser_ReadValue(t *testing.T) {
+	input := "+OK\r\n-ERR bad\r\n:-42\r\n$5\r\nhello\r\n$-1\r\n*-1\r\n_\r\n#t\r\n,1.5\r\n,-inf\r\n" +
+		"(12345678901234567890\r\n!3\r\nbad\r\n=7\r\ntxt:abc\r\n" +
+		"*2\r\n:1\r\n*1\r\n+x\r\n%1\r\n+k\r\n:2\r\n~1\r\n#f\r\n>2\r\n+message\r\n$1\r\nm\r\n|1\r\n+ttl\r\n:3\r\n"
+	want := []Value{
+		{Type: SimpleString, Str: []byte("OK")},
+		{Type: Error, Str: []byte("ERR bad")},
+		{Type: Integer, Int: -42},
+		{Type: BulkString, Str: []byte("hello")},
+		{Type: Null},
+		{Type: Null},
+		{Type: Null},
+		{Type: Boolean, Bool: true},
+		{Type: Double, Float: 1.5},
+		{Type: Double, Float: math.Inf(-1)},
+		{Type: BigNumber, Str: []byte("12345678901234567890")},
+		{Type: BulkError, Str: []byte("bad")},
+		{Type: VerbatimString, Str: []byte("txt:abc")},
+		{Type: Array, Elems: []Value{{Type: Integer, Int: 1}, {Type: Array, Elems: []Value{{Type: SimpleString, Str: []byte("x")}}}}},
+		{Type: Map, Elems: []Value{{Type: SimpleString, Str: []byte("k")}, {Type: Integer, Int: 2}}},
+		{Type: Set, Elems: []Value{{Type: Boolean}}},
+		{Type: Push, Elems: []Value{{Type: SimpleString, Str: []byte("message")}, {Type: BulkString, Str: []byte("m")}}},
+		{Type: Attribute, Elems: []Value{{Type: SimpleString, Str: []byte("ttl")}, {Type: Integer, Int: 3}}},
+	}
+	var p Parser
+	buf := muduo.NewBuffer()
+	var got []Value
+	for i := 0; i < len(input); i++ {
+		_, _ = buf.Write([]byte{input[i]})
+		v, err := p.ReadValue(buf)
+		if err != nil {
+			t.Fatalf("at %d: %v", i, err)
+		}
+		if v != nil {
+			got = append(got, *v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d values, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("value %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	for _, input := range []string{"?\r\n", ":x\r\n", "#x\r\n", "_x\r\n", "=2\r\nab\r\n", "%-1\r\n", strings.Repeat("*1\r\n", maxDepth+1)} {
+		if _, err := p.ReadValue(bufferOf(input)); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	write := func(w *Writer) {
+		w.Attribute(1)
+		w.SimpleString("key-popularity")
+		w.Array(2)
+		w.BulkString("a")
+		w.Double(0.5)
+		w.Map(2)
+		w.SimpleString("first\r\nline")
+		w.Integer(1)
+		w.BulkString("second")
+		w.Set(2)
+		w.Boolean(true)
+		w.Null()
+		w.Push(1)
+		w.BigNumber("123")
+		w.BulkError("SYNTAX bad\nthing")
+		w.Verbatim("txt", "some text")
+		w.Error("ERR no")
+	}
+	tests := []struct {
+		proto int
+		want  string
+	}{
+		{2, "*4\r\n+first  line\r\n:1\r\n$6\r\nsecond\r\n*2\r\n:1\r\n$-1\r\n*1\r\n$3\r\n123\r\n" +
+			"-SYNTAX bad thing\r\n$9\r\nsome text\r\n-ERR no\r\n"},
+		{3, "|1\r\n+key-popularity\r\n*2\r\n$1\r\na\r\n,0.5\r\n" +
+			"%2\r\n+first  line\r\n:1\r\n$6\r\nsecond\r\n~2\r\n#t\r\n_\r\n>1\r\n(123\r\n" +
+			"!16\r\nSYNTAX bad\nthing\r\n=13\r\ntxt:some text\r\n-ERR no\r\n"},
+	}
+	for _, tt := range tests {
+		w := NewWriter(tt.proto)
+		write(w)
+		if got := string(w.Bytes()); got != tt.want {
+			t.Errorf("RESP%d:\ngot  %q\nwant %q", tt.proto, got, tt.want)
+		}
+
+		// what the parser reads is written back the same
+		var p Parser
+		buf := bufferOf(tt.want)
+		out := NewWriter(tt.proto)
+		for buf.ReadableBytes() > 0 {
+			v, err := p.ReadValue(buf)
+			if err != nil || v == nil {
+				t.Fatalf("RESP%d: %v", tt.proto, err)
+			}
+			out.Value(v)
+		}
+		if got := string(out.Bytes()); got != tt.want {
+			t.Errorf("RESP%d round trip:\ngot  %q\nwant %q", tt.proto, got, tt.want)
+		}
+	}
+
+	w := NewWriter(2)
+	w.Null()
+	w.NullArray()
+	w.Proto = 3
+	w.NullArray()
+	if got := string(w.Bytes()); got != "$-1\r\n*-1\r\n_\r\n" {
+		t.Errorf("nulls: got %q", got)
+	}
+}
@@ -0,0 +1,301 @@
+package resp
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Writer appends encoded values to a byte slice. With Proto 2 the RESP3 types
+// are downgraded the way Redis does it: null becomes a null bulk string, maps
+// become flat arrays, sets and pushes arrays, booleans integers, doubles, big
+// numbers and verbatim strings bulk strings, bulk errors errors, and attributes
+// are dropped together with their elements.
+//
+// Aggregates are written as a header followed by their elements:
+//
+//	w.Array(2)
+//	w.BulkString("hello")
+//	w.Integer(42)
+type Writer struct {
+	// Proto is 2 or 3, 2 when 0.
+	Proto int
+	buf   []byte
+	// skip counts the values still to drop of an attribute written with Proto 2
+	skip int
+}
+
+// NewWriter returns a Writer for protocol version proto.
+func NewWriter(proto int) *Writer {
+	return &Writer{Proto: proto}
+}
+
+// Bytes returns the values written since the last Reset.
+func (w *Writer) Bytes() []byte {
+	return w.buf
+}
+
+func (w *Writer) Len() int {
+	return len(w.buf)
+}
+
+func (w *Writer) Reset() {
+	w.buf = w.buf[:0]
+	w.skip = 0
+}
+
+func (w *Writer) resp3() bool {
+	return w.Proto >= 3
+}
+
+// begin reports whether the next value is written, aggregates dropped along
+// with an attribute add their elements to the values to drop.
+func (w *Writer) begin(elems int) bool {
+	if w.skip == 0 {
+		return true
+	}
+	w.skip += elems - 1
+	return false
+}
+
+func (w *Writer) line(t Type, s string) {
+	w.buf = append(w.buf, byte(t))
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+func (w *Writer) header(t Type, n int) {
+	w.buf = append(w.buf, byte(t))
+	w.buf = strconv.AppendInt(w.buf, int64(n), 10)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+func (w *Writer) bulk(t Type, b []byte) {
+	w.header(t, len(b))
+	w.buf = append(w.buf, b...)
+	w.buf = append(w.buf, '\r', '\n')
+}
+
+// noCRLF keeps a simple string on one line.
+func noCRLF(s string) string {
+	if strings.ContainsAny(s, "\r\n") {
+		return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	}
+	return s
+}
+
+func (w *Writer) SimpleString(s string) {
+	if w.begin(0) {
+		w.line(SimpleString, noCRLF(s))
+	}
+}
+
+// Error writes an error, msg starts with its code as in "ERR unknown command".
+func (w *Writer) Error(msg string) {
+	if w.begin(0) {
+		w.line(Error, noCRLF(msg))
+	}
+}
+
+func (w *Writer) Integer(n int64) {
+	if w.begin(0) {
+		w.line(Integer, strconv.FormatInt(n, 10))
+	}
+}
+
+func (w *Writer) Bulk(b []byte) {
+	if w.begin(0) {
+		w.bulk(BulkString, b)
+	}
+}
+
+func (w *Writer) BulkString(s string) {
+	if w.begin(0) {
+		w.header(BulkString, len(s))
+		w.buf = append(w.buf, s...)
+		w.buf = append(w.buf, '\r', '\n')
+	}
+}
+
+// Null writes a null, a null bulk string with Proto 2.
+func (w *Writer) Null() {
+	if !w.begin(0) {
+		return
+	}
+	if w.resp3() {
+		w.line(Null, "")
+	} else {
+		w.line(BulkString, "-1")
+	}
+}
+
+// NullArray writes a null, a null array with Proto 2.
+func (w *Writer) NullArray() {
+	if !w.begin(0) {
+		return
+	}
+	if w.resp3() {
+		w.line(Null, "")
+	} else {
+		w.line(Array, "-1")
+	}
+}
+
+func (w *Writer) Array(n int) {
+	if w.begin(n) {
+		w.header(Array, n)
+	}
+}
+
+// Map starts a map of n pairs, write the key and value of each in turn.
+func (w *Writer) Map(n int) {
+	if !w.begin(2 * n) {
+		return
+	}
+	if w.resp3() {
+		w.header(Map, n)
+	} else {
+		w.header(Array, 2*n)
+	}
+}
+
+func (w *Writer) Set(n int) {
+	w.aggregate(Set, n)
+}
+
+// Push starts an out of band message such as a pub/sub message.
+func (w *Writer) Push(n int) {
+	w.aggregate(Push, n)
+}
+
+func (w *Writer) aggregate(t Type, n int) {
+	if !w.begin(n) {
+		return
+	}
+	if w.resp3() {
+		w.header(t, n)
+	} else {
+		w.header(Array, n)
+	}
+}
+
+// Attribute starts an attribute of n pairs that goes with the value written
+// after it.
+func (w *Writer) Attribute(n int) {
+	if !w.resp3() {
+		w.skip += 2 * n
+		return
+	}
+	if w.begin(2 * n) {
+		w.header(Attribute, n)
+	}
+}
+
+func (w *Writer) Boolean(b bool) {
+	if !w.begin(0) {
+		return
+	}
+	switch {
+	case !w.resp3() && b:
+		w.line(Integer, "1")
+	case !w.resp3():
+		w.line(Integer, "0")
+	case b:
+		w.line(Boolean, "t")
+	default:
+		w.line(Boolean, "f")
+	}
+}
+
+func (w *Writer) Double(f float64) {
+	if !w.begin(0) {
+		return
+	}
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	if w.resp3() {
+		w.line(Double, s)
+	} else {
+		w.bulk(BulkString, []byte(s))
+	}
+}
+
+// BigNumber writes an integer of any size given in decimal.
+func (w *Writer) BigNumber(s string) {
+	if !w.begin(0) {
+		return
+	}
+	if w.resp3() {
+		w.line(BigNumber, s)
+	} else {
+		w.bulk(BulkString, []byte(s))
+	}
+}
+
+// BulkError writes an error that may span lines.
+func (w *Writer) BulkError(msg string) {
+	if !w.begin(0) {
+		return
+	}
+	if w.resp3() {
+		w.bulk(BulkError, []byte(msg))
+	} else {
+		w.line(Error, noCRLF(msg))
+	}
+}
+
+// Verbatim writes text with its three letter format, such as "txt" or "mkd".
+func (w *Writer) Verbatim(format string, text string) {
+	if !w.begin(0) {
+		return
+	}
+	if w.resp3() {
+		w.bulk(VerbatimString, []byte(format+":"+text))
+	} else {
+		w.bulk(BulkString, []byte(text))
+	}
+}
+
+// Value writes a decoded value.
+func (w *Writer) Value(v *Value) {
+	switch v.Type {
+	case SimpleString:
+		w.SimpleString(string(v.Str))
+	case Error:
+		w.Error(string(v.Str))
+	case Integer:
+		w.Integer(v.Int)
+	case BulkString:
+		w.Bulk(v.Str)
+	case Null:
+		w.Null()
+	case Boolean:
+		w.Boolean(v.Bool)
+	case Double:
+		w.Double(v.Float)
+	case BigNumber:
+		w.BigNumber(string(v.Str))
+	case BulkError:
+		w.BulkError(string(v.Str))
+	case VerbatimString:
+		w.Verbatim(string(v.Str[:3]), string(v.Str[4:]))
+	case Array, Set, Push:
+		w.aggregate(v.Type, len(v.Elems))
+	case Map:
+		w.Map(len(v.Elems) / 2)
+	case Attribute:
+		w.Attribute(len(v.Elems) / 2)
+	}
+	for i := range v.Elems {
+		w.Value(&v.Elems[i])
+	}
+}
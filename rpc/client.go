@@ -0,0 +1,151 @@
+package rpc
+
+import (
+	"context"
+	"muduo"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"sync"
+	"time"
+)
+
+// Client is the stub for calling a Server. Its calls are pipelined on a single
+// connection that lives on the Eventloop passed to NewClient, the caller runs
+// that loop. A Client does not reconnect once its connection is gone.
+type Client struct {
+	el   *muduo.Eventloop
+	tcp  *muduo.TcpClient
+	opts options
+
+	mu        sync.Mutex
+	mux       *muduo.Mux
+	connected chan struct{}
+	dialed    bool
+	closed    bool
+}
+
+func NewClient(el *muduo.Eventloop, svrAddr string, opts ...Option) (*Client, error) {
+	tcp, err := muduo.NewTcpClient(el, svrAddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		el:        el,
+		tcp:       tcp,
+		opts:      newOptions(opts),
+		connected: make(chan struct{}),
+	}
+	tcp.SetOnConn(c.onConn)
+	return c, nil
+}
+
+// Connect connects to the server, retrying with the default policy until ctx is done.
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errors.ErrClientClosed
+	}
+	if !c.dialed {
+		c.dialed = true
+		c.tcp.Connect()
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.connected:
+		return nil
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+func (c *Client) onConn(conn *muduo.TcpConn) {
+	if !conn.IsConnected() {
+		c.mu.Lock()
+		c.mux = nil
+		c.mu.Unlock()
+		return
+	}
+	mux := muduo.NewMux(conn, muxCodec{maxFrame: c.opts.maxFrame})
+	mux.SetOnAbandon(c.cancel)
+	c.mu.Lock()
+	c.mux = mux
+	c.mu.Unlock()
+	close(c.connected)
+}
+
+// cancel tells the server to stop working on a call the caller gave up on. Calls
+// that timed out are left alone, the server has the same deadline.
+func (c *Client) cancel(conn *muduo.TcpConn, id uint64, err error) {
+	if err == errors.ErrCallTimeout {
+		return
+	}
+	msg := &message{kind: kindCancel, id: id}
+	if _, err := conn.Write(msg.encode()); err != nil {
+		logging.Debugf("rpc client: cancel call %d: %v", id, err)
+	}
+}
+
+// Call invokes method with args and unmarshals the result into reply, which
+// may be nil to discard it. ctx's deadline is sent along, the server gives up
+// when it passes and so does Call, with ErrCallTimeout. When ctx is canceled the
+// server is told to stop. Calls in flight when the connection drops fail with
+// ErrConnDropped, an error status from the server is returned as *Error.
+func (c *Client) Call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	c.mu.Lock()
+	mux, closed := c.mux, c.closed
+	c.mu.Unlock()
+	if closed {
+		return errors.ErrClientClosed
+	}
+	if mux == nil {
+		return errors.ErrConnNotOpened
+	}
+	payload, err := c.opts.serializer.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req := &message{kind: kindRequest, method: method, payload: payload}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.timeout = time.Until(deadline)
+		if req.timeout <= 0 {
+			return errors.ErrCallTimeout
+		}
+	}
+	frame, err := mux.Call(ctx, req.encode())
+	if err != nil {
+		return err
+	}
+	resp, err := parse(frame)
+	if err != nil {
+		return err
+	}
+	switch resp.status {
+	case StatusOK:
+		if reply == nil {
+			return nil
+		}
+		return c.opts.serializer.Unmarshal(resp.payload, reply)
+	case StatusDeadlineExceeded:
+		return errors.ErrCallTimeout
+	}
+	return &Error{Status: resp.status, Message: string(resp.payload)}
+}
+
+// Close closes the connection, calls in flight fail with ErrConnDropped.
+func (c *Client) Close() {
+	c.mu.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	c.el.AsyncExecute(func() {
+		c.tcp.Stop()
+		if conn := c.tcp.GetConn(); conn != nil {
+			conn.ForceClose()
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"muduo"
+	"muduo/pkg/errors"
+	"time"
+)
+
+// kind tells requests, responses and cancellations apart.
+type kind uint8
+
+const (
+	kindRequest kind = iota + 1
+	kindResponse
+	kindCancel
+)
+
+// Status is the outcome of a call, carried by its response.
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	// StatusError means the handler returned an error, the payload is its text.
+	StatusError
+	StatusNoMethod
+	StatusBadRequest
+	StatusDeadlineExceeded
+	StatusCanceled
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusError:
+		return "error"
+	case StatusNoMethod:
+		return "no such method"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusDeadlineExceeded:
+		return "deadline exceeded"
+	case StatusCanceled:
+		return "canceled"
+	}
+	return "unknown status"
+}
+
+// A frame is laid out as follows, integers are big endian:
+//
+//	length  uint32  bytes after this field
+//	kind    uint8
+//	status  uint8   responses only
+//	id      uint64  call id
+//	timeout int64   requests only, nanoseconds left until the caller's deadline, 0 for none
+//	mlen    uint16
+//	method  [mlen]byte
+//	payload [length-20-mlen]byte
+const (
+	lengthSize = 4
+	headerSize = 20
+	idOffset   = lengthSize + 2
+	// DefaultMaxFrame bounds frames unless WithMaxFrame says otherwise.
+	DefaultMaxFrame = 16 << 20
+)
+
+type message struct {
+	kind    kind
+	status  Status
+	id      uint64
+	timeout time.Duration
+	method  string
+	payload []byte
+}
+
+func (m *message) encode() []byte {
+	frame := make([]byte, lengthSize+headerSize+len(m.method)+len(m.payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-lengthSize))
+	frame[4] = byte(m.kind)
+	frame[5] = byte(m.status)
+	binary.BigEndian.PutUint64(frame[idOffset:], m.id)
+	binary.BigEndian.PutUint64(frame[14:], uint64(m.timeout))
+	binary.BigEndian.PutUint16(frame[22:], uint16(len(m.method)))
+	n := copy(frame[lengthSize+headerSize:], m.method)
+	copy(frame[lengthSize+headerSize+n:], m.payload)
+	return frame
+}
+
+// nextFrame removes the next frame from buf and returns it without the length
+// field, or nil when it is incomplete.
+func nextFrame(buf *muduo.Buffer, maxFrame int) ([]byte, error) {
+	if buf.ReadableBytes() < lengthSize {
+		return nil, nil
+	}
+	n := int(binary.BigEndian.Uint32(buf.Peek()))
+	if n > maxFrame {
+		return nil, errors.ErrFrameTooLarge
+	}
+	if n < headerSize {
+		return nil, errors.ErrBadFrame
+	}
+	if buf.ReadableBytes() < lengthSize+n {
+		return nil, nil
+	}
+	buf.Advance(lengthSize)
+	return buf.Next(n), nil
+}
+
+// parse decodes a frame returned by nextFrame, the message aliases frame.
+func parse(frame []byte) (*message, error) {
+	mlen := int(binary.BigEndian.Uint16(frame[18:]))
+	if headerSize+mlen > len(frame) {
+		return nil, errors.ErrBadFrame
+	}
+	m := &message{
+		kind:    kind(frame[0]),
+		status:  Status(frame[1]),
+		id:      binary.BigEndian.Uint64(frame[2:]),
+		timeout: time.Duration(binary.BigEndian.Uint64(frame[10:])),
+		method:  string(frame[headerSize : headerSize+mlen]),
+		payload: frame[headerSize+mlen:],
+	}
+	if m.kind < kindRequest || m.kind > kindCancel {
+		return nil, errors.ErrBadFrame
+	}
+	return m, nil
+}
+
+// muxCodec lets muduo.Mux match responses to calls. Requests are encoded up
+// front with id 0, the Mux fills in the id it assigns.
+type muxCodec struct {
+	maxFrame int
+}
+
+func (c muxCodec) EncodeRequest(id uint64, req []byte) []byte {
+	frame := append([]byte(nil), req...)
+	binary.BigEndian.PutUint64(frame[idOffset:], id)
+	return frame
+}
+
+func (c muxCodec) DecodeResponse(buf *muduo.Buffer) (uint64, []byte, error) {
+	for {
+		frame, err := nextFrame(buf, c.maxFrame)
+		if frame == nil || err != nil {
+			return 0, nil, err
+		}
+		m, err := parse(frame)
+		if err != nil {
+			return 0, nil, err
+		}
+		if m.kind == kindResponse {
+			return m.id, frame, nil
+		}
+	}
+}
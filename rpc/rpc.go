@@ -0,0 +1,56 @@
+// Package rpc is a small RPC framework on top of muduo.TcpServer and
+// muduo.TcpClient in the spirit of muduo's protorpc. A Server dispatches
+// requests to registered methods, a Client pipelines calls on one connection.
+// Callers' deadlines travel with the request, and a call the client gives up on
+// is canceled on the server too.
+package rpc
+
+import "fmt"
+
+// Error is returned by Client.Call when the server answers with a status other
+// than StatusOK or StatusDeadlineExceeded.
+type Error struct {
+	Status  Status
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "rpc: " + e.Status.String()
+	}
+	return fmt.Sprintf("rpc: %s: %s", e.Status, e.Message)
+}
+
+type options struct {
+	serializer Serializer
+	maxFrame   int
+}
+
+// Option configures a Server or a Client.
+type Option func(o *options)
+
+// WithSerializer replaces JSON as the payload encoding.
+func WithSerializer(s Serializer) Option {
+	return func(o *options) {
+		o.serializer = s
+	}
+}
+
+// WithMaxFrame closes connections that send frames longer than n bytes,
+// DefaultMaxFrame by default.
+func WithMaxFrame(n int) Option {
+	return func(o *options) {
+		o.maxFrame = n
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		serializer: JSON,
+		maxFrame:   DefaultMaxFrame,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,258 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"muduo"
+	"muduo/pkg/errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type addArgs struct {
+	A, B int
+}
+
+type sum struct {
+	Sum int
+}
+
+// startServer runs a server with a few test methods, ended reports why each
+// "Block" call returned.
+func startServer(t *testing.T, opts ...Option) (s *Server, ended chan error, stop func()) {
+	el := muduo.NewEventloop("rpc")
+	s = NewServer(el, "rpc", "tcp4://127.0.0.1:0", 1, opts...)
+	ended = make(chan error, 8)
+	register := func(name string, handler interface{}) {
+		if err := s.Register(name, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	register("Arith.Add", func(_ context.Context, args *addArgs) (*sum, error) {
+		return &sum{Sum: args.A + args.B}, nil
+	})
+	register("Echo", func(_ context.Context, msg string) (string, error) {
+		return msg, nil
+	})
+	register("Fail", func(_ context.Context, msg string) (string, error) {
+		return "", fmt.Errorf("failed: %s", msg)
+	})
+	register("Deadline", func(ctx context.Context, _ string) (time.Duration, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return 0, nil
+		}
+		return time.Until(deadline), nil
+	})
+	register("Block", func(ctx context.Context, _ string) (string, error) {
+		<-ctx.Done()
+		ended <- ctx.Err()
+		return "", ctx.Err()
+	})
+	s.Start()
+	listening := make(chan struct{})
+	el.AsyncExecute(func() { close(listening) })
+	stopped := make(chan struct{})
+	go func() {
+		el.Loop()
+		close(stopped)
+	}()
+	<-listening
+	return s, ended, func() {
+		s.Shutdown(100 * time.Millisecond)
+		<-stopped
+	}
+}
+
+func dial(t *testing.T, addr string, opts ...Option) (*Client, func()) {
+	el := muduo.NewEventloopEngine("rpc-client").StartLoop()
+	c, err := NewClient(el, "tcp4://"+addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		el.AsyncExecute(el.Stop)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	s := NewServer(muduo.NewEventloop("rpc"), "rpc", "tcp4://127.0.0.1:0", 1)
+	for _, bad := range []interface{}{
+		42,
+		func(string) (string, error) { return "", nil },
+		func(context.Context, string) string { return "" },
+	} {
+		if err := s.Register("bad", bad); err == nil {
+			t.Errorf("Register accepted %T", bad)
+		}
+	}
+	echo := func(_ context.Context, s string) (string, error) { return s, nil }
+	if err := s.Register("Echo", echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register("Echo", echo); err == nil {
+		t.Fatal("Register accepted a duplicate")
+	}
+}
+
+func TestClient_Call(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		serializer Serializer
+	}{{"json", JSON}, {"gob", Gob}} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _, stop := startServer(t, WithSerializer(tc.serializer))
+			defer stop()
+			c, closeClient := dial(t, s.Addr(), WithSerializer(tc.serializer))
+			defer closeClient()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					var reply sum
+					if err := c.Call(ctx, "Arith.Add", &addArgs{A: i, B: 1}, &reply); err != nil || reply.Sum != i+1 {
+						t.Errorf("Add(%d, 1) = %d, %v", i, reply.Sum, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			var echo string
+			if err := c.Call(ctx, "Echo", "hello", &echo); err != nil || echo != "hello" {
+				t.Fatalf("Echo = %q, %v", echo, err)
+			}
+			err := c.Call(ctx, "Fail", "boom", nil)
+			if e, ok := err.(*Error); !ok || e.Status != StatusError || e.Message != "failed: boom" {
+				t.Fatalf("Fail = %v", err)
+			}
+			err = c.Call(ctx, "Missing", "", nil)
+			if e, ok := err.(*Error); !ok || e.Status != StatusNoMethod {
+				t.Fatalf("Missing = %v", err)
+			}
+			err = c.Call(ctx, "Arith.Add", "not a struct", nil)
+			if e, ok := err.(*Error); !ok || e.Status != StatusBadRequest {
+				t.Fatalf("bad args = %v", err)
+			}
+		})
+	}
+}
+
+func TestClient_Deadline(t *testing.T) {
+	s, ended, stop := startServer(t)
+	defer stop()
+	c, closeClient := dial(t, s.Addr())
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var left time.Duration
+	if err := c.Call(ctx, "Deadline", "", &left); err != nil {
+		t.Fatal(err)
+	}
+	if left <= 4*time.Second || left > 5*time.Second {
+		t.Fatalf("server saw %v left, want about 5s", left)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if err := c.Call(short, "Block", "", nil); err != errors.ErrCallTimeout {
+		t.Fatalf("err = %v, want ErrCallTimeout", err)
+	}
+	select {
+	case err := <-ended:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("server call ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server call is still running")
+	}
+}
+
+func TestClient_Cancel(t *testing.T) {
+	s, ended, stop := startServer(t)
+	defer stop()
+	c, closeClient := dial(t, s.Addr())
+	defer closeClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := c.Call(ctx, "Block", "", nil); err != context.Canceled {
+		t.Fatalf("err = %v, want Canceled", err)
+	}
+	select {
+	case err := <-ended:
+		if err != context.Canceled {
+			t.Fatalf("server call ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server call was not canceled")
+	}
+
+	// closing the client cancels what is still running
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Call(context.Background(), "Block", "", nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	if err := <-result; err != errors.ErrConnDropped {
+		t.Fatalf("err = %v, want ErrConnDropped", err)
+	}
+	if err := <-ended; err != context.Canceled {
+		t.Fatalf("server call ended with %v", err)
+	}
+	if err := c.Call(context.Background(), "Echo", "", nil); err != errors.ErrClientClosed {
+		t.Fatalf("err = %v, want ErrClientClosed", err)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	in := &message{kind: kindRequest, id: 7, timeout: time.Second, method: "Echo", payload: []byte("hi")}
+	buf := muduo.NewBuffer()
+	frame := in.encode()
+	_, _ = buf.Write(frame[:10])
+	if f, err := nextFrame(buf, DefaultMaxFrame); f != nil || err != nil {
+		t.Fatalf("partial frame = %q, %v", f, err)
+	}
+	_, _ = buf.Write(frame[10:])
+	f, err := nextFrame(buf, DefaultMaxFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.kind != in.kind || out.id != in.id || out.timeout != in.timeout ||
+		out.method != in.method || string(out.payload) != "hi" {
+		t.Fatalf("parsed %+v", out)
+	}
+
+	_, _ = buf.Write(in.encode())
+	if _, err := nextFrame(buf, 8); err != errors.ErrFrameTooLarge {
+		t.Fatalf("err = %v, want ErrFrameTooLarge", err)
+	}
+	bad := in.encode()
+	bad[4] = 9
+	if _, err := parse(bad[lengthSize:]); err != errors.ErrBadFrame {
+		t.Fatalf("err = %v, want ErrBadFrame", err)
+	}
+	if !strings.Contains((&Error{Status: StatusNoMethod, Message: "X"}).Error(), "no such method") {
+		t.Fatal("Error does not name the status")
+	}
+}
@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"muduo"
+	"muduo/pkg/logging"
+	"reflect"
+	"time"
+)
+
+var (
+	ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+type method struct {
+	fn      reflect.Value
+	argType reflect.Type // the type allocated for unmarshalling, the pointee for pointer arguments
+	argPtr  bool
+}
+
+// Server dispatches requests to the methods registered on it. Each method runs
+// on a goroutine of its own with a context that is canceled when the caller's
+// deadline passes, the caller cancels the call or the connection goes away.
+type Server struct {
+	svr     *muduo.TcpServer
+	opts    options
+	methods map[string]*method
+}
+
+// serverConn tracks the calls in progress on one connection, on its loop.
+type serverConn struct {
+	calls map[uint64]context.CancelFunc
+}
+
+func NewServer(el *muduo.Eventloop, name string, addr string, engineCnt int, opts ...Option) *Server {
+	s := &Server{
+		svr:     muduo.NewTcpServer(el, name, addr, engineCnt),
+		opts:    newOptions(opts),
+		methods: make(map[string]*method),
+	}
+	s.svr.SetOnConn(s.onConn)
+	s.svr.SetOnMsg(s.onMsg)
+	return s
+}
+
+// Register adds a method, handler must look like
+//
+//	func(ctx context.Context, args T) (R, error)
+//
+// T is unmarshalled from the request and R marshalled into the response.
+// Methods must be registered before Start.
+func (s *Server) Register(name string, handler interface{}) error {
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 2 ||
+		t.In(0) != ctxType || t.Out(1) != errType {
+		return fmt.Errorf("rpc: method %s has type %v, want func(context.Context, T) (R, error)", name, t)
+	}
+	if _, dup := s.methods[name]; dup {
+		return fmt.Errorf("rpc: method %s is already registered", name)
+	}
+	m := &method{fn: fn, argType: t.In(1)}
+	if m.argType.Kind() == reflect.Ptr {
+		m.argType = m.argType.Elem()
+		m.argPtr = true
+	}
+	s.methods[name] = m
+	return nil
+}
+
+func (s *Server) Start() {
+	s.svr.Start()
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.svr.Addr()
+}
+
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.svr.Shutdown(timeout)
+}
+
+func (s *Server) onConn(conn *muduo.TcpConn) {
+	if conn.IsConnected() {
+		conn.SetContext(&serverConn{calls: make(map[uint64]context.CancelFunc)})
+		return
+	}
+	sc := conn.GetContext().(*serverConn)
+	for _, cancel := range sc.calls {
+		cancel()
+	}
+	sc.calls = nil
+}
+
+func (s *Server) onMsg(conn *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+	sc := conn.GetContext().(*serverConn)
+	for {
+		frame, err := nextFrame(buf, s.opts.maxFrame)
+		if err == nil && frame == nil {
+			return
+		}
+		var m *message
+		if err == nil {
+			m, err = parse(frame)
+		}
+		if err != nil {
+			logging.Errorf("rpc server: %s sent a bad frame: %v", conn.Name(), err)
+			conn.ForceClose()
+			return
+		}
+		switch m.kind {
+		case kindRequest:
+			s.dispatch(conn, sc, m)
+		case kindCancel:
+			if cancel := sc.calls[m.id]; cancel != nil {
+				delete(sc.calls, m.id)
+				cancel()
+			}
+		default:
+			logging.Warnf("rpc server: %s sent a response", conn.Name())
+		}
+	}
+}
+
+func (s *Server) dispatch(conn *muduo.TcpConn, sc *serverConn, req *message) {
+	md := s.methods[req.method]
+	if md == nil {
+		s.reply(conn, req.id, StatusNoMethod, []byte(req.method))
+		return
+	}
+	if _, dup := sc.calls[req.id]; dup {
+		s.reply(conn, req.id, StatusBadRequest, []byte("duplicate call id"))
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if req.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), req.timeout)
+	}
+	sc.calls[req.id] = cancel
+	id, payload := req.id, append([]byte(nil), req.payload...)
+	go func() {
+		status, out := s.invoke(ctx, md, payload)
+		conn.Eventloop().AsyncExecute(func() {
+			if _, ok := sc.calls[id]; !ok {
+				// canceled by the caller or the connection is gone, nobody waits
+				return
+			}
+			delete(sc.calls, id)
+			cancel()
+			s.reply(conn, id, status, out)
+		})
+	}()
+}
+
+func (s *Server) invoke(ctx context.Context, md *method, payload []byte) (status Status, out []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Errorf("rpc server: method panicked: %v", r)
+			status, out = StatusError, []byte(fmt.Sprintf("panic: %v", r))
+		}
+	}()
+	arg := reflect.New(md.argType)
+	if err := s.opts.serializer.Unmarshal(payload, arg.Interface()); err != nil {
+		return StatusBadRequest, []byte(err.Error())
+	}
+	if !md.argPtr {
+		arg = arg.Elem()
+	}
+	ret := md.fn.Call([]reflect.Value{reflect.ValueOf(ctx), arg})
+	if err := ctx.Err(); err != nil {
+		if err == context.DeadlineExceeded {
+			return StatusDeadlineExceeded, nil
+		}
+		return StatusCanceled, nil
+	}
+	if err, _ := ret[1].Interface().(error); err != nil {
+		return StatusError, []byte(err.Error())
+	}
+	data, err := s.opts.serializer.Marshal(ret[0].Interface())
+	if err != nil {
+		return StatusError, []byte(err.Error())
+	}
+	return StatusOK, data
+}
+
+func (s *Server) reply(conn *muduo.TcpConn, id uint64, status Status, payload []byte) {
+	resp := &message{kind: kindResponse, status: status, id: id, payload: payload}
+	if _, err := conn.Write(resp.encode()); err != nil {
+		logging.Warnf("rpc server: reply to %s: %v", conn.Name(), err)
+	}
+}
@@ -0,0 +1,103 @@
+package muduo
+
+import (
+	"golang.org/x/sys/unix"
+	"muduo/pkg/logging"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type SignalCallback func(sig os.Signal)
+
+// signalPipe delivers signals to the loop goroutine. signalfd would need the signals
+// blocked in every thread, which the Go runtime does not allow, so os/signal feeds a
+// self-pipe whose read end is a Channel of the loop.
+type signalPipe struct {
+	el        *Eventloop
+	r, w      int
+	ch        *Channel
+	notify    chan os.Signal
+	done      chan struct{}
+	callbacks map[syscall.Signal][]SignalCallback
+}
+
+func newSignalPipe(el *Eventloop) *signalPipe {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		panic(err)
+	}
+	sp := &signalPipe{
+		el:        el,
+		r:         p[0],
+		w:         p[1],
+		ch:        NewChannel(el, p[0]),
+		notify:    make(chan os.Signal, 16),
+		done:      make(chan struct{}),
+		callbacks: make(map[syscall.Signal][]SignalCallback),
+	}
+	sp.ch.setReadCallback(sp.handleRead)
+	sp.ch.enableReading()
+	go sp.forward()
+	return sp
+}
+
+func (sp *signalPipe) forward() {
+	defer close(sp.done)
+	for sig := range sp.notify {
+		if s, ok := sig.(syscall.Signal); ok {
+			_, _ = unix.Write(sp.w, []byte{byte(s)})
+		}
+	}
+}
+
+func (sp *signalPipe) handleRead(_ time.Time) {
+	var buf [64]byte
+	for {
+		n, err := unix.Read(sp.r, buf[:])
+		if n <= 0 || err != nil {
+			return
+		}
+		for _, b := range buf[:n] {
+			sig := syscall.Signal(b)
+			logging.Infof("eventloop[%s] received signal %v", sp.el.id, sig)
+			for _, cb := range sp.callbacks[sig] {
+				cb(sig)
+			}
+		}
+	}
+}
+
+func (sp *signalPipe) add(sig syscall.Signal, cb SignalCallback) {
+	if len(sp.callbacks[sig]) == 0 {
+		signal.Notify(sp.notify, sig)
+	}
+	sp.callbacks[sig] = append(sp.callbacks[sig], cb)
+}
+
+func (sp *signalPipe) close() {
+	signal.Stop(sp.notify)
+	close(sp.notify)
+	// the forwarder must not write to the pipe once its fd number can be reused
+	<-sp.done
+	sp.ch.disableAll()
+	sp.el.removeChannel(sp.ch)
+	_ = unix.Close(sp.r)
+	_ = unix.Close(sp.w)
+}
+
+// OnSignal runs cb on the loop goroutine whenever sig is delivered to the process.
+// The signal's default action (e.g. termination) no longer happens once a callback
+// is registered. It must be called on the loop goroutine or before Loop starts.
+func (el *Eventloop) OnSignal(sig os.Signal, cb SignalCallback) {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		logging.Errorf("eventloop[%s] unsupported signal %v", el.id, sig)
+		return
+	}
+	if el.signals == nil {
+		el.signals = newSignalPipe(el)
+	}
+	el.signals.add(s, cb)
+}
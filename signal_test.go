@@ -0,0 +1,31 @@
+package muduo
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEventloop_OnSignal(t *testing.T) {
+	el := NewEventloop("")
+	var got []os.Signal
+	el.OnSignal(syscall.SIGUSR1, func(sig os.Signal) {
+		got = append(got, sig)
+	})
+	el.OnSignal(syscall.SIGUSR1, func(sig os.Signal) {
+		got = append(got, sig)
+		el.Stop()
+	})
+	el.ScheduleDelay(func() {
+		_ = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	}, 10*time.Millisecond)
+	el.ScheduleDelay(func() {
+		t.Error("signal was not delivered")
+		el.Stop()
+	}, 5*time.Second)
+	el.Loop()
+	if len(got) != 2 || got[0] != syscall.SIGUSR1 {
+		t.Errorf("unexpected signals %v", got)
+	}
+}
@@ -0,0 +1,398 @@
+// Package socks5 reads and writes the messages of SOCKS version 5 (RFC 1928)
+// and of its username/password authentication (RFC 1929).
+//
+// A client greets the server with the authentication methods it supports, the
+// server selects one, the client authenticates if it has to and sends a
+// request, which the server answers with a reply. UDP relayed through an
+// association is framed in datagrams of their own.
+package socks5
+
+import (
+	"encoding/binary"
+	"muduo/pkg/errors"
+	"net"
+	"strconv"
+)
+
+// Version is the protocol version every message but those of the
+// username/password authentication starts with.
+const Version = 5
+
+// authVersion is the version of the username/password authentication.
+const authVersion = 1
+
+// Authentication methods.
+const (
+	MethodNoAuth       byte = 0x00
+	MethodUserPass     byte = 0x02
+	MethodNoAcceptable byte = 0xff
+)
+
+// Commands of a request.
+const (
+	CmdConnect      byte = 0x01
+	CmdBind         byte = 0x02
+	CmdUDPAssociate byte = 0x03
+)
+
+// Codes of a reply.
+const (
+	ReplySucceeded           byte = 0x00
+	ReplyGeneralFailure      byte = 0x01
+	ReplyNotAllowed          byte = 0x02
+	ReplyNetworkUnreachable  byte = 0x03
+	ReplyHostUnreachable     byte = 0x04
+	ReplyConnectionRefused   byte = 0x05
+	ReplyTTLExpired          byte = 0x06
+	ReplyCommandNotSupported byte = 0x07
+	ReplyAddrNotSupported    byte = 0x08
+)
+
+// Address types.
+const (
+	atypIPv4   byte = 0x01
+	atypDomain byte = 0x03
+	atypIPv6   byte = 0x04
+)
+
+// ReplyError is the code of a reply other than ReplySucceeded.
+type ReplyError byte
+
+func (e ReplyError) Error() string {
+	switch byte(e) {
+	case ReplyGeneralFailure:
+		return "SOCKS5 general failure"
+	case ReplyNotAllowed:
+		return "SOCKS5 connection not allowed by ruleset"
+	case ReplyNetworkUnreachable:
+		return "SOCKS5 network unreachable"
+	case ReplyHostUnreachable:
+		return "SOCKS5 host unreachable"
+	case ReplyConnectionRefused:
+		return "SOCKS5 connection refused"
+	case ReplyTTLExpired:
+		return "SOCKS5 TTL expired"
+	case ReplyCommandNotSupported:
+		return "SOCKS5 command not supported"
+	case ReplyAddrNotSupported:
+		return "SOCKS5 address type not supported"
+	}
+	return "SOCKS5 reply " + strconv.Itoa(int(e))
+}
+
+// Addr is the address of a request, reply or datagram: an IP address, or a
+// host name left to the server to resolve.
+type Addr struct {
+	// IP is nil for a host name.
+	IP   net.IP
+	Host string
+	Port int
+}
+
+// NewAddr returns the address of host, an IP address or a host name, and port.
+func NewAddr(host string, port int) Addr {
+	if ip := net.ParseIP(host); ip != nil {
+		return Addr{IP: ip, Port: port}
+	}
+	return Addr{Host: host, Port: port}
+}
+
+// AddrOf returns the address of a *net.TCPAddr or *net.UDPAddr, and the
+// unspecified IPv4 address for anything else.
+func AddrOf(a net.Addr) Addr {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return Addr{IP: a.IP, Port: a.Port}
+	case *net.UDPAddr:
+		return Addr{IP: a.IP, Port: a.Port}
+	}
+	return Addr{IP: net.IPv4zero}
+}
+
+func (a Addr) String() string {
+	host := a.Host
+	if a.IP != nil {
+		host = a.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Port))
+}
+
+func appendAddr(b []byte, a Addr) ([]byte, error) {
+	if a.Port < 0 || a.Port > 0xffff {
+		return b, errors.ErrBadSocksMessage
+	}
+	switch {
+	case a.IP.To4() != nil:
+		b = append(append(b, atypIPv4), a.IP.To4()...)
+	case len(a.IP) == net.IPv6len:
+		b = append(append(b, atypIPv6), a.IP...)
+	case a.IP == nil && a.Host == "":
+		b = append(b, atypIPv4, 0, 0, 0, 0)
+	case a.IP == nil && len(a.Host) <= 0xff:
+		b = append(append(b, atypDomain, byte(len(a.Host))), a.Host...)
+	default:
+		return b, errors.ErrBadSocksMessage
+	}
+	return append(b, byte(a.Port>>8), byte(a.Port)), nil
+}
+
+// addrLen returns the length of the address data starts with, ATYP included,
+// or 0 when data is too short to tell.
+func addrLen(data []byte) (int, error) {
+	if len(data) < 1 {
+		return 0, nil
+	}
+	switch data[0] {
+	case atypIPv4:
+		return 1 + net.IPv4len + 2, nil
+	case atypIPv6:
+		return 1 + net.IPv6len + 2, nil
+	case atypDomain:
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if data[1] == 0 {
+			return 0, errors.ErrBadSocksMessage
+		}
+		return 2 + int(data[1]) + 2, nil
+	}
+	return 0, errors.ErrBadSocksMessage
+}
+
+// parseAddr reads the address data starts with, it returns a length of 0
+// when the address is incomplete.
+func parseAddr(data []byte) (Addr, int, error) {
+	n, err := addrLen(data)
+	if err != nil || n == 0 || len(data) < n {
+		return Addr{}, 0, err
+	}
+	var a Addr
+	switch data[0] {
+	case atypIPv4, atypIPv6:
+		a.IP = append(net.IP(nil), data[1:n-2]...)
+	default:
+		a.Host = string(data[2 : n-2])
+	}
+	a.Port = int(binary.BigEndian.Uint16(data[n-2:]))
+	return a, n, nil
+}
+
+// Greeting is the first message of a client, with the authentication methods
+// it supports.
+type Greeting struct {
+	Methods []byte
+}
+
+// ParseGreeting reads the greeting data starts with and returns it with its
+// length. Like every Parse function of the package, it returns a nil message
+// and 0 when data is a message yet incomplete, and ErrBadSocksMessage when it
+// is malformed.
+func ParseGreeting(data []byte) (*Greeting, int, error) {
+	if len(data) < 2 {
+		return nil, 0, versionError(data, Version)
+	}
+	if data[0] != Version || data[1] == 0 {
+		return nil, 0, errors.ErrBadSocksMessage
+	}
+	n := 2 + int(data[1])
+	if len(data) < n {
+		return nil, 0, nil
+	}
+	return &Greeting{Methods: append([]byte(nil), data[2:n]...)}, n, nil
+}
+
+// Has tells whether the client supports method.
+func (g *Greeting) Has(method byte) bool {
+	for _, m := range g.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Greeting) Append(b []byte) ([]byte, error) {
+	if len(g.Methods) == 0 || len(g.Methods) > 0xff {
+		return b, errors.ErrBadSocksMessage
+	}
+	return append(append(b, Version, byte(len(g.Methods))), g.Methods...), nil
+}
+
+// ParseMethod reads the method selected by the server.
+func ParseMethod(data []byte) (byte, int, error) {
+	if len(data) < 2 {
+		return 0, 0, versionError(data, Version)
+	}
+	if data[0] != Version {
+		return 0, 0, errors.ErrBadSocksMessage
+	}
+	return data[1], 2, nil
+}
+
+// AppendMethod appends the selection of method.
+func AppendMethod(b []byte, method byte) []byte {
+	return append(b, Version, method)
+}
+
+// UserPass is the username/password authentication of a client.
+type UserPass struct {
+	Username string
+	Password string
+}
+
+func ParseUserPass(data []byte) (*UserPass, int, error) {
+	if len(data) < 2 {
+		return nil, 0, versionError(data, authVersion)
+	}
+	if data[0] != authVersion || data[1] == 0 {
+		return nil, 0, errors.ErrBadSocksMessage
+	}
+	ulen := int(data[1])
+	if len(data) < 2+ulen+1 {
+		return nil, 0, nil
+	}
+	n := 2 + ulen + 1 + int(data[2+ulen])
+	if len(data) < n {
+		return nil, 0, nil
+	}
+	return &UserPass{Username: string(data[2 : 2+ulen]), Password: string(data[2+ulen+1 : n])}, n, nil
+}
+
+func (u *UserPass) Append(b []byte) ([]byte, error) {
+	if len(u.Username) == 0 || len(u.Username) > 0xff || len(u.Password) > 0xff {
+		return b, errors.ErrBadSocksMessage
+	}
+	b = append(append(b, authVersion, byte(len(u.Username))), u.Username...)
+	return append(append(b, byte(len(u.Password))), u.Password...), nil
+}
+
+// ParseAuthStatus reads the answer of the server to a UserPass, which is ok
+// when it accepts the credentials.
+func ParseAuthStatus(data []byte) (ok bool, n int, err error) {
+	if len(data) < 2 {
+		return false, 0, versionError(data, authVersion)
+	}
+	if data[0] != authVersion {
+		return false, 0, errors.ErrBadSocksMessage
+	}
+	return data[1] == 0, 2, nil
+}
+
+// AppendAuthStatus appends the answer to a UserPass.
+func AppendAuthStatus(b []byte, ok bool) []byte {
+	if ok {
+		return append(b, authVersion, 0)
+	}
+	return append(b, authVersion, 1)
+}
+
+// Request is the command of a client.
+type Request struct {
+	Command byte
+	// Addr is the destination of a CONNECT, or the address a UDP ASSOCIATE
+	// client sends its datagrams from, zero when it does not know yet.
+	Addr Addr
+}
+
+func ParseRequest(data []byte) (*Request, int, error) {
+	code, a, n, err := parseMessage(data)
+	if n == 0 {
+		return nil, 0, err
+	}
+	return &Request{Command: code, Addr: a}, n, nil
+}
+
+func (r *Request) Append(b []byte) ([]byte, error) {
+	return appendAddr(append(b, Version, r.Command, 0), r.Addr)
+}
+
+// Reply is the answer of the server to a request.
+type Reply struct {
+	Code byte
+	// Addr is the address the server connected from, or the one it relays
+	// the datagrams of a UDP association on.
+	Addr Addr
+}
+
+func ParseReply(data []byte) (*Reply, int, error) {
+	code, a, n, err := parseMessage(data)
+	if n == 0 {
+		return nil, 0, err
+	}
+	return &Reply{Code: code, Addr: a}, n, nil
+}
+
+func (r *Reply) Append(b []byte) ([]byte, error) {
+	return appendAddr(append(b, Version, r.Code, 0), r.Addr)
+}
+
+// MessageLen returns the length of the request or reply data starts with, or
+// 0 until data has its first 5 bytes. It lets a reader take a reply off a
+// connection without reading into what follows it.
+func MessageLen(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, versionError(data, Version)
+	}
+	if data[0] != Version || data[2] != 0 {
+		return 0, errors.ErrBadSocksMessage
+	}
+	n, err := addrLen(data[3:])
+	if n == 0 {
+		return 0, err
+	}
+	return 3 + n, nil
+}
+
+// parseMessage reads a request or a reply, which share their layout.
+func parseMessage(data []byte) (byte, Addr, int, error) {
+	n, err := MessageLen(data)
+	if n == 0 || len(data) < n {
+		return 0, Addr{}, 0, err
+	}
+	a, _, err := parseAddr(data[3:n])
+	if err != nil {
+		return 0, Addr{}, 0, err
+	}
+	return data[1], a, n, nil
+}
+
+// Datagram is a UDP datagram relayed through an association: from the client,
+// Addr is where the server sends Data; to the client, where Data came from.
+type Datagram struct {
+	// Frag is the fragment number, 0 for a datagram that stands alone.
+	Frag byte
+	Addr Addr
+	Data []byte
+}
+
+// ParseDatagram reads a whole datagram, Data shares the memory of data.
+func ParseDatagram(data []byte) (*Datagram, error) {
+	if len(data) < 4 || data[0] != 0 || data[1] != 0 {
+		return nil, errors.ErrBadSocksMessage
+	}
+	a, n, err := parseAddr(data[3:])
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errors.ErrBadSocksMessage
+	}
+	return &Datagram{Frag: data[2], Addr: a, Data: data[3+n:]}, nil
+}
+
+func (d *Datagram) Append(b []byte) ([]byte, error) {
+	b, err := appendAddr(append(b, 0, 0, d.Frag), d.Addr)
+	if err != nil {
+		return b, err
+	}
+	return append(b, d.Data...), nil
+}
+
+// versionError checks the version of a message too short to parse, so that
+// garbage is refused as soon as its first byte is in.
+func versionError(data []byte, version byte) error {
+	if len(data) > 0 && data[0] != version {
+		return errors.ErrBadSocksMessage
+	}
+	return nil
+}
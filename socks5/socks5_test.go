@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"bytes"
+	"muduo/pkg/errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGreeting(t *testing.T) {
+	b, err := (&Greeting{Methods: []byte{MethodNoAuth, MethodUserPass}}).Append(nil)
+	if err != nil || !bytes.Equal(b, []byte{5, 2, 0, 2}) {
+		t.Fatalf("Append % x, %v", b, err)
+	}
+	g, n, err := ParseGreeting(append(b, 0xaa))
+	if err != nil || n != 4 || !g.Has(MethodUserPass) || g.Has(MethodNoAcceptable) {
+		t.Fatalf("Parse %+v, %d, %v", g, n, err)
+	}
+	for _, data := range [][]byte{{4, 1, 0}, {5, 0}, {'G', 'E', 'T'}, {'G'}} {
+		if _, _, err := ParseGreeting(data); err != errors.ErrBadSocksMessage {
+			t.Fatalf("% x: %v", data, err)
+		}
+	}
+	if _, err := (&Greeting{}).Append(nil); err != errors.ErrBadSocksMessage {
+		t.Fatalf("no methods %v", err)
+	}
+
+	if m, n, err := ParseMethod(AppendMethod(nil, MethodNoAcceptable)); err != nil || n != 2 || m != MethodNoAcceptable {
+		t.Fatalf("method %x, %d, %v", m, n, err)
+	}
+}
+
+func TestUserPass(t *testing.T) {
+	u := &UserPass{Username: "alice", Password: "s3cret"}
+	b, err := u.Append(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, n, err := ParseUserPass(b)
+	if err != nil || n != len(b) || *parsed != *u {
+		t.Fatalf("Parse %+v, %d, %v", parsed, n, err)
+	}
+	for _, u := range []*UserPass{{}, {Username: strings.Repeat("u", 256)}, {Username: "u", Password: strings.Repeat("p", 256)}} {
+		if _, err := u.Append(nil); err != errors.ErrBadSocksMessage {
+			t.Fatalf("%d/%d: %v", len(u.Username), len(u.Password), err)
+		}
+	}
+	if _, _, err := ParseUserPass([]byte{5, 1, 'u', 0}); err != errors.ErrBadSocksMessage {
+		t.Fatalf("version 5 %v", err)
+	}
+
+	for _, ok := range []bool{true, false} {
+		if got, n, err := ParseAuthStatus(AppendAuthStatus(nil, ok)); got != ok || n != 2 || err != nil {
+			t.Fatalf("status %v: %v, %d, %v", ok, got, n, err)
+		}
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	cases := []struct {
+		addr Addr
+		wire []byte
+		want string
+	}{
+		{Addr{IP: net.ParseIP("192.168.0.1"), Port: 80}, []byte{1, 192, 168, 0, 1, 0, 80}, "192.168.0.1:80"},
+		{Addr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			[]byte{4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 0xbb}, "[2001:db8::1]:443"},
+		{Addr{Host: "example.com", Port: 8080}, append([]byte{3, 11}, "example.com\x1f\x90"...), "example.com:8080"},
+		{Addr{}, []byte{1, 0, 0, 0, 0, 0, 0}, "0.0.0.0:0"},
+	}
+	for _, c := range cases {
+		b, err := (&Request{Command: CmdConnect, Addr: c.addr}).Append(nil)
+		if err != nil || !bytes.Equal(b, append([]byte{5, 1, 0}, c.wire...)) {
+			t.Fatalf("Append %v: % x, %v", c.addr, b, err)
+		}
+		r, n, err := ParseRequest(append(b, "payload"...))
+		if err != nil || n != len(b) || r.Command != CmdConnect || r.Addr.String() != c.want {
+			t.Fatalf("Parse %v: %+v, %d, %v", c.addr, r, n, err)
+		}
+		if l, err := MessageLen(b[:5]); l != len(b) || err != nil {
+			t.Fatalf("MessageLen %v: %d, %v", c.addr, l, err)
+		}
+
+		b, _ = (&Reply{Code: ReplyHostUnreachable, Addr: c.addr}).Append(nil)
+		if r, n, err := ParseReply(b); err != nil || n != len(b) || r.Code != ReplyHostUnreachable {
+			t.Fatalf("reply %v: %+v, %d, %v", c.addr, r, n, err)
+		}
+	}
+
+	if a := NewAddr("::1", 1); a.IP == nil || a.Host != "" {
+		t.Fatalf("NewAddr IP %+v", a)
+	}
+	if a := NewAddr("localhost", 1); a.IP != nil || a.String() != "localhost:1" {
+		t.Fatalf("NewAddr host %+v", a)
+	}
+	if _, err := (&Request{Addr: Addr{Host: strings.Repeat("h", 256)}}).Append(nil); err != errors.ErrBadSocksMessage {
+		t.Fatalf("long host %v", err)
+	}
+	if ReplyError(ReplyConnectionRefused).Error() != "SOCKS5 connection refused" {
+		t.Fatalf("error %q", ReplyError(ReplyConnectionRefused))
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	for i, b := range [][]byte{
+		{4, 1, 0, 1, 127, 0, 0, 1, 0, 80}, // version 4
+		{5, 1, 1, 1, 127, 0, 0, 1, 0, 80}, // reserved byte
+		{5, 1, 0, 2, 127, 0, 0, 1, 0, 80}, // address type 2
+		{5, 1, 0, 3, 0, 0, 80},            // empty host name
+	} {
+		if _, _, err := ParseRequest(b); err != errors.ErrBadSocksMessage {
+			t.Fatalf("case %d: %v", i, err)
+		}
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	req, _ := (&Request{Command: CmdConnect, Addr: Addr{Host: "example.com", Port: 80}}).Append(nil)
+	greeting, _ := (&Greeting{Methods: []byte{0, 1, 2}}).Append(nil)
+	auth, _ := (&UserPass{Username: "alice", Password: "s3cret"}).Append(nil)
+	parsers := []func([]byte) (int, error){
+		func(b []byte) (int, error) { _, n, err := ParseRequest(b); return n, err },
+		func(b []byte) (int, error) { _, n, err := ParseGreeting(b); return n, err },
+		func(b []byte) (int, error) { _, n, err := ParseUserPass(b); return n, err },
+	}
+	for i, msg := range [][]byte{req, greeting, auth} {
+		for j := 0; j < len(msg); j++ {
+			if n, err := parsers[i](msg[:j]); n != 0 || err != nil {
+				t.Fatalf("% x: %d, %v", msg[:j], n, err)
+			}
+		}
+		if n, err := parsers[i](msg); n != len(msg) || err != nil {
+			t.Fatalf("% x: %d, %v", msg, n, err)
+		}
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	d := &Datagram{Addr: Addr{IP: net.ParseIP("10.0.0.1").To4(), Port: 53}, Data: []byte("query")}
+	b, err := d.Append(nil)
+	if err != nil || !bytes.Equal(b, append([]byte{0, 0, 0, 1, 10, 0, 0, 1, 0, 53}, "query"...)) {
+		t.Fatalf("Append % x, %v", b, err)
+	}
+	parsed, err := ParseDatagram(b)
+	if err != nil || !reflect.DeepEqual(parsed, d) {
+		t.Fatalf("Parse %+v, %v", parsed, err)
+	}
+	for _, b := range [][]byte{b[:5], {0, 1, 0, 1, 10, 0, 0, 1, 0, 53}, {0, 0}} {
+		if _, err := ParseDatagram(b); err != errors.ErrBadSocksMessage {
+			t.Fatalf("% x: %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package muduo
+
+import (
+	"context"
+	"io"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SyncClient is a blocking facade over TcpClient for tools and tests. It runs its
+// own EventloopEngine, all I/O still happens on that loop and the methods only
+// wait for it. A SyncClient is used for a single connection, it does not reconnect.
+type SyncClient struct {
+	addr   string
+	codec  Codec
+	opts   []EventloopOption
+	el     *Eventloop
+	client *TcpClient
+
+	mu      sync.Mutex
+	conn    *TcpConn
+	frames  [][]byte
+	err     error         // why the connection is gone, returned once frames are drained
+	notify  chan struct{} // signaled when a frame arrives or the connection goes away
+	dialed  chan error
+	dialing bool
+	closed  bool
+}
+
+// states of a SyncClient.Write
+const (
+	writePending = iota
+	writeStarted
+	writeCanceled
+)
+
+// NewSyncClient creates a client for svrAddr whose frames are split by codec.
+// opts configure the client's Eventloop.
+func NewSyncClient(svrAddr string, codec Codec, opts ...EventloopOption) *SyncClient {
+	return &SyncClient{
+		addr:   svrAddr,
+		codec:  codec,
+		opts:   opts,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Dial starts the loop and connects, retrying with the default policy until ctx
+// is done.
+func (c *SyncClient) Dial(ctx context.Context) error {
+	c.mu.Lock()
+	if c.el != nil {
+		c.mu.Unlock()
+		return errors.ErrClientClosed
+	}
+	c.el = NewEventloopEngine("sync-client", c.opts...).StartLoop()
+	client, err := NewTcpClient(c.el, c.addr)
+	if err != nil {
+		c.mu.Unlock()
+		c.el.AsyncStop()
+		return err
+	}
+	c.client = client
+	c.dialed = make(chan error, 1)
+	c.dialing = true
+	c.mu.Unlock()
+
+	client.SetOnConn(c.onConn)
+	client.SetOnMsg(c.onMsg)
+	client.SetOnGiveUp(func() {
+		c.finishDial(errors.ErrConnNotOpened)
+	})
+	client.Connect()
+	select {
+	case err := <-c.dialed:
+		if err != nil {
+			c.Close()
+		}
+		return err
+	case <-ctx.Done():
+		c.Close()
+		return ctx.Err()
+	}
+}
+
+func (c *SyncClient) finishDial(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dialing {
+		c.dialing = false
+		c.dialed <- err
+	}
+}
+
+func (c *SyncClient) onConn(conn *TcpConn) {
+	if conn.IsConnected() {
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+		c.finishDial(nil)
+		return
+	}
+	c.fail(io.EOF)
+}
+
+func (c *SyncClient) onMsg(conn *TcpConn, buf *Buffer, _ time.Time) {
+	for {
+		frame, err := c.codec.Decode(buf)
+		if err != nil {
+			logging.Errorf("SyncClient[%s] decode error: %v", c.addr, err)
+			c.fail(err)
+			conn.ForceClose()
+			return
+		}
+		if frame == nil {
+			return
+		}
+		c.mu.Lock()
+		c.frames = append(c.frames, append([]byte(nil), frame...))
+		c.mu.Unlock()
+		c.signal()
+	}
+}
+
+// fail records why the connection is unusable, the first reason wins.
+func (c *SyncClient) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.conn = nil
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *SyncClient) signal() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Write queues data on the connection. It returns once the loop has written
+// data or buffered it for sending, or with ctx.Err() if ctx is done before the
+// loop gets to it; data is then not written at all.
+func (c *SyncClient) Write(ctx context.Context, data []byte) error {
+	c.mu.Lock()
+	el, err := c.el, c.err
+	c.mu.Unlock()
+	if el == nil {
+		return errors.ErrConnNotOpened
+	}
+	if err != nil {
+		return err
+	}
+	buf := append([]byte(nil), data...)
+	// the loop and the caller race to claim the write, whoever loses leaves it
+	// to the other
+	state := int32(writePending)
+	done := make(chan error, 1)
+	el.AsyncExecute(func() {
+		if !atomic.CompareAndSwapInt32(&state, writePending, writeStarted) {
+			return
+		}
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn == nil {
+			done <- errors.ErrConnNotOpened
+			return
+		}
+		_, err := conn.Write(buf)
+		done <- err
+	})
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&state, writePending, writeCanceled) {
+			return ctx.Err()
+		}
+		// the loop is writing it already
+		return <-done
+	}
+}
+
+// ReadFrame returns the next frame decoded by the codec. Once the connection is
+// gone it returns the remaining frames, then the reason: io.EOF when the server
+// closed it.
+func (c *SyncClient) ReadFrame(ctx context.Context) ([]byte, error) {
+	for {
+		c.mu.Lock()
+		if len(c.frames) > 0 {
+			frame := c.frames[0]
+			c.frames[0] = nil
+			c.frames = c.frames[1:]
+			c.mu.Unlock()
+			return frame, nil
+		}
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-c.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close closes the connection and stops the loop, it must not be called from
+// the loop goroutine.
+func (c *SyncClient) Close() {
+	c.mu.Lock()
+	el, client, closed := c.el, c.client, c.closed
+	c.closed = true
+	if c.err == nil {
+		c.err = errors.ErrClientClosed
+	}
+	c.mu.Unlock()
+	if el == nil || closed {
+		return
+	}
+	c.finishDial(errors.ErrClientClosed)
+	c.signal()
+	stopped := make(chan struct{})
+	el.AsyncExecute(func() {
+		if client != nil {
+			client.Stop()
+			if conn := client.GetConn(); conn != nil {
+				conn.setOnClose(func(conn *TcpConn) {
+					// release the connection now, the loop is about to stop
+					conn.connectDestroyed()
+					_ = conn.so.close()
+				})
+				conn.ForceClose()
+			}
+		}
+		el.AsyncExecute(func() {
+			el.Stop()
+			close(stopped)
+		})
+	})
+	<-stopped
+}
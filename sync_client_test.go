@@ -0,0 +1,88 @@
+package muduo
+
+import (
+	"context"
+	"io"
+	"muduo/pkg/errors"
+	"testing"
+	"time"
+)
+
+func TestSyncClient(t *testing.T) {
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "echo", "tcp4://127.0.0.1:0", 1)
+	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, t time.Time) {
+		data := buffer.Next(-1)
+		if string(data) == "\x00\x00\x00\x03bye" {
+			conn.ShutdownWrite()
+			return
+		}
+		_, _ = conn.Write(data)
+	})
+	stop := startTestServer(t, el, svr)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	codec := LengthFieldCodec{}
+	client := NewSyncClient("tcp4://"+svr.addr, codec)
+	if err := client.Dial(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"hello", "world"} {
+		if err := client.Write(ctx, codec.Encode([]byte(msg))); err != nil {
+			t.Fatal(err)
+		}
+		frame, err := client.ReadFrame(ctx)
+		if err != nil || string(frame) != msg {
+			t.Fatalf("read %q, %v, want %q", frame, err, msg)
+		}
+	}
+
+	// a write the loop has not got to when ctx is done is not sent
+	busy := make(chan struct{})
+	client.el.AsyncExecute(func() { <-busy })
+	canceled, cancelNow := context.WithCancel(ctx)
+	cancelNow()
+	if err := client.Write(canceled, codec.Encode([]byte("dropped"))); err != context.Canceled {
+		t.Fatalf("err = %v, want Canceled", err)
+	}
+	close(busy)
+	if err := client.Write(ctx, codec.Encode([]byte("sent"))); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := client.ReadFrame(ctx); err != nil || string(frame) != "sent" {
+		t.Fatalf("read %q, %v, want %q", frame, err, "sent")
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelShort()
+	if _, err := client.ReadFrame(short); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+
+	// the server closes the connection
+	if err := client.Write(ctx, codec.Encode([]byte("bye"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReadFrame(ctx); err != io.EOF {
+		t.Fatalf("err = %v, want io.EOF", err)
+	}
+	client.Close()
+	client.Close()
+	if err := client.Write(ctx, []byte("x")); err == nil {
+		t.Fatal("write after Close should fail")
+	}
+}
+
+func TestSyncClient_DialTimeout(t *testing.T) {
+	client := NewSyncClient("tcp4://"+closedPort(t), LineCodec{})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := client.Dial(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+	if _, err := client.ReadFrame(context.Background()); err != errors.ErrClientClosed {
+		t.Fatalf("err = %v, want ErrClientClosed", err)
+	}
+}
@@ -44,8 +44,42 @@ func (c *TcpClient) GetConn() *TcpConn {
 	return c.conn
 }
 
-func (c *TcpClient) SetRetry(retry bool) {
-	c.retry = retry
+// SetRetry makes the client reconnect after the connection is lost, and paces
+// both reconnects and failed connects with policy.
+func (c *TcpClient) SetRetry(policy RetryPolicy) {
+	c.retry = true
+	c.connector.SetRetryPolicy(policy)
+}
+
+// SetEndpoints replaces the server addresses, see Connector.SetEndpoints.
+func (c *TcpClient) SetEndpoints(svrAddrs ...string) error {
+	return c.connector.SetEndpoints(svrAddrs...)
+}
+
+// SetResolver replaces net.DefaultResolver for host name lookups.
+func (c *TcpClient) SetResolver(r Resolver) {
+	c.connector.SetResolver(r)
+}
+
+// SetSocks5 connects through a SOCKS5 proxy, see Connector.SetSocks5. The
+// handshake is over by the time the connection callback is called.
+func (c *TcpClient) SetSocks5(proxyAddr, username, password string) error {
+	return c.connector.SetSocks5(proxyAddr, username, password)
+}
+
+// SetConnectTimeout bounds each connect attempt, see Connector.SetConnectTimeout.
+func (c *TcpClient) SetConnectTimeout(d time.Duration) {
+	c.connector.SetConnectTimeout(d)
+}
+
+// SetOnConnectFailed is called after every failed connect attempt.
+func (c *TcpClient) SetOnConnectFailed(cb func(err error, attempt int)) {
+	c.connector.SetOnConnectFailed(cb)
+}
+
+// SetOnGiveUp is called once the retry policy runs out of attempts.
+func (c *TcpClient) SetOnGiveUp(cb func()) {
+	c.connector.SetOnGiveUp(cb)
 }
 
 func (c *TcpClient) SetOnConn(cb func(*TcpConn)) {
@@ -56,6 +90,10 @@ func (c *TcpClient) SetOnMsg(cb func(*TcpConn, *Buffer, time.Time)) {
 	c.onMsg = cb
 }
 
+func (c *TcpClient) SetOnWriteComplete(cb func(*TcpConn)) {
+	c.onWriteComplete = cb
+}
+
 func (c *TcpClient) Connect() {
 	c._connect = true
 	c.connector.Start()
@@ -96,7 +134,7 @@ func (c *TcpClient) Destroy() {
 }
 
 func (c *TcpClient) newConn(fd int) {
-	peerAddr := SockaddrToTCPOrUnixAddr(c.connector.unixSvrAddr)
+	peerAddr := c.connector.RemoteAddr()
 	localAddr, err := GetLocalAddr(fd)
 	if err != nil {
 		logging.Errorf("TcpClient::newConn [%s] - failed to get local addr, %v", c.connector.svrAddr, err)
@@ -124,6 +162,9 @@ func (c *TcpClient) removeConn(conn *TcpConn) {
 
 	c.el.AsyncExecute(func() {
 		conn.connectDestroyed()
+		if err := conn.so.close(); err != nil {
+			logging.Errorf("close socket error: %v", err)
+		}
 	})
 	if c.retry && c._connect {
 		c.connector.Restart()
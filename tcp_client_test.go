@@ -2,17 +2,32 @@ package muduo
 
 import (
 	"muduo/pkg/logging"
+	"net"
 	"testing"
 	"time"
 )
 
 func TestNewTcpClient(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = c.Write([]byte("hello client"))
+		_ = c.Close()
+	}()
+
 	el := NewEventloop("test")
-	client, err := NewTcpClient(el, "tcp4://192.168.1.57:9681")
-	client.SetRetry(true)
+	client, err := NewTcpClient(el, "tcp4://"+ln.Addr().String())
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	client.SetRetry(DefaultRetryPolicy())
 	client.SetOnConn(func(conn *TcpConn) {
 		if conn.state == Connected {
 			logging.Infof("connection established: %s, addr=%s", conn.name, conn.peerAddr.String())
@@ -20,9 +35,23 @@ func TestNewTcpClient(t *testing.T) {
 			logging.Infof("connection closed: %s, addr=%s", conn.name, conn.peerAddr.String())
 		}
 	})
+	received := make(chan string, 1)
 	client.SetOnMsg(func(conn *TcpConn, buffer *Buffer, t time.Time) {
-		logging.Infof("message received: fd=%d, addr=%s, msg=%s", conn.so.fd, conn.peerAddr.String(), string(buffer.Next(-1)))
+		msg := string(buffer.Next(-1))
+		logging.Infof("message received: fd=%d, addr=%s, msg=%s", conn.so.fd, conn.peerAddr.String(), msg)
+		received <- msg
 	})
 	client.Connect()
-	el.Loop()
+	stop := startLoop(el)
+	defer stop()
+
+	select {
+	case msg := <-received:
+		if msg != "hello client" {
+			t.Fatalf("got %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	el.AsyncExecute(client.Stop)
 }
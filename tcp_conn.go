@@ -5,6 +5,7 @@ import (
 	"muduo/pkg/errors"
 	"muduo/pkg/logging"
 	"muduo/pkg/util"
+	"muduo/proxyproto"
 	"net"
 	"sync/atomic"
 	"time"
@@ -34,9 +35,22 @@ type TcpConn struct {
 	onMsg           func(*TcpConn, *Buffer, time.Time)
 	onClose         func(*TcpConn)
 	onWriteComplete func(*TcpConn)
+	onHighWaterMark func(*TcpConn, int)
+	onHalfClose     func(*TcpConn)
+	highWaterMark   int
 	inbound         *Buffer
 	outbound        *Buffer
-	ctx             interface{}
+	ctx             unsafe.Pointer // *interface{}
+	io              ioPoller       // set when the loop's poller performs the socket I/O
+	sending         []byte         // bytes handed to io and not yet acknowledged
+	readStopped     bool
+	held            bool // data or EOF received while reading was stopped
+	eof             bool // EOF received while reading was stopped
+	halfClosed      bool // the peer shut down its writing side
+	writeShut       bool
+	closed          bool
+	proxyHeader     *proxyproto.Header
+	proxyTimer      *TimerTask
 }
 
 func NewTcpConn(el *Eventloop, name string, fd int, localAddr, peerAddr net.Addr) *TcpConn {
@@ -53,6 +67,10 @@ func NewTcpConn(el *Eventloop, name string, fd int, localAddr, peerAddr net.Addr
 	}
 	logging.Debugf("new connection: fd=%d, addr=%s", fd, peerAddr.String())
 	conn.ch.setReadCallback(conn.handleRead)
+	conn.ch.setWriteCallback(conn.handleWrite)
+	if iop, ok := el.poller.(ioPoller); ok {
+		conn.io = iop
+	}
 	return conn
 }
 
@@ -76,6 +94,22 @@ func (c *TcpConn) SetOnWriteComplete(cb func(*TcpConn)) {
 	c.onWriteComplete = cb
 }
 
+// SetHighWaterMark calls cb, with the bytes waiting, when the output not yet
+// written grows past mark: the peer reads slower than it is written to, and
+// whoever produces the output should pause. The write complete callback tells
+// when the output has drained.
+func (c *TcpConn) SetHighWaterMark(cb func(*TcpConn, int), mark int) {
+	c.onHighWaterMark = cb
+	c.highWaterMark = mark
+}
+
+// SetOnHalfClose keeps the connection open when the peer shuts down its writing
+// side: reading stops and cb is called, and writing goes on until ShutdownWrite,
+// which then closes the connection. By default EOF closes the connection.
+func (c *TcpConn) SetOnHalfClose(cb func(*TcpConn)) {
+	c.onHalfClose = cb
+}
+
 func (c *TcpConn) GetConnState() ConnState {
 	return c.state
 }
@@ -88,6 +122,12 @@ func (c *TcpConn) GetPeerAddr() net.Addr {
 	return c.peerAddr
 }
 
+// ProxyHeader returns the PROXY protocol header the connection started with,
+// TLVs included, or nil when the server does not expect one.
+func (c *TcpConn) ProxyHeader() *proxyproto.Header {
+	return c.proxyHeader
+}
+
 func (c *TcpConn) GetInboundBuffer() *Buffer {
 	return c.inbound
 }
@@ -105,22 +145,52 @@ func (c *TcpConn) IsDisconnected() bool {
 }
 
 func (c *TcpConn) SetContext(ctx interface{}) {
-	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&c.ctx)), unsafe.Pointer(&ctx))
+	atomic.StorePointer(&c.ctx, unsafe.Pointer(&ctx))
 }
 
 func (c *TcpConn) GetContext() interface{} {
-	return *(*interface{})(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&c.ctx))))
+	p := atomic.LoadPointer(&c.ctx)
+	if p == nil {
+		return nil
+	}
+	return *(*interface{})(p)
 }
 
 func (c *TcpConn) Name() string {
 	return c.name
 }
 
+// pendingOutput is the number of bytes written and not yet sent.
+func (c *TcpConn) pendingOutput() int {
+	return c.outbound.ReadableBytes() + len(c.sending)
+}
+
+// checkHighWaterMark calls the high water mark callback when the output has
+// just grown past the mark from old bytes.
+func (c *TcpConn) checkHighWaterMark(old int) {
+	if c.onHighWaterMark == nil {
+		return
+	}
+	if n := c.pendingOutput(); old < c.highWaterMark && n >= c.highWaterMark {
+		c.el.AsyncExecute(func() {
+			c.onHighWaterMark(c, n)
+		})
+	}
+}
+
 func (c *TcpConn) Write(buf []byte) (int, error) {
 	if c.state == Connected {
 		if len(buf) == 0 {
 			return 0, nil
 		}
+		old := c.pendingOutput()
+		if c.io != nil {
+			_, _ = c.outbound.Write(buf)
+			c.checkHighWaterMark(old)
+			c.flush()
+			// the io poller sends whatever is buffered, it is all accepted
+			return len(buf), nil
+		}
 		var sent int
 		// if no data in outbound buffer, try writing directly
 		if !c.ch.isWriting() && c.outbound.ReadableBytes() == 0 {
@@ -129,7 +199,9 @@ func (c *TcpConn) Write(buf []byte) (int, error) {
 				logging.Errorf("write error: %v", err)
 				return sent, err
 			}
-			sent = n
+			if n > 0 {
+				sent = n
+			}
 			if sent < len(buf) {
 				logging.Debugf("write partial data: %d/%d", n, len(buf))
 			} else {
@@ -142,6 +214,7 @@ func (c *TcpConn) Write(buf []byte) (int, error) {
 		}
 		if sent < len(buf) {
 			_, _ = c.outbound.Write(buf[sent:])
+			c.checkHighWaterMark(old)
 			if !c.ch.isWriting() {
 				c.ch.enableWriting()
 			}
@@ -183,18 +256,70 @@ func (c *TcpConn) SetTcpNoDelay(enable bool) error {
 }
 
 func (c *TcpConn) shutdownWrite() {
-	if !c.ch.isWriting() {
+	if !c.ch.isWriting() && c.sending == nil && !c.writeShut {
 		err := unix.Shutdown(c.ch.fd, unix.SHUT_WR)
 		if err != nil {
 			logging.Errorf("shutdown error: %v", err)
 		}
+		c.writeShut = true
+		if c.halfClosed {
+			c.handleClose()
+		}
+	}
+}
+
+// StopRead stops reading from the socket until StartRead, so a peer sending
+// faster than its data is consumed is held back by TCP flow control. It must
+// be called on the loop of the connection.
+func (c *TcpConn) StopRead() {
+	if c.readStopped || c.closed || c.halfClosed {
+		return
+	}
+	c.readStopped = true
+	if c.io != nil {
+		c.io.stopRecv(c.ch)
+	} else {
+		c.ch.disableReading()
+	}
+}
+
+// StartRead resumes reading after StopRead. Data that arrived in between is
+// passed to the message callback first. It must be called on the loop of the
+// connection.
+func (c *TcpConn) StartRead() {
+	if !c.readStopped || c.closed {
+		return
+	}
+	c.readStopped = false
+	if c.held {
+		c.held = false
+		if c.inbound.ReadableBytes() > 0 && c.onMsg != nil {
+			c.onMsg(c, c.inbound, c.el.Now())
+			if c.readStopped || c.closed {
+				return
+			}
+		}
+		if c.eof {
+			c.eof = false
+			c.handleEOF()
+			return
+		}
+	}
+	if c.io != nil {
+		c.io.recv(c.ch, c.handleRecv)
+	} else {
+		c.ch.enableReading()
 	}
 }
 
 func (c *TcpConn) connectEstablished() {
 	util.Assert(c.state == Connecting, "state should be connecting")
 	c.state = Connected
-	c.ch.enableReading()
+	if c.io != nil {
+		c.io.recv(c.ch, c.handleRecv)
+	} else {
+		c.ch.enableReading()
+	}
 	if c.onConn != nil {
 		c.onConn(c)
 	}
@@ -204,7 +329,9 @@ func (c *TcpConn) connectDestroyed() {
 	util.Assert(c.state == Connected || c.state == Disconnecting, "state should be connected or disconnecting")
 	c.state = Disconnected
 	c.ch.disableAll()
-	c.onConn(c)
+	if c.onConn != nil {
+		c.onConn(c)
+	}
 	c.el.removeChannel(c.ch)
 }
 
@@ -220,7 +347,88 @@ func (c *TcpConn) handleRead(ts time.Time) {
 			c.onMsg(c, c.inbound, ts)
 		}
 	} else {
+		c.handleEOF()
+	}
+}
+
+// handleRecv is the completion counterpart of handleRead.
+func (c *TcpConn) handleRecv(data []byte, err error) {
+	if err != nil {
+		logging.Errorf("recv error: %s", err.Error())
+		c.handleError(err)
+		c.handleClose()
+		return
+	}
+	if c.readStopped {
+		// completions of a recv being stopped
+		c.held = true
+		if len(data) > 0 {
+			_, _ = c.inbound.Write(data)
+		} else {
+			c.eof = true
+		}
+		return
+	}
+	if len(data) > 0 {
+		_, _ = c.inbound.Write(data)
+		if c.onMsg != nil {
+			c.onMsg(c, c.inbound, c.el.Now())
+		}
+	} else {
+		c.handleEOF()
+	}
+}
+
+// handleEOF handles the peer shutting down its writing side.
+func (c *TcpConn) handleEOF() {
+	if c.onHalfClose == nil || c.writeShut {
 		c.handleClose()
+		return
+	}
+	if c.halfClosed {
+		return
+	}
+	c.halfClosed = true
+	if c.io == nil {
+		c.ch.disableReading()
+	}
+	c.onHalfClose(c)
+}
+
+// flush hands the outbound buffer to the io poller unless a send is in flight.
+func (c *TcpConn) flush() {
+	if c.sending != nil || c.outbound.ReadableBytes() == 0 {
+		return
+	}
+	c.sending = append([]byte(nil), c.outbound.Next(-1)...)
+	c.io.send(c.ch, c.sending, c.handleSent)
+}
+
+// handleSent is the completion counterpart of handleWrite.
+func (c *TcpConn) handleSent(n int, err error) {
+	if err != nil {
+		c.sending = nil
+		logging.Errorf("send error: %v", err)
+		c.handleError(err)
+		return
+	}
+	if n < len(c.sending) {
+		c.sending = c.sending[n:]
+		c.io.send(c.ch, c.sending, c.handleSent)
+		return
+	}
+	c.sending = nil
+	if c.outbound.ReadableBytes() > 0 {
+		c.flush()
+		return
+	}
+	if c.onWriteComplete != nil {
+		c.el.AsyncExecute(func() {
+			c.onWriteComplete(c)
+		})
+	}
+	if c.state == Disconnecting {
+		c.shutdownWrite()
 	}
 }
 
@@ -234,7 +442,9 @@ func (c *TcpConn) handleWrite() {
 			c.handleError(err)
 			return
 		}
-		c.outbound.Advance(n)
+		if n > 0 {
+			c.outbound.Advance(n)
+		}
 		if c.outbound.ReadableBytes() == 0 {
 			c.ch.disableWriting()
 			if c.onWriteComplete != nil {
@@ -253,7 +463,19 @@ func (c *TcpConn) handleWrite() {
 	}
 }
 
+// ForceClose closes the connection without waiting for the peer, discarding
+// any output that has not been written yet.
+func (c *TcpConn) ForceClose() {
+	if c.state == Connected || c.state == Disconnecting {
+		c.el.AsyncExecute(c.handleClose)
+	}
+}
+
 func (c *TcpConn) handleClose() {
+	if c.closed {
+		return
+	}
+	c.closed = true
 	logging.Debugf("connection closed: fd=%d, addr=%s", c.so.fd, c.peerAddr.String())
 	c.ch.disableAll()
 	c.onClose(c)
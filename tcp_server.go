@@ -3,9 +3,12 @@ package muduo
 import (
 	"golang.org/x/sys/unix"
 	"muduo/pkg/logging"
+	"muduo/proxyproto"
 	"net"
+	"os"
 	"strconv"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -23,6 +26,9 @@ type TcpServer struct {
 	connMap         map[string]*TcpConn
 	tcpNoDelay      int32
 	keepAlive       int32
+	shuttingDown    bool
+	shutdownTimer   *TimerTask
+	proxyTimeout    time.Duration
 }
 
 func NewTcpServer(el *Eventloop, name string, addr string, engineCnt int) *TcpServer {
@@ -42,6 +48,12 @@ func NewTcpServer(el *Eventloop, name string, addr string, engineCnt int) *TcpSe
 	return s
 }
 
+// Addr returns the address the server listens on, with the actual port when it
+// was created with port 0.
+func (s *TcpServer) Addr() string {
+	return s.addr
+}
+
 func (s *TcpServer) SetEngineCnt(cnt int) {
 	s.group.engineCnt = cnt
 }
@@ -54,6 +66,17 @@ func (s *TcpServer) SetTcpNoDelay(tcpNoDelay bool) {
 	}
 }
 
+// SetProxyProtocol makes every connection start with a PROXY protocol header,
+// version 1 or 2, as sent by load balancers in front of the server. The header
+// is read and stripped before the connection callback, and GetPeerAddr and
+// GetLocalAddr then report the addresses of the client's connection to the
+// load balancer; TcpConn.ProxyHeader has the whole header with its TLVs.
+// Connections without a valid header within timeout are closed unseen. It must
+// be called before Start.
+func (s *TcpServer) SetProxyProtocol(timeout time.Duration) {
+	s.proxyTimeout = timeout
+}
+
 func (s *TcpServer) Start() {
 	if !s.started {
 		s.started = true
@@ -82,14 +105,13 @@ func (s *TcpServer) newConn(fd int, addr net.Addr) {
 	connName := s.name + "[" + s.addr + "]" + "-conn-" + strconv.Itoa(int(s.nextConnId))
 	s.nextConnId++
 	logging.Infof("new connection: fd=%d, addr=%s", fd, addr.String())
-	// TODO get local addr
-	//localAddr0, err := unix.Getsockname(fd)
-	//if err != nil {
-	//	logging.Errorf("getsockname error: %v", err)
-	//	return
-	//}
-	//localAddr := SockaddrToTCPAddr(localAddr0)
-	localAddr := s.ac.localAddr
+	// the address the peer connected to, which differs from the listening one
+	// on a wildcard address
+	localAddr, err := GetLocalAddr(fd)
+	if err != nil {
+		logging.Errorf("getsockname error: %v", err)
+		localAddr = s.ac.localAddr
+	}
 	el := s.group.GetNextLoop()
 	conn := NewTcpConn(el, connName, fd, localAddr, addr)
 	if atomic.LoadInt32(&s.tcpNoDelay) == 1 {
@@ -99,6 +121,10 @@ func (s *TcpServer) newConn(fd int, addr net.Addr) {
 	s.connMap[connName] = conn
 	conn.SetOnConn(s.onConn)
 	conn.SetOnMsg(s.onMsg)
+	if s.proxyTimeout > 0 {
+		conn.SetOnConn(s.awaitProxyHeader)
+		conn.SetOnMsg(s.readProxyHeader)
+	}
 	conn.SetOnWriteComplete(s.onWriteComplete)
 	conn.setOnClose(s.removeConn)
 	el.AsyncExecute(func() {
@@ -106,12 +132,114 @@ func (s *TcpServer) newConn(fd int, addr net.Addr) {
 	})
 }
 
+// awaitProxyHeader is the connection callback of a connection whose PROXY
+// header has yet to come.
+func (s *TcpServer) awaitProxyHeader(conn *TcpConn) {
+	if conn.IsConnected() {
+		conn.proxyTimer = conn.el.ScheduleDelay(func() {
+			conn.proxyTimer = nil
+			logging.Warnf("TcpServer[%s] no PROXY header from %s in %v", s.name, conn.peerAddr, s.proxyTimeout)
+			conn.ForceClose()
+		}, s.proxyTimeout)
+	} else if conn.proxyTimer != nil {
+		conn.proxyTimer.Cancel()
+		conn.proxyTimer = nil
+	}
+}
+
+// readProxyHeader is the message callback of a connection whose PROXY header
+// has yet to come. Once it has, the connection is handed to the callbacks of
+// the server, with the data that followed the header.
+func (s *TcpServer) readProxyHeader(conn *TcpConn, buf *Buffer, ts time.Time) {
+	if conn.proxyTimer == nil {
+		// the timeout fired in this loop iteration, the close is queued
+		return
+	}
+	h, n, err := proxyproto.Parse(buf.Peek())
+	if err != nil {
+		logging.Warnf("TcpServer[%s] bad PROXY header from %s: %v", s.name, conn.peerAddr, err)
+		conn.ForceClose()
+		return
+	}
+	if h == nil {
+		return
+	}
+	buf.Advance(n)
+	conn.proxyTimer.Cancel()
+	conn.proxyTimer = nil
+	conn.proxyHeader = h
+	// a LOCAL header, or one with unknown addresses, is about the connection itself
+	if h.Command == proxyproto.Proxy && h.Source != nil {
+		conn.peerAddr, conn.localAddr = h.Source, h.Destination
+	}
+	conn.SetOnConn(s.onConn)
+	conn.SetOnMsg(s.onMsg)
+	if s.onConn != nil {
+		s.onConn(conn)
+	}
+	if buf.ReadableBytes() > 0 && conn.IsConnected() && s.onMsg != nil {
+		s.onMsg(conn, buf, ts)
+	}
+}
+
 func (s *TcpServer) removeConn(conn *TcpConn) {
 	s.el.AsyncExecute(func() {
 		s.removeConnInLoop(conn)
 	})
 }
 
+// Shutdown stops the server gracefully: it stops accepting, half-closes every
+// connection once its pending output is written and waits for the peers to close.
+// Connections still open after timeout are closed forcibly. Then the worker loops
+// and the server's own Eventloop are stopped, so Loop returns.
+func (s *TcpServer) Shutdown(timeout time.Duration) {
+	s.el.AsyncExecute(func() {
+		s.shutdownInLoop(timeout)
+	})
+}
+
+// ShutdownOnSignal wires SIGTERM and SIGINT to Shutdown.
+func (s *TcpServer) ShutdownOnSignal(timeout time.Duration) {
+	cb := func(sig os.Signal) {
+		logging.Infof("TcpServer[%s] shutting down on %v", s.name, sig)
+		s.shutdownInLoop(timeout)
+	}
+	s.el.OnSignal(syscall.SIGTERM, cb)
+	s.el.OnSignal(syscall.SIGINT, cb)
+}
+
+func (s *TcpServer) shutdownInLoop(timeout time.Duration) {
+	if s.shuttingDown {
+		return
+	}
+	s.shuttingDown = true
+	s.ac.close()
+	if len(s.connMap) == 0 {
+		s.finishShutdown()
+		return
+	}
+	for _, conn := range s.connMap {
+		c := conn
+		c.el.AsyncExecute(c.ShutdownWrite)
+	}
+	s.shutdownTimer = s.el.ScheduleDelay(func() {
+		logging.Warnf("TcpServer[%s] %d connections are still open, close them", s.name, len(s.connMap))
+		for _, conn := range s.connMap {
+			conn.ForceClose()
+		}
+	}, timeout)
+}
+
+func (s *TcpServer) finishShutdown() {
+	if s.shutdownTimer != nil {
+		s.shutdownTimer.Cancel()
+		s.shutdownTimer = nil
+	}
+	s.group.Stop()
+	s.el.Stop()
+	logging.Infof("TcpServer[%s] is shut down", s.name)
+}
+
 func (s *TcpServer) removeConnInLoop(conn *TcpConn) {
 	delete(s.connMap, conn.name)
 	el := conn.el
@@ -122,6 +250,9 @@ func (s *TcpServer) removeConnInLoop(conn *TcpConn) {
 			logging.Errorf("close socket error: %v", err)
 		}
 	})
+	if s.shuttingDown && len(s.connMap) == 0 {
+		s.finishShutdown()
+	}
 }
 
 // SockaddrToTCPAddr converts a Sockaddr to a net.TCPAddr
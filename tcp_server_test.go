@@ -1,33 +1,91 @@
 package muduo
 
 import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"io"
 	"muduo/pkg/logging"
+	"muduo/proxyproto"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
 
+// startTestServer starts svr on el's own goroutine, the returned func shuts it
+// down and waits for the loop to exit.
+func startTestServer(t *testing.T, el *Eventloop, svr *TcpServer) func() {
+	svr.Start()
+	listening := make(chan struct{})
+	el.AsyncExecute(func() { close(listening) })
+	stopped := make(chan struct{})
+	go func() {
+		el.Loop()
+		close(stopped)
+	}()
+	<-listening
+	return func() {
+		svr.Shutdown(100 * time.Millisecond)
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Error("server loop did not stop")
+		}
+	}
+}
+
+func dialTestServer(t *testing.T, svr *TcpServer) net.Conn {
+	c, err := net.DialTimeout("tcp", svr.addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
 func TestNewTcpServer(t *testing.T) {
 	el := NewEventloop("boss")
-	svr := NewTcpServer(el, "hello", "tcp4://:4589", 4)
+	svr := NewTcpServer(el, "hello", "tcp4://127.0.0.1:0", 4)
+	events := make(chan string, 3)
 	svr.SetOnConn(func(conn *TcpConn) {
 		if conn.state == Connected {
 			logging.Infof("connection established: fd=%d, addr=%s", conn.so.fd, conn.peerAddr.String())
+			events <- "up"
 		} else {
 			logging.Infof("connection closed: fd=%d, addr=%s", conn.so.fd, conn.peerAddr.String())
+			events <- "down"
 		}
 	})
 
 	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, t time.Time) {
-		logging.Infof("message received: fd=%d, addr=%s, msg=%s", conn.so.fd, conn.peerAddr.String(), string(buffer.Next(-1)))
+		msg := string(buffer.Next(-1))
+		logging.Infof("message received: fd=%d, addr=%s, msg=%s", conn.so.fd, conn.peerAddr.String(), msg)
+		events <- msg
 	})
 
-	svr.Start()
-	el.Loop()
+	stop := startTestServer(t, el, svr)
+	defer stop()
+	c := dialTestServer(t, svr)
+	_, _ = c.Write([]byte("hello"))
+	_ = c.Close()
+	for _, want := range []string{"up", "hello", "down"} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
 }
 
 func TestTcpServer_Write(t *testing.T) {
 	el := NewEventloop("boss")
-	svr := NewTcpServer(el, "hello", "tcp4://:4589", 4)
+	svr := NewTcpServer(el, "hello", "tcp4://127.0.0.1:0", 4)
 	svr.SetOnConn(func(conn *TcpConn) {
 		if conn.state == Connected {
 			logging.Infof("connection established: %s, %s, addr=%s", conn.name, conn.el.id, conn.peerAddr.String())
@@ -43,13 +101,58 @@ func TestTcpServer_Write(t *testing.T) {
 		_, _ = conn.Write(data)
 	})
 
-	svr.Start()
-	el.Loop()
+	stop := startTestServer(t, el, svr)
+	defer stop()
+	c := dialTestServer(t, svr)
+	defer c.Close()
+	greeting := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(c, greeting); err != nil || string(greeting) != "hello world" {
+		t.Fatalf("read %q, %v", greeting, err)
+	}
+	_, _ = c.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(c, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("read %q, %v", echo, err)
+	}
+}
+
+// testWriter writes through TcpConn as an io.Writer, which takes a count
+// short of the data for an error.
+func testWriter(t *testing.T, opts ...EventloopOption) {
+	el := NewEventloop("boss", opts...)
+	svr := NewTcpServer(el, "writer", "tcp4://127.0.0.1:0", 1)
+	written := make(chan error, 1)
+	svr.SetOnConn(func(conn *TcpConn) {
+		if conn.IsConnected() {
+			_, err := io.Copy(conn, strings.NewReader("hello 42"))
+			written <- err
+		}
+	})
+	stop := startTestServer(t, el, svr)
+	defer stop()
+	c := dialTestServer(t, svr)
+	defer c.Close()
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("hello 42"))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "hello 42" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
+
+func TestTcpConn_Writer(t *testing.T) {
+	testWriter(t)
+}
+
+func TestTcpConn_WriterIoUring(t *testing.T) {
+	skipWithoutIoUring(t)
+	testWriter(t, WithIoUring())
 }
 
 func TestTcpServer_SetOnWriteComplete(t *testing.T) {
 	el := NewEventloop("boss")
-	svr := NewTcpServer(el, "hello", "tcp4://:4589", 4)
+	svr := NewTcpServer(el, "hello", "tcp4://127.0.0.1:0", 4)
 	svr.SetOnConn(func(conn *TcpConn) {
 		if conn.state == Connected {
 			logging.Infof("connection established: %s, addr=%s", conn.name, conn.peerAddr.String())
@@ -61,15 +164,412 @@ func TestTcpServer_SetOnWriteComplete(t *testing.T) {
 
 	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, t time.Time) {
 		data := buffer.Next(-1)
-		logging.Infof("message received: $s, addr=%s, msg=%s", conn.name, conn.peerAddr.String(), string(data))
+		logging.Infof("message received: %s, addr=%s, msg=%s", conn.name, conn.peerAddr.String(), string(data))
 		//_, _ = conn.Write(data)
 	})
 
+	completed := make(chan struct{}, 1)
 	svr.SetOnWriteComplete(func(conn *TcpConn) {
 		logging.Infof("write complete: %s, addr=%s", conn.name, conn.peerAddr.String())
-		// _, _ = conn.Write([]byte("Write complete"))
+		completed <- struct{}{}
 	})
 
+	stop := startTestServer(t, el, svr)
+	defer stop()
+	c := dialTestServer(t, svr)
+	defer c.Close()
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write complete callback was not called")
+	}
+}
+
+func testEchoServer(t *testing.T, opts ...EventloopOption) {
+	el := NewEventloop("boss", opts...)
+	svr := NewTcpServer(el, "echo", "tcp4://127.0.0.1:0", 2)
+	svr.SetOnMsg(func(conn *TcpConn, buffer *Buffer, t time.Time) {
+		_, _ = conn.Write(buffer.Next(-1))
+	})
+	svr.Start()
+	listening := make(chan struct{})
+	el.AsyncExecute(func() { close(listening) })
+	go el.Loop()
+	defer el.AsyncStop()
+	<-listening
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := net.DialTimeout("tcp", svr.addr, time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+			// large enough to need partial writes and several recv buffers
+			msg := bytes.Repeat([]byte{byte('a' + i)}, 1<<20)
+			go func() {
+				_, _ = c.Write(msg)
+			}()
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("client %d: echo mismatch", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTcpServer_Echo(t *testing.T) {
+	testEchoServer(t)
+}
+
+func TestTcpServer_EchoIoUring(t *testing.T) {
+	skipWithoutIoUring(t)
+	testEchoServer(t, WithIoUring())
+}
+
+func TestTcpServer_ShutdownOnSignal(t *testing.T) {
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "graceful", "tcp4://127.0.0.1:0", 2)
+	connected := make(chan struct{}, 1)
+	svr.SetOnConn(func(conn *TcpConn) {
+		if conn.IsConnected() {
+			_, _ = conn.Write([]byte("bye"))
+			connected <- struct{}{}
+		}
+	})
+	svr.ShutdownOnSignal(time.Second)
 	svr.Start()
-	el.Loop()
+	stopped := make(chan struct{})
+	go func() {
+		el.Loop()
+		close(stopped)
+	}()
+
+	var c net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", svr.addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-connected
+	_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	// pending output is flushed, then the server half-closes the connection
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(c)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	_ = c.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server loop did not stop")
+	}
+}
+
+// skipWithoutIoUring skips the test when the kernel lacks io_uring.
+func skipWithoutIoUring(t *testing.T) {
+	probe := NewEventloop("probe", WithIoUring())
+	if _, ok := probe.poller.(*uringPoller); !ok {
+		t.Skip("io_uring is not available")
+	}
+	_ = probe.poller.close()
+}
+
+func testStopRead(t *testing.T, opts ...EventloopOption) {
+	el := NewEventloop("boss", opts...)
+	svr := NewTcpServer(el, "stop-read", "tcp4://127.0.0.1:0", 1)
+	conns := make(chan *TcpConn, 1)
+	received := make(chan int, 16)
+	svr.SetOnConn(func(conn *TcpConn) {
+		if conn.IsConnected() {
+			conn.StopRead()
+			conns <- conn
+		}
+	})
+	svr.SetOnMsg(func(conn *TcpConn, buf *Buffer, _ time.Time) {
+		received <- len(buf.Next(-1))
+	})
+	defer startTestServer(t, el, svr)()
+
+	c := dialTestServer(t, svr)
+	defer c.Close()
+	conn := <-conns
+	if _, err := c.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		t.Fatalf("read %d bytes while stopped", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Eventloop().AsyncExecute(conn.StartRead)
+	total := 0
+	for total < 1000 {
+		select {
+		case n := <-received:
+			total += n
+		case <-time.After(5 * time.Second):
+			t.Fatalf("read %d bytes after StartRead", total)
+		}
+	}
+}
+
+func TestTcpConn_StopRead(t *testing.T) {
+	testStopRead(t)
+}
+
+func TestTcpConn_StopReadIoUring(t *testing.T) {
+	skipWithoutIoUring(t)
+	testStopRead(t, WithIoUring())
+}
+
+func testHighWaterMark(t *testing.T, opts ...EventloopOption) {
+	el := NewEventloop("boss", opts...)
+	svr := NewTcpServer(el, "high-water", "tcp4://127.0.0.1:0", 1)
+	const size = 8 << 20
+	high := make(chan int, 1)
+	drained := make(chan struct{}, 1)
+	svr.SetOnConn(func(conn *TcpConn) {
+		if conn.IsConnected() {
+			conn.SetHighWaterMark(func(conn *TcpConn, n int) { high <- n }, 1<<20)
+			_, _ = conn.Write(make([]byte, size))
+		}
+	})
+	svr.SetOnWriteComplete(func(conn *TcpConn) {
+		select {
+		case drained <- struct{}{}:
+		default:
+		}
+	})
+	defer startTestServer(t, el, svr)()
+
+	c := dialTestServer(t, svr)
+	defer c.Close()
+	select {
+	case n := <-high:
+		if n < 1<<20 {
+			t.Fatalf("high water mark called at %d bytes", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("high water mark not reached")
+	}
+	if _, err := io.ReadFull(c, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output not drained")
+	}
+}
+
+func TestTcpConn_HighWaterMark(t *testing.T) {
+	testHighWaterMark(t)
+}
+
+func TestTcpConn_HighWaterMarkIoUring(t *testing.T) {
+	skipWithoutIoUring(t)
+	testHighWaterMark(t, WithIoUring())
+}
+
+func testHalfClose(t *testing.T, opts ...EventloopOption) {
+	el := NewEventloop("boss", opts...)
+	svr := NewTcpServer(el, "half-close", "tcp4://127.0.0.1:0", 1)
+	closed := make(chan struct{})
+	svr.SetOnConn(func(conn *TcpConn) {
+		if !conn.IsConnected() {
+			close(closed)
+			return
+		}
+		conn.SetOnHalfClose(func(conn *TcpConn) {
+			// the peer is done sending, answer and close
+			_, _ = conn.Write([]byte(" world"))
+			conn.ShutdownWrite()
+		})
+	})
+	svr.SetOnMsg(func(conn *TcpConn, buf *Buffer, _ time.Time) {
+		_, _ = conn.Write(buf.Next(-1))
+	})
+	defer startTestServer(t, el, svr)()
+
+	c := dialTestServer(t, svr)
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(c)
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestTcpConn_HalfClose(t *testing.T) {
+	testHalfClose(t)
+}
+
+func TestTcpConn_HalfCloseIoUring(t *testing.T) {
+	skipWithoutIoUring(t)
+	testHalfClose(t, WithIoUring())
+}
+
+func TestTcpServer_ProxyProtocol(t *testing.T) {
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "proxied", "tcp4://127.0.0.1:0", 1)
+	svr.SetProxyProtocol(200 * time.Millisecond)
+	type seen struct {
+		peer, local string
+		header      *proxyproto.Header
+	}
+	conns := make(chan seen, 8)
+	svr.SetOnConn(func(conn *TcpConn) {
+		if conn.IsConnected() {
+			conns <- seen{conn.GetPeerAddr().String(), conn.GetLocalAddr().String(), conn.ProxyHeader()}
+		}
+	})
+	svr.SetOnMsg(func(conn *TcpConn, buf *Buffer, _ time.Time) {
+		_, _ = conn.Write(buf.Next(-1))
+	})
+	defer startTestServer(t, el, svr)()
+
+	// v1, the data following the header in the same segment
+	c := dialTestServer(t, svr)
+	defer c.Close()
+	_, _ = c.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 4242 443\r\nping"))
+	got := seen{}
+	select {
+	case got = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection")
+	}
+	if got.peer != "203.0.113.7:4242" || got.local != "198.51.100.1:443" || got.header.Version != 1 {
+		t.Fatalf("v1 %+v", got)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	// v2 with TLVs, written a byte at a time
+	h := &proxyproto.Header{
+		Version:     2,
+		Command:     proxyproto.Proxy,
+		Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 4242},
+		Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		TLVs:        []proxyproto.TLV{{Type: proxyproto.TypeUniqueID, Value: []byte("abc")}},
+	}
+	header, _ := h.Append(nil)
+	c2 := dialTestServer(t, svr)
+	defer c2.Close()
+	for _, b := range header {
+		_, _ = c2.Write([]byte{b})
+	}
+	got = <-conns
+	if got.peer != "[2001:db8::7]:4242" || got.local != "[2001:db8::1]:443" {
+		t.Fatalf("v2 %+v", got)
+	}
+	if v, ok := got.header.TLV(proxyproto.TypeUniqueID); !ok || string(v) != "abc" {
+		t.Fatalf("TLV %q", v)
+	}
+
+	// LOCAL keeps the addresses of the connection
+	header, _ = (&proxyproto.Header{Version: 2, Command: proxyproto.Local}).Append(nil)
+	c3 := dialTestServer(t, svr)
+	defer c3.Close()
+	_, _ = c3.Write(header)
+	got = <-conns
+	if got.peer != c3.LocalAddr().String() || got.header.Command != proxyproto.Local {
+		t.Fatalf("LOCAL %+v, client %s", got, c3.LocalAddr())
+	}
+
+	// no header, or too late: closed before the connection callback
+	for _, data := range []string{"GET / HTTP/1.1\r\n\r\n", "PROXY TCP4 "} {
+		c := dialTestServer(t, svr)
+		defer c.Close()
+		_, _ = c.Write([]byte(data))
+		if rest, err := io.ReadAll(c); err != nil || len(rest) != 0 {
+			t.Fatalf("%q: read %q, %v", data, rest, err)
+		}
+	}
+	select {
+	case got := <-conns:
+		t.Fatalf("connection without a header %+v", got)
+	default:
+	}
+}
+
+func TestTcpServer_ProxyProtocolLateHeader(t *testing.T) {
+	el := NewEventloop("boss")
+	svr := NewTcpServer(el, "proxied", "tcp4://127.0.0.1:0", 0)
+	svr.SetProxyProtocol(20 * time.Millisecond)
+	conns := make(chan *TcpConn, 1)
+	svr.SetOnConn(func(conn *TcpConn) { conns <- conn })
+	defer startTestServer(t, el, svr)()
+
+	c := dialTestServer(t, svr)
+	defer c.Close()
+	fd := -1
+	for fd < 0 {
+		el.runSync(func() {
+			for _, conn := range svr.connMap {
+				if conn.proxyTimer != nil {
+					fd = conn.so.fd
+				}
+			}
+		})
+	}
+
+	// with the loop held, the timeout expires and then the header comes, so
+	// one poll reports the timer first and the header next: the header is
+	// read after the timer closed the connection, before the close has run
+	held, release := make(chan struct{}), make(chan struct{})
+	el.AsyncExecute(func() {
+		close(held)
+		<-release
+	})
+	<-held
+	time.Sleep(50 * time.Millisecond)
+	_, _ = c.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 4242 443\r\n"))
+	for {
+		n, err := unix.Poll([]unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}, 5000)
+		if n > 0 || err != unix.EINTR {
+			break
+		}
+	}
+	close(release)
+	// closed with the header unread, which may reset the connection
+	rest, err := io.ReadAll(c)
+	if ne, ok := err.(net.Error); len(rest) != 0 || ok && ne.Timeout() {
+		t.Fatalf("read %q, %v", rest, err)
+	}
+	select {
+	case conn := <-conns:
+		t.Fatalf("connection after the timeout %s", conn.GetPeerAddr())
+	default:
+	}
 }
@@ -2,54 +2,287 @@ package muduo
 
 import (
 	"container/heap"
+	"fmt"
 	"golang.org/x/sys/unix"
+	"math/rand"
 	"muduo/pkg/logging"
 	"muduo/pkg/util"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
-var (
-	invalidTime = time.Unix(0, 0)
+// TimerState is the lifecycle state of a TimerTask.
+type TimerState int32
+
+const (
+	// TimerPending means the task is waiting for its deadline.
+	TimerPending TimerState = iota
+	// TimerRunning means the callback is running on the loop goroutine.
+	TimerRunning
+	// TimerFired means the task has run for the last time.
+	TimerFired
+	// TimerCancelled means the task was cancelled and will not run again.
+	TimerCancelled
 )
 
+func (s TimerState) String() string {
+	switch s {
+	case TimerPending:
+		return "pending"
+	case TimerRunning:
+		return "running"
+	case TimerFired:
+		return "fired"
+	case TimerCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// TimerTask is a callback scheduled on an Eventloop. Its deadline is kept on the
+// monotonic clock, so wall clock jumps neither fire nor stall it.
 type TimerTask struct {
-	tq       *timerQueue
-	expire   time.Time
-	interval time.Duration
-	repeat   bool
-	cb       func()
-	index    int // for heap
-	canceled bool
+	tq         *timerQueue
+	when       int64 // deadline, monotonic nanoseconds since the queue's epoch
+	seq        uint64
+	interval   time.Duration
+	repeat     bool
+	cb         func()
+	index      int // for heap
+	state      int32
+	mu         sync.Mutex // guards state transitions and done
+	done       chan struct{}
+	reset      bool          // Reset set next, the loop has not applied it yet
+	next       time.Duration // deadline set by Reset, guarded by mu
+	fixedDelay bool          // next run is measured from the end of the callback
+	cron       *CronSchedule // next run is the next activation of the schedule
+	jitter     time.Duration
+	splay      time.Duration
+	maxRuns    int
+	runs       int
+}
+
+// ScheduleOption tunes a TimerTask created by one of the Schedule methods.
+type ScheduleOption func(tt *TimerTask)
+
+// WithJitter delays every run by a random duration in [0, d), so that timers
+// created together do not keep firing together.
+func WithJitter(d time.Duration) ScheduleOption {
+	return func(tt *TimerTask) {
+		tt.jitter = d
+	}
+}
+
+// WithSplay delays the first run by a random duration in [0, d), spreading the
+// start of periodic jobs across a fleet.
+func WithSplay(d time.Duration) ScheduleOption {
+	return func(tt *TimerTask) {
+		tt.splay = d
+	}
+}
+
+// WithMaxRuns stops a repeating task after it has run n times.
+func WithMaxRuns(n int) ScheduleOption {
+	return func(tt *TimerTask) {
+		tt.maxRuns = n
+	}
 }
 
-func newTimerTask(tq *timerQueue, cb func(), t time.Time, interval time.Duration) *TimerTask {
+func newTimerTask(tq *timerQueue, cb func(), when time.Duration, interval time.Duration) *TimerTask {
 	tt := &TimerTask{
 		tq:       tq,
-		expire:   t,
+		when:     int64(when),
 		cb:       cb,
 		interval: interval,
 		repeat:   interval > 0,
 		index:    -1,
-		canceled: false,
+		state:    int32(TimerPending),
+		done:     make(chan struct{}),
+	}
+	return tt
+}
+
+func newFixedDelayTask(tq *timerQueue, cb func(), delay time.Duration) *TimerTask {
+	tt := newTimerTask(tq, cb, tq.elapsed()+delay, delay)
+	tt.fixedDelay = true
+	return tt
+}
+
+func newCronTask(tq *timerQueue, expr string, tz *time.Location, cb func()) (*TimerTask, error) {
+	schedule, err := ParseCron(expr, tz)
+	if err != nil {
+		return nil, err
+	}
+	first := schedule.Next(tq.now())
+	if first.IsZero() {
+		return nil, fmt.Errorf("cron: %q never fires", expr)
+	}
+	tt := newTimerTask(tq, cb, tq.deadline(first), 0)
+	tt.cron = schedule
+	tt.repeat = true
+	return tt, nil
+}
+
+// apply applies opts, then randomizes the first deadline.
+func (tt *TimerTask) apply(opts ...ScheduleOption) *TimerTask {
+	for _, opt := range opts {
+		opt(tt)
 	}
+	tt.setWhen(tt.deadline() + randDuration(tt.splay) + randDuration(tt.jitter))
 	return tt
 }
 
-func (tt *TimerTask) Cancel() {
+// State returns the current lifecycle state, it is safe to call from any goroutine.
+func (tt *TimerTask) State() TimerState {
+	return TimerState(atomic.LoadInt32(&tt.state))
+}
+
+// Done returns a channel that is closed once the task has fired for the last
+// time or has been cancelled.
+func (tt *TimerTask) Done() <-chan struct{} {
+	return tt.done
+}
+
+// Remaining returns the time left until the next run, or 0 when the task is not pending.
+func (tt *TimerTask) Remaining() time.Duration {
+	tt.mu.Lock()
+	if tt.State() != TimerPending {
+		tt.mu.Unlock()
+		return 0
+	}
+	when := tt.deadline()
+	if tt.reset {
+		when = tt.next
+	}
+	tt.mu.Unlock()
+	d := when - tt.tq.elapsed()
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Cancel stops the task, a callback that has not started yet will not run.
+// It reports whether the task was pending or running.
+func (tt *TimerTask) Cancel() bool {
+	tt.mu.Lock()
+	s := tt.State()
+	if s == TimerFired || s == TimerCancelled {
+		tt.mu.Unlock()
+		return false
+	}
+	tt.setState(TimerCancelled)
+	close(tt.done)
+	tt.mu.Unlock()
 	tt.tq.cancel(tt)
+	return true
+}
+
+// Reset moves the next run to deadline. A repeating task carries on from there.
+// It reports false, and does nothing, when the task has already fired for the last
+// time or has been cancelled.
+func (tt *TimerTask) Reset(deadline time.Time) bool {
+	tt.mu.Lock()
+	s := tt.State()
+	if s == TimerFired || s == TimerCancelled {
+		tt.mu.Unlock()
+		return false
+	}
+	// when is only written on the loop, where the heap is ordered by it
+	tt.next = tt.tq.deadline(deadline)
+	tt.reset = true
+	tt.mu.Unlock()
+	tt.tq.el.AsyncExecute(func() {
+		tt.tq.reschedule(tt)
+	})
+	return true
+}
+
+func (tt *TimerTask) deadline() time.Duration {
+	return time.Duration(atomic.LoadInt64(&tt.when))
+}
+
+func (tt *TimerTask) setWhen(when time.Duration) {
+	atomic.StoreInt64(&tt.when, int64(when))
+}
+
+func (tt *TimerTask) setState(s TimerState) {
+	atomic.StoreInt32(&tt.state, int32(s))
+}
+
+// begin moves a pending task to running, it returns false when it was cancelled.
+func (tt *TimerTask) begin() bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.State() != TimerPending {
+		return false
+	}
+	tt.setState(TimerRunning)
+	// a pending Reset is consumed by this run
+	tt.reset = false
+	return true
 }
 
 func (tt *TimerTask) run() {
+	tt.runs++
 	tt.cb()
 }
 
-func (tt *TimerTask) restart(t time.Time) {
-	if tt.repeat {
-		tt.expire = t.Add(tt.interval)
-	} else {
-		tt.expire = time.Unix(0, 0)
+// finish decides, after a run, whether the task goes back to the heap.
+func (tt *TimerTask) finish(now time.Duration) bool {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.State() == TimerCancelled {
+		return false
+	}
+	if tt.reset {
+		// the callback moved its own deadline
+		tt.setWhen(tt.next)
+		tt.reset = false
+		tt.setState(TimerPending)
+		return true
+	}
+	if tt.restart(now) {
+		tt.setState(TimerPending)
+		return true
 	}
+	tt.setState(TimerFired)
+	close(tt.done)
+	return false
+}
+
+func (tt *TimerTask) restart(now time.Duration) bool {
+	if tt.maxRuns > 0 && tt.runs >= tt.maxRuns {
+		tt.repeat = false
+	}
+	if !tt.repeat {
+		return false
+	}
+	var when time.Duration
+	switch {
+	case tt.cron != nil:
+		next := tt.cron.Next(tt.tq.now())
+		if next.IsZero() {
+			tt.repeat = false
+			return false
+		}
+		when = tt.tq.deadline(next)
+	case tt.fixedDelay:
+		when = tt.tq.elapsed() + tt.interval
+	default:
+		when = now + tt.interval
+	}
+	tt.setWhen(when + randDuration(tt.jitter))
+	return true
+}
+
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
 }
 
 type timerQueue struct {
@@ -57,61 +290,116 @@ type timerQueue struct {
 	timerFd        int
 	timerFdChannel *Channel
 	tasks          *timerTaskHeap
+	clock          Clock
+	fake           bool      // clock is a FakeClock, elapsed follows its readings
+	epoch          time.Time // start of elapsed, read from the monotonic clock unless fake
+	seq            uint64
 }
 
-func newTimerQueue(el *Eventloop) *timerQueue {
-	timerFd, err := unix.TimerfdCreate(unix.CLOCK_MONOTONIC, unix.TFD_NONBLOCK|unix.TFD_CLOEXEC)
-	if err != nil {
-		panic(err)
-	}
-	timerFdChannel := NewChannel(el, timerFd)
+// newTimerQueue creates a timer queue. Without a timerfd the owning Eventloop
+// must bound its poll timeout with nextTimeout and call runExpired itself.
+func newTimerQueue(el *Eventloop, useTimerFd bool) *timerQueue {
 	tq := &timerQueue{
-		el:             el,
-		timerFd:        timerFd,
-		timerFdChannel: timerFdChannel,
+		el:      el,
+		timerFd: -1,
 		tasks: &timerTaskHeap{
 			tasks: make([]*TimerTask, 0),
 		},
+		clock: el.clock,
+	}
+	_, tq.fake = tq.clock.(*FakeClock)
+	if tq.fake {
+		tq.epoch = tq.clock.Now()
+	} else {
+		tq.epoch = time.Now()
+	}
+	if useTimerFd {
+		timerFd, err := unix.TimerfdCreate(unix.CLOCK_MONOTONIC, unix.TFD_NONBLOCK|unix.TFD_CLOEXEC)
+		if err != nil {
+			panic(err)
+		}
+		tq.timerFd = timerFd
+		tq.timerFdChannel = NewChannel(el, timerFd)
+		tq.timerFdChannel.setReadCallback(tq.handleRead)
+		tq.timerFdChannel.enableReading()
+	}
+	if fc, ok := tq.clock.(*FakeClock); ok {
+		fc.attach(tq)
 	}
-	timerFdChannel.setReadCallback(tq.handleRead)
-	timerFdChannel.enableReading()
 	return tq
 }
 
-func (tq *timerQueue) addTask(cb func(), t time.Time, interval time.Duration) *TimerTask {
-	tt := newTimerTask(tq, cb, t, interval)
-	earliestChanged := tq.insert(tt)
-	if earliestChanged {
-		logging.Debugf("timerQueue::addTask() earliestChanged")
-		resetTimerFd(tq.timerFd, t)
+// now returns the current time of the loop's clock, time.Now carries a monotonic reading.
+func (tq *timerQueue) now() time.Time {
+	return tq.clock.Now()
+}
+
+// elapsed returns the monotonic time since the queue was created. The timerfd
+// and the poll timeouts wait on the monotonic clock, so unless the clock is fake
+// elapsed is measured on it too, and a Clock whose readings have no monotonic
+// reading does not move the deadlines when its wall clock jumps.
+func (tq *timerQueue) elapsed() time.Duration {
+	if tq.fake {
+		return tq.now().Sub(tq.epoch)
 	}
+	return time.Since(tq.epoch)
+}
+
+// deadline converts an absolute time into a monotonic deadline. A time without
+// a monotonic reading (e.g. from time.Date) is measured against the wall clock
+// once, here, and is not affected by later wall clock changes.
+func (tq *timerQueue) deadline(t time.Time) time.Duration {
+	return tq.elapsed() + t.Sub(tq.now())
+}
+
+func (tq *timerQueue) addTask(cb func(), when time.Duration, interval time.Duration) *TimerTask {
+	tt := newTimerTask(tq, cb, when, interval)
+	tq.addTask0(tt)
 	return tt
 }
 
 func (tq *timerQueue) addTask0(task *TimerTask) {
+	// cancelled, or already pushed by a Reset that ran first
+	if task.State() != TimerPending || task.index >= 0 {
+		return
+	}
 	earliestChanged := tq.insert(task)
-	if earliestChanged {
+	if earliestChanged && tq.timerFd >= 0 {
 		logging.Debugf("timerQueue::addTask0() earliestChanged")
-		resetTimerFd(tq.timerFd, task.expire)
+		tq.resetTimerFd(task.deadline())
 	}
 }
 
 func (tq *timerQueue) cancel(tt *TimerTask) {
 	tq.el.AsyncExecute(func() {
-		// why we need to set repeat to false?
-		// because when user call cancel, it means user don't want to run this task any more
-		// timer queue will call handleRead to run expired task, if task is repeat and not cancel, it will be added to timer queue again
-		// user can call cancel in TimerTask's timeout callback, so we need to set repeat to false
-		tt.repeat = false
-		// if you cancel the timer in another timer's callback, the timer will still run, so we need to set canceled to true
-		// and don't run timer's callback if it is canceled
-		tt.canceled = true
-		if tt.index > 0 {
+		if tt.index >= 0 {
 			heap.Remove(tq.tasks, tt.index)
 		}
 	})
 }
 
+// reschedule applies the deadline set by Reset and moves the task in the heap.
+func (tq *timerQueue) reschedule(tt *TimerTask) {
+	tt.mu.Lock()
+	if tt.State() != TimerPending || !tt.reset {
+		// cancelled, consumed by a run, or running: finish puts it back at the
+		// new deadline
+		tt.mu.Unlock()
+		return
+	}
+	tt.setWhen(tt.next)
+	tt.reset = false
+	tt.mu.Unlock()
+	if tt.index >= 0 {
+		heap.Fix(tq.tasks, tt.index)
+	} else {
+		heap.Push(tq.tasks, tt)
+	}
+	if tq.timerFd >= 0 {
+		tq.resetTimerFd(tq.tasks.Top().deadline())
+	}
+}
+
 func (tq *timerQueue) handleRead(ts time.Time) {
 	logging.Debugf("timerQueue::handleRead()")
 	var exp uint64
@@ -119,46 +407,58 @@ func (tq *timerQueue) handleRead(ts time.Time) {
 	if err != nil {
 		logging.Errorf("timerQueue::handleRead() %v", err)
 	}
-	now := time.Now()
+	tq.runExpired()
+}
+
+func (tq *timerQueue) runExpired() {
+	now := tq.elapsed()
 	expiredTask := tq.getExpired(now)
 	for _, v := range expiredTask {
-		if !v.canceled {
+		// a callback earlier in this batch may have cancelled v
+		if v.begin() {
 			v.run()
 		}
 	}
 	tq.reset(expiredTask, now)
 }
 
+// nextTimeout returns how long until the earliest pending task is due.
+func (tq *timerQueue) nextTimeout() (time.Duration, bool) {
+	if tq.tasks.Len() == 0 {
+		return 0, false
+	}
+	return tq.tasks.Top().deadline() - tq.elapsed(), true
+}
+
 func (tq *timerQueue) shutdown() {
-	_ = unix.Close(tq.timerFd)
+	if tq.timerFd >= 0 {
+		_ = unix.Close(tq.timerFd)
+	}
+	if fc, ok := tq.clock.(*FakeClock); ok {
+		fc.detach(tq)
+	}
 }
 
-func (tq *timerQueue) reset(expired []*TimerTask, t time.Time) {
+func (tq *timerQueue) reset(expired []*TimerTask, now time.Duration) {
 	for _, v := range expired {
-		if v.repeat && !v.canceled {
-			v.restart(t)
+		if v.State() == TimerRunning && v.finish(now) {
 			tq.insert(v)
 		}
 	}
-	if tq.tasks.Len() > 0 {
-		nextExpire := tq.tasks.Top().expire
-		if nextExpire.After(invalidTime) {
-			// reset timerfd
-			resetTimerFd(tq.timerFd, nextExpire)
-		}
+	if tq.tasks.Len() > 0 && tq.timerFd >= 0 {
+		tq.resetTimerFd(tq.tasks.Top().deadline())
 	}
 }
 
-func resetTimerFd(timerFd int, t time.Time) {
+func (tq *timerQueue) resetTimerFd(when time.Duration) {
 	var its unix.ItimerSpec
 	var oldTs unix.ItimerSpec
-	// its.Value = unix.NsecToTimespec(t.UnixNano())
-	duration := t.Sub(time.Now())
+	duration := when - tq.elapsed()
 	if duration.Microseconds() < 100 {
 		duration = 100 * time.Microsecond
 	}
 	its.Value = unix.NsecToTimespec(duration.Nanoseconds())
-	err := unix.TimerfdSettime(timerFd, 0, &its, &oldTs)
+	err := unix.TimerfdSettime(tq.timerFd, 0, &its, &oldTs)
 	if err != nil {
 		logging.Errorf("resetTimerFd() %v", err)
 	}
@@ -166,17 +466,18 @@ func resetTimerFd(timerFd int, t time.Time) {
 
 func (tq *timerQueue) insert(task *TimerTask) bool {
 	earliestChanged := false
-	expire := task.expire
-	if tq.tasks.Len() == 0 || expire.Before(tq.tasks.Top().expire) {
+	if tq.tasks.Len() == 0 || task.deadline() < tq.tasks.Top().deadline() {
 		earliestChanged = true
 	}
+	tq.seq++
+	task.seq = tq.seq
 	heap.Push(tq.tasks, task)
 	return earliestChanged
 
 }
 
-func (tq *timerQueue) getExpired(t time.Time) []*TimerTask {
-	return tq.tasks.getAndRemoveExpired(t)
+func (tq *timerQueue) getExpired(now time.Duration) []*TimerTask {
+	return tq.tasks.getAndRemoveExpired(now)
 }
 
 type timerTaskHeap struct {
@@ -188,13 +489,12 @@ func (h *timerTaskHeap) Len() int {
 }
 
 func (h *timerTaskHeap) Less(i, j int) bool {
-	if h.tasks[i].expire.Before(h.tasks[j].expire) {
-		return true
-	} else if h.tasks[i].expire.Equal(h.tasks[j].expire) {
-		return i < j
-	} else {
-		return false
+	a, b := h.tasks[i], h.tasks[j]
+	if a.deadline() != b.deadline() {
+		return a.deadline() < b.deadline()
 	}
+	// tasks with the same deadline run in the order they were scheduled
+	return a.seq < b.seq
 }
 
 func (h *timerTaskHeap) Swap(i, j int) {
@@ -223,14 +523,14 @@ func (h *timerTaskHeap) Top() *TimerTask {
 	return h.tasks[0]
 }
 
-func (h *timerTaskHeap) getAndRemoveExpired(t time.Time) []*TimerTask {
+func (h *timerTaskHeap) getAndRemoveExpired(now time.Duration) []*TimerTask {
 	var ret []*TimerTask
 	for {
 		if h.Len() == 0 {
 			break
 		}
 		pop := h.Top()
-		if pop.expire.Before(t) || pop.expire.Equal(t) {
+		if pop.deadline() <= now {
 			tmp := heap.Pop(h)
 			util.Assert(tmp == pop, "t == pop")
 			ret = append(ret, pop)
@@ -3,6 +3,7 @@ package muduo
 import (
 	"container/heap"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,7 +15,7 @@ func TestLowerBound(t *testing.T) {
 	for i := 0; i < 10; i++ {
 
 		heap.Push(timers, &TimerTask{
-			expire:   time.Unix(int64(rand.Intn(100)), 0),
+			when:     int64(time.Duration(rand.Intn(100)) * time.Second),
 			interval: time.Second,
 			repeat:   true,
 			cb:       func() {},
@@ -22,14 +23,205 @@ func TestLowerBound(t *testing.T) {
 	}
 
 	for _, v := range timers.tasks {
-		t.Logf("%d", v.expire.Unix())
+		t.Logf("%v", v.deadline())
 	}
 
 	t.Logf("----------------------")
 
-	ret := timers.getAndRemoveExpired(time.Unix(30, 0))
+	ret := timers.getAndRemoveExpired(30 * time.Second)
 	for _, v := range ret {
-		t.Logf("%d", v.expire.Unix())
+		t.Logf("%v", v.deadline())
 	}
 
 }
+
+// startLoop runs el on its own goroutine and waits until it is looping, the
+// returned func stops it and waits.
+func startLoop(el *Eventloop) func() {
+	stopped := make(chan struct{})
+	looping := make(chan struct{})
+	el.AsyncExecute(func() { close(looping) })
+	go func() {
+		el.Loop()
+		close(stopped)
+	}()
+	<-looping
+	return func() {
+		el.AsyncStop()
+		<-stopped
+	}
+}
+
+func waitDone(t *testing.T, tt *TimerTask, d time.Duration) {
+	t.Helper()
+	select {
+	case <-tt.Done():
+	case <-time.After(d):
+		t.Fatalf("timer task is still %v after %v", tt.State(), d)
+	}
+}
+
+func TestTimerTask_Lifecycle(t *testing.T) {
+	el := NewEventloop("")
+	stop := startLoop(el)
+	defer stop()
+
+	tt := el.AsyncScheduleDelay(func() {}, 50*time.Millisecond)
+	if s := tt.State(); s != TimerPending {
+		t.Fatalf("state = %v, want pending", s)
+	}
+	if r := tt.Remaining(); r <= 0 || r > 50*time.Millisecond {
+		t.Fatalf("remaining = %v", r)
+	}
+	waitDone(t, tt, time.Second)
+	if s := tt.State(); s != TimerFired {
+		t.Fatalf("state = %v, want fired", s)
+	}
+	if tt.Remaining() != 0 {
+		t.Fatalf("remaining = %v after firing", tt.Remaining())
+	}
+	if tt.Cancel() {
+		t.Fatal("Cancel of a fired task should report false")
+	}
+	if tt.Reset(time.Now().Add(time.Second)) {
+		t.Fatal("Reset of a fired task should report false")
+	}
+}
+
+func TestTimerTask_CancelEarliest(t *testing.T) {
+	el := NewEventloop("")
+	stop := startLoop(el)
+	defer stop()
+
+	ran := make(chan string, 2)
+	first := el.AsyncScheduleDelay(func() { ran <- "first" }, 50*time.Millisecond)
+	second := el.AsyncScheduleDelay(func() { ran <- "second" }, 100*time.Millisecond)
+	// first sits at the top of the heap
+	synced := make(chan struct{})
+	el.AsyncExecute(func() { close(synced) })
+	<-synced
+	if !first.Cancel() {
+		t.Fatal("Cancel of a pending task should report true")
+	}
+	if s := first.State(); s != TimerCancelled {
+		t.Fatalf("state = %v, want cancelled", s)
+	}
+	select {
+	case <-first.Done():
+	default:
+		t.Fatal("Done is not closed after Cancel")
+	}
+	waitDone(t, second, time.Second)
+	if got := <-ran; got != "second" {
+		t.Fatalf("%s ran", got)
+	}
+	remaining := make(chan int)
+	el.AsyncExecute(func() { remaining <- el.tq.tasks.Len() })
+	if n := <-remaining; n != 0 {
+		t.Fatalf("%d tasks left in the queue", n)
+	}
+}
+
+func TestTimerTask_CancelFromCallback(t *testing.T) {
+	el := NewEventloop("")
+	stop := startLoop(el)
+	defer stop()
+
+	var second *TimerTask
+	ran := false
+	when := time.Now().Add(50 * time.Millisecond)
+	done := make(chan struct{})
+	el.AsyncExecute(func() {
+		el.Schedule(func() { second.Cancel() }, when)
+		second = el.Schedule(func() { ran = true }, when)
+		el.Schedule(func() { close(done) }, when.Add(50*time.Millisecond))
+	})
+	<-done
+	if ran {
+		t.Fatal("a task cancelled by an earlier callback of the same batch ran")
+	}
+}
+
+func TestTimerTask_Reset(t *testing.T) {
+	el := NewEventloop("")
+	stop := startLoop(el)
+	defer stop()
+
+	start := time.Now()
+	tt := el.AsyncScheduleDelay(func() {}, time.Hour)
+	if !tt.Reset(start.Add(50 * time.Millisecond)) {
+		t.Fatal("Reset of a pending task should report true")
+	}
+	if r := tt.Remaining(); r > 50*time.Millisecond {
+		t.Fatalf("remaining = %v after Reset", r)
+	}
+	waitDone(t, tt, time.Second)
+
+	// a repeating task carries on from the new deadline
+	runs := make(chan time.Time, 8)
+	rate := el.AsyncScheduleAtFixRate(func() { runs <- time.Now() }, time.Hour)
+	rate.Reset(time.Now().Add(20 * time.Millisecond))
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Fatal("reset repeating task did not run")
+	}
+	if s := rate.State(); s != TimerPending {
+		t.Fatalf("state = %v, want pending", s)
+	}
+	if r := rate.Remaining(); r < 59*time.Minute {
+		t.Fatalf("remaining = %v, want about an hour", r)
+	}
+	rate.Cancel()
+}
+
+// jumpingClock reads the wall clock, off by skew and without a monotonic
+// reading, like a host whose clock is stepped by NTP or an operator.
+type jumpingClock struct {
+	mu   sync.Mutex
+	skew time.Duration
+}
+
+func (c *jumpingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Round(0).Add(c.skew)
+}
+
+func (c *jumpingClock) jump(d time.Duration) {
+	c.mu.Lock()
+	c.skew += d
+	c.mu.Unlock()
+}
+
+func TestTimerTask_WallClockJumps(t *testing.T) {
+	clock := &jumpingClock{}
+	el := NewEventloop("", WithClock(clock))
+	stop := startLoop(el)
+	defer stop()
+
+	start := time.Now()
+	fired := make(chan time.Time, 1)
+	tt := el.AsyncScheduleDelay(func() { fired <- time.Now() }, 200*time.Millisecond)
+	for _, jump := range []time.Duration{time.Hour, -2 * time.Hour, 24 * time.Hour} {
+		clock.jump(jump)
+		if s := tt.State(); s != TimerPending {
+			t.Fatalf("state = %v after a wall clock jump of %v", s, jump)
+		}
+		if r := tt.Remaining(); r <= 0 || r > 200*time.Millisecond {
+			t.Fatalf("remaining = %v after a wall clock jump of %v", r, jump)
+		}
+	}
+	// a deadline read from the jumping clock is measured against it once
+	if !tt.Reset(clock.Now().Add(100 * time.Millisecond)) {
+		t.Fatal("Reset of a pending task should report true")
+	}
+	clock.jump(-time.Hour)
+	if r := tt.Remaining(); r <= 0 || r > 100*time.Millisecond {
+		t.Fatalf("remaining = %v after Reset", r)
+	}
+	waitDone(t, tt, time.Second)
+	if d := (<-fired).Sub(start); d < 100*time.Millisecond || d > 900*time.Millisecond {
+		t.Fatalf("fired after %v, want about 100ms", d)
+	}
+}
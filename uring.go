@@ -0,0 +1,334 @@
+package muduo
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	uringOpPollAdd     = 6
+	uringOpPollRemove  = 7
+	uringOpAccept      = 13
+	uringOpAsyncCancel = 14
+	uringOpSend        = 26
+	uringOpRecv        = 27
+
+	uringSqeBufferSelect = 1 << 5
+
+	uringPollAddMulti    = 1 << 0
+	uringAcceptMultishot = 1 << 0
+	uringRecvMultishot   = 1 << 1
+
+	uringAsyncCancelAll = 1 << 0
+	uringAsyncCancelFd  = 1 << 1
+
+	uringCqeFBuffer     = 1 << 0
+	uringCqeFMore       = 1 << 1
+	uringCqeBufferShift = 16
+
+	uringEnterGetEvents = 1 << 0
+	uringEnterExtArg    = 1 << 3
+
+	uringFeatSingleMmap = 1 << 0
+	uringFeatNoDrop     = 1 << 1
+	uringFeatExtArg     = 1 << 8
+
+	uringOffSqRing = 0
+	uringOffCqRing = 0x8000000
+	uringOffSqes   = 0x10000000
+
+	uringRegisterPbufRing = 22
+)
+
+type uringSqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type uringCqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCpu  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSqringOffsets
+	cqOff        uringCqringOffsets
+}
+
+type uringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufGroup    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	_           uint64
+}
+
+type uringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type uringGeteventsArg struct {
+	sigmask   uint64
+	sigmaskSz uint32
+	pad       uint32
+	ts        uint64
+}
+
+type uringBufReg struct {
+	ringAddr    uint64
+	ringEntries uint32
+	bgid        uint16
+	flags       uint16
+	resv        [3]uint64
+}
+
+// uring is a minimal io_uring instance: one submission and one completion ring,
+// driven only from the owning Eventloop goroutine.
+type uring struct {
+	fd        int
+	ringMem   []byte
+	sqeMem    []byte
+	sqHead    *uint32
+	sqTail    *uint32
+	sqMask    uint32
+	sqEntries uint32
+	sqes      []uringSqe
+	cqHead    *uint32
+	cqTail    *uint32
+	cqMask    uint32
+	cqes      []uringCqe
+	tail      uint32 // local sq tail, published on submit
+	submitted uint32
+}
+
+func newUring(entries uint32) (*uring, error) {
+	var params uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &uring{fd: int(fd)}
+	required := uint32(uringFeatSingleMmap | uringFeatNoDrop | uringFeatExtArg)
+	if params.features&required != required {
+		_ = unix.Close(r.fd)
+		return nil, os.NewSyscallError("io_uring_setup", unix.ENOTSUP)
+	}
+	sqSize := params.sqOff.array + params.sqEntries*4
+	cqSize := params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCqe{}))
+	ringSize := sqSize
+	if cqSize > ringSize {
+		ringSize = cqSize
+	}
+	var err error
+	r.ringMem, err = unix.Mmap(r.fd, uringOffSqRing, int(ringSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		_ = unix.Close(r.fd)
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	r.sqeMem, err = unix.Mmap(r.fd, uringOffSqes, int(params.sqEntries)*int(unsafe.Sizeof(uringSqe{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		_ = unix.Munmap(r.ringMem)
+		_ = unix.Close(r.fd)
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.ringMem[params.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.ringMem[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.ringMem[params.sqOff.ringMask]))
+	r.sqEntries = params.sqEntries
+	r.sqes = unsafe.Slice((*uringSqe)(unsafe.Pointer(&r.sqeMem[0])), params.sqEntries)
+	// the sq array is an indirection we do not need, map slot i to sqe i once.
+	array := unsafe.Slice((*uint32)(unsafe.Pointer(&r.ringMem[params.sqOff.array])), params.sqEntries)
+	for i := range array {
+		array[i] = uint32(i)
+	}
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.ringMem[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.ringMem[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.ringMem[params.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCqe)(unsafe.Pointer(&r.ringMem[params.cqOff.cqes])), params.cqEntries)
+	r.tail = atomic.LoadUint32(r.sqTail)
+	r.submitted = r.tail
+	return r, nil
+}
+
+// getSqe returns a zeroed submission entry, flushing the queue to the kernel when it is full.
+func (r *uring) getSqe() *uringSqe {
+	for r.tail-atomic.LoadUint32(r.sqHead) >= r.sqEntries {
+		_ = r.enter(0, 0, nil)
+	}
+	sqe := &r.sqes[r.tail&r.sqMask]
+	*sqe = uringSqe{}
+	r.tail++
+	return sqe
+}
+
+// enter submits all queued entries and, when ts is not nil, waits for at least
+// minComplete completions or until ts elapses.
+func (r *uring) enter(flags uint32, minComplete uint32, ts *unix.Timespec) error {
+	atomic.StoreUint32(r.sqTail, r.tail)
+	toSubmit := r.tail - r.submitted
+	var (
+		ret   uintptr
+		errno unix.Errno
+	)
+	if ts != nil {
+		arg := uringGeteventsArg{ts: uint64(uintptr(unsafe.Pointer(ts)))}
+		ret, _, errno = unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete),
+			uintptr(flags|uringEnterGetEvents|uringEnterExtArg), uintptr(unsafe.Pointer(&arg)), unsafe.Sizeof(arg))
+	} else {
+		if toSubmit == 0 {
+			return nil
+		}
+		ret, _, errno = unix.RawSyscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), 0, uintptr(flags), 0, 0)
+	}
+	if errno != 0 {
+		return errnoErr(errno)
+	}
+	r.submitted += uint32(ret)
+	return nil
+}
+
+// cqReady reports whether completions are waiting to be reaped.
+func (r *uring) cqReady() bool {
+	return *r.cqHead != atomic.LoadUint32(r.cqTail)
+}
+
+// reap appends every pending completion to cqes and releases their ring slots.
+func (r *uring) reap(cqes []uringCqe) []uringCqe {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqes = append(cqes, r.cqes[head&r.cqMask])
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	return cqes
+}
+
+func (r *uring) register(opcode uintptr, arg unsafe.Pointer, nrArgs uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), opcode, uintptr(arg), nrArgs, 0, 0)
+	if errno != 0 {
+		return os.NewSyscallError("io_uring_register", errno)
+	}
+	return nil
+}
+
+func (r *uring) close() error {
+	_ = unix.Munmap(r.sqeMem)
+	_ = unix.Munmap(r.ringMem)
+	return unix.Close(r.fd)
+}
+
+// uringBufRing is a provided buffer ring (linux 5.19) the kernel picks recv buffers from.
+type uringBufRing struct {
+	ringMem []byte
+	bufMem  []byte
+	bufSize int
+	mask    uint16
+	tail    uint16
+}
+
+type uringBuf struct {
+	addr uint64
+	len  uint32
+	bid  uint16
+	_    uint16 // overlaps the ring tail for entry 0
+}
+
+func newUringBufRing(r *uring, bgid uint16, entries int, bufSize int) (*uringBufRing, error) {
+	ringMem, err := unix.Mmap(-1, 0, entries*int(unsafe.Sizeof(uringBuf{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	bufMem, err := unix.Mmap(-1, 0, entries*bufSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		_ = unix.Munmap(ringMem)
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	br := &uringBufRing{
+		ringMem: ringMem,
+		bufMem:  bufMem,
+		bufSize: bufSize,
+		mask:    uint16(entries - 1),
+	}
+	reg := uringBufReg{
+		ringAddr:    uint64(uintptr(unsafe.Pointer(&ringMem[0]))),
+		ringEntries: uint32(entries),
+		bgid:        bgid,
+	}
+	if err = r.register(uringRegisterPbufRing, unsafe.Pointer(&reg), 1); err != nil {
+		br.free()
+		return nil, err
+	}
+	for i := 0; i < entries; i++ {
+		br.push(uint16(i))
+	}
+	br.publish()
+	return br, nil
+}
+
+func (br *uringBufRing) buf(bid uint16) []byte {
+	off := int(bid) * br.bufSize
+	return br.bufMem[off : off+br.bufSize]
+}
+
+func (br *uringBufRing) push(bid uint16) {
+	bufs := unsafe.Slice((*uringBuf)(unsafe.Pointer(&br.ringMem[0])), int(br.mask)+1)
+	b := &bufs[br.tail&br.mask]
+	b.addr = uint64(uintptr(unsafe.Pointer(&br.bufMem[int(bid)*br.bufSize])))
+	b.len = uint32(br.bufSize)
+	b.bid = bid
+	br.tail++
+}
+
+// publish makes pushed buffers visible to the kernel. The tail shares a word with
+// the bid of entry 0, which only this goroutine ever writes.
+func (br *uringBufRing) publish() {
+	word := (*uint32)(unsafe.Pointer(&br.ringMem[12]))
+	bid0 := *(*uint16)(unsafe.Pointer(&br.ringMem[12]))
+	atomic.StoreUint32(word, uint32(bid0)|uint32(br.tail)<<16)
+}
+
+// recycle gives a consumed buffer back to the kernel.
+func (br *uringBufRing) recycle(bid uint16) {
+	br.push(bid)
+	br.publish()
+}
+
+func (br *uringBufRing) free() {
+	_ = unix.Munmap(br.bufMem)
+	_ = unix.Munmap(br.ringMem)
+}
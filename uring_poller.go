@@ -0,0 +1,369 @@
+package muduo
+
+import (
+	"container/list"
+	"golang.org/x/sys/unix"
+	"muduo/pkg/logging"
+	"muduo/pkg/util"
+	"time"
+	"unsafe"
+)
+
+const (
+	uringEntries  = 256
+	uringBufGroup = 0
+	uringBufCount = 128
+	uringBufSize  = 16 * 1024
+)
+
+type uringOpKind int
+
+const (
+	uringPoll uringOpKind = iota
+	uringAccept
+	uringRecv
+	uringSend
+)
+
+// uringOp is one in-flight submission, identified by its user_data token.
+type uringOp struct {
+	kind     uringOpKind
+	ch       *Channel
+	token    uint64
+	events   uint32
+	gen      uint64 // poll generation the op was last reported active in
+	nres     int    // completions seen so far
+	dead     bool   // canceled, remaining completions are dropped
+	stopped  bool   // canceled, remaining completions are delivered but not rearmed
+	data     []byte // send payload, pinned until the send completes
+	onAccept func(int, error)
+	onRecv   func([]byte, error)
+	onSend   func(int, error)
+}
+
+// uringChannel tracks the operations submitted on behalf of one Channel.
+type uringChannel struct {
+	poll *uringOp
+	io   []*uringOp
+}
+
+type uringPoller struct {
+	el              *Eventloop
+	ring            *uring
+	bufRing         *uringBufRing
+	channelMap      map[int]*Channel
+	channels        map[*Channel]*uringChannel
+	ops             map[uint64]*uringOp
+	nextToken       uint64
+	gen             uint64
+	cqes            []uringCqe
+	acceptMultishot bool
+	recvMultishot   bool
+}
+
+func newUringPoller(el *Eventloop) (*uringPoller, error) {
+	ring, err := newUring(uringEntries)
+	if err != nil {
+		return nil, err
+	}
+	bufRing, err := newUringBufRing(ring, uringBufGroup, uringBufCount, uringBufSize)
+	if err != nil {
+		_ = ring.close()
+		return nil, err
+	}
+	return &uringPoller{
+		el:              el,
+		ring:            ring,
+		bufRing:         bufRing,
+		channelMap:      make(map[int]*Channel),
+		channels:        make(map[*Channel]*uringChannel),
+		ops:             make(map[uint64]*uringOp),
+		nextToken:       1,
+		cqes:            make([]uringCqe, 0, uringEntries),
+		acceptMultishot: true,
+		recvMultishot:   true,
+	}, nil
+}
+
+func (p *uringPoller) poll(timeout time.Duration) (now time.Time) {
+	var err error
+	if timeout <= 0 || p.ring.cqReady() {
+		err = p.ring.enter(0, 0, nil)
+	} else {
+		ts := unix.NsecToTimespec(timeout.Nanoseconds())
+		err = p.ring.enter(0, 1, &ts)
+	}
+	now = p.el.Now()
+	if err != nil && err != unix.ETIME && err != unix.EINTR {
+		logging.Errorf("error occurs in io_uring: %v", err)
+	}
+	p.cqes = p.ring.reap(p.cqes[:0])
+	if len(p.cqes) == 0 {
+		logging.Debugf("nothing happened, timeout %v", timeout)
+		return
+	}
+	logging.Debugf("%d completions happened", len(p.cqes))
+	p.gen++
+	for i := range p.cqes {
+		p.complete(&p.cqes[i], p.el.activeChannels)
+	}
+	return
+}
+
+func (p *uringPoller) complete(cqe *uringCqe, activeChannels *list.List) {
+	op := p.ops[cqe.userData]
+	if op == nil || op.dead {
+		// a completion of a canceled op or of a poll/cancel request
+		if cqe.flags&uringCqeFBuffer != 0 {
+			p.bufRing.recycle(uint16(cqe.flags >> uringCqeBufferShift))
+		}
+		if op != nil && cqe.flags&uringCqeFMore == 0 {
+			p.release(op)
+		}
+		return
+	}
+	more := cqe.flags&uringCqeFMore != 0
+	res := cqe.res
+	op.nres++
+	rearm := false
+	switch op.kind {
+	case uringPoll:
+		if res > 0 {
+			if op.gen == p.gen {
+				op.ch.revents |= uint32(res)
+			} else {
+				op.gen = p.gen
+				op.ch.revents = uint32(res)
+				op.ch.ele = activeChannels.PushBack(op.ch)
+			}
+		}
+		rearm = !more
+	case uringAccept:
+		if res == -int32(unix.EINVAL) && op.nres == 1 && p.acceptMultishot {
+			logging.Warnf("io_uring multishot accept is not supported, fall back to single shot")
+			p.acceptMultishot = false
+		} else if res >= 0 {
+			op.onAccept(int(res), nil)
+		} else if res != -int32(unix.ECANCELED) {
+			op.onAccept(-1, unix.Errno(-res))
+		}
+		rearm = !more
+	case uringRecv:
+		if cqe.flags&uringCqeFBuffer != 0 {
+			bid := uint16(cqe.flags >> uringCqeBufferShift)
+			op.onRecv(p.bufRing.buf(bid)[:res], nil)
+			p.bufRing.recycle(bid)
+			rearm = !more
+		} else if res == -int32(unix.EINVAL) && op.nres == 1 && p.recvMultishot {
+			logging.Warnf("io_uring multishot recv is not supported, fall back to single shot")
+			p.recvMultishot = false
+			rearm = true
+		} else if res == -int32(unix.ENOBUFS) {
+			// every provided buffer is in use, the multishot recv has been terminated.
+			rearm = !more
+		} else if res == 0 {
+			op.onRecv(nil, nil)
+		} else if res != -int32(unix.ECANCELED) {
+			op.onRecv(nil, unix.Errno(-res))
+		}
+	case uringSend:
+		if res >= 0 {
+			op.onSend(int(res), nil)
+		} else {
+			op.onSend(0, unix.Errno(-res))
+		}
+	}
+	if !more {
+		p.release(op)
+		// the callback above may have removed the channel, which kills the op.
+		if rearm && !op.dead && !op.stopped {
+			p.rearm(op)
+		}
+	}
+}
+
+func (p *uringPoller) updateChannel(channel *Channel) {
+	logging.Debugf("fd = %d index = %d events = %d", channel.fd, channel.index, channel.events)
+	p.register(channel)
+	uc := p.channels[channel]
+	if uc.poll != nil && uc.poll.events == channel.events {
+		return
+	}
+	if uc.poll != nil {
+		p.cancelPoll(uc.poll)
+		uc.poll = nil
+	}
+	if channel.IsNoneEvent() {
+		channel.index = channelDel
+	} else {
+		uc.poll = p.submitPoll(channel)
+	}
+}
+
+func (p *uringPoller) removeChannel(channel *Channel) {
+	fd := channel.fd
+	idx := channel.index
+	util.Assert(p.channelMap[fd] == channel, "channelMap should have fd %d", fd)
+	util.Assert(idx == channelAdd || idx == channelDel, "channel index should be channelAdd or channelDel")
+	delete(p.channelMap, fd)
+	uc := p.channels[channel]
+	delete(p.channels, channel)
+	if uc.poll != nil {
+		p.cancelPoll(uc.poll)
+	}
+	if len(uc.io) > 0 {
+		for _, op := range uc.io {
+			op.dead = true
+		}
+		sqe := p.ring.getSqe()
+		sqe.opcode = uringOpAsyncCancel
+		sqe.fd = int32(fd)
+		sqe.opFlags = uringAsyncCancelFd | uringAsyncCancelAll
+		// submit now, the fd is usually closed right after the channel is removed
+		_ = p.ring.enter(0, 0, nil)
+	}
+	channel.index = channelNew
+}
+
+func (p *uringPoller) accept(channel *Channel, cb func(fd int, err error)) {
+	p.register(channel)
+	p.submitAccept(&uringOp{kind: uringAccept, ch: channel, onAccept: cb})
+}
+
+func (p *uringPoller) recv(channel *Channel, cb func(data []byte, err error)) {
+	p.register(channel)
+	p.submitRecv(&uringOp{kind: uringRecv, ch: channel, onRecv: cb})
+}
+
+func (p *uringPoller) stopRecv(channel *Channel) {
+	uc := p.channels[channel]
+	if uc == nil {
+		return
+	}
+	for _, op := range uc.io {
+		if op.kind == uringRecv && !op.stopped {
+			op.stopped = true
+			sqe := p.ring.getSqe()
+			sqe.opcode = uringOpAsyncCancel
+			sqe.addr = op.token
+		}
+	}
+}
+
+func (p *uringPoller) send(channel *Channel, data []byte, cb func(n int, err error)) {
+	op := p.track(&uringOp{kind: uringSend, ch: channel, data: data, onSend: cb})
+	sqe := p.ring.getSqe()
+	sqe.opcode = uringOpSend
+	sqe.fd = int32(channel.fd)
+	sqe.addr = uint64(uintptr(unsafe.Pointer(&data[0])))
+	sqe.len = uint32(len(data))
+	sqe.opFlags = unix.MSG_NOSIGNAL
+	sqe.userData = op.token
+}
+
+func (p *uringPoller) hasChannel(fd int) bool {
+	return p.channelMap[fd] != nil
+}
+
+func (p *uringPoller) close() error {
+	err := p.ring.close()
+	p.bufRing.free()
+	return err
+}
+
+// register makes the channel known to the poller, the same way epoll bookkeeping does.
+func (p *uringPoller) register(channel *Channel) {
+	fd := channel.fd
+	if channel.index == channelNew {
+		util.Assert(p.channelMap[fd] == nil, "channelMap should not have fd %d", fd)
+		p.channelMap[fd] = channel
+		p.channels[channel] = &uringChannel{}
+	} else {
+		util.Assert(p.channelMap[fd] == channel, "channelMap should have fd %d", fd)
+	}
+	channel.index = channelAdd
+}
+
+func (p *uringPoller) track(op *uringOp) *uringOp {
+	op.token = p.nextToken
+	p.nextToken++
+	p.ops[op.token] = op
+	if op.kind != uringPoll {
+		uc := p.channels[op.ch]
+		uc.io = append(uc.io, op)
+	}
+	return op
+}
+
+// release forgets an op once the kernel has posted its final completion.
+func (p *uringPoller) release(op *uringOp) {
+	delete(p.ops, op.token)
+	if op.kind == uringPoll {
+		return
+	}
+	if uc := p.channels[op.ch]; uc != nil {
+		for i, v := range uc.io {
+			if v == op {
+				uc.io = append(uc.io[:i], uc.io[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (p *uringPoller) rearm(op *uringOp) {
+	switch op.kind {
+	case uringPoll:
+		if uc := p.channels[op.ch]; uc != nil && uc.poll == op {
+			uc.poll = p.submitPoll(op.ch)
+		}
+	case uringAccept:
+		p.submitAccept(&uringOp{kind: uringAccept, ch: op.ch, onAccept: op.onAccept})
+	case uringRecv:
+		p.submitRecv(&uringOp{kind: uringRecv, ch: op.ch, onRecv: op.onRecv})
+	}
+}
+
+func (p *uringPoller) submitPoll(channel *Channel) *uringOp {
+	op := p.track(&uringOp{kind: uringPoll, ch: channel, events: channel.events})
+	logging.Debugf("io_uring poll add, %s", events2String(channel.fd, channel.events))
+	sqe := p.ring.getSqe()
+	sqe.opcode = uringOpPollAdd
+	sqe.fd = int32(channel.fd)
+	sqe.len = uringPollAddMulti
+	sqe.opFlags = channel.events
+	sqe.userData = op.token
+	return op
+}
+
+func (p *uringPoller) cancelPoll(op *uringOp) {
+	op.dead = true
+	sqe := p.ring.getSqe()
+	sqe.opcode = uringOpPollRemove
+	sqe.addr = op.token
+}
+
+func (p *uringPoller) submitAccept(op *uringOp) {
+	p.track(op)
+	sqe := p.ring.getSqe()
+	sqe.opcode = uringOpAccept
+	sqe.fd = int32(op.ch.fd)
+	sqe.opFlags = unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC
+	if p.acceptMultishot {
+		sqe.ioprio = uringAcceptMultishot
+	}
+	sqe.userData = op.token
+}
+
+func (p *uringPoller) submitRecv(op *uringOp) {
+	p.track(op)
+	sqe := p.ring.getSqe()
+	sqe.opcode = uringOpRecv
+	sqe.fd = int32(op.ch.fd)
+	sqe.flags = uringSqeBufferSelect
+	sqe.bufGroup = uringBufGroup
+	if p.recvMultishot {
+		sqe.ioprio = uringRecvMultishot
+	}
+	sqe.userData = op.token
+}
@@ -0,0 +1,131 @@
+package muduo
+
+import (
+	"golang.org/x/sys/unix"
+	"muduo/pkg/errors"
+	"strings"
+	"time"
+)
+
+// WatchEvent is a set of events on a watched fd.
+type WatchEvent uint32
+
+const (
+	Readable WatchEvent = 1 << iota
+	Writable
+	Hangup
+	Error
+)
+
+func (e WatchEvent) String() string {
+	var names []string
+	if e&Readable != 0 {
+		names = append(names, "Readable")
+	}
+	if e&Writable != 0 {
+		names = append(names, "Writable")
+	}
+	if e&Hangup != 0 {
+		names = append(names, "Hangup")
+	}
+	if e&Error != 0 {
+		names = append(names, "Error")
+	}
+	if len(names) == 0 {
+		return "None"
+	}
+	return strings.Join(names, "|")
+}
+
+// WatchHandler is called on the loop goroutine with the events that fired.
+type WatchHandler func(w *Watcher, events WatchEvent, ts time.Time)
+
+// Watcher is the handle of a user fd registered on an Eventloop.
+type Watcher struct {
+	el      *Eventloop
+	ch      *Channel
+	handler WatchHandler
+	closed  bool
+}
+
+// Watch registers a user owned fd (pipe, inotify, signalfd, netlink, tun...) on the
+// loop. events selects Readable and/or Writable, Hangup and Error are always reported.
+// It must be called on the loop goroutine, use AsyncExecute from anywhere else.
+// The fd is not closed by Unwatch. Handlers should drain the fd: with WithIoUring
+// readiness is reported on state changes rather than level triggered.
+func (el *Eventloop) Watch(fd int, events WatchEvent, handler WatchHandler) (*Watcher, error) {
+	if el.hasChannel(fd) {
+		return nil, errors.ErrFdAlreadyWatched
+	}
+	w := &Watcher{
+		el:      el,
+		ch:      NewChannel(el, fd),
+		handler: handler,
+	}
+	w.ch.setEventsCallback(w.handleEvents)
+	w.ch.events = watchEventsToPoll(events)
+	w.ch.update()
+	return w, nil
+}
+
+// Fd returns the watched fd.
+func (w *Watcher) Fd() int {
+	return w.ch.fd
+}
+
+// Modify replaces the set of events the handler is interested in.
+func (w *Watcher) Modify(events WatchEvent) error {
+	if w.closed {
+		return errors.ErrWatcherClosed
+	}
+	w.ch.events = watchEventsToPoll(events)
+	w.ch.update()
+	return nil
+}
+
+// Unwatch removes the fd from the loop, it is safe to call from the handler.
+func (w *Watcher) Unwatch() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.ch.disableAll()
+	w.el.removeChannel(w.ch)
+}
+
+func (w *Watcher) handleEvents(revents uint32, ts time.Time) {
+	if w.closed {
+		return
+	}
+	if events := pollToWatchEvents(revents); events != 0 {
+		w.handler(w, events, ts)
+	}
+}
+
+func watchEventsToPoll(events WatchEvent) uint32 {
+	var ev uint32
+	if events&Readable != 0 {
+		ev |= eventRead
+	}
+	if events&Writable != 0 {
+		ev |= eventWrite
+	}
+	return ev
+}
+
+func pollToWatchEvents(revents uint32) WatchEvent {
+	var events WatchEvent
+	if revents&(unix.POLLIN|unix.POLLPRI|unix.POLLRDHUP) != 0 {
+		events |= Readable
+	}
+	if revents&unix.POLLOUT != 0 {
+		events |= Writable
+	}
+	if revents&(unix.POLLHUP|unix.POLLRDHUP) != 0 {
+		events |= Hangup
+	}
+	if revents&(unix.POLLERR|unix.POLLNVAL) != 0 {
+		events |= Error
+	}
+	return events
+}
@@ -0,0 +1,91 @@
+package muduo
+
+import (
+	"golang.org/x/sys/unix"
+	"testing"
+	"time"
+)
+
+func testWatch(t *testing.T, opts ...EventloopOption) {
+	el := NewEventloop("", opts...)
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(p[0])
+
+	var got []WatchEvent
+	w, err := el.Watch(p[0], Readable, func(w *Watcher, events WatchEvent, ts time.Time) {
+		got = append(got, events)
+		var buf [16]byte
+		for {
+			if n, _ := unix.Read(w.Fd(), buf[:]); n <= 0 {
+				break
+			}
+		}
+		if events&Hangup != 0 {
+			w.Unwatch()
+			el.Stop()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := el.Watch(p[0], Readable, nil); err == nil {
+		t.Error("watching the same fd twice should fail")
+	}
+	el.ScheduleDelay(func() {
+		_, _ = unix.Write(p[1], []byte("hello"))
+	}, 10*time.Millisecond)
+	el.ScheduleDelay(func() {
+		_ = unix.Close(p[1])
+	}, 50*time.Millisecond)
+	el.ScheduleDelay(func() {
+		t.Error("hangup was not reported")
+		el.Stop()
+	}, 5*time.Second)
+	el.Loop()
+
+	if len(got) < 2 || got[0] != Readable || got[len(got)-1]&Hangup == 0 {
+		t.Errorf("unexpected events %v", got)
+	}
+	if err := w.Modify(Readable); err == nil {
+		t.Error("modify after unwatch should fail")
+	}
+}
+
+func TestEventloop_Watch(t *testing.T) {
+	testWatch(t)
+}
+
+func TestEventloop_WatchIoUring(t *testing.T) {
+	testWatch(t, WithIoUring())
+}
+
+func TestWatcher_Modify(t *testing.T) {
+	el := NewEventloop("")
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	var writable bool
+	w, err := el.Watch(p[1], 0, func(w *Watcher, events WatchEvent, ts time.Time) {
+		writable = events&Writable != 0
+		w.Unwatch()
+		el.Stop()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	el.ScheduleDelay(func() {
+		_ = w.Modify(Writable)
+	}, 10*time.Millisecond)
+	el.ScheduleDelay(el.Stop, 5*time.Second)
+	el.Loop()
+	if !writable {
+		t.Error("write end of an empty pipe should be writable")
+	}
+}
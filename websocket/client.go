@@ -0,0 +1,200 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"muduo"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client opens a WebSocket connection on a TcpClient. It runs on the
+// Eventloop passed to NewClient and does not reconnect.
+type Client struct {
+	el   *muduo.Eventloop
+	tcp  *muduo.TcpClient
+	url  *url.URL
+	opts *options
+	cb   callbacks
+
+	// Header is sent with the opening handshake, set it before Connect.
+	Header nethttp.Header
+
+	mu     sync.Mutex
+	conn   *Conn
+	closed bool
+}
+
+// NewClient creates a client for a ws:// URL.
+func NewClient(el *muduo.Eventloop, rawurl string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	tcp, err := muduo.NewTcpClient(el, "tcp://"+host)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		el:     el,
+		tcp:    tcp,
+		url:    u,
+		opts:   newOptions(opts),
+		Header: make(nethttp.Header),
+	}
+	tcp.SetOnConn(c.onConn)
+	tcp.SetOnMsg(c.onMsg)
+	return c, nil
+}
+
+// SetOnOpen is called once the opening handshake is done.
+func (c *Client) SetOnOpen(cb func(c *Conn)) {
+	c.cb.onOpen = cb
+}
+
+// SetOnMessage is called with every complete message.
+func (c *Client) SetOnMessage(cb func(c *Conn, op Opcode, payload []byte)) {
+	c.cb.onMessage = cb
+}
+
+// SetOnClose is called when the open connection is gone, or when the opening
+// handshake fails, with CloseAbnormal.
+func (c *Client) SetOnClose(cb func(c *Conn, err *CloseError)) {
+	c.cb.onClose = cb
+}
+
+func (c *Client) Connect() {
+	c.tcp.Connect()
+}
+
+// Conn returns the connection, nil until the TCP connection is up.
+func (c *Client) Conn() *Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Close stops connecting and starts the closing handshake of an open connection.
+func (c *Client) Close() {
+	c.mu.Lock()
+	conn, closed := c.conn, c.closed
+	c.closed = true
+	c.mu.Unlock()
+	if closed {
+		return
+	}
+	c.tcp.Stop()
+	if conn != nil {
+		conn.Close(CloseNormal, "")
+	}
+}
+
+func (c *Client) onConn(tcp *muduo.TcpConn) {
+	if !tcp.IsConnected() {
+		conn := tcp.GetContext().(*Conn)
+		if !conn.open && conn.cb.onClose != nil {
+			conn.cb.onClose(conn, &CloseError{Code: CloseAbnormal, Reason: "handshake failed"})
+		}
+		conn.disconnected()
+		return
+	}
+	conn := newConn(tcp, c.opts, &c.cb, true)
+	tcp.SetContext(conn)
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	var nonce [16]byte
+	_, _ = rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	conn.key = key
+	var b strings.Builder
+	b.WriteString("GET " + c.url.RequestURI() + " HTTP/1.1\r\nHost: " + c.url.Host + "\r\n")
+	b.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n")
+	b.WriteString("Sec-WebSocket-Key: " + key + "\r\n")
+	if len(c.opts.subprotocols) > 0 {
+		b.WriteString("Sec-WebSocket-Protocol: " + strings.Join(c.opts.subprotocols, ", ") + "\r\n")
+	}
+	if c.opts.compression {
+		b.WriteString("Sec-WebSocket-Extensions: " + clientDeflateOffer + "\r\n")
+	}
+	for k, vs := range c.Header {
+		for _, v := range vs {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	conn.write([]byte(b.String()))
+	conn.timer = conn.el.ScheduleDelay(func() {
+		conn.timer = nil
+		logging.Debugf("websocket: handshake with %s timed out", c.url.Host)
+		tcp.ForceClose()
+	}, c.opts.handshakeTimeout)
+}
+
+func (c *Client) onMsg(tcp *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+	conn := tcp.GetContext().(*Conn)
+	if !conn.open {
+		i := buf.Search(headEnd)
+		if i < 0 {
+			if buf.ReadableBytes() > c.opts.maxHandshake {
+				tcp.ForceClose()
+			}
+			return
+		}
+		head := buf.Next(i + len(headEnd))
+		if err := c.checkResponse(conn, head); err != nil {
+			logging.Warnf("websocket: handshake with %s failed: %v", c.url.Host, err)
+			tcp.ForceClose()
+			return
+		}
+		conn.opened()
+	}
+	conn.handleData(buf)
+}
+
+func (c *Client) checkResponse(conn *Conn, head []byte) error {
+	resp, err := nethttp.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != nethttp.StatusSwitchingProtocols {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	if !hasToken(resp.Header["Upgrade"], "websocket") || !hasToken(resp.Header["Connection"], "upgrade") ||
+		resp.Header.Get("Sec-Websocket-Accept") != acceptKey(conn.key) {
+		return errors.ErrBadHandshake
+	}
+	if p := resp.Header.Get("Sec-Websocket-Protocol"); p != "" {
+		if !hasToken([]string{strings.Join(c.opts.subprotocols, ",")}, p) {
+			return errors.ErrBadHandshake
+		}
+		conn.protocol = p
+	}
+	answers := resp.Header["Sec-Websocket-Extensions"]
+	if len(answers) > 0 && !c.opts.compression {
+		return errors.ErrBadHandshake
+	}
+	in, ok := checkDeflate(answers)
+	if !ok {
+		return errors.ErrBadHandshake
+	}
+	conn.inflater = in
+	return nil
+}
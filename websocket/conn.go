@@ -0,0 +1,328 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"muduo"
+	"muduo/pkg/errors"
+	"muduo/pkg/logging"
+	nethttp "net/http"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// callbacks are shared by the connections of a Server or a Client, they run
+// on the connection's loop.
+type callbacks struct {
+	onOpen    func(c *Conn)
+	onMessage func(c *Conn, op Opcode, payload []byte)
+	onClose   func(c *Conn, err *CloseError)
+}
+
+// Conn is an open WebSocket connection. Its methods may be called from any
+// goroutine.
+type Conn struct {
+	tcp      *muduo.TcpConn
+	el       *muduo.Eventloop
+	opts     *options
+	cb       *callbacks
+	client   bool // masks its frames
+	request  *nethttp.Request
+	key      string // Sec-WebSocket-Key sent by a client
+	protocol string
+	inflater *inflater // set when permessage-deflate is negotiated
+	closing  int32     // a close frame is queued, atomic
+	ctx      atomic.Value
+
+	// owned by the loop
+	open       bool
+	msgOp      Opcode // of the message being assembled, 0 when there is none
+	msgDeflate bool
+	msg        []byte
+	closeSent  bool
+	closeErr   *CloseError // why the connection is closing
+	gone       bool        // the TCP connection is closed
+	heard      bool        // a frame arrived since the last keepalive tick
+	pinged     bool
+	keepalive  *muduo.TimerTask
+	timer      *muduo.TimerTask // handshake or close timeout
+}
+
+func newConn(tcp *muduo.TcpConn, opts *options, cb *callbacks, client bool) *Conn {
+	return &Conn{
+		tcp:    tcp,
+		el:     tcp.Eventloop(),
+		opts:   opts,
+		cb:     cb,
+		client: client,
+	}
+}
+
+// TcpConn returns the underlying connection.
+func (c *Conn) TcpConn() *muduo.TcpConn {
+	return c.tcp
+}
+
+// Request returns the opening handshake request, on the server side.
+func (c *Conn) Request() *nethttp.Request {
+	return c.request
+}
+
+// Subprotocol returns the negotiated subprotocol, "" when there is none.
+func (c *Conn) Subprotocol() string {
+	return c.protocol
+}
+
+// Compressed reports whether permessage-deflate is in use.
+func (c *Conn) Compressed() bool {
+	return c.inflater != nil
+}
+
+func (c *Conn) SetContext(ctx interface{}) {
+	c.ctx.Store(&ctx)
+}
+
+func (c *Conn) GetContext() interface{} {
+	if p, ok := c.ctx.Load().(*interface{}); ok {
+		return *p
+	}
+	return nil
+}
+
+// WriteMessage sends payload as one text or binary message.
+func (c *Conn) WriteMessage(op Opcode, payload []byte) error {
+	if op != OpText && op != OpBinary {
+		return errors.ErrUnsupportedOpcode
+	}
+	if atomic.LoadInt32(&c.closing) != 0 {
+		return errors.ErrConnClosing
+	}
+	compressed := c.inflater != nil
+	if compressed {
+		payload = compress(payload)
+	}
+	frame := appendFrame(nil, true, compressed, op, payload, c.client)
+	c.el.AsyncExecute(func() {
+		if !c.closeSent && !c.gone {
+			c.write(frame)
+		}
+	})
+	return nil
+}
+
+// Ping sends a ping, the pong is handled by the package.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return errors.ErrFrameTooLarge
+	}
+	frame := appendFrame(nil, true, false, OpPing, data, c.client)
+	c.el.AsyncExecute(func() {
+		if !c.closeSent && !c.gone {
+			c.write(frame)
+		}
+	})
+	return nil
+}
+
+// Close starts the closing handshake, the connection is closed once the peer
+// answers or the close timeout passes.
+func (c *Conn) Close(code int, reason string) {
+	atomic.StoreInt32(&c.closing, 1)
+	c.el.AsyncExecute(func() {
+		c.sendClose(&CloseError{Code: code, Reason: reason})
+	})
+}
+
+func (c *Conn) write(b []byte) {
+	if _, err := c.tcp.Write(b); err != nil {
+		logging.Debugf("websocket: write to %s: %v", c.tcp.Name(), err)
+	}
+}
+
+func (c *Conn) writeControl(op Opcode, payload []byte) {
+	c.write(appendFrame(nil, true, false, op, payload, c.client))
+}
+
+// opened finishes the opening handshake and starts the keepalive.
+func (c *Conn) opened() {
+	c.open = true
+	c.stopTimer()
+	if d := c.opts.pingInterval; d > 0 {
+		c.keepalive = c.el.ScheduleAtFixRate(c.tick, d)
+	}
+	if c.cb.onOpen != nil {
+		c.cb.onOpen(c)
+	}
+}
+
+// tick pings a quiet peer, and drops it when the previous ping went unanswered.
+func (c *Conn) tick() {
+	switch {
+	case c.heard:
+		c.pinged = false
+	case c.pinged:
+		logging.Debugf("websocket: %s does not answer pings", c.tcp.Name())
+		c.closeErr = &CloseError{Code: CloseAbnormal, Reason: "keepalive timed out"}
+		c.tcp.ForceClose()
+	case !c.closeSent:
+		c.writeControl(OpPing, nil)
+		c.pinged = true
+	}
+	c.heard = false
+}
+
+// handleData reads the frames in buf.
+func (c *Conn) handleData(buf *muduo.Buffer) {
+	for !c.gone && c.closeErr == nil {
+		f, err := readFrame(buf, !c.client, c.opts.maxMessage)
+		if err != nil {
+			c.fail(err.(*CloseError))
+			return
+		}
+		if f == nil {
+			return
+		}
+		c.heard = true
+		switch f.opcode {
+		case OpPing:
+			if !c.closeSent {
+				c.writeControl(OpPong, f.payload)
+			}
+		case OpPong:
+		case OpClose:
+			c.handleClose(f.payload)
+		case OpText, OpBinary:
+			if c.msgOp != 0 {
+				c.fail(protocolError("message inside a fragmented message"))
+				return
+			}
+			if f.rsv1 && c.inflater == nil {
+				c.fail(protocolError("compressed frame without permessage-deflate"))
+				return
+			}
+			c.msgOp, c.msgDeflate = f.opcode, f.rsv1
+			c.msg = append(c.msg[:0], f.payload...)
+		case OpContinuation:
+			if c.msgOp == 0 || f.rsv1 {
+				c.fail(protocolError("unexpected continuation frame"))
+				return
+			}
+			if len(c.msg)+len(f.payload) > c.opts.maxMessage {
+				c.fail(&CloseError{Code: CloseMessageTooBig, Reason: "message is too big"})
+				return
+			}
+			c.msg = append(c.msg, f.payload...)
+		}
+		if f.fin && !f.opcode.isControl() {
+			if err := c.deliver(); err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) deliver() *CloseError {
+	op, payload := c.msgOp, c.msg
+	c.msgOp, c.msg = 0, nil
+	if c.msgDeflate {
+		var err *CloseError
+		if payload, err = c.inflater.inflate(payload, c.opts.maxMessage); err != nil {
+			return err
+		}
+	}
+	if op == OpText && !utf8.Valid(payload) {
+		return &CloseError{Code: CloseInvalidPayload, Reason: "text is not UTF-8"}
+	}
+	if c.cb.onMessage != nil {
+		c.cb.onMessage(c, op, payload)
+	}
+	return nil
+}
+
+func (c *Conn) handleClose(payload []byte) {
+	received := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		c.fail(protocolError("bad close frame"))
+		return
+	case len(payload) >= 2:
+		received.Code = int(binary.BigEndian.Uint16(payload))
+		received.Reason = string(payload[2:])
+		if !validCloseCode(received.Code) {
+			c.fail(protocolError("bad close code"))
+			return
+		}
+		if !utf8.ValidString(received.Reason) {
+			c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "close reason is not UTF-8"})
+			return
+		}
+	}
+	answered := c.closeSent
+	c.sendClose(received)
+	c.closeErr = received
+	if !c.client || answered {
+		// the server closes the TCP connection first, RFC 6455 section 7.1.1
+		c.tcp.ShutdownWrite()
+	}
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 3000 && code <= 4999:
+		return true
+	case code == 1004 || code == CloseNoStatus || code == CloseAbnormal:
+		return false
+	}
+	return code >= 1000 && code <= 1011
+}
+
+// sendClose queues a close frame once and bounds the wait for the peer's.
+func (c *Conn) sendClose(err *CloseError) {
+	atomic.StoreInt32(&c.closing, 1)
+	if c.closeSent || c.gone {
+		return
+	}
+	c.closeSent = true
+	c.writeControl(OpClose, closePayload(err.Code, err.Reason))
+	c.stopTimer()
+	c.timer = c.el.ScheduleDelay(func() {
+		c.timer = nil
+		c.tcp.ForceClose()
+	}, c.opts.closeTimeout)
+}
+
+// fail answers a protocol violation with a close frame and closes.
+func (c *Conn) fail(err *CloseError) {
+	logging.Debugf("websocket: %s failed: %v", c.tcp.Name(), err)
+	c.sendClose(err)
+	c.closeErr = err
+	c.tcp.ShutdownWrite()
+}
+
+// disconnected reports the end of an open connection.
+func (c *Conn) disconnected() {
+	c.gone = true
+	atomic.StoreInt32(&c.closing, 1)
+	c.stopTimer()
+	if c.keepalive != nil {
+		c.keepalive.Cancel()
+		c.keepalive = nil
+	}
+	if !c.open {
+		return
+	}
+	err := c.closeErr
+	if err == nil {
+		err = &CloseError{Code: CloseAbnormal, Reason: "connection dropped"}
+	}
+	if c.cb.onClose != nil {
+		c.cb.onClose(c, err)
+	}
+}
+
+func (c *Conn) stopTimer() {
+	if c.timer != nil {
+		c.timer.Cancel()
+		c.timer = nil
+	}
+}
@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// deflateTail ends every compressed message, it is stripped on the wire. The
+// final empty block after it lets the reader see the end of the stream.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+const deflateWindow = 32 << 10
+
+var writerPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// compress deflates payload on its own, outgoing messages never take over the
+// context of earlier ones.
+func compress(payload []byte) []byte {
+	var buf bytes.Buffer
+	w := writerPool.Get().(*flate.Writer)
+	w.Reset(&buf)
+	_, _ = w.Write(payload)
+	_ = w.Flush()
+	writerPool.Put(w)
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail[:4])
+}
+
+// inflater decompresses incoming messages. With context takeover the peer may
+// refer back to earlier messages, so the last window of output is kept.
+type inflater struct {
+	takeover bool
+	window   []byte
+}
+
+func (in *inflater) inflate(data []byte, max int) ([]byte, *CloseError) {
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail))
+	r := flate.NewReaderDict(src, in.window)
+	var out bytes.Buffer
+	n, err := out.ReadFrom(io.LimitReader(r, int64(max)+1))
+	_ = r.Close()
+	if err != nil {
+		return nil, &CloseError{Code: CloseInvalidPayload, Reason: "bad compressed data"}
+	}
+	if n > int64(max) {
+		return nil, &CloseError{Code: CloseMessageTooBig, Reason: "message is too big"}
+	}
+	if in.takeover {
+		in.window = append(in.window, out.Bytes()...)
+		if len(in.window) > deflateWindow {
+			in.window = append([]byte(nil), in.window[len(in.window)-deflateWindow:]...)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// extension is one offer or answer of a Sec-WebSocket-Extensions header.
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+func parseExtensions(values []string) []extension {
+	var exts []extension
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			parts := strings.Split(item, ";")
+			ext := extension{name: strings.TrimSpace(parts[0]), params: make(map[string]string)}
+			if ext.name == "" {
+				continue
+			}
+			for _, p := range parts[1:] {
+				k, val := p, ""
+				if i := strings.IndexByte(p, '='); i >= 0 {
+					k, val = p[:i], strings.Trim(strings.TrimSpace(p[i+1:]), `"`)
+				}
+				ext.params[strings.TrimSpace(k)] = val
+			}
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// acceptDeflate picks the first permessage-deflate offer the server can honour.
+// The server never takes over its context, so it always answers with
+// server_no_context_takeover.
+func acceptDeflate(offers []string) (answer string, in *inflater, ok bool) {
+	for _, ext := range parseExtensions(offers) {
+		if ext.name != "permessage-deflate" {
+			continue
+		}
+		if bits, set := ext.params["server_max_window_bits"]; set && bits != "15" {
+			// Go's flate always uses a 32KiB window
+			continue
+		}
+		answer = "permessage-deflate; server_no_context_takeover"
+		in = &inflater{takeover: true}
+		if _, set := ext.params["client_no_context_takeover"]; set {
+			answer += "; client_no_context_takeover"
+			in.takeover = false
+		}
+		return answer, in, true
+	}
+	return "", nil, false
+}
+
+// clientDeflateOffer is what a client asks for.
+const clientDeflateOffer = "permessage-deflate; client_no_context_takeover"
+
+// checkDeflate validates the server's answer to clientDeflateOffer.
+func checkDeflate(answers []string) (in *inflater, ok bool) {
+	exts := parseExtensions(answers)
+	if len(exts) == 0 {
+		return nil, true
+	}
+	if len(exts) != 1 || exts[0].name != "permessage-deflate" {
+		return nil, false
+	}
+	params := exts[0].params
+	if bits, set := params["client_max_window_bits"]; set {
+		if n, err := strconv.Atoi(bits); err != nil || n != 15 {
+			return nil, false
+		}
+	}
+	_, noTakeover := params["server_no_context_takeover"]
+	return &inflater{takeover: !noTakeover}, true
+}
@@ -0,0 +1,145 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"muduo"
+)
+
+// CloseError is why a connection was closed: the code and reason of the close
+// frame, or the code a protocol violation is answered with.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+func protocolError(reason string) *CloseError {
+	return &CloseError{Code: CloseProtocolError, Reason: reason}
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool // set on the first frame of a compressed message
+	opcode  Opcode
+	payload []byte // unmasked, aliases the input buffer
+}
+
+// readFrame removes the next frame from buf, or returns nil when it is incomplete.
+// Frames from clients must be masked and frames from servers must not.
+func readFrame(buf *muduo.Buffer, fromClient bool, maxPayload int) (*frame, error) {
+	data := buf.Peek()
+	if len(data) < 2 {
+		return nil, nil
+	}
+	f := &frame{
+		fin:    data[0]&0x80 != 0,
+		rsv1:   data[0]&0x40 != 0,
+		opcode: Opcode(data[0] & 0x0f),
+	}
+	if data[0]&0x30 != 0 {
+		return nil, protocolError("reserved bits are set")
+	}
+	masked := data[1]&0x80 != 0
+	if masked != fromClient {
+		if fromClient {
+			return nil, protocolError("client frame is not masked")
+		}
+		return nil, protocolError("server frame is masked")
+	}
+	n := uint64(data[1] & 0x7f)
+	header := 2
+	switch n {
+	case 126:
+		if len(data) < 4 {
+			return nil, nil
+		}
+		n = uint64(binary.BigEndian.Uint16(data[2:]))
+		header = 4
+	case 127:
+		if len(data) < 10 {
+			return nil, nil
+		}
+		n = binary.BigEndian.Uint64(data[2:])
+		header = 10
+	}
+	if f.opcode.isControl() {
+		if !f.fin || n > 125 {
+			return nil, protocolError("bad control frame")
+		}
+	} else if f.opcode > OpBinary {
+		return nil, protocolError("reserved opcode")
+	}
+	if n > uint64(maxPayload) {
+		return nil, &CloseError{Code: CloseMessageTooBig, Reason: "message is too big"}
+	}
+	var key []byte
+	if masked {
+		key = data[header : header+4]
+		header += 4
+	}
+	if len(data) < header+int(n) {
+		return nil, nil
+	}
+	buf.Advance(header)
+	f.payload = buf.Next(int(n))
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+func maskBytes(key []byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+// appendFrame appends a frame carrying payload to b, masked when mask is set.
+func appendFrame(b []byte, fin, rsv1 bool, op Opcode, payload []byte, mask bool) []byte {
+	first := byte(op)
+	if fin {
+		first |= 0x80
+	}
+	if rsv1 {
+		first |= 0x40
+	}
+	second := byte(0)
+	if mask {
+		second = 0x80
+	}
+	n := len(payload)
+	switch {
+	case n < 126:
+		b = append(b, first, second|byte(n))
+	case n <= 0xffff:
+		b = append(b, first, second|126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		b = append(append(b, first, second|127), ext[:]...)
+	}
+	if !mask {
+		return append(b, payload...)
+	}
+	var key [4]byte
+	_, _ = rand.Read(key[:])
+	b = append(b, key[:]...)
+	start := len(b)
+	b = append(b, payload...)
+	maskBytes(key[:], b[start:])
+	return b
+}
+
+func closePayload(code int, reason string) []byte {
+	if code == CloseNoStatus {
+		return nil
+	}
+	b := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return append(b, reason...)
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"bytes"
+	"muduo"
+	"strings"
+	"testing"
+)
+
+func TestFrame_RoundTrip(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		for _, mask := range []bool{false, true} {
+			payload := bytes.Repeat([]byte{'x'}, n)
+			buf := muduo.NewBuffer()
+			wire := appendFrame(nil, true, false, OpBinary, payload, mask)
+			// a partial frame is left in the buffer
+			_, _ = buf.Write(wire[:len(wire)-1])
+			if f, err := readFrame(buf, mask, 1<<20); f != nil || err != nil {
+				t.Fatalf("len %d: partial frame read as %v, %v", n, f, err)
+			}
+			_, _ = buf.Write(wire[len(wire)-1:])
+			f, err := readFrame(buf, mask, 1<<20)
+			if err != nil || f == nil {
+				t.Fatalf("len %d: %v", n, err)
+			}
+			if !f.fin || f.opcode != OpBinary || !bytes.Equal(f.payload, payload) {
+				t.Fatalf("len %d mask %v: got fin %v opcode %v len %d", n, mask, f.fin, f.opcode, len(f.payload))
+			}
+			if buf.ReadableBytes() != 0 {
+				t.Fatalf("len %d: %d bytes left", n, buf.ReadableBytes())
+			}
+		}
+	}
+}
+
+func TestFrame_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		wire       []byte
+		fromClient bool
+		code       int
+	}{
+		{"unmasked client frame", appendFrame(nil, true, false, OpText, []byte("hi"), false), true, CloseProtocolError},
+		{"masked server frame", appendFrame(nil, true, false, OpText, []byte("hi"), true), false, CloseProtocolError},
+		{"reserved bits", []byte{0x80 | 0x20 | byte(OpText), 0}, false, CloseProtocolError},
+		{"reserved opcode", []byte{0x83, 0}, false, CloseProtocolError},
+		{"fragmented control", appendFrame(nil, false, false, OpPing, nil, false), false, CloseProtocolError},
+		{"long control", appendFrame(nil, true, false, OpPing, make([]byte, 126), false), false, CloseProtocolError},
+		{"too big", appendFrame(nil, true, false, OpBinary, make([]byte, 200), false), false, CloseMessageTooBig},
+	}
+	for _, tt := range tests {
+		buf := muduo.NewBuffer()
+		_, _ = buf.Write(tt.wire)
+		_, err := readFrame(buf, tt.fromClient, 128)
+		if ce, ok := err.(*CloseError); !ok || ce.Code != tt.code {
+			t.Errorf("%s: got %v, want code %d", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestDeflate(t *testing.T) {
+	in := &inflater{takeover: true}
+	for _, msg := range []string{"", "hello", strings.Repeat("websocket ", 1000)} {
+		compressed := compress([]byte(msg))
+		out, err := in.inflate(compressed, 1<<20)
+		if err != nil {
+			t.Fatalf("%q: %v", msg, err)
+		}
+		if string(out) != msg {
+			t.Fatalf("got %q, want %q", out, msg)
+		}
+	}
+	big := compress(bytes.Repeat([]byte{'a'}, 1000))
+	if _, err := in.inflate(big, 100); err == nil || err.Code != CloseMessageTooBig {
+		t.Fatalf("inflating past the limit: %v", err)
+	}
+	if _, err := in.inflate([]byte{0xff, 0xff, 0xff}, 100); err == nil || err.Code != CloseInvalidPayload {
+		t.Fatalf("inflating garbage: %v", err)
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	answer, in, ok := acceptDeflate([]string{"x-foo, permessage-deflate; server_max_window_bits=10",
+		clientDeflateOffer})
+	if !ok || answer != "permessage-deflate; server_no_context_takeover; client_no_context_takeover" || in.takeover {
+		t.Fatalf("got %q %+v %v", answer, in, ok)
+	}
+	in, ok = checkDeflate([]string{answer})
+	if !ok || in == nil || in.takeover {
+		t.Fatalf("client: got %+v %v", in, ok)
+	}
+	if _, ok := checkDeflate([]string{"permessage-deflate; client_max_window_bits=9"}); ok {
+		t.Fatal("accepted a window the client did not offer")
+	}
+	if _, _, ok := acceptDeflate([]string{"x-foo"}); ok {
+		t.Fatal("accepted an unknown extension")
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example of RFC 6455 section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got %s", got)
+	}
+}
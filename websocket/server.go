@@ -0,0 +1,177 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"muduo"
+	"muduo/pkg/logging"
+	nethttp "net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var headEnd = []byte("\r\n\r\n")
+
+// Server accepts WebSocket connections. Connections whose opening handshake
+// fails are answered with an HTTP error and closed.
+type Server struct {
+	svr         *muduo.TcpServer
+	opts        *options
+	cb          callbacks
+	checkOrigin func(r *nethttp.Request) bool
+}
+
+func NewServer(el *muduo.Eventloop, name string, addr string, engineCnt int, opts ...Option) *Server {
+	s := &Server{
+		svr:  muduo.NewTcpServer(el, name, addr, engineCnt),
+		opts: newOptions(opts),
+	}
+	s.svr.SetOnConn(s.onConn)
+	s.svr.SetOnMsg(s.onMsg)
+	return s
+}
+
+// SetOnOpen is called once the opening handshake is done.
+func (s *Server) SetOnOpen(cb func(c *Conn)) {
+	s.cb.onOpen = cb
+}
+
+// SetOnMessage is called with every complete message, payload is decompressed
+// and may be kept.
+func (s *Server) SetOnMessage(cb func(c *Conn, op Opcode, payload []byte)) {
+	s.cb.onMessage = cb
+}
+
+// SetOnClose is called when an open connection is gone, err tells why:
+// CloseAbnormal when it dropped without a closing handshake.
+func (s *Server) SetOnClose(cb func(c *Conn, err *CloseError)) {
+	s.cb.onClose = cb
+}
+
+// SetCheckOrigin decides which handshake requests are accepted, all are by default.
+func (s *Server) SetCheckOrigin(cb func(r *nethttp.Request) bool) {
+	s.checkOrigin = cb
+}
+
+func (s *Server) Start() {
+	s.svr.Start()
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.svr.Addr()
+}
+
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.svr.Shutdown(timeout)
+}
+
+func (s *Server) onConn(tcp *muduo.TcpConn) {
+	if tcp.IsConnected() {
+		c := newConn(tcp, s.opts, &s.cb, false)
+		tcp.SetContext(c)
+		c.timer = c.el.ScheduleDelay(func() {
+			c.timer = nil
+			logging.Debugf("websocket: handshake of %s timed out", tcp.Name())
+			tcp.ForceClose()
+		}, s.opts.handshakeTimeout)
+		return
+	}
+	tcp.GetContext().(*Conn).disconnected()
+}
+
+func (s *Server) onMsg(tcp *muduo.TcpConn, buf *muduo.Buffer, _ time.Time) {
+	c := tcp.GetContext().(*Conn)
+	if !c.open {
+		if !s.handshake(c, buf) {
+			return
+		}
+	}
+	c.handleData(buf)
+}
+
+// handshake answers the opening handshake once its head is in buf, and reports
+// whether the connection is open.
+func (s *Server) handshake(c *Conn, buf *muduo.Buffer) bool {
+	if c.closeSent {
+		// rejected, waiting for the peer to close
+		buf.Next(-1)
+		return false
+	}
+	i := buf.Search(headEnd)
+	if i < 0 {
+		if buf.ReadableBytes() > s.opts.maxHandshake {
+			s.reject(c, nethttp.StatusRequestHeaderFieldsTooLarge, "")
+		}
+		return false
+	}
+	head := buf.Next(i + len(headEnd))
+	req, err := nethttp.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		s.reject(c, nethttp.StatusBadRequest, "")
+		return false
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		s.reject(c, nethttp.StatusUpgradeRequired, "Sec-WebSocket-Version: 13\r\n")
+		return false
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 ||
+		req.Method != "GET" || !hasToken(req.Header["Upgrade"], "websocket") ||
+		!hasToken(req.Header["Connection"], "upgrade") {
+		s.reject(c, nethttp.StatusBadRequest, "")
+		return false
+	}
+	if s.checkOrigin != nil && !s.checkOrigin(req) {
+		s.reject(c, nethttp.StatusForbidden, "")
+		return false
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if c.protocol = selectProtocol(s.opts.subprotocols, req.Header["Sec-Websocket-Protocol"]); c.protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + c.protocol + "\r\n"
+	}
+	if s.opts.compression {
+		if answer, in, ok := acceptDeflate(req.Header["Sec-Websocket-Extensions"]); ok {
+			c.inflater = in
+			resp += "Sec-WebSocket-Extensions: " + answer + "\r\n"
+		}
+	}
+	c.request = req
+	c.write([]byte(resp + "\r\n"))
+	c.opened()
+	return true
+}
+
+func (s *Server) reject(c *Conn, status int, header string) {
+	logging.Debugf("websocket: reject handshake of %s with %d", c.tcp.Name(), status)
+	c.closeSent = true
+	c.write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + nethttp.StatusText(status) + "\r\n" +
+		header + "Connection: close\r\nContent-Length: 0\r\n\r\n"))
+	c.tcp.ShutdownWrite()
+}
+
+// hasToken reports whether a comma separated header holds token.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectProtocol picks the server's most preferred subprotocol the client offers.
+func selectProtocol(supported []string, offered []string) string {
+	for _, p := range supported {
+		if hasToken(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+// Package websocket implements RFC 6455 on top of muduo.TcpServer and
+// muduo.TcpClient. The opening handshake is read from the connection's input
+// buffer, after it the connection carries frames. Control frames are answered
+// by the package, idle connections are pinged from an Eventloop timer, and
+// messages can be compressed with permessage-deflate (RFC 7692).
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"time"
+)
+
+// Opcode tells what a frame carries.
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+func (op Opcode) String() string {
+	switch op {
+	case OpContinuation:
+		return "continuation"
+	case OpText:
+		return "text"
+	case OpBinary:
+		return "binary"
+	case OpClose:
+		return "close"
+	case OpPing:
+		return "ping"
+	case OpPong:
+		return "pong"
+	}
+	return "reserved"
+}
+
+func (op Opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+// Close codes of RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // never sent, reported when the close frame has no code
+	CloseAbnormal        = 1006 // never sent, reported when the connection dropped without a close frame
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// acceptKey computes Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+type options struct {
+	pingInterval     time.Duration
+	closeTimeout     time.Duration
+	maxMessage       int
+	maxHandshake     int
+	compression      bool
+	subprotocols     []string
+	handshakeTimeout time.Duration
+}
+
+// Option configures a Server or a Client.
+type Option func(o *options)
+
+// WithPingInterval pings the peer every d when it sent nothing since the last
+// tick, and closes the connection when a ping stays unanswered for another d.
+// The default is 30s, 0 disables keepalive.
+func WithPingInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.pingInterval = d
+	}
+}
+
+// WithCloseTimeout bounds the wait for the peer's close frame after sending
+// one, 5s by default.
+func WithCloseTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.closeTimeout = d
+	}
+}
+
+// WithMaxMessage closes connections that send longer messages with
+// CloseMessageTooBig, 16MiB by default.
+func WithMaxMessage(n int) Option {
+	return func(o *options) {
+		o.maxMessage = n
+	}
+}
+
+// WithCompression negotiates permessage-deflate.
+func WithCompression() Option {
+	return func(o *options) {
+		o.compression = true
+	}
+}
+
+// WithSubprotocols lists the subprotocols a server accepts, in order of
+// preference, or the ones a client offers.
+func WithSubprotocols(protocols ...string) Option {
+	return func(o *options) {
+		o.subprotocols = protocols
+	}
+}
+
+// WithHandshakeTimeout closes connections that do not finish the opening
+// handshake in time, 10s by default.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.handshakeTimeout = d
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		pingInterval:     30 * time.Second,
+		closeTimeout:     5 * time.Second,
+		maxMessage:       16 << 20,
+		maxHandshake:     8 << 10,
+		handshakeTimeout: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,347 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"muduo"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type closed struct {
+	conn *Conn
+	err  *CloseError
+}
+
+// startServer runs an echo server that rejects http://evil.example, closes reports the connections it sees end.
+func startServer(t *testing.T, opts ...Option) (s *Server, closes chan closed, stop func()) {
+	el := muduo.NewEventloop("websocket")
+	s = NewServer(el, "websocket", "tcp4://127.0.0.1:0", 1, opts...)
+	closes = make(chan closed, 8)
+	s.SetOnMessage(func(c *Conn, op Opcode, payload []byte) {
+		if string(payload) == "bye" {
+			c.Close(CloseGoingAway, "bye")
+			return
+		}
+		_ = c.WriteMessage(op, payload)
+	})
+	s.SetOnClose(func(c *Conn, err *CloseError) {
+		closes <- closed{c, err}
+	})
+	s.SetCheckOrigin(func(r *nethttp.Request) bool {
+		return r.Header.Get("Origin") != "http://evil.example"
+	})
+	s.Start()
+	listening := make(chan struct{})
+	el.AsyncExecute(func() { close(listening) })
+	stopped := make(chan struct{})
+	go func() {
+		el.Loop()
+		close(stopped)
+	}()
+	<-listening
+	return s, closes, func() {
+		s.Shutdown(100 * time.Millisecond)
+		<-stopped
+	}
+}
+
+type message struct {
+	op      Opcode
+	payload string
+}
+
+// dial opens a client, messages receives what the server sends.
+func dial(t *testing.T, s *Server, opts ...Option) (c *Client, messages chan message, closes chan closed, stop func()) {
+	el := muduo.NewEventloopEngine("websocket-client").StartLoop()
+	c, err := NewClient(el, "ws://"+s.Addr()+"/echo", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages = make(chan message, 8)
+	closes = make(chan closed, 1)
+	opened := make(chan struct{})
+	c.SetOnOpen(func(*Conn) { close(opened) })
+	c.SetOnMessage(func(_ *Conn, op Opcode, payload []byte) {
+		messages <- message{op, string(payload)}
+	})
+	c.SetOnClose(func(conn *Conn, err *CloseError) {
+		closes <- closed{conn, err}
+	})
+	c.Connect()
+	select {
+	case <-opened:
+	case err := <-closes:
+		t.Fatalf("handshake: %v", err.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake timed out")
+	}
+	return c, messages, closes, func() {
+		c.Close()
+		el.AsyncExecute(el.Stop)
+	}
+}
+
+func receive(t *testing.T, messages chan message) message {
+	t.Helper()
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+	}
+	return message{}
+}
+
+func waitClose(t *testing.T, closes chan closed) closed {
+	t.Helper()
+	select {
+	case c := <-closes:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection did not close")
+	}
+	return closed{}
+}
+
+func TestEcho(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		opts := []Option{WithSubprotocols("chat", "superchat")}
+		if compression {
+			opts = append(opts, WithCompression())
+		}
+		s, _, stop := startServer(t, opts...)
+		c, messages, _, close := dial(t, s, append(opts, WithSubprotocols("superchat"))...)
+		conn := c.Conn()
+		if conn.Compressed() != compression || conn.Subprotocol() != "superchat" {
+			t.Fatalf("negotiated compression %v subprotocol %q", conn.Compressed(), conn.Subprotocol())
+		}
+		big := strings.Repeat("0123456789", 10000)
+		for _, m := range []message{{OpText, "hello"}, {OpBinary, "\x00\x01\x02"}, {OpText, big}, {OpText, ""}} {
+			if err := conn.WriteMessage(m.op, []byte(m.payload)); err != nil {
+				t.Fatal(err)
+			}
+			if got := receive(t, messages); got.op != m.op || got.payload != m.payload {
+				t.Fatalf("compression %v: got %v %d bytes, want %v %d bytes",
+					compression, got.op, len(got.payload), m.op, len(m.payload))
+			}
+		}
+		close()
+		stop()
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	s, serverCloses, stop := startServer(t)
+	defer stop()
+
+	// the client closes
+	c, _, closes, close := dial(t, s)
+	c.Conn().Close(4000, "done")
+	if got := waitClose(t, closes).err; got.Code != 4000 || got.Reason != "done" {
+		t.Fatalf("client saw %v", got)
+	}
+	if got := waitClose(t, serverCloses).err; got.Code != 4000 || got.Reason != "done" {
+		t.Fatalf("server saw %v", got)
+	}
+	if err := c.Conn().WriteMessage(OpText, []byte("late")); err == nil {
+		t.Fatal("wrote to a closed connection")
+	}
+	close()
+
+	// the server closes
+	c, _, closes, close = dial(t, s)
+	defer close()
+	_ = c.Conn().WriteMessage(OpText, []byte("bye"))
+	if got := waitClose(t, closes).err; got.Code != CloseGoingAway || got.Reason != "bye" {
+		t.Fatalf("client saw %v", got)
+	}
+	if got := waitClose(t, serverCloses).err; got.Code != CloseGoingAway {
+		t.Fatalf("server saw %v", got)
+	}
+}
+
+// rawDial completes the opening handshake on a plain connection.
+func rawDial(t *testing.T, s *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", s.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(c, "GET /echo HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	r := bufio.NewReader(c)
+	resp, err := nethttp.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != nethttp.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got %s %v", resp.Status, resp.Header)
+	}
+	return c, r
+}
+
+// readServerFrame reads one unmasked frame.
+func readServerFrame(t *testing.T, r *bufio.Reader) (Opcode, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := int(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		_, _ = io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, _ = io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return Opcode(head[0] & 0x0f), payload
+}
+
+func TestFragmentation(t *testing.T) {
+	s, _, stop := startServer(t)
+	defer stop()
+	c, r := rawDial(t, s)
+	defer c.Close()
+
+	var wire []byte
+	wire = appendFrame(wire, false, false, OpText, []byte("hel"), true)
+	wire = appendFrame(wire, true, false, OpPing, []byte("between"), true)
+	wire = appendFrame(wire, false, false, OpContinuation, []byte("lo "), true)
+	wire = appendFrame(wire, true, false, OpContinuation, []byte("world"), true)
+	// written byte by byte so frames arrive split
+	for i := range wire {
+		if _, err := c.Write(wire[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if op, payload := readServerFrame(t, r); op != OpPong || string(payload) != "between" {
+		t.Fatalf("got %v %q, want the pong", op, payload)
+	}
+	if op, payload := readServerFrame(t, r); op != OpText || string(payload) != "hello world" {
+		t.Fatalf("got %v %q", op, payload)
+	}
+
+	// a new message inside a fragmented one
+	wire = appendFrame(nil, false, false, OpText, []byte("a"), true)
+	wire = appendFrame(wire, true, false, OpText, []byte("b"), true)
+	_, _ = c.Write(wire)
+	op, payload := readServerFrame(t, r)
+	if op != OpClose || binary.BigEndian.Uint16(payload) != CloseProtocolError {
+		t.Fatalf("got %v %q, want a protocol error", op, payload)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	s, closes, stop := startServer(t)
+	defer stop()
+	c, r := rawDial(t, s)
+	defer c.Close()
+	_, _ = c.Write(appendFrame(nil, true, false, OpText, []byte{0xff, 0xfe}, true))
+	op, payload := readServerFrame(t, r)
+	if op != OpClose || binary.BigEndian.Uint16(payload) != CloseInvalidPayload {
+		t.Fatalf("got %v %q", op, payload)
+	}
+	c.Close()
+	if got := waitClose(t, closes).err; got.Code != CloseInvalidPayload {
+		t.Fatalf("server saw %v", got)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	s, closes, stop := startServer(t, WithPingInterval(20*time.Millisecond))
+	defer stop()
+	c, r := rawDial(t, s)
+	defer c.Close()
+
+	// answered pings keep the connection open
+	for i := 0; i < 3; i++ {
+		if op, _ := readServerFrame(t, r); op != OpPing {
+			t.Fatalf("got %v, want a ping", op)
+		}
+		_, _ = c.Write(appendFrame(nil, true, false, OpPong, nil, true))
+	}
+	select {
+	case got := <-closes:
+		t.Fatalf("closed while answering pings: %v", got.err)
+	default:
+	}
+	// a silent peer is dropped
+	if got := waitClose(t, closes).err; got.Code != CloseAbnormal {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	s, _, stop := startServer(t)
+	defer stop()
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"old version", "Sec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", nethttp.StatusUpgradeRequired},
+		{"bad key", "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: short\r\n", nethttp.StatusBadRequest},
+		{"bad origin", "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nOrigin: http://evil.example\r\n",
+			nethttp.StatusForbidden},
+	}
+	for _, tt := range tests {
+		c, err := net.DialTimeout("tcp", s.Addr(), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+tt.header+"\r\n")
+		resp, err := nethttp.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got %s, want %d", tt.name, resp.Status, tt.status)
+		}
+		if tt.status == nethttp.StatusUpgradeRequired && resp.Header.Get("Sec-WebSocket-Version") != "13" {
+			t.Errorf("%s: no supported version in %v", tt.name, resp.Header)
+		}
+		c.Close()
+	}
+
+	// a client sees the rejection as an abnormal close
+	el := muduo.NewEventloopEngine("websocket-client").StartLoop()
+	defer el.AsyncExecute(el.Stop)
+	client, err := NewClient(el, "ws://"+s.Addr()+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Header.Set("Origin", "http://evil.example")
+	closes := make(chan closed, 1)
+	client.SetOnClose(func(c *Conn, err *CloseError) { closes <- closed{c, err} })
+	client.Connect()
+	if got := waitClose(t, closes).err; got.Code != CloseAbnormal {
+		t.Fatalf("got %v", got)
+	}
+	client.Close()
+}
+
+func TestNewClient(t *testing.T) {
+	el := muduo.NewEventloop("websocket-client")
+	for _, bad := range []string{"http://example.com/", "wss://example.com/", "ws://%zz"} {
+		if _, err := NewClient(el, bad); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}